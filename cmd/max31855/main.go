@@ -8,71 +8,44 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"sort"
-	"strconv"
-	"time"
 
-	"github.com/google/periph/conn/spi"
-	"github.com/google/periph/host"
 	"github.com/tve/devices/max31855"
+	"periph.io/x/periph/conn/spi/spireg"
+	"periph.io/x/periph/host"
 )
 
 func mainImpl() error {
 	if len(os.Args) > 2 {
-		return errors.New("Optionally specify the SPI bus name or number")
+		return errors.New("Optionally specify the SPI port name or number")
 	}
-	n := -1
+	name := ""
 	if len(os.Args) == 2 {
-		var err error
-		if n, err = strconv.Atoi(os.Args[1]); err != nil {
-			return err
-		}
+		name = os.Args[1]
 	}
 
 	if _, err := host.Init(); err != nil {
 		return err
 	}
 
-	s, err := spi.New(n, 0)
+	s, err := spireg.Open(name)
 	if err != nil {
 		return err
 	}
+	defer s.Close()
 
-	d, err := max31855.New(s)
+	d, err := max31855.New(s, nil)
 	if err != nil {
 		return err
 	}
 
-	// Loop to collect multiple samples and choose the median value. This seems to be
-	// necessary because every now and then the max31855 seems to return a bad value,
-	// depends a lot on noise...
-	// This loop iterates until it got 3 errors or 3 measurements. It sleeps 100ms
-	// between readings to give the max31855 time to perform a fresh ADC.
-	var temp, iTemp [3]float64
-	var nTemp, nErr int
-	for {
-		eT, iT, err := d.Temperature()
-		if err != nil {
-			nErr++
-			if nErr == 3 {
-				return err
-			}
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-		temp[nTemp] = eT.Float64()
-		iTemp[nTemp] = iT.Float64()
-		nTemp++
-		if nTemp == 3 {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
+	// Take the median of multiple samples because every now and then the max31855 seems to
+	// return a bad value, depends a lot on noise...
+	temp, iTemp, err := d.Sense(max31855.SenseOpts{})
+	if err != nil {
+		return err
 	}
-	// Sort measurements so we can pick the median.
-	sort.Float64s(temp[:])
-	sort.Float64s(iTemp[:])
 
-	fmt.Printf("Thermocouple: %.1f°C internal: %.2f°C\n", temp[1], iTemp[1])
+	fmt.Printf("Thermocouple: %.1f°C internal: %.2f°C\n", temp.Float64(), iTemp.Float64())
 
 	return nil
 }
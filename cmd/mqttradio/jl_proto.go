@@ -3,7 +3,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tve/devices/sx1231"
 	"github.com/tve/devices/varint"
@@ -50,6 +55,151 @@ func init() {
 	RegisterModule(module{"jl-ack", jlAck})
 }
 
+//===== JeeLabs rfm69 transmission with ACK and retries
+
+// jlTxAck forwards JeeLabs packets to a raw tx topic and retransmits the ones that request an
+// ACK until the destination node acks or the retries are exhausted. The result of each such
+// delivery is published as a jlTxAckResult. Deliveries to the same node are serialized, those
+// to different nodes proceed concurrently.
+//
+// An ACK is a packet received on the raw rx topic from the destination node to the source
+// without ACK request and with at most 2 payload bytes, as sent by the jl-ack module.
+type jlTxAck struct {
+	timeout time.Duration        // time to wait for an ACK, doubles with each retry
+	retries int                  // max number of retransmissions
+	result  func(jlTxAckResult)  // publishes the result of a delivery
+	mu      sync.Mutex           // protects nodes and waiting
+	nodes   map[byte]*sync.Mutex // serializes the deliveries to each node
+	waiting map[byte]jlTxAckWait // ACK being waited for, by node
+}
+
+// jlTxAckWait is an ACK being waited for.
+type jlTxAckWait struct {
+	src  byte             // source of the packet, i.e., destination of the ACK
+	acks chan RawRxPacket // receives the ACK
+}
+
+// jlTxAckResult is the structure published to MQTT by the jl-tx-ack module for each packet that
+// requests an ACK.
+type jlTxAckResult struct {
+	Dst      byte `json:"dst"`      // destination node
+	Acked    bool `json:"acked"`    // true if an ACK has been received
+	Attempts int  `json:"attempts"` // number of times the packet was transmitted
+	Rssi     int  `json:"rssi"`     // RSSI in dB of the ACK, 0 if none
+}
+
+// newJLTxAck returns a jlTxAck using the timeout and retries of the config.
+func newJLTxAck(mc ModuleConfig, result func(jlTxAckResult)) *jlTxAck {
+	a := &jlTxAck{timeout: time.Duration(mc.Timeout) * time.Millisecond, retries: mc.Retries,
+		result: result, nodes: map[byte]*sync.Mutex{}, waiting: map[byte]jlTxAckWait{}}
+	if a.timeout <= 0 {
+		a.timeout = 100 * time.Millisecond
+	}
+	switch {
+	case a.retries == 0:
+		a.retries = 3
+	case a.retries < 0:
+		a.retries = 0
+	}
+	return a
+}
+
+// setupJLTxAck subscribes a jlTxAck to the rx topic of the config and returns its handler for
+// the packets to transmit.
+func setupJLTxAck(mc ModuleConfig, mq *mq, debug LogPrintf) (interface{}, func(), error) {
+	if mc.Rx == "" {
+		return nil, nil, errors.New("the jl-tx-ack module requires an rx topic")
+	}
+	topic := mc.Result
+	if topic == "" {
+		topic = mc.Sub + "/result"
+	}
+	a := newJLTxAck(mc, func(r jlTxAckResult) { mq.Publish(topic, r) })
+	if err := mq.Subscribe(mc.Rx, func(m *RawRxMessage) { a.rx(m, debug) }); err != nil {
+		return nil, nil, err
+	}
+	return a.tx, nil, nil
+}
+
+// tx handles a packet to transmit. It is called synchronously by the publisher, so packets
+// requesting an ACK are delivered in a goroutine.
+func (a *jlTxAck) tx(m *RawTxMessage, pub pubFunc, debug LogPrintf) {
+	src, dst, ack, _, err := sx1231.JLDecode(group, m.Payload.Packet)
+	if err != nil {
+		debug("Can't decode JL packet: %s", err)
+		return
+	}
+	if !ack {
+		pub("", m.Payload)
+		return
+	}
+	go a.deliver(src, dst, m.Payload, pub, debug)
+}
+
+// deliver transmits a packet until it is acked and publishes the result.
+func (a *jlTxAck) deliver(src, dst byte, pkt RawTxPacket, pub pubFunc, debug LogPrintf) {
+	a.mu.Lock()
+	node := a.nodes[dst]
+	if node == nil {
+		node = &sync.Mutex{}
+		a.nodes[dst] = node
+	}
+	a.mu.Unlock()
+	node.Lock()
+	defer node.Unlock()
+
+	w := jlTxAckWait{src: src, acks: make(chan RawRxPacket, 1)}
+	a.mu.Lock()
+	a.waiting[dst] = w
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.waiting, dst)
+		a.mu.Unlock()
+	}()
+
+	res := jlTxAckResult{Dst: dst}
+	timeout := a.timeout
+	for res.Attempts <= a.retries {
+		res.Attempts++
+		pub("", pkt)
+		select {
+		case ackPkt := <-w.acks:
+			res.Acked, res.Rssi = true, ackPkt.Rssi
+			a.result(res)
+			return
+		case <-time.After(timeout):
+		}
+		debug("No ACK from node %d after %d attempt(s)", dst, res.Attempts)
+		timeout *= 2
+	}
+	a.result(res)
+}
+
+// rx handles a packet received on the raw rx topic and passes it on if it is an ACK being
+// waited for.
+func (a *jlTxAck) rx(m *RawRxMessage, debug LogPrintf) {
+	src, dst, ack, payload, err := sx1231.JLDecode(group, m.Payload.Packet)
+	if err != nil || ack || len(payload) > 2 {
+		return
+	}
+	a.mu.Lock()
+	w, ok := a.waiting[src]
+	a.mu.Unlock()
+	if !ok || w.src != dst {
+		return
+	}
+	debug("ACK from node %d", src)
+	select {
+	case w.acks <- m.Payload:
+	default:
+	}
+}
+
+func init() {
+	RegisterModule(module{"jl-tx-ack", moduleSetup(setupJLTxAck)})
+}
+
 //===== JeeLabs rfm69 packet decoder
 
 // jlDecode decodes a packet using the JeeLabs protocol and having a type byte as the first byte in
@@ -97,8 +247,58 @@ func jlviDecode(m *jlRxMessage, pub pubFunc, debug LogPrintf) {
 	pub("", varintRxPacket{jlRxPacket: m.Payload, Data: varint.Decode(m.Payload.Packet)})
 }
 
+// setupJLVarint returns jlviDecode unless the module is configured with a schema, in which case
+// the values are decoded according to the schema and published as named fields.
+func setupJLVarint(mc ModuleConfig, mq *mq, debug LogPrintf) (interface{}, func(), error) {
+	if mc.Schema == "" {
+		return jlviDecode, nil, nil
+	}
+	schema, err := parseSchema(mc.Schema)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(m *jlRxMessage, pub pubFunc, debug LogPrintf) {
+		var values []interface{}
+		if err := varint.Unmarshal(schema, m.Payload.Packet, &values); err != nil {
+			debug("Can't decode varint packet from node %d: %s", m.Payload.Src, err)
+			return
+		}
+		fields := make(map[string]interface{}, len(schema))
+		for i, fs := range schema {
+			fields[fs.Name] = values[i]
+		}
+		pub("", schemaRxPacket{jlRxPacket: m.Payload, Fields: fields})
+	}, nil, nil
+}
+
+// parseSchema parses a comma-separated list of fields, each consisting of a name optionally
+// followed by ":u" for an unsigned value and by ":<scale>", e.g. "count:u, temp:0.01".
+func parseSchema(s string) ([]varint.FieldSpec, error) {
+	var schema []varint.FieldSpec
+	for _, f := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(f), ":")
+		fs := varint.FieldSpec{Name: parts[0]}
+		if fs.Name == "" {
+			return nil, fmt.Errorf("empty field name in schema %q", s)
+		}
+		for _, p := range parts[1:] {
+			if p == "u" {
+				fs.Unsigned = true
+				continue
+			}
+			scale, err := strconv.ParseFloat(p, 64)
+			if err != nil || scale == 0 {
+				return nil, fmt.Errorf("invalid option %q of field %s in schema", p, fs.Name)
+			}
+			fs.Scale = scale
+		}
+		schema = append(schema, fs)
+	}
+	return schema, nil
+}
+
 func init() {
-	RegisterModule(module{"jl-varint", jlviDecode})
+	RegisterModule(module{"jl-varint", moduleSetup(setupJLVarint)})
 }
 
 // varintRxPacket is the structure of packets published to MQTT by the jl-varint decoder.
@@ -106,3 +306,45 @@ type varintRxPacket struct {
 	jlRxPacket
 	Data []int `json:"data"`
 }
+
+// schemaRxPacket is the structure of packets published to MQTT by the jl-varint decoder when
+// it is configured with a schema.
+type schemaRxPacket struct {
+	jlRxPacket
+	Fields map[string]interface{} `json:"fields"`
+}
+
+//===== JeeLabs node details decoder
+
+// jlNodeDetails decodes the node details packets (packet type 1) that nodes send periodically.
+// It expects a decoded packet whose payload consists of varints in the order Vstart[mV],
+// Vend[mV], Temp[cC], PktSent, PktRecv, Pout[dBm], Fadj[Hz], RSSIavg[dBm] and publishes the
+// result by adding "/stats" to the configured publication topic.
+func jlNodeDetails(m *jlRxMessage, pub pubFunc, debug LogPrintf) {
+	v := varint.Decode(m.Payload.Packet)
+	if len(v) < 8 {
+		debug("Node details packet from node %d too short: %d values", m.Payload.Src, len(v))
+		return
+	}
+	pub("/stats", nodeDetailsRxPacket{jlRxPacket: m.Payload,
+		VStart: v[0], VEnd: v[1], Temp: float64(v[2]) / 100, PktSent: v[3], PktRecv: v[4],
+		Pout: v[5], Fadj: v[6], RssiAvg: v[7]})
+}
+
+func init() {
+	RegisterModule(module{"jl-nodedetails", jlNodeDetails})
+}
+
+// nodeDetailsRxPacket is the structure of packets published to MQTT by the jl-nodedetails
+// decoder.
+type nodeDetailsRxPacket struct {
+	jlRxPacket
+	VStart  int     `json:"vstart"`   // supply voltage in mV before TX
+	VEnd    int     `json:"vend"`     // supply voltage in mV after TX
+	Temp    float64 `json:"temp"`     // temperature in degrees C
+	PktSent int     `json:"pkt_sent"` // number of packets sent
+	PktRecv int     `json:"pkt_recv"` // number of packets received
+	Pout    int     `json:"pout"`     // TX power in dBm
+	Fadj    int     `json:"fadj"`     // frequency adjustment in Hz
+	RssiAvg int     `json:"rssi_avg"` // average RSSI in dBm of packets received
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2017 by Thorsten von Eicken, see LICENSE file for details
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tve/devices/sx1231"
+	"github.com/tve/devices/varint"
+)
+
+func TestJLNodeDetails(t *testing.T) {
+	m := &jlRxMessage{Topic: "fsk-gw/rx/jl/1", Payload: jlRxPacket{Src: 12, Type: 1}}
+	m.Payload.Packet = varint.Encode([]int{3300, 3215, 2150, 1234, 567, 13, -2500, -87})
+
+	var topic string
+	var got nodeDetailsRxPacket
+	pub := func(t string, p interface{}) { topic, got = t, p.(nodeDetailsRxPacket) }
+	jlNodeDetails(m, pub, t.Logf)
+
+	if topic != "/stats" {
+		t.Errorf("expected topic /stats, got %q", topic)
+	}
+	want := nodeDetailsRxPacket{jlRxPacket: m.Payload, VStart: 3300, VEnd: 3215, Temp: 21.5,
+		PktSent: 1234, PktRecv: 567, Pout: 13, Fadj: -2500, RssiAvg: -87}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v expected %+v", got, want)
+	}
+
+	// Short packets are dropped.
+	topic = ""
+	m.Payload.Packet = varint.Encode([]int{3300, 3215})
+	jlNodeDetails(m, pub, t.Logf)
+	if topic != "" {
+		t.Errorf("short packet was published")
+	}
+}
+
+func TestJLTxAck(t *testing.T) {
+	results := make(chan jlTxAckResult, 1)
+	a := newJLTxAck(ModuleConfig{Timeout: 10, Retries: 2}, func(r jlTxAckResult) { results <- r })
+	txs := make(chan RawTxPacket, 10)
+	pub := func(t string, p interface{}) { txs <- p.(RawTxPacket) }
+	ackPkt := &RawRxMessage{Payload: RawRxPacket{Packet: sx1231.JLEncode(group, 5, 0, false,
+		[]byte{20, 0}), Rssi: -70}}
+
+	// Packets that don't request an ACK are just forwarded.
+	m := &RawTxMessage{Payload: RawTxPacket{Packet: sx1231.JLEncode(group, 0, 5, false, nil)}}
+	a.tx(m, pub, t.Logf)
+	if len(txs) != 1 || len(results) != 0 {
+		t.Errorf("expected one transmission and no result, got %d %d", len(txs), len(results))
+	}
+	<-txs
+
+	// No ACK: the packet is transmitted 1+2 times.
+	m.Payload.Packet = sx1231.JLEncode(group, 0, 5, true, []byte{2, 1})
+	a.tx(m, pub, t.Logf)
+	select {
+	case r := <-results:
+		if r != (jlTxAckResult{Dst: 5, Attempts: 3}) || len(txs) != 3 {
+			t.Errorf("unexpected result %+v after %d transmissions", r, len(txs))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no result")
+	}
+	for len(txs) > 0 {
+		<-txs
+	}
+
+	// ACK after the second transmission, an ACK from another node doesn't count.
+	a.tx(m, pub, t.Logf)
+	<-txs
+	a.rx(&RawRxMessage{Payload: RawRxPacket{Packet: sx1231.JLEncode(group, 6, 0, false, nil)}},
+		t.Logf)
+	<-txs
+	a.rx(ackPkt, t.Logf)
+	select {
+	case r := <-results:
+		if r != (jlTxAckResult{Dst: 5, Acked: true, Attempts: 2, Rssi: -70}) {
+			t.Errorf("unexpected result %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no result")
+	}
+}
+
+func TestJLVarintSchema(t *testing.T) {
+	h, _, err := setupJLVarint(ModuleConfig{Schema: "count:u, temp:0.01, rssi"}, nil, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &jlRxMessage{Topic: "fsk-gw/rx/jl/2", Payload: jlRxPacket{Src: 12, Type: 2}}
+	m.Payload.Packet = append(varint.EncodeUint([]uint64{200}), varint.Encode([]int{2150, -87})...)
+	var got []interface{}
+	pub := func(t string, p interface{}) { got = append(got, p) }
+	handler := h.(func(*jlRxMessage, pubFunc, LogPrintf))
+	handler(m, pub, t.Logf)
+	want := schemaRxPacket{jlRxPacket: m.Payload, Fields: map[string]interface{}{
+		"count": uint64(200), "temp": 21.5, "rssi": int64(-87)}}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Errorf("got %+v expected %+v", got, want)
+	}
+
+	// Short packets are dropped.
+	m.Payload.Packet = m.Payload.Packet[:2]
+	handler(m, pub, t.Logf)
+	if len(got) != 1 {
+		t.Errorf("short packet was published")
+	}
+
+	// Without schema the values are published as an array.
+	if h, _, _ := setupJLVarint(ModuleConfig{}, nil, t.Logf); reflect.ValueOf(h).Pointer() !=
+		reflect.ValueOf(jlviDecode).Pointer() {
+		t.Error("expected jlviDecode without schema")
+	}
+	for _, s := range []string{"a,,b", "a:x", "a:0", ":u"} {
+		if _, err := parseSchema(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
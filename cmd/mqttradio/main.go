@@ -5,13 +5,12 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"sort"
-	"time"
+	"syscall"
 
-	"github.com/BurntSushi/toml"
 	"github.com/tve/devices/spimux"
 	"github.com/tve/devices/sx1231"
 	"github.com/tve/devices/sx1276"
@@ -40,6 +39,12 @@ type MqttConfig struct {
 	Port     int
 	User     string
 	Password string
+	Status   string // topic for retained online/offline status, "-" for none
+	TLS      bool   // use TLS, i.e., an ssl:// broker URL
+	CAFile   string `toml:"ca_file"`              // PEM file with CA certs, default: system CAs
+	CertFile string `toml:"cert_file"`            // PEM file with client certificate
+	KeyFile  string `toml:"key_file"`             // PEM file with client certificate key
+	Insecure bool   `toml:"insecure_skip_verify"` // don't verify the broker's certificate
 }
 
 // RadioConfig holds the info from one radio config section. Multiple sections
@@ -56,6 +61,7 @@ type RadioConfig struct {
 	Sync       string // sync bytes
 	Rate       string // data rate name, from radio driver
 	Power      int    // TX power level, in dBm
+	Encoding   string // encoding of packets on the rx topic: base64 (default), hex, or array
 }
 
 // ModuleConfig holds the info from one protocol module section. Multiple sections
@@ -64,6 +70,15 @@ type ModuleConfig struct {
 	Name string // name of module (identifies the code for it)
 	Sub  string // mqtt topic to subscribe to
 	Pub  string // mqtt topic to publish to
+	// Settings of the jl-tx-ack module.
+	Rx      string // raw rx topic on which ACKs are received
+	Result  string // topic to publish delivery results to, default: Sub + "/result"
+	Timeout int    // time to wait for the first ACK in ms, default: 100, doubles with each retry
+	Retries int    // max number of retransmissions, default: 3, -1 for none
+	// Settings of the node-tracker module.
+	Stale int // seconds after which a node not heard is flagged as stale, default: 3600
+	// Settings of the jl-varint module.
+	Schema string // comma-separated fields name[:u][:scale] to publish instead of a data array
 	//Offset int //
 	//Value  int
 	//Mask   int
@@ -104,20 +119,9 @@ func main() {
 	}
 
 	// Process the config file.
-	config := &Config{}
-	rawConfig, err := ioutil.ReadFile(*configFile)
+	config, err := loadConfig(*configFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot access config file: %s", err)
-		os.Exit(1)
-	}
-	err = toml.Unmarshal(rawConfig, config)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot parse config file: %s", err)
-		os.Exit(1)
-	}
-
-	if len(config.Radio) == 0 {
-		fmt.Fprintf(os.Stderr, "At least one radio must be specified in the config")
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 
@@ -147,27 +151,27 @@ func main() {
 	// We keep a map of unused muxed SPI devices. Basically when the first radio uses a
 	// muxed SPI chip select the remainder is entered here so the other radio gets it from
 	// here.
-	muxes := map[string]spi.PortCloser{}
-	for _, r := range config.Radio {
-		if err := startRadio(r, muxes, mq, logger); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to config radio for %s: %s\n", r.Prefix, err)
-			os.Exit(1)
-		}
+	gw := &gateway{conf: config, mq: mq, muxes: map[string]spi.PortCloser{},
+		radios: map[string]*runningRadio{}, debug: logger}
+	if err := gw.startRadios(config.Radio); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
 	}
 
 	log.Printf("Configuring modules")
-	for _, m := range config.Module {
-		if err := hookModule(m, mq, logger); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to install module %s (%s->%s): %s\n",
-				m.Name, m.Sub, m.Pub, err)
-			os.Exit(1)
-		}
+	if err := gw.hookModules(config.Module); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
 	}
 
+	// Reload the config on SIGHUP.
 	log.Printf("Gateway is ready")
-	for {
-		time.Sleep(time.Hour)
-	} // ugh!
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("SIGHUP: reloading %s", *configFile)
+		gw.reload(*configFile)
+	}
 }
 
 // muxedSPI opens an SPI bus and uses an extra pin to mux it across two radios.
@@ -20,11 +20,20 @@ import (
 // be a pointer to a struct that has a Topic string field and a Payload struct field.
 // The Payload struct field can then describe the payload.
 // See the RawRxMessage and RawTxMessage structs in raw.go for examples.
+//
+// A module that needs its config or additional subscriptions uses a moduleSetup as handler
+// instead.
 type module struct {
 	name    string      // name of the module, needs to be used in the config
-	handler interface{} // func(m *msgType, pub pubFunc, debug LogPrintf)
+	handler interface{} // func(m *msgType, pub pubFunc, debug LogPrintf) or moduleSetup
 }
 
+// moduleSetup is called by hookModule with the config of the module instance and returns the
+// actual handler, as well as a function stopping the instance for a module that runs in the
+// background, nil otherwise. The stop function is called when a config reload removes the
+// module or hooks it again, which calls the setup again.
+type moduleSetup func(mc ModuleConfig, mq *mq, debug LogPrintf) (interface{}, func(), error)
+
 // pubFunc is the publishing function passed into a runner. The payload must
 // consist of a pointer to a struct that can be marshaled to JSON (typ it
 // needs to contain json tags).
@@ -42,24 +51,37 @@ func RegisterModule(m module) {
 }
 
 // hookModule instantiates a module by launching a goroutine for the subscription and
-// by providing a publishing function.
-func hookModule(mc ModuleConfig, mq *mq, debug LogPrintf) error {
+// by providing a publishing function. It returns the stop function of the instance, if any.
+func hookModule(mc ModuleConfig, mq *mq, debug LogPrintf) (stop func(), err error) {
 	debug("Hooking module %s (%s -> %s)", mc.Name, mc.Sub, mc.Pub)
 	m, ok := modules[mc.Name]
 	if !ok {
-		return fmt.Errorf("module %s not found", m)
+		return nil, fmt.Errorf("module %s not found", m)
+	}
+
+	handlerFunc := m.handler
+	if setup, ok := m.handler.(moduleSetup); ok {
+		if handlerFunc, stop, err = setup(mc, mq, debug); err != nil {
+			return nil, err
+		}
 	}
+	defer func() { // don't leave an instance running if it can't be hooked
+		if err != nil && stop != nil {
+			stop()
+			stop = nil
+		}
+	}()
 
 	// Derive the type of the subscription message. This will panic if the runner doesn't have
 	// an appropriate type, which is OK for now.
-	handler := reflect.ValueOf(m.handler)
+	handler := reflect.ValueOf(handlerFunc)
 	handlerType := handler.Type()
 	if handlerType.Kind() != reflect.Func || handlerType.NumIn() != 3 {
-		return errors.New("module handler is not a function with 3 arguments")
+		return stop, errors.New("module handler is not a function with 3 arguments")
 	}
 	msgType := handlerType.In(0)
 	if msgType.Kind() != reflect.Ptr || msgType.Elem().Kind() != reflect.Struct {
-		return errors.New("first arg of module handler is not a pointer to a struct")
+		return stop, errors.New("first arg of module handler is not a pointer to a struct")
 	}
 
 	// Create a publish function.
@@ -75,6 +97,6 @@ func hookModule(mc ModuleConfig, mq *mq, debug LogPrintf) error {
 	})
 
 	// Create the subscription, this will launch a goroutine.
-	err := mq.Subscribe(mc.Sub, subFunc.Interface())
-	return err
+	err = mq.Subscribe(mc.Sub, subFunc.Interface())
+	return stop, err
 }
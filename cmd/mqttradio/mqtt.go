@@ -3,10 +3,14 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"reflect"
 	"runtime"
@@ -27,17 +31,33 @@ type Message struct {
 
 // mq is a handle onto a MQTT broker connection.
 type mq struct {
-	conn     mqtt.Client          // broker connection
-	subHooks []subHook            // subscription hooks
-	dedupMu  sync.Mutex           // protects dedup
-	dedup    map[uint64]time.Time // de-dup of messages we sent
+	conn     mqtt.Client           // broker connection
+	status   string                // topic for online/offline status, "" for none
+	subHooks []subHook             // subscription hooks
+	subMu    sync.Mutex            // protects subHooks and subs
+	subs     []subscription        // broker subscriptions, to renew after a reconnect
+	dedupMu  sync.Mutex            // protects dedup
+	dedup    map[uint64]dedupEntry // de-dup of messages we sent
+}
+
+// dedupEntry records a message we published and that has been forwarded locally to count hooks,
+// count is the number of times the message is expected to come back from the broker.
+type dedupEntry struct {
+	at    time.Time // when the message was published, for GC
+	count int       // number of subscriptions expected to receive the message
+}
+
+// subscription is a broker subscription.
+type subscription struct {
+	topic   string              // topic filter
+	handler mqtt.MessageHandler // handler for the messages received
 }
 
 // subHook is a subscription hook, that is, a hook to subscribe to messages internally so they
 // get forwarded locally instead of traveling all the way to the broker and back. (Messages always
 // get published to the broker, so the local routing is in addition, not in replacement.)
 type subHook struct {
-	topic  string        // topic that is being matched (exact match for now)
+	topic  string        // topic filter that is being matched, may contain + and # wildcards
 	evFunc reflect.Value // event function for the subscription
 	evType reflect.Type  // type of the event
 }
@@ -52,23 +72,119 @@ func newMQ(conf MqttConfig, debug LogPrintf) (*mq, error) {
 	}
 	//mqtt.DEBUG = log.New(os.Stderr, "", 0)
 	mqtt.ERROR = log.New(os.Stderr, "", 0)
-	opts := mqtt.NewClientOptions().
-		AddBroker(fmt.Sprintf("tcp://%s:%d", conf.Host, conf.Port))
+	scheme := "tcp"
+	var tlsConf *tls.Config
+	if conf.TLS {
+		var err error
+		if tlsConf, err = newTLSConfig(conf); err != nil {
+			return nil, err
+		}
+		scheme = "ssl"
+	}
+	broker := fmt.Sprintf("%s://%s:%d", scheme, conf.Host, conf.Port)
+	opts := mqtt.NewClientOptions().AddBroker(broker)
 	opts.ClientID = id
 	opts.Username = conf.User
 	opts.Password = conf.Password
+	opts.TLSConfig = tlsConf
+	opts.AutoReconnect = true
 
-	mqConn := mqtt.NewClient(opts)
-	if token := mqConn.Connect(); !token.WaitTimeout(10 * time.Second) {
-		return nil, token.Error()
+	// Status topic with a last will, so consumers can tell whether the GW is alive.
+	mq := &mq{dedup: make(map[uint64]dedupEntry)}
+	switch conf.Status {
+	case "-":
+		// no status topic
+	case "":
+		mq.status = "mqttradio/" + hostname + "/status"
+	default:
+		mq.status = conf.Status
+	}
+	if mq.status != "" {
+		opts.SetWill(mq.status, "offline", 1, true)
+	}
+	opts.SetOnConnectHandler(mq.onConnect)
+
+	// Perform a TLS handshake up-front to be able to tell TLS errors from MQTT errors.
+	if tlsConf != nil {
+		addr := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		c, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConf.Clone())
+		if err != nil {
+			return nil, fmt.Errorf("TLS handshake with %s failed: %s", addr, err)
+		}
+		c.Close()
+	}
+
+	mq.conn = mqtt.NewClient(opts)
+	token := mq.conn.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return nil, fmt.Errorf("timeout connecting to %s", broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("MQTT CONNECT to %s failed: %s", broker, err)
 	}
-	mq := &mq{conn: mqConn, dedup: make(map[uint64]time.Time)}
 	go mq.gc()
 
 	log.Printf("MQTT connected")
 	return mq, nil
 }
 
+// onConnect is called by the MQTT client each time the connection to the broker is established.
+// It renews all subscriptions, which the broker doesn't keep across connections, and publishes
+// the online status.
+func (mq *mq) onConnect(c mqtt.Client) {
+	mq.subMu.Lock()
+	subs := append([]subscription(nil), mq.subs...)
+	mq.subMu.Unlock()
+	for _, s := range subs {
+		token := c.Subscribe(s.topic, 1, s.handler)
+		if !token.WaitTimeout(2 * time.Second) {
+			log.Printf("MQTT: timeout resubscribing to %s", s.topic)
+		} else if err := token.Error(); err != nil {
+			log.Printf("MQTT: cannot resubscribe to %s: %s", s.topic, err)
+		}
+	}
+	if mq.status != "" {
+		c.Publish(mq.status, 1, true, "online")
+	}
+	if len(subs) > 0 {
+		log.Printf("MQTT reconnected, renewed %d subscriptions", len(subs))
+	}
+}
+
+// newTLSConfig produces the TLS configuration for the broker connection.
+func newTLSConfig(conf MqttConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         conf.Host,
+		InsecureSkipVerify: conf.Insecure,
+	}
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read MQTT CA file: %s", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in MQTT CA file %s",
+				conf.CAFile)
+		}
+	}
+	switch {
+	case conf.CertFile == "" && conf.KeyFile == "":
+		// no client certificate
+	case conf.CertFile == "" || conf.KeyFile == "":
+		return nil, fmt.Errorf("both cert_file and key_file are required for an MQTT " +
+			"client certificate")
+	default:
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load MQTT client certificate: %s", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
 // gc is an endless loop that removes message de-duplication IDs that are older than a few
 // minutes. These are evidently ones for which we don't have a subscription.
 func (mq *mq) gc() {
@@ -79,8 +195,8 @@ func (mq *mq) gc() {
 			return // mq must have been deallocated
 		}
 		tooOld := time.Now().Add(-10 * time.Minute)
-		for h, t := range mq.dedup {
-			if t.Before(tooOld) {
+		for h, e := range mq.dedup {
+			if e.at.Before(tooOld) {
 				delete(mq.dedup, h)
 			}
 		}
@@ -90,68 +206,123 @@ func (mq *mq) gc() {
 
 // Publish publishes a message and handles immediate forwarding to any internal subscriptions.
 func (mq *mq) Publish(topic string, payload interface{}) {
+	mq.publish(topic, payload, func() ([]byte, error) { return json.Marshal(payload) })
+}
+
+// publish implements Publish using marshal to produce the JSON payload sent to the broker,
+// which happens after the internal forwarding.
+func (mq *mq) publish(topic string, payload interface{}, marshal func() ([]byte, error)) {
 	// Internal subscription hooks. For now we assume that the types are reflect.Assignable.
 	// Ideally we'd marshal and unmarshal via json if they're not in order to provide
 	// exactly the same semantics as if we had gone via MQTT.
 	payVal := reflect.Indirect(reflect.ValueOf(payload))
-	for _, hook := range mq.subHooks {
-		if topic == hook.topic {
+	hooked := 0
+	mq.subMu.Lock()
+	hooks := mq.subHooks
+	mq.subMu.Unlock()
+	for _, hook := range hooks {
+		if topicMatch(hook.topic, topic) {
 			//log.Printf("PUB hook: %s", topic)
 			evPtr := reflect.New(hook.evType)
 			evStruct := reflect.Indirect(evPtr)
 			evStruct.FieldByName("Topic").SetString(topic)
 			evStruct.FieldByName("Payload").Set(payVal)
 			hook.evFunc.Call([]reflect.Value{evPtr})
+			hooked++
 		}
 	}
 	runtime.Gosched() // yield the CPU so any hooks can run
 
 	// External MQTT publishing.
-	jsonPayload, _ := json.Marshal(payload)
+	jsonPayload, _ := marshal()
 	mq.conn.Publish(topic, 1, false, jsonPayload)
-	// Add message ID to de-dup hash with timestamp for GC.
+	mq.sent(topic, string(jsonPayload), hooked)
+}
+
+// PublishRetained publishes a message with the retain flag set so subscribers that connect later
+// still receive it. Retained messages describe state rather than events, so they are not forwarded
+// to internal subscriptions. A nil payload clears the retained message of the topic.
+func (mq *mq) PublishRetained(topic string, payload interface{}) {
+	jsonPayload := []byte{}
+	if payload != nil {
+		jsonPayload, _ = json.Marshal(payload)
+	}
+	mq.conn.Publish(topic, 1, true, jsonPayload)
+}
+
+// sent adds a message that has been forwarded to count internal subscription hooks to the
+// de-dup hash so the copies coming back from the broker can be dropped.
+func (mq *mq) sent(topic, payload string, count int) {
+	if count == 0 {
+		return
+	}
 	mq.dedupMu.Lock()
-	hash := hashMessage(topic, string(jsonPayload))
-	mq.dedup[hash] = time.Now()
+	defer mq.dedupMu.Unlock()
+	hash := hashMessage(topic, payload)
+	e := mq.dedup[hash]
+	mq.dedup[hash] = dedupEntry{at: time.Now(), count: e.count + count}
 	//log.Printf("Published %d to %s", hash, topic)
-	mq.dedupMu.Unlock()
+}
+
+// isDup checks whether a message received from the broker is one that we published and already
+// forwarded locally.
+func (mq *mq) isDup(topic, payload string) bool {
+	mq.dedupMu.Lock()
+	defer mq.dedupMu.Unlock()
+	hash := hashMessage(topic, payload)
+	e, dup := mq.dedup[hash]
+	if !dup {
+		return false
+	}
+	if e.count--; e.count > 0 {
+		mq.dedup[hash] = e
+	} else {
+		delete(mq.dedup, hash)
+	}
+	return true
 }
 
 // Subscribe subscribes to an MQTT topic and ensures that internal forwarding occurs as well.
+// The topic may contain + and # wildcards, which are matched the same way by the broker and
+// for internal forwarding.
 func (mq *mq) Subscribe(topic string, eventFunc interface{}) error {
 	// A few sanity checks.
+	if !validFilter(topic) {
+		return fmt.Errorf("cannot subscribe to %q: invalid topic filter", topic)
+	}
 	eventFuncType := reflect.TypeOf(eventFunc)
-	if eventFuncType.Kind() != reflect.Func {
-		panic("eventFunc must be a function")
+	if eventFuncType == nil || eventFuncType.Kind() != reflect.Func {
+		return fmt.Errorf("cannot subscribe to %s: eventFunc must be a function, got %T",
+			topic, eventFunc)
 	}
 	if eventFuncType.NumIn() != 1 || eventFuncType.NumOut() != 0 {
-		panic("eventFunc must take one parameter and not return any")
+		return fmt.Errorf("cannot subscribe to %s: eventFunc must take one parameter and "+
+			"not return any, got %s", topic, eventFuncType)
 	}
 	eventPtrType := eventFuncType.In(0)
 	if eventPtrType.Kind() != reflect.Ptr {
-		panic("eventFunc must take a pointer parameter")
+		return fmt.Errorf("cannot subscribe to %s: eventFunc must take a pointer parameter, "+
+			"got %s", topic, eventPtrType)
 	}
 	eventType := eventPtrType.Elem()
 	if eventType.Kind() != reflect.Struct {
-		panic("eventFunc must take a pointer to a struct as parameter")
+		return fmt.Errorf("cannot subscribe to %s: eventFunc must take a pointer to a struct "+
+			"as parameter, got %s", topic, eventPtrType)
+	}
+	for _, f := range []string{"Topic", "Payload"} {
+		if _, ok := eventType.FieldByName(f); !ok {
+			return fmt.Errorf("cannot subscribe to %s: %s has no %s field",
+				topic, eventType, f)
+		}
 	}
 	eventFuncValue := reflect.ValueOf(eventFunc)
 
-	// Internal subscription hook.
-	mq.subHooks = append(mq.subHooks, subHook{topic, eventFuncValue, eventType})
-
 	// MQTT subscription handler.
 	handler := func(c mqtt.Client, m mqtt.Message) {
 		// Check whether we sent it, in which case we already forwarded locally.
 		payload := string(m.Payload())
-		hash := hashMessage(topic, payload)
-		//log.Printf("Sub got %d from %s", hash, topic)
-		mq.dedupMu.Lock()
-		_, dup := mq.dedup[hash]
-		delete(mq.dedup, hash)
-		mq.dedupMu.Unlock()
-		if dup {
-			return
+		if payload == "" || mq.isDup(m.Topic(), payload) {
+			return // cleared retained message or already forwarded
 		}
 
 		msg := reflect.New(eventType)
@@ -166,13 +337,93 @@ func (mq *mq) Subscribe(topic string, eventFunc interface{}) error {
 	}
 
 	// Perform MQTT subscription.
-	if token := mq.conn.Subscribe(topic, 1, handler); !token.WaitTimeout(2 * time.Second) {
-		return token.Error()
+	token := mq.conn.Subscribe(topic, 1, handler)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("timeout subscribing to %s", topic)
+	}
+	if err := token.Error(); err != nil {
+		return err
 	}
 
+	// Internal subscription hook, and remember the subscription so it can be renewed after a
+	// reconnect. The hooks slice is replaced rather than appended to in place because Publish
+	// iterates over it without holding the lock.
+	mq.subMu.Lock()
+	hooks := make([]subHook, len(mq.subHooks), len(mq.subHooks)+1)
+	copy(hooks, mq.subHooks)
+	mq.subHooks = append(hooks, subHook{topic, eventFuncValue, eventType})
+	mq.subs = append(mq.subs, subscription{topic, handler})
+	mq.subMu.Unlock()
 	return nil
 }
 
+// Unsubscribe removes all subscriptions to the topic filter, which must match the one passed
+// to Subscribe exactly.
+func (mq *mq) Unsubscribe(topic string) error {
+	mq.subMu.Lock()
+	var hooks []subHook
+	for _, h := range mq.subHooks {
+		if h.topic != topic {
+			hooks = append(hooks, h)
+		}
+	}
+	mq.subHooks = hooks
+	subs := mq.subs[:0]
+	for _, s := range mq.subs {
+		if s.topic != topic {
+			subs = append(subs, s)
+		}
+	}
+	mq.subs = subs
+	mq.subMu.Unlock()
+
+	token := mq.conn.Unsubscribe(topic)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("timeout unsubscribing from %s", topic)
+	}
+	return token.Error()
+}
+
+// validFilter checks that an MQTT topic filter is well-formed: wildcards must occupy an entire
+// level and # may only appear as the last level.
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		switch {
+		case l == "#" && i != len(levels)-1:
+			return false
+		case l != "#" && l != "+" && strings.ContainsAny(l, "#+"):
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatch returns true if the topic matches the filter using MQTT semantics: + matches exactly
+// one level and # matches any number of levels, including the parent level. Wildcards at the
+// start of a filter do not match topics starting with $.
+func topicMatch(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && len(filter) > 0 && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, f := range fl {
+		switch {
+		case f == "#":
+			return true
+		case i >= len(tl):
+			return false
+		case f != "+" && f != tl[i]:
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
 func hashMessage(s ...string) uint64 {
 	key := strings.Join(s, "ǂ")
 	h := fnv.New64()
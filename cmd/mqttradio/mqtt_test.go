@@ -0,0 +1,205 @@
+// Copyright (c) 2017 by Thorsten von Eicken, see LICENSE file for details
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+var topicMatches = []struct {
+	filter, topic string
+	match         bool
+}{
+	{"home/jl/rx", "home/jl/rx", true},
+	{"home/jl/rx", "home/jl/tx", false},
+	{"home/jl/rx", "home/jl/rx/1", false},
+	{"home/jl/rx/+", "home/jl/rx/1", true},
+	{"home/jl/rx/+", "home/jl/rx", false},
+	{"home/jl/rx/+", "home/jl/rx/1/2", false},
+	{"home/+/rx", "home/jl/rx", true},
+	{"home/+/rx", "home/jl/tx", false},
+	{"+/+", "home/jl", true},
+	{"+", "/home", false},
+	{"+/home", "/home", true},
+	{"home/#", "home", true},
+	{"home/#", "home/jl", true},
+	{"home/#", "home/jl/rx/1", true},
+	{"home/#", "homer/jl", false},
+	{"home/+/#", "home/jl/rx/1", true},
+	{"home/+/#", "home", false},
+	{"#", "home/jl/rx", true},
+	{"#", "$SYS/broker", false},
+	{"+/broker", "$SYS/broker", false},
+	{"$SYS/#", "$SYS/broker", true},
+}
+
+func TestTopicMatch(t *testing.T) {
+	for _, tc := range topicMatches {
+		if got := topicMatch(tc.filter, tc.topic); got != tc.match {
+			t.Errorf("topicMatch(%q, %q): got %v expected %v",
+				tc.filter, tc.topic, got, tc.match)
+		}
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	for f, valid := range map[string]bool{
+		"home/jl/rx": true, "home/+/rx": true, "home/#": true, "#": true, "+": true,
+		"": false, "home/#/rx": false, "home/jl+/rx": false, "home/rx#": false,
+	} {
+		if got := validFilter(f); got != valid {
+			t.Errorf("validFilter(%q): got %v expected %v", f, got, valid)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	mq := &mq{dedup: make(map[uint64]dedupEntry)}
+
+	// A message that wasn't forwarded locally must not be dropped.
+	mq.sent("home/jl/rx", `{"a":1}`, 0)
+	if mq.isDup("home/jl/rx", `{"a":1}`) {
+		t.Errorf("message without local hooks flagged as duplicate")
+	}
+
+	// A message forwarded to two hooks, e.g. "home/jl/rx/+" and "home/#", comes back from the
+	// broker once per subscription and both copies must be dropped, but not a third one.
+	mq.sent("home/jl/rx/1", `{"a":1}`, 2)
+	for i := 0; i < 2; i++ {
+		if !mq.isDup("home/jl/rx/1", `{"a":1}`) {
+			t.Errorf("copy %d not flagged as duplicate", i)
+		}
+	}
+	if mq.isDup("home/jl/rx/1", `{"a":1}`) {
+		t.Errorf("third copy flagged as duplicate")
+	}
+
+	// Dedup is by actual topic, not by subscription filter.
+	mq.sent("home/jl/rx/1", `{"a":1}`, 1)
+	if mq.isDup("home/jl/rx/2", `{"a":1}`) {
+		t.Errorf("message on different topic flagged as duplicate")
+	}
+	if mq.isDup("home/jl/rx/1", `{"a":2}`) {
+		t.Errorf("message with different payload flagged as duplicate")
+	}
+	if !mq.isDup("home/jl/rx/1", `{"a":1}`) {
+		t.Errorf("message not flagged as duplicate")
+	}
+	if len(mq.dedup) != 0 {
+		t.Errorf("dedup not empty: %+v", mq.dedup)
+	}
+}
+
+func TestSubscribeErrors(t *testing.T) {
+	mq := &mq{dedup: make(map[uint64]dedupEntry)}
+	for n, f := range map[string]interface{}{
+		"nil":         nil,
+		"not-func":    42,
+		"no-params":   func() {},
+		"returns":     func(m *RawTxMessage) error { return nil },
+		"not-pointer": func(m RawTxMessage) {},
+		"not-struct":  func(m *int) {},
+		"no-payload":  func(m *struct{ Topic string }) {},
+	} {
+		if err := mq.Subscribe("home/tx", f); err == nil {
+			t.Errorf("Subscribe %s: expected error", n)
+		}
+	}
+	if err := mq.Subscribe("home/#/tx", func(m *RawTxMessage) {}); err == nil {
+		t.Errorf("Subscribe with invalid filter: expected error")
+	}
+	if len(mq.subHooks) != 0 {
+		t.Errorf("failed subscriptions left hooks behind: %d", len(mq.subHooks))
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	for n, conf := range map[string]MqttConfig{
+		"cert-no-key": {Host: "broker", TLS: true, CertFile: "client.pem"},
+		"key-no-cert": {Host: "broker", TLS: true, KeyFile: "client.key"},
+		"missing-ca":  {Host: "broker", TLS: true, CAFile: "/nonexistent/ca.pem"},
+		"missing-cert": {Host: "broker", TLS: true, CertFile: "/nonexistent/client.pem",
+			KeyFile: "/nonexistent/client.key"},
+	} {
+		if _, err := newTLSConfig(conf); err == nil {
+			t.Errorf("%s: expected error", n)
+		}
+	}
+	tlsConf, err := newTLSConfig(MqttConfig{Host: "broker", TLS: true, Insecure: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tlsConf.ServerName != "broker" || !tlsConf.InsecureSkipVerify {
+		t.Errorf("unexpected TLS config: %+v", tlsConf)
+	}
+}
+
+// fakeClient is an MQTT client that records subscriptions and publications, the methods not
+// implemented here panic.
+type fakeClient struct {
+	mqtt.Client
+	subs   []string
+	unsubs []string
+	pubs   []string
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, h mqtt.MessageHandler) mqtt.Token {
+	c.subs = append(c.subs, topic)
+	return doneToken{}
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.unsubs = append(c.unsubs, topics...)
+	return doneToken{}
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool,
+	payload interface{}) mqtt.Token {
+	c.pubs = append(c.pubs, fmt.Sprintf("%s %v %s", topic, retained, payload))
+	return doneToken{}
+}
+
+// doneToken is an MQTT token for an operation that completed successfully.
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (doneToken) Error() error                   { return nil }
+
+func TestResubscribe(t *testing.T) {
+	c := &fakeClient{}
+	mq := &mq{conn: c, status: "gw/status", dedup: make(map[uint64]dedupEntry)}
+	if err := mq.Subscribe("fsk-gw/tx", func(m *RawTxMessage) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mq.Subscribe("lora-gw/+/tx", func(m *RawTxMessage) {}); err != nil {
+		t.Fatal(err)
+	}
+	if mq.Subscribe("bad/#/filter", func(m *RawTxMessage) {}) == nil {
+		t.Fatal("expected error")
+	}
+
+	// Simulate a reconnect.
+	c2 := &fakeClient{}
+	mq.onConnect(c2)
+	if !reflect.DeepEqual(c2.subs, []string{"fsk-gw/tx", "lora-gw/+/tx"}) {
+		t.Errorf("expected both subscriptions to be renewed, got %v", c2.subs)
+	}
+	if !reflect.DeepEqual(c2.pubs, []string{"gw/status true online"}) {
+		t.Errorf("expected retained online status, got %v", c2.pubs)
+	}
+
+	// No status topic.
+	mq.status = ""
+	c3 := &fakeClient{}
+	mq.onConnect(c3)
+	if len(c3.subs) != 2 || len(c3.pubs) != 0 {
+		t.Errorf("unexpected subs %v / pubs %v", c3.subs, c3.pubs)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2017 by Thorsten von Eicken, see LICENSE file for details
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//===== Node presence tracker
+
+// nodeTracker keeps track of when each node was last heard and with what link quality. It
+// subscribes to the output of the jl-decode module and publishes, retained, the state of a node
+// to Pub + "/<node>" each time the node is heard or becomes stale, as well as the state of all
+// nodes to Pub. The state is kept in memory only, so the summary published to Pub at startup is
+// empty and the retained node topics left over from a previous run are cleared. Stopping the
+// tracker clears the topics it published.
+type nodeTracker struct {
+	topic   string                                  // topic prefix to publish to
+	stale   time.Duration                           // time after which a node is flagged as stale
+	publish func(topic string, payload interface{}) // publishes retained messages, nil clears
+	done    chan struct{}                           // closed to stop the stale check goroutine
+	mu      sync.Mutex                              // protects nodes
+	nodes   map[byte]*nodeState                     // state of each node heard
+}
+
+// nodeMessage is a node state received from MQTT.
+type nodeMessage struct {
+	Topic   string
+	Payload nodeState
+}
+
+// nodeState is the structure published to MQTT by the node-tracker module for each node, the
+// RSSI and FEI are exponential moving averages over the last 8 or so packets.
+type nodeState struct {
+	Node     byte      `json:"node"`      // node ID
+	LastSeen time.Time `json:"last_seen"` // time the last packet was received
+	Packets  int       `json:"packets"`   // number of packets received since startup
+	Rssi     float64   `json:"rssi"`      // average RSSI in dB
+	Fei      float64   `json:"fei"`       // average frequency error in Hz
+	Stale    bool      `json:"stale"`     // true if not heard for the stale interval
+}
+
+// nodeAvgWeight is the weight of a new packet in the moving averages of the nodeState.
+const nodeAvgWeight = 1.0 / 8
+
+// newNodeTracker returns a nodeTracker using the stale interval of the config.
+func newNodeTracker(mc ModuleConfig, publish func(string, interface{})) *nodeTracker {
+	t := &nodeTracker{topic: mc.Pub, stale: time.Duration(mc.Stale) * time.Second,
+		publish: publish, done: make(chan struct{}), nodes: map[byte]*nodeState{}}
+	if t.stale <= 0 {
+		t.stale = time.Hour
+	}
+	return t
+}
+
+// setupNodeTracker starts a tracker for the config and returns its handler and a function
+// stopping it. The tracker subscribes to its node topics to clear the retained messages of nodes
+// it hasn't heard.
+func setupNodeTracker(mc ModuleConfig, mq *mq, debug LogPrintf) (interface{}, func(), error) {
+	t := newNodeTracker(mc, mq.PublishRetained)
+	if err := mq.Subscribe(t.topic+"/+", t.leftover); err != nil {
+		return nil, nil, err
+	}
+	t.publishAll()
+	go t.run(time.NewTicker(t.stale / 4))
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			if err := mq.Unsubscribe(t.topic + "/+"); err != nil {
+				debug("Node tracker %s: %s", t.topic, err)
+			}
+			t.stop()
+		})
+	}
+	return t.rx, stop, nil
+}
+
+// run checks for stale nodes at each tick until the tracker is stopped.
+func (t *nodeTracker) run(ticker *time.Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.checkStale(now)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// stop stops the stale check and clears the retained messages of the tracker so they don't
+// conflict with those of a tracker replacing it.
+func (t *nodeTracker) stop() {
+	close(t.done)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id := range t.nodes {
+		t.publish(fmt.Sprintf("%s/%d", t.topic, id), nil)
+	}
+	t.nodes = map[byte]*nodeState{}
+	t.publish(t.topic, nil)
+}
+
+// leftover clears the retained state of a node that the tracker hasn't heard, which was published
+// by a previous run. The states of the nodes heard are the tracker's own messages coming back.
+func (t *nodeTracker) leftover(m *nodeMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nodes[m.Payload.Node] == nil {
+		t.publish(m.Topic, nil)
+	}
+}
+
+// rx updates the state of the node that sent a packet and publishes it.
+func (t *nodeTracker) rx(m *jlRxMessage, pub pubFunc, debug LogPrintf) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := &m.Payload
+	n := t.nodes[p.Src]
+	if n == nil {
+		n = &nodeState{Node: p.Src, Rssi: float64(p.Rssi), Fei: float64(p.Fei)}
+		t.nodes[p.Src] = n
+	}
+	n.LastSeen = time.Now()
+	n.Packets++
+	n.Rssi += (float64(p.Rssi) - n.Rssi) * nodeAvgWeight
+	n.Fei += (float64(p.Fei) - n.Fei) * nodeAvgWeight
+	if n.Stale {
+		debug("Node %d is back", n.Node)
+	}
+	n.Stale = false
+	t.publishNode(n)
+}
+
+// checkStale flags the nodes that haven't been heard for the stale interval.
+func (t *nodeTracker) checkStale(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, n := range t.nodes {
+		if !n.Stale && now.Sub(n.LastSeen) >= t.stale {
+			n.Stale = true
+			t.publishNode(n)
+		}
+	}
+}
+
+// publishNode publishes the state of a node and the summary, the lock must be held.
+func (t *nodeTracker) publishNode(n *nodeState) {
+	t.publish(fmt.Sprintf("%s/%d", t.topic, n.Node), *n)
+	t.publishAll()
+}
+
+// publishAll publishes the state of all nodes, the lock must be held.
+func (t *nodeTracker) publishAll() {
+	all := make(map[string]nodeState, len(t.nodes))
+	for id, n := range t.nodes {
+		all[fmt.Sprint(id)] = *n
+	}
+	t.publish(t.topic, all)
+}
+
+func init() {
+	RegisterModule(module{"node-tracker", moduleSetup(setupNodeTracker)})
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2017 by Thorsten von Eicken, see LICENSE file for details
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNodeTracker(t *testing.T) {
+	pubs := map[string]interface{}{}
+	tr := newNodeTracker(ModuleConfig{Pub: "fsk-gw/nodes", Stale: 60},
+		func(topic string, p interface{}) { pubs[topic] = p })
+	tr.publishAll()
+	if all, ok := pubs["fsk-gw/nodes"].(map[string]nodeState); !ok || len(all) != 0 {
+		t.Errorf("expected empty summary at startup, got %+v", pubs)
+	}
+
+	m := &jlRxMessage{Topic: "fsk-gw/rx/jl/2", Payload: jlRxPacket{Src: 12, Type: 2}}
+	m.Payload.Rssi, m.Payload.Fei = -80, 1000
+	tr.rx(m, nil, t.Logf)
+	m.Payload.Rssi, m.Payload.Fei = -72, 200
+	tr.rx(m, nil, t.Logf)
+	n, ok := pubs["fsk-gw/nodes/12"].(nodeState)
+	if !ok || n.Node != 12 || n.Packets != 2 || n.Rssi != -79 || n.Fei != 900 || n.Stale {
+		t.Errorf("unexpected node state %+v", pubs["fsk-gw/nodes/12"])
+	}
+	if all := pubs["fsk-gw/nodes"].(map[string]nodeState); all["12"] != n {
+		t.Errorf("unexpected summary %+v", all)
+	}
+
+	// The node becomes stale once and is back with the next packet.
+	tr.checkStale(n.LastSeen.Add(59 * time.Second))
+	if pubs["fsk-gw/nodes/12"].(nodeState).Stale {
+		t.Error("node flagged as stale too early")
+	}
+	delete(pubs, "fsk-gw/nodes/12")
+	tr.checkStale(n.LastSeen.Add(time.Minute))
+	if n, ok := pubs["fsk-gw/nodes/12"].(nodeState); !ok || !n.Stale {
+		t.Errorf("expected node to be stale, got %+v", pubs["fsk-gw/nodes/12"])
+	}
+	delete(pubs, "fsk-gw/nodes/12")
+	tr.checkStale(n.LastSeen.Add(2 * time.Minute))
+	if _, ok := pubs["fsk-gw/nodes/12"]; ok {
+		t.Error("stale node published again")
+	}
+	tr.rx(m, nil, t.Logf)
+	if n := pubs["fsk-gw/nodes/12"].(nodeState); n.Stale || n.Packets != 3 {
+		t.Errorf("expected node to be back, got %+v", n)
+	}
+}
+
+func TestNodeTrackerStop(t *testing.T) {
+	c := &fakeClient{}
+	mq := &mq{conn: c, dedup: make(map[uint64]dedupEntry)}
+	mc := ModuleConfig{Name: "node-tracker", Sub: "fsk-gw/rx/jl/+", Pub: "fsk-gw/nodes"}
+	h, stop, err := setupNodeTracker(mc, mq, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.subs, []string{"fsk-gw/nodes/+"}) {
+		t.Fatalf("expected a subscription to the node topics, got %v", c.subs)
+	}
+	leftover := mq.subHooks[0].evFunc.Interface().(func(*nodeMessage))
+	h.(func(*jlRxMessage, pubFunc, LogPrintf))(
+		&jlRxMessage{Payload: jlRxPacket{Src: 12}}, nil, t.Logf)
+
+	// The retained state of a node not heard is cleared, the tracker's own is left alone.
+	c.pubs = nil
+	leftover(&nodeMessage{Topic: "fsk-gw/nodes/12", Payload: nodeState{Node: 12}})
+	leftover(&nodeMessage{Topic: "fsk-gw/nodes/7", Payload: nodeState{Node: 7}})
+	if !reflect.DeepEqual(c.pubs, []string{"fsk-gw/nodes/7 true "}) {
+		t.Errorf("expected the leftover node to be cleared, got %v", c.pubs)
+	}
+
+	// Stopping the tracker clears its topics, stopping it again does nothing.
+	c.pubs = nil
+	stop()
+	want := []string{"fsk-gw/nodes/12 true ", "fsk-gw/nodes true "}
+	if !reflect.DeepEqual(c.pubs, want) || !reflect.DeepEqual(c.unsubs, c.subs) {
+		t.Errorf("expected %v and unsubscribe, got %v / %v", want, c.pubs, c.unsubs)
+	}
+	stop()
+	if len(c.pubs) != len(want) || len(c.unsubs) != 1 {
+		t.Errorf("tracker stopped twice: %v / %v", c.pubs, c.unsubs)
+	}
+}
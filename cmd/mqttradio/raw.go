@@ -3,9 +3,13 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tve/devices/sx1231"
@@ -17,13 +21,92 @@ import (
 	"periph.io/x/periph/conn/spi/spireg"
 )
 
+// PacketBytes holds a raw packet. It is encoded in JSON like a []byte, i.e., as base64 string,
+// except in the messages published to the rx topic of a radio configured with another
+// encoding, see RadioConfig.Encoding. All the encodings are accepted when decoding: an array
+// is an array of byte values, a string of "0x" followed by hex digits is hex, and any other
+// string is base64.
+type PacketBytes []byte
+
+// UnmarshalJSON decodes a packet in any of the encodings.
+func (p *PacketBytes) UnmarshalJSON(b []byte) error {
+	switch {
+	case string(b) == "null":
+		*p = nil
+		return nil
+	case len(b) > 0 && b[0] == '[':
+		var a []int
+		if err := json.Unmarshal(b, &a); err != nil {
+			return err
+		}
+		pkt := make(PacketBytes, len(a))
+		for i, v := range a {
+			if v < 0 || v > 255 {
+				return fmt.Errorf("packet byte %d out of range: %d", i, v)
+			}
+			pkt[i] = byte(v)
+		}
+		*p = pkt
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if strings.HasPrefix(s, "0x") {
+		if pkt, err := hex.DecodeString(s[2:]); err == nil {
+			*p = pkt
+			return nil
+		}
+	}
+	pkt, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*p = pkt
+	return nil
+}
+
+// encode returns the packet as a value that json.Marshal encodes using the encoding, which is
+// one of the values of RadioConfig.Encoding.
+func (p PacketBytes) encode(encoding string) interface{} {
+	switch encoding {
+	case "hex":
+		return "0x" + hex.EncodeToString(p)
+	case "array":
+		a := make([]int, len(p))
+		for i, b := range p {
+			a[i] = int(b)
+		}
+		return a
+	}
+	return []byte(p)
+}
+
+// validEncoding checks that the encoding is one of the values of RadioConfig.Encoding.
+func validEncoding(encoding string) error {
+	switch encoding {
+	case "", "base64", "hex", "array":
+		return nil
+	}
+	return fmt.Errorf("unknown packet encoding: %s", encoding)
+}
+
 // RawRxPacket is the structure published to MQTT for raw packets received on a radio.
 type RawRxPacket struct {
-	Packet []byte    `json:"packet"` // packet, including headers, excl sync, length, CRC
-	Rssi   int       `json:"rssi"`   // RSSI in dB for packet, 0 if unknown
-	Snr    int       `json:"snr"`    // Signal to noise in dB, 0 if unknown (ugh)
-	Fei    int       `json:"fei"`    // Freq error in Hz for packet, 0 if unknown (ugh)
-	At     time.Time `json:"at"`     // time of recv interrupt
+	Packet PacketBytes `json:"packet"` // packet, including headers, excl sync, length, CRC
+	Rssi   int         `json:"rssi"`   // RSSI in dB for packet, 0 if unknown
+	Snr    int         `json:"snr"`    // Signal to noise in dB, 0 if unknown (ugh)
+	Fei    int         `json:"fei"`    // Freq error in Hz for packet, 0 if unknown (ugh)
+	At     time.Time   `json:"at"`     // time of recv interrupt
+}
+
+// marshal returns the JSON encoding of the packet with the packet bytes in the encoding.
+func (p *RawRxPacket) marshal(encoding string) ([]byte, error) {
+	return json.Marshal(struct {
+		*RawRxPacket
+		Packet interface{} `json:"packet"`
+	}{p, p.Packet.encode(encoding)})
 }
 
 // RawRxMessage is the full MQTT message for a RawRxPacket. Primarily used when subscribing
@@ -37,7 +120,8 @@ type RawRxMessage struct {
 // It is a struct for symmetry with RawRxPacket and to allow more fields to be added in the
 // future as needed.
 type RawTxPacket struct {
-	Packet []byte `json:"packet"` // packet, including headers, excl sync, length, CRC
+	Packet PacketBytes `json:"packet"`          // packet, including headers, excl sync, length, CRC
+	Power  int         `json:"power,omitempty"` // TX power in dBm, 0 for default (sx1231 only)
 }
 
 // RawTxMessage is the full MQTT message for a RawTxPacket.
@@ -46,9 +130,66 @@ type RawTxMessage struct {
 	Payload RawTxPacket
 }
 
+// RadioInfo is the structure published to MQTT, retained, on the info topic of a radio when it
+// has been started and when its settings are changed. It reflects the settings actually applied
+// by the driver, which may differ from the config, e.g., due to power clamping.
+type RadioInfo struct {
+	Type  string `json:"type"`  // radio type, as in the config
+	Freq  uint32 `json:"freq"`  // center frequency in Hz
+	Rate  string `json:"rate"`  // data rate or LoRa config name
+	Power int    `json:"power"` // TX power in dBm
+	Sync  string `json:"sync"`  // sync bytes, in hex
+}
+
+// radioControl changes the settings of a running radio in place, it is used when the config
+// is reloaded.
+type radioControl interface {
+	SetFrequency(freq uint32)
+	SetRate(rate string) error
+	SetPower(dBm int)
+	Info() RadioInfo // current settings, the Type is filled in by the caller
+	Close() error    // stops the radio, its goroutines exit
+}
+
+// runningRadio is a radio that has been started by startRadio.
+type runningRadio struct {
+	conf   RadioConfig         // config the radio is running with
+	ctl    radioControl        // control of the radio's settings
+	txFunc func(*RawTxMessage) // MQTT -> radio function subscribed to the tx topic
+}
+
+// publishInfo publishes the current settings of the radio to its info topic.
+func (rr *runningRadio) publishInfo(mq *mq) {
+	info := rr.ctl.Info()
+	info.Type = rr.conf.Type
+	mq.PublishRetained(rr.conf.Prefix+"/info", &info)
+}
+
+// validRate checks that the rate is supported by the radio type.
+func validRate(radioType, rate string) error {
+	switch radioType {
+	case "lora.sx1276":
+		if _, ok := sx1276.Configs[rate]; !ok {
+			return fmt.Errorf("unknown LoRa config %s", rate)
+		}
+	case "fsk.rfm69", "fsk.rfm69h":
+		r, err := strconv.ParseUint(rate, 0, 32)
+		if err != nil {
+			return fmt.Errorf("cannot parse data rate %s: %s", rate, err)
+		}
+		if _, ok := sx1231.Rates[uint32(r)]; !ok {
+			return fmt.Errorf("unsupported data rate %s", rate)
+		}
+	default:
+		return fmt.Errorf("unknown radio type: %s", radioType)
+	}
+	return nil
+}
+
 // startRadio prepares all the devices, pins, and MQTT channels needed to operate a radio
 // and then calls the radio type specific function to start the gatewaying goroutines.
-func startRadio(r RadioConfig, muxes map[string]spi.PortCloser, mq *mq, debug LogPrintf) error {
+func startRadio(r RadioConfig, muxes map[string]spi.PortCloser, mq *mq, debug LogPrintf,
+) (*runningRadio, error) {
 	if debug != nil {
 		debug("Configuring radio for %s: %+v", r.Prefix, r)
 	}
@@ -61,7 +202,7 @@ func startRadio(r RadioConfig, muxes map[string]spi.PortCloser, mq *mq, debug Lo
 		// Easy case: non-muxed SPI bus.
 		dev, err = spireg.Open(fmt.Sprintf("SPI%d.%d", r.SpiBus, r.SpiCS))
 		if err != nil {
-			return err
+			return nil, err
 		}
 	} else {
 		// More complex: SPI bus with muxed chip select.
@@ -74,11 +215,11 @@ func startRadio(r RadioConfig, muxes map[string]spi.PortCloser, mq *mq, debug Lo
 		if dev == nil {
 			// Need to open a muxed bus.
 			if r.CSMuxValue < 0 || r.CSMuxValue > 1 {
-				return fmt.Errorf("Sorry, CSMuxValue must be 0 or 1")
+				return nil, fmt.Errorf("Sorry, CSMuxValue must be 0 or 1")
 			}
 			d, err := muxedSPI(r.CSMuxPin)
 			if err != nil {
-				return fmt.Errorf("Error opening SPI: %s", err)
+				return nil, fmt.Errorf("Error opening SPI: %s", err)
 			}
 			// Save the device we're not using for later.
 			k := muxKey(r.SpiBus, r.SpiCS, r.CSMuxPin, 1-r.CSMuxValue)
@@ -88,18 +229,20 @@ func startRadio(r RadioConfig, muxes map[string]spi.PortCloser, mq *mq, debug Lo
 	}
 
 	// Create MQTT publisher with prefix for rx.
-	rxPub := func(pkt *RawRxPacket) { mq.Publish(r.Prefix+"/rx", pkt) }
+	rxPub := func(pkt *RawRxPacket) {
+		mq.publish(r.Prefix+"/rx", pkt, func() ([]byte, error) { return pkt.marshal(r.Encoding) })
+	}
 
 	// Open the interrupt pin.
 	intrPin := gpioreg.ByName(r.IntrPin)
 	if intrPin == nil {
-		return fmt.Errorf("cannot open pin %s", r.IntrPin)
+		return nil, fmt.Errorf("cannot open pin %s", r.IntrPin)
 	}
 
 	// Parse the sync word string into a byte array.
 	sy, err := strconv.ParseUint(r.Sync, 0, 64)
 	if err != nil {
-		return fmt.Errorf("cannot parse sync bytes %s: %s", r.Sync, err)
+		return nil, fmt.Errorf("cannot parse sync bytes %s: %s", r.Sync, err)
 	}
 	sync := []byte{}
 	for sy > 0 {
@@ -110,27 +253,28 @@ func startRadio(r RadioConfig, muxes map[string]spi.PortCloser, mq *mq, debug Lo
 	rs := &radioSettings{dev: dev, intrPin: intrPin, freq: uint32(r.Freq),
 		rate: r.Rate, sync: sync, power: r.Power}
 
-	var txFunc func(*RawTxMessage)
+	rr := &runningRadio{conf: r}
 	switch r.Type {
 	case "lora.sx1276":
-		txFunc, err = lora1276GW(rs, r.Prefix, rxPub, debug)
+		rr.txFunc, rr.ctl, err = lora1276GW(rs, r.Prefix, rxPub, debug)
 	case "fsk.rfm69":
-		txFunc, err = fsk69GW(rs, false, r.Prefix, rxPub, debug)
+		rr.txFunc, rr.ctl, err = fsk69GW(rs, false, r.Prefix, rxPub, debug)
 	case "fsk.rfm69h":
-		txFunc, err = fsk69GW(rs, true, r.Prefix, rxPub, debug)
+		rr.txFunc, rr.ctl, err = fsk69GW(rs, true, r.Prefix, rxPub, debug)
 	default:
 		err = fmt.Errorf("unknown radio type: %s", r.Type)
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Create MQTT subscription for Tx.
-	if err := mq.Subscribe(r.Prefix+"/tx", txFunc); err != nil {
-		return err
+	if err := mq.Subscribe(r.Prefix+"/tx", rr.txFunc); err != nil {
+		return nil, err
 	}
 
-	return err
+	rr.publishInfo(mq)
+	return rr, nil
 }
 
 // radioSettings contains the settings of a radio.
@@ -147,7 +291,7 @@ type radioSettings struct {
 // between the radio and mqtt.
 func lora1276GW(conf *radioSettings, prefix string,
 	rxPub func(*RawRxPacket), debug LogPrintf,
-) (func(*RawTxMessage), error) {
+) (func(*RawTxMessage), radioControl, error) {
 	log.Printf("Initializing LoRA sx1276 radio for %s", prefix)
 	radio, err := sx1276.New(conf.dev, conf.intrPin, sx1276.RadioOpts{
 		Sync:   conf.sync[0],
@@ -156,7 +300,7 @@ func lora1276GW(conf *radioSettings, prefix string,
 		Logger: sx1276.LogPrintf(debug),
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	radio.SetPower(byte(conf.power))
 	log.Printf("LoRa radio ready")
@@ -168,6 +312,9 @@ func lora1276GW(conf *radioSettings, prefix string,
 		}
 		for {
 			pkt, err := radio.Receive()
+			if err == sx1276.ErrClosed {
+				return
+			}
 			if err != nil {
 				log.Printf("%s: receive error: %s", prefix, err)
 				continue
@@ -177,7 +324,6 @@ func lora1276GW(conf *radioSettings, prefix string,
 			rxPub(&RawRxPacket{Packet: pkt.Payload, Rssi: pkt.Rssi, Snr: pkt.Snr,
 				Fei: pkt.Fei, At: pkt.At})
 		}
-		log.Printf("%s: radio->mqtt goroutine exiting", prefix)
 	}()
 
 	// MQTT -> Radio function
@@ -196,21 +342,61 @@ func lora1276GW(conf *radioSettings, prefix string,
 			}
 			time.Sleep(10 * time.Millisecond)
 		}
-		return
 	}
-	return txFunc, nil
+	return txFunc, loraControl{radio, conf.sync[0]}, nil
+}
+
+// loraControl implements radioControl for an sx1276. The setters of the sx1276 driver don't
+// lock the radio, which is necessary because the receive goroutine is using it concurrently.
+type loraControl struct {
+	radio *sx1276.Radio
+	sync  byte // the sx1276 only uses the first sync byte
+}
+
+func (c loraControl) SetFrequency(freq uint32) {
+	c.radio.Lock()
+	defer c.radio.Unlock()
+	c.radio.SetFrequency(freq)
+}
+
+func (c loraControl) SetRate(rate string) error {
+	if err := validRate("lora.sx1276", rate); err != nil {
+		return err
+	}
+	c.radio.Lock()
+	defer c.radio.Unlock()
+	c.radio.SetConfig(rate)
+	return nil
 }
 
+func (c loraControl) SetPower(dBm int) {
+	c.radio.Lock()
+	defer c.radio.Unlock()
+	c.radio.SetPower(byte(dBm))
+}
+
+func (c loraControl) Close() error { return c.radio.Close() }
+
+func (c loraControl) Info() RadioInfo {
+	c.radio.Lock()
+	defer c.radio.Unlock()
+	return RadioInfo{Freq: c.radio.Frequency(), Rate: c.radio.Config(),
+		Power: c.radio.Power(), Sync: fmt.Sprintf("%#x", []byte{c.sync})}
+}
+
+// verifyInterval is how often the radio configuration is read back to detect corruption.
+const verifyInterval = 5 * time.Minute
+
 // fsk69GW instantiates an sx1231 radio, and then gateways between the radio and mqtt.
 // If paBoost is true then power amplifiers PA1 and PA2 are used, else PA0 is used.
 func fsk69GW(conf *radioSettings, paBoost bool, prefix string,
 	rxPub func(*RawRxPacket), debug LogPrintf,
-) (func(*RawTxMessage), error) {
+) (func(*RawTxMessage), radioControl, error) {
 
 	log.Printf("Initializing FSK sx1231 radio for %s", prefix)
 	rate, err := strconv.ParseUint(conf.rate, 0, 32)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse data rate %s: %s", conf.rate, err)
+		return nil, nil, fmt.Errorf("cannot parse data rate %s: %s", conf.rate, err)
 	}
 
 	radio, err := sx1231.New(conf.dev, conf.intrPin, sx1231.RadioOpts{
@@ -221,10 +407,31 @@ func fsk69GW(conf *radioSettings, paBoost bool, prefix string,
 		Logger:  sx1231.LogPrintf(debug),
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	radio.SetPower(byte(conf.power))
-	log.Printf("FSK radio ready")
+	power, err := radio.SetPower(conf.power)
+	if err != nil {
+		log.Printf("%s: %s", prefix, err)
+	}
+	log.Printf("FSK radio ready, TX power %ddBm", power)
+
+	// Periodically check that the radio's registers haven't been corrupted, until the receive
+	// goroutine sees that the radio has been closed.
+	closed := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(verifyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := radio.VerifyConfig(); err != nil {
+					log.Printf("%s: %s", prefix, err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
 
 	// Radio -> MQTT goroutine.
 	go func() {
@@ -233,6 +440,10 @@ func fsk69GW(conf *radioSettings, paBoost bool, prefix string,
 		}
 		for {
 			pkt, err := radio.Receive()
+			if err == sx1231.ErrClosed {
+				close(closed)
+				return
+			}
 			if err != nil {
 				log.Printf("%s: receive error: %s", prefix, err)
 				continue
@@ -242,16 +453,16 @@ func fsk69GW(conf *radioSettings, paBoost bool, prefix string,
 			rxPub(&RawRxPacket{Packet: pkt.Payload, Rssi: pkt.Rssi, Snr: pkt.Snr,
 				Fei: pkt.Fei, At: pkt.At})
 		}
-		log.Printf("%s: radio->mqtt goroutine exiting", prefix)
 	}()
 
 	// MQTT -> Radio function
 	txFunc := func(m *RawTxMessage) {
 		buf := m.Payload.Packet
 		log.Printf("%s: TX %db: %#x", prefix, len(buf), buf)
+		pkt := &sx1231.TxPacket{Payload: buf, Power: m.Payload.Power}
 		// Retry loop while radio is busy.
 		for {
-			err := radio.Transmit(buf)
+			err := radio.TransmitPacket(pkt)
 			if err == nil {
 				return
 			}
@@ -261,8 +472,41 @@ func fsk69GW(conf *radioSettings, paBoost bool, prefix string,
 			}
 			time.Sleep(10 * time.Millisecond)
 		}
-		return
 	}
 
-	return txFunc, nil
+	return txFunc, fskControl{radio, prefix, conf.sync}, nil
+}
+
+// fskControl implements radioControl for an sx1231.
+type fskControl struct {
+	radio  *sx1231.Radio
+	prefix string
+	sync   []byte
+}
+
+func (c fskControl) SetFrequency(freq uint32) { c.radio.SetFrequency(freq) }
+
+func (c fskControl) SetRate(rate string) error {
+	if err := validRate("fsk.rfm69", rate); err != nil {
+		return err
+	}
+	r, _ := strconv.ParseUint(rate, 0, 32)
+	c.radio.SetRate(uint32(r))
+	return nil
+}
+
+func (c fskControl) SetPower(dBm int) {
+	power, err := c.radio.SetPower(dBm)
+	if err != nil {
+		log.Printf("%s: %s", c.prefix, err)
+	}
+	log.Printf("%s: TX power %ddBm", c.prefix, power)
+}
+
+func (c fskControl) Close() error { return c.radio.Close() }
+
+func (c fskControl) Info() RadioInfo {
+	rate, _ := c.radio.CurrentRate()
+	return RadioInfo{Freq: c.radio.Frequency(), Rate: strconv.FormatUint(uint64(rate), 10),
+		Power: c.radio.Power(), Sync: fmt.Sprintf("%#x", c.sync)}
 }
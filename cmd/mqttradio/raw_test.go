@@ -0,0 +1,55 @@
+// Copyright (c) 2017 by Thorsten von Eicken, see LICENSE file for details
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPacketBytes(t *testing.T) {
+	pkt := &RawRxPacket{Packet: PacketBytes{0x01, 0xab, 0xff}, Rssi: -80}
+	for enc, want := range map[string]string{
+		"":       `"Aav/"`,
+		"base64": `"Aav/"`,
+		"hex":    `"0x01abff"`,
+		"array":  `[1,171,255]`,
+	} {
+		b, err := pkt.marshal(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"packet":`+want) ||
+			!strings.Contains(string(b), `"rssi":-80`) {
+			t.Errorf("%q: unexpected JSON %s", enc, b)
+		}
+
+		// The tx topic accepts all the encodings.
+		var m RawTxMessage
+		if err := json.Unmarshal([]byte(`{"Topic":"gw/tx","Payload":{"packet":`+want+`}}`),
+			&m); err != nil {
+			t.Fatalf("%q: %s", enc, err)
+		}
+		if !reflect.DeepEqual(m.Payload.Packet, pkt.Packet) {
+			t.Errorf("%q: decoded %#x", enc, m.Payload.Packet)
+		}
+	}
+
+	var p PacketBytes
+	for _, bad := range []string{`"0x1"`, `"$$"`, `[1,256]`, `[-1]`, `42`} {
+		if err := json.Unmarshal([]byte(bad), &p); err == nil {
+			t.Errorf("%s: expected error, got %#x", bad, p)
+		}
+	}
+	if err := json.Unmarshal([]byte(`null`), &p); err != nil || p != nil {
+		t.Errorf("null: got %#x, err %v", p, err)
+	}
+
+	// Other messages use base64 and keep all their fields.
+	b, _ := json.Marshal(jlRxPacket{RawRxPacket: *pkt, Src: 3})
+	if !strings.Contains(string(b), `"packet":"Aav/"`) || !strings.Contains(string(b), `"src":3`) {
+		t.Errorf("unexpected JSON %s", b)
+	}
+}
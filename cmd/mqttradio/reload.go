@@ -0,0 +1,274 @@
+// Copyright (c) 2017 by Thorsten von Eicken, see LICENSE file for details
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/BurntSushi/toml"
+	"periph.io/x/periph/conn/spi"
+)
+
+// gateway holds the running state of the GW such that the config can be reloaded.
+type gateway struct {
+	conf    *Config                   // config the GW is running with
+	mq      *mq                       // broker connection
+	muxes   map[string]spi.PortCloser // unused muxed SPI devices, see startRadio
+	radios  map[string]*runningRadio  // running radios indexed by topic prefix
+	modules []ModuleConfig            // hooked modules
+	stops   []func()                  // stop functions of the hooked modules, nil for most
+	debug   LogPrintf
+}
+
+// loadConfig reads and parses the config file and checks that it makes sense.
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+	rawConfig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access config file: %s", err)
+	}
+	if err := toml.Unmarshal(rawConfig, config); err != nil {
+		return nil, fmt.Errorf("cannot parse config file: %s", err)
+	}
+
+	if len(config.Radio) == 0 {
+		return nil, errors.New("at least one radio must be specified in the config")
+	}
+	prefixes := map[string]bool{}
+	for _, r := range config.Radio {
+		if prefixes[r.Prefix] {
+			return nil, fmt.Errorf("radio prefix %s is used more than once", r.Prefix)
+		}
+		prefixes[r.Prefix] = true
+		if err := validRate(r.Type, r.Rate); err != nil {
+			return nil, fmt.Errorf("radio %s: %s", r.Prefix, err)
+		}
+		if err := validEncoding(r.Encoding); err != nil {
+			return nil, fmt.Errorf("radio %s: %s", r.Prefix, err)
+		}
+	}
+	for _, m := range config.Module {
+		if _, ok := modules[m.Name]; !ok {
+			return nil, fmt.Errorf("module %s not found", m.Name)
+		}
+	}
+	return config, nil
+}
+
+// startRadios starts all the radios in the config.
+func (gw *gateway) startRadios(radios []RadioConfig) error {
+	for _, r := range radios {
+		rr, err := startRadio(r, gw.muxes, gw.mq, gw.debug)
+		if err != nil {
+			return fmt.Errorf("failed to config radio for %s: %s", r.Prefix, err)
+		}
+		gw.radios[r.Prefix] = rr
+	}
+	return nil
+}
+
+// hookModules hooks all the modules in the config.
+func (gw *gateway) hookModules(mods []ModuleConfig) error {
+	for _, m := range mods {
+		stop, err := hookModule(m, gw.mq, gw.debug)
+		if err != nil {
+			return fmt.Errorf("failed to install module %s (%s->%s): %s",
+				m.Name, m.Sub, m.Pub, err)
+		}
+		gw.modules = append(gw.modules, m)
+		gw.stops = append(gw.stops, stop)
+	}
+	return nil
+}
+
+// reload re-reads the config file and applies the differences to the running GW. An invalid
+// config is rejected as a whole and the GW keeps running with the old one. Modules get added
+// and removed, radios get added, removed, and their frequency, rate, and power get changed in
+// place. Changing the hardware settings of a radio requires a restart, such changes are logged
+// and otherwise ignored, as are changes to the MQTT section.
+func (gw *gateway) reload(path string) {
+	conf, err := loadConfig(path)
+	if err != nil {
+		log.Printf("Config reload failed, keeping the old config: %s", err)
+		return
+	}
+	if conf.Mqtt != gw.conf.Mqtt || conf.Debug != gw.conf.Debug {
+		log.Printf("Config reload: MQTT and debug settings require a restart")
+	}
+
+	// Radios. The removed ones are shut down first so their hardware can be reused right away.
+	keep := map[string]bool{}
+	for _, r := range conf.Radio {
+		keep[r.Prefix] = true
+	}
+	gone := map[string]bool{} // tx topics of the removed radios, already unsubscribed
+	for p, rr := range gw.radios {
+		if !keep[p] {
+			log.Printf("Config reload: removing radio %s", p)
+			gw.removeRadio(rr)
+			gone[p+"/tx"] = true
+		}
+	}
+	for _, r := range conf.Radio {
+		rr := gw.radios[r.Prefix]
+		switch {
+		case rr == nil:
+			if err := gw.startRadios([]RadioConfig{r}); err != nil {
+				log.Printf("Config reload: %s", err)
+			}
+		case r.hardware() != rr.conf.hardware():
+			log.Printf("Config reload: radio %s: changing the type, pins, sync bytes, or "+
+				"encoding requires a restart", r.Prefix)
+		default:
+			gw.updateRadio(rr, r)
+		}
+	}
+
+	// Modules. Unsubscribing is by topic, so the surviving modules and radios that share a
+	// topic with a removed module or radio need to be subscribed again. A module subscribed
+	// again has all its topics unsubscribed first, which may affect further modules.
+	wanted := map[ModuleConfig]int{}
+	for _, m := range conf.Module {
+		wanted[m]++
+	}
+	var running, added []ModuleConfig
+	var stops, removed []func()
+	unsub := map[string]bool{}
+	for topic := range gone {
+		unsub[topic] = true
+	}
+	for i, m := range gw.modules {
+		if wanted[m] > 0 {
+			wanted[m]--
+			running = append(running, m)
+			stops = append(stops, gw.stops[i])
+		} else {
+			log.Printf("Config reload: removing module %s (%s->%s)", m.Name, m.Sub, m.Pub)
+			for _, topic := range m.topics() {
+				unsub[topic] = true
+			}
+			if gw.stops[i] != nil {
+				removed = append(removed, gw.stops[i])
+			}
+		}
+	}
+	for _, m := range conf.Module {
+		if wanted[m] > 0 {
+			wanted[m]--
+			added = append(added, m)
+		}
+	}
+	resub := make([]bool, len(running))
+	for changed := true; changed; {
+		changed = false
+		for i, m := range running {
+			for _, topic := range m.topics() {
+				resub[i] = resub[i] || unsub[topic]
+			}
+			for _, topic := range m.topics() {
+				if resub[i] && !unsub[topic] {
+					unsub[topic], changed = true, true
+				}
+			}
+		}
+	}
+	for topic := range unsub {
+		if gone[topic] {
+			continue
+		}
+		if err := gw.mq.Unsubscribe(topic); err != nil {
+			log.Printf("Config reload: %s", err)
+		}
+	}
+	for _, stop := range removed {
+		stop() // once unsubscribed so the module doesn't process further messages
+	}
+	// A module subscribed again is hooked again, which creates a new instance, so the old one
+	// is stopped like those of the removed modules.
+	gw.modules, gw.stops = nil, nil
+	for i, m := range running {
+		if resub[i] {
+			if stops[i] != nil {
+				stops[i]()
+			}
+			added = append(added, m)
+		} else {
+			gw.modules = append(gw.modules, m)
+			gw.stops = append(gw.stops, stops[i])
+		}
+	}
+	for _, rr := range gw.radios {
+		if topic := rr.conf.Prefix + "/tx"; unsub[topic] {
+			if err := gw.mq.Subscribe(topic, rr.txFunc); err != nil {
+				log.Printf("Config reload: radio %s: %s", rr.conf.Prefix, err)
+			}
+		}
+	}
+	for _, m := range added {
+		if err := gw.hookModules([]ModuleConfig{m}); err != nil {
+			log.Printf("Config reload: %s", err)
+		}
+	}
+
+	gw.conf = conf
+	log.Printf("Config reloaded")
+}
+
+// removeRadio stops forwarding packets to and from a radio, closes it, and clears its info
+// topic.
+func (gw *gateway) removeRadio(rr *runningRadio) {
+	p := rr.conf.Prefix
+	if err := gw.mq.Unsubscribe(p + "/tx"); err != nil {
+		log.Printf("Config reload: radio %s: %s", p, err)
+	}
+	if err := rr.ctl.Close(); err != nil {
+		log.Printf("Config reload: radio %s: %s", p, err)
+	}
+	gw.mq.PublishRetained(p+"/info", nil)
+	delete(gw.radios, p)
+}
+
+// updateRadio applies the changes to the settings of a running radio that can be changed in
+// place and publishes the new settings to the radio's info topic.
+func (gw *gateway) updateRadio(rr *runningRadio, r RadioConfig) {
+	if r == rr.conf {
+		return
+	}
+	defer rr.publishInfo(gw.mq)
+	if r.Freq != rr.conf.Freq {
+		log.Printf("Config reload: radio %s: frequency %d", r.Prefix, r.Freq)
+		rr.ctl.SetFrequency(uint32(r.Freq))
+		rr.conf.Freq = r.Freq
+	}
+	if r.Rate != rr.conf.Rate {
+		log.Printf("Config reload: radio %s: rate %s", r.Prefix, r.Rate)
+		if err := rr.ctl.SetRate(r.Rate); err != nil {
+			log.Printf("Config reload: radio %s: %s", r.Prefix, err)
+		} else {
+			rr.conf.Rate = r.Rate
+		}
+	}
+	if r.Power != rr.conf.Power {
+		log.Printf("Config reload: radio %s: power %ddBm", r.Prefix, r.Power)
+		rr.ctl.SetPower(r.Power)
+		rr.conf.Power = r.Power
+	}
+}
+
+// hardware returns the radio config with the settings that can be changed in place cleared,
+// i.e., what's left identifies the radio hardware and the driver.
+func (r RadioConfig) hardware() RadioConfig {
+	r.Freq, r.Rate, r.Power = 0, "", 0
+	return r
+}
+
+// topics returns the topics the module subscribes to.
+func (m ModuleConfig) topics() []string {
+	if m.Rx != "" {
+		return []string{m.Sub, m.Rx}
+	}
+	return []string{m.Sub}
+}
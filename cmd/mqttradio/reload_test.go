@@ -0,0 +1,192 @@
+// Copyright (c) 2017 by Thorsten von Eicken, see LICENSE file for details
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeControl is a radioControl that records the changes made.
+type fakeControl struct {
+	calls []string
+}
+
+func (c *fakeControl) SetFrequency(freq uint32) {
+	c.calls = append(c.calls, fmt.Sprintf("freq %d", freq))
+}
+
+func (c *fakeControl) SetRate(rate string) error {
+	c.calls = append(c.calls, "rate "+rate)
+	return nil
+}
+
+func (c *fakeControl) SetPower(dBm int) {
+	c.calls = append(c.calls, fmt.Sprintf("power %d", dBm))
+}
+
+func (c *fakeControl) Close() error {
+	c.calls = append(c.calls, "close")
+	return nil
+}
+
+func (c *fakeControl) Info() RadioInfo {
+	return RadioInfo{Freq: 912500000, Rate: "50000", Power: 17, Sync: "0xaa2d06"}
+}
+
+// writeConfig writes the sample config file with the replacements applied to a temp file.
+func writeConfig(t *testing.T, dir string, oldnew ...string) string {
+	raw, err := ioutil.ReadFile("mqttradio.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := strings.NewReplacer(oldnew...).Replace(string(raw))
+	path := filepath.Join(dir, "mqttradio.toml")
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttradio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf, err := loadConfig(writeConfig(t, dir))
+	if err != nil {
+		t.Fatalf("sample config: %s", err)
+	}
+	if len(conf.Radio) != 1 || len(conf.Module) != 4 {
+		t.Errorf("unexpected sample config: %+v", conf)
+	}
+
+	for n, oldnew := range map[string][]string{
+		"syntax":         {"[mqtt]", "[mqtt"},
+		"no-radio":       {"[[radio]]", "[unused]"},
+		"bad-rate":       {`"49233"`, `"49234"`},
+		"bad-type":       {`"fsk.rfm69"`, `"fsk.rfm70"`},
+		"unknown-module": {`"jl-ack"`, `"jl-nak"`},
+		"dup-prefix":     {"[[module]]", "[[radio]]\ntype=\"fsk.rfm69\"\nprefix=\"fsk-gw\"\nrate=\"50000\"\n[[module]]"},
+	} {
+		if _, err := loadConfig(writeConfig(t, dir, oldnew...)); err == nil {
+			t.Errorf("%s: expected error", n)
+		}
+	}
+	if _, err := loadConfig(filepath.Join(dir, "nonexistent.toml")); err == nil {
+		t.Errorf("missing file: expected error")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttradio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Set up a GW with the sample config and a fake radio.
+	c := &fakeClient{}
+	mq := &mq{conn: c, dedup: make(map[uint64]dedupEntry)}
+	conf, err := loadConfig(writeConfig(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl := &fakeControl{}
+	gw := &gateway{conf: conf, mq: mq, radios: map[string]*runningRadio{
+		"fsk-gw": {conf: conf.Radio[0], ctl: ctl, txFunc: func(m *RawTxMessage) {}},
+	}, debug: t.Logf}
+	if err := gw.mq.Subscribe("fsk-gw/tx", gw.radios["fsk-gw"].txFunc); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.hookModules(conf.Module); err != nil {
+		t.Fatal(err)
+	}
+	hookTopics := func() []string {
+		var topics []string
+		for _, h := range mq.subHooks {
+			topics = append(topics, h.topic)
+		}
+		return topics
+	}
+
+	// An invalid config changes nothing.
+	gw.reload(writeConfig(t, dir, "power = 13", "power = 13\nrate = 42"))
+	if len(ctl.calls) != 0 || gw.conf != conf || len(c.unsubs) != 0 {
+		t.Errorf("invalid config was applied: %v %v", ctl.calls, c.unsubs)
+	}
+
+	// Change the rate and power and replace jl-ack, which shares its subscription with the
+	// jl-decode module that stays, and jl-varint with new jl-decode modules.
+	gw.reload(writeConfig(t, dir, `"49233"`, `"50000"`, "power = 13", "power = 17",
+		`"jl-ack"`, `"jl-decode"`, `"jl-varint"`, `"jl-decode"`))
+	if !reflect.DeepEqual(ctl.calls, []string{"rate 50000", "power 17"}) {
+		t.Errorf("unexpected radio changes: %v", ctl.calls)
+	}
+	if len(gw.modules) != 4 {
+		t.Errorf("expected 4 modules, got %+v", gw.modules)
+	}
+	want := []string{"fsk-gw/tx", "fsk-gw/rx/jl/1", "fsk-gw/rx", "fsk-gw/rx/jl/2", "fsk-gw/rx"}
+	if got := hookTopics(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected hooks %v, got %v", want, got)
+	}
+	if len(c.unsubs) != 2 {
+		t.Errorf("expected 2 topics to be unsubscribed, got %v", c.unsubs)
+	}
+	info := `fsk-gw/info true {"type":"fsk.rfm69","freq":912500000,"rate":"50000",` +
+		`"power":17,"sync":"0xaa2d06"}`
+	if !reflect.DeepEqual(c.pubs, []string{info}) {
+		t.Errorf("expected retained radio info, got %v", c.pubs)
+	}
+}
+
+func TestReloadRemoveRadio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttradio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &fakeClient{}
+	mq := &mq{conn: c, dedup: make(map[uint64]dedupEntry)}
+	conf, err := loadConfig(writeConfig(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl := &fakeControl{}
+	sent := 0
+	gw := &gateway{conf: conf, mq: mq, radios: map[string]*runningRadio{
+		"fsk-gw": {conf: conf.Radio[0], ctl: ctl, txFunc: func(m *RawTxMessage) { sent++ }},
+	}, debug: t.Logf}
+	if err := gw.mq.Subscribe("fsk-gw/tx", gw.radios["fsk-gw"].txFunc); err != nil {
+		t.Fatal(err)
+	}
+	tx := &RawTxPacket{Packet: []byte{1, 2, 3}}
+	mq.Publish("fsk-gw/tx", tx)
+	if sent != 1 {
+		t.Fatalf("expected the radio to transmit, sent %d", sent)
+	}
+
+	// Renaming the radio removes it, starting the new one fails without hardware.
+	gw.reload(writeConfig(t, dir, `prefix   = "fsk-gw"`, `prefix   = "fsk-gw2"`))
+	if _, ok := gw.radios["fsk-gw"]; ok || !reflect.DeepEqual(ctl.calls, []string{"close"}) {
+		t.Errorf("expected the radio to be closed and removed, got %v", ctl.calls)
+	}
+	if !reflect.DeepEqual(c.unsubs, []string{"fsk-gw/tx"}) {
+		t.Errorf("expected the tx topic to be unsubscribed, got %v", c.unsubs)
+	}
+	if len(c.pubs) == 0 || c.pubs[len(c.pubs)-1] != "fsk-gw/info true " {
+		t.Errorf("expected the retained info to be cleared, got %v", c.pubs)
+	}
+	mq.Publish("fsk-gw/tx", tx)
+	if sent != 1 {
+		t.Errorf("removed radio still transmits, sent %d", sent)
+	}
+}
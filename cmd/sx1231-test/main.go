@@ -67,9 +67,9 @@ func run(intrPinName, csPinName string, csVal, power int, debug bool) error {
 			log.Printf("Sending packet %d ...", i)
 			t0 = time.Now()
 			if i&1 == 0 {
-				rfm69.SetPower(0x18)
+				rfm69.SetPower(power - 6)
 			} else {
-				rfm69.SetPower(0x1F)
+				rfm69.SetPower(power)
 			}
 			//msg := "\x01Hello there, these are 60 chars............................"
 			msg := []byte(fmt.Sprintf("\x01Hello %03d", i))
@@ -101,7 +101,7 @@ func main() {
 	intrPin := flag.String("intr", "XIO-P0", "sx1231 radio interrupt pin name")
 	csPin := flag.String("cspin", "CSID0", "sx1231 radio chip select pin name")
 	csVal := flag.Int("csval", 0, "sx1231 radio chip select value (0 or 1)")
-	power := flag.Int("power", 15, "sx1231 radio output power in dBm (2..17)")
+	power := flag.Int("power", 15, "sx1231 radio output power in dBm (-18..20)")
 	debug := flag.Bool("debug", false, "enable debug output")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s:\n", os.Args[0])
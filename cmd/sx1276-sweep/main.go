@@ -12,11 +12,11 @@ import (
 	"strings"
 	"time"
 
-	"github.com/google/periph/conn/gpio"
-	"github.com/google/periph/conn/spi"
-	"github.com/google/periph/host"
 	"github.com/tve/devices/spimux"
 	"github.com/tve/devices/sx1276"
+	"periph.io/x/periph/conn/gpio/gpioreg"
+	"periph.io/x/periph/conn/spi/spireg"
+	"periph.io/x/periph/host"
 )
 
 func panicIf(err error) {
@@ -29,13 +29,13 @@ func main() {
 	_, err := host.Init()
 	panicIf(err)
 
-	selPinName := ""
-	selPin := gpio.ByName("CSID0")
+	selPinName := "CSID0"
+	selPin := gpioreg.ByName(selPinName)
 	if selPin == nil {
 		panic("Cannot open pin " + selPinName)
 	}
 
-	spiBus, err := spi.New(-1, 0)
+	spiBus, err := spireg.Open("")
 	panicIf(err)
 
 	_, spi1276 := spimux.New(spiBus, selPin)
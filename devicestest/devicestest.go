@@ -0,0 +1,306 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+// Package devicestest provides a simulated SPI device and GPIO pin to unit test the device
+// drivers without hardware.
+//
+// SPI simulates a chip accessed through a register file, as the Semtech radios are: the first
+// byte of each transaction is the register address with bit 7 set for writes, and the remaining
+// bytes read or write consecutive registers. The test can script the values returned by reads
+// and attach side effects to register writes, for example to raise IRQ flags or to trigger an
+// edge on a Pin connected to an interrupt line. All register writes are recorded so the test can
+// check how the driver programmed the chip.
+//
+// Port hands out the SPI to the driver's New function and Pin stands in for an interrupt or
+// other input pin.
+package devicestest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"periph.io/x/periph/conn"
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/spi"
+)
+
+// Write is a register write recorded by SPI.
+type Write struct {
+	Addr byte // register address
+	Data byte // value written
+}
+
+// SPI is a simulated SPI device with a register file, see the package documentation. The
+// methods are concurrency safe, the write hooks are called without the internal lock held so
+// they may call the other methods.
+type SPI struct {
+	mu        sync.Mutex
+	regs      [0x80]byte
+	fifo      [0x80]bool            // registers that don't auto-increment in bursts
+	responses map[byte][]byte       // scripted read values, consumed in order
+	hooks     map[byte][]func(byte) // side effects of writes
+	writes    []Write               // all register writes
+	err       error                 // error returned by Tx
+}
+
+// NewSPI returns an SPI with all registers zero.
+func NewSPI() *SPI {
+	return &SPI{responses: map[byte][]byte{}, hooks: map[byte][]func(byte){}}
+}
+
+// Tx performs a register read or write transaction.
+func (s *SPI) Tx(w, r []byte) error {
+	if len(w) == 0 {
+		return nil
+	}
+	if r != nil && len(r) != len(w) {
+		return errors.New("devicestest: Tx buffers must have the same length")
+	}
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	addr := w[0] & 0x7f
+	write := w[0]&0x80 != 0
+	var hooks []func()
+	for i := 1; i < len(w); i++ {
+		a := addr
+		if !s.fifo[addr] {
+			a = (addr + byte(i) - 1) & 0x7f
+		}
+		if write {
+			v := w[i]
+			s.regs[a] = v
+			s.writes = append(s.writes, Write{a, v})
+			for _, h := range s.hooks[a] {
+				h := h
+				hooks = append(hooks, func() { h(v) })
+			}
+			continue
+		}
+		v := s.regs[a]
+		if q := s.responses[a]; len(q) > 0 {
+			v, s.responses[a] = q[0], q[1:]
+		}
+		if r != nil {
+			r[i] = v
+		}
+	}
+	s.mu.Unlock()
+	for _, h := range hooks {
+		h()
+	}
+	return nil
+}
+
+// Duplex returns conn.Full.
+func (s *SPI) Duplex() conn.Duplex { return conn.Full }
+
+// TxPackets performs each packet as a separate transaction.
+func (s *SPI) TxPackets(p []spi.Packet) error {
+	for _, pkt := range p {
+		if err := s.Tx(pkt.W, pkt.R); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reg returns the current value of a register.
+func (s *SPI) Reg(addr byte) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.regs[addr&0x7f]
+}
+
+// SetReg sets the value of a register without recording a write or calling hooks, this is how
+// the test simulates the chip changing a register.
+func (s *SPI) SetReg(addr, value byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.regs[addr&0x7f] = value
+}
+
+// SetFIFO marks a register as a FIFO: the address doesn't auto-increment in burst transactions,
+// so all the bytes of a burst read or write that register.
+func (s *SPI) SetFIFO(addr byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fifo[addr&0x7f] = true
+}
+
+// Respond queues values to be returned by the next reads of a register, one per read. Once they
+// are consumed reads return the register value again. Writes don't affect the queue.
+func (s *SPI) Respond(addr byte, values ...byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr &= 0x7f
+	s.responses[addr] = append(s.responses[addr], values...)
+}
+
+// OnWrite adds a hook that is called with the value each time a register is written, after the
+// register has been updated.
+func (s *SPI) OnWrite(addr byte, hook func(value byte)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr &= 0x7f
+	s.hooks[addr] = append(s.hooks[addr], hook)
+}
+
+// Writes returns all the register writes performed so far, in order.
+func (s *SPI) Writes() []Write {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Write(nil), s.writes...)
+}
+
+// Written returns the values written to a register so far, in order.
+func (s *SPI) Written(addr byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var values []byte
+	for _, w := range s.writes {
+		if w.Addr == addr&0x7f {
+			values = append(values, w.Data)
+		}
+	}
+	return values
+}
+
+// Fail makes all subsequent transactions return err, nil reverts to normal operation.
+func (s *SPI) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Port is an spi.PortCloser that hands out a connection and records the parameters that were
+// requested.
+type Port struct {
+	Conn   spi.Conn // connection returned by DevParams
+	MaxHz  int64    // maximum speed passed to DevParams
+	Mode   spi.Mode // mode passed to DevParams
+	Bits   int      // bits per word passed to DevParams
+	Closed int      // number of times Close has been called
+}
+
+// DevParams records the parameters and returns the Conn.
+func (p *Port) DevParams(maxHz int64, mode spi.Mode, bits int) (spi.Conn, error) {
+	if p.Conn == nil {
+		return nil, errors.New("devicestest: Port has no Conn")
+	}
+	p.MaxHz, p.Mode, p.Bits = maxHz, mode, bits
+	return p.Conn, nil
+}
+
+// LimitSpeed is a no-op.
+func (p *Port) LimitSpeed(maxHz int64) error { return nil }
+
+// Close counts the calls.
+func (p *Port) Close() error {
+	p.Closed++
+	return nil
+}
+
+// Pin is a simulated input pin. Its level is set by the test and Trigger signals an edge to
+// WaitForEdge, edges don't accumulate beyond one, as with the Linux driver. The methods are
+// concurrency safe.
+type Pin struct {
+	N   string // name of the pin
+	Num int    // number of the pin
+
+	mu    sync.Mutex
+	level gpio.Level
+	pull  gpio.Pull
+	edge  gpio.Edge
+	edges chan struct{}
+}
+
+// NewPin returns a low pin with the given name and number.
+func NewPin(name string, number int) *Pin {
+	return &Pin{N: name, Num: number, edges: make(chan struct{}, 1)}
+}
+
+func (p *Pin) String() string   { return fmt.Sprintf("%s(%d)", p.N, p.Num) }
+func (p *Pin) Name() string     { return p.N }
+func (p *Pin) Number() int      { return p.Num }
+func (p *Pin) Function() string { return "In" }
+
+// In records the configuration, see Edge, and flushes any pending edge.
+func (p *Pin) In(pull gpio.Pull, edge gpio.Edge) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pull, p.edge = pull, edge
+	select {
+	case <-p.edges:
+	default:
+	}
+	return nil
+}
+
+// Read returns the level set using Set or Trigger.
+func (p *Pin) Read() gpio.Level {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.level
+}
+
+// WaitForEdge waits for Trigger to be called, a timeout of -1 waits forever.
+func (p *Pin) WaitForEdge(timeout time.Duration) bool {
+	if timeout < 0 {
+		<-p.edges
+		return true
+	}
+	select {
+	case <-p.edges:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Pull returns the pull passed to In.
+func (p *Pin) Pull() gpio.Pull {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pull
+}
+
+// Edge returns the edge detection passed to In.
+func (p *Pin) Edge() gpio.Edge {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.edge
+}
+
+// Set changes the level of the pin without signaling an edge.
+func (p *Pin) Set(l gpio.Level) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.level = l
+}
+
+// Trigger changes the level of the pin and signals an edge, it is dropped if the pin is not
+// configured to detect edges of that direction.
+func (p *Pin) Trigger(l gpio.Level) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.level = l
+	switch {
+	case p.edge == gpio.BothEdges,
+		p.edge == gpio.RisingEdge && l == gpio.High,
+		p.edge == gpio.FallingEdge && l == gpio.Low:
+	default:
+		return
+	}
+	select {
+	case p.edges <- struct{}{}:
+	default:
+	}
+}
+
+var _ spi.Conn = &SPI{}
+var _ spi.PortCloser = &Port{}
+var _ gpio.PinIn = &Pin{}
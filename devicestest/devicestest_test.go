@@ -0,0 +1,64 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package devicestest
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+)
+
+func TestSPI(t *testing.T) {
+	s := NewSPI()
+	s.SetFIFO(0)
+	var hooked []byte
+	s.OnWrite(0x11, func(v byte) {
+		hooked = append(hooked, v)
+		s.SetReg(0x20, v+1) // hooks may call back into the SPI
+	})
+
+	// Burst writes auto-increment, except into a FIFO.
+	s.Tx([]byte{0x90, 1, 2, 3}, make([]byte, 4))
+	s.Tx([]byte{0x80, 4, 5}, nil)
+	want := []Write{{0x10, 1}, {0x11, 2}, {0x12, 3}, {0, 4}, {0, 5}}
+	if !reflect.DeepEqual(s.Writes(), want) {
+		t.Errorf("expected writes %v, got %v", want, s.Writes())
+	}
+	if !bytes.Equal(hooked, []byte{2}) || s.Reg(0x20) != 3 {
+		t.Errorf("hook not called correctly: %x %#x", hooked, s.Reg(0x20))
+	}
+
+	// Scripted responses come first, then the register file.
+	s.Respond(0x10, 0xaa, 0xbb)
+	r := make([]byte, 3)
+	for _, want := range [][]byte{{0xaa, 2}, {0xbb, 2}, {1, 2}} {
+		s.Tx([]byte{0x10, 0, 0}, r)
+		if !bytes.Equal(r[1:], want) {
+			t.Errorf("expected read %x, got %x", want, r[1:])
+		}
+	}
+	if w := s.Written(0x11); !bytes.Equal(w, []byte{2}) {
+		t.Errorf("expected 0x11 to be written once, got %x", w)
+	}
+}
+
+func TestPin(t *testing.T) {
+	p := NewPin("GPIO4", 4)
+	p.Trigger(gpio.High)
+	if p.WaitForEdge(0) {
+		t.Error("edge signaled without edge detection")
+	}
+	p.In(gpio.PullDown, gpio.RisingEdge)
+	p.Trigger(gpio.Low)
+	p.Trigger(gpio.High)
+	p.Trigger(gpio.High) // edges don't accumulate
+	if !p.WaitForEdge(time.Second) || p.WaitForEdge(time.Millisecond) {
+		t.Error("expected exactly one edge")
+	}
+	if p.Read() != gpio.High || p.Pull() != gpio.PullDown || p.Edge() != gpio.RisingEdge {
+		t.Errorf("unexpected pin state %s %s %s", p.Read(), p.Pull(), p.Edge())
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+// Package duty tracks the airtime of transmissions in order to enforce a duty-cycle limit,
+// it is shared by the radio drivers.
+package duty
+
+import "time"
+
+// Window is the period over which the duty cycle is measured, ETSI EN 300 220 uses one hour.
+const Window = time.Hour
+
+// Cycle tracks the airtime of transmissions over a sliding window in order to enforce a
+// duty-cycle limit.
+type Cycle struct {
+	budget time.Duration // max airtime within the window
+	window time.Duration // length of the sliding window
+	sent   []txRecord    // transmissions within the window, oldest first
+	used   time.Duration // sum of the airtime of all transmissions in sent
+}
+
+// txRecord is a transmission accounted for by Cycle.
+type txRecord struct {
+	at  time.Time     // start of transmission
+	air time.Duration // time on air
+}
+
+// New returns a duty-cycle limiter allowing the given fraction (e.g. 0.01 for 1%) of the window
+// to be spent transmitting.
+func New(limit float64, window time.Duration) *Cycle {
+	return &Cycle{budget: time.Duration(limit * float64(window)), window: window}
+}
+
+// Budget returns the max airtime within the window.
+func (d *Cycle) Budget() time.Duration {
+	return d.budget
+}
+
+// expire drops the transmissions that have left the window.
+func (d *Cycle) expire(now time.Time) {
+	i := 0
+	for i < len(d.sent) && now.Sub(d.sent[i].at) >= d.window {
+		d.used -= d.sent[i].air
+		i++
+	}
+	d.sent = d.sent[i:]
+}
+
+// Wait returns how long the caller has to wait until a transmission with the given airtime fits
+// into the budget, or 0 if it may be sent now. It returns the full window if the transmission is
+// longer than the entire budget and thus can never be sent.
+func (d *Cycle) Wait(now time.Time, air time.Duration) time.Duration {
+	d.expire(now)
+	excess := d.used + air - d.budget
+	if excess <= 0 {
+		return 0
+	}
+	for _, tx := range d.sent {
+		excess -= tx.air
+		if excess <= 0 {
+			return tx.at.Add(d.window).Sub(now)
+		}
+	}
+	return d.window
+}
+
+// Record accounts for a transmission starting now.
+func (d *Cycle) Record(now time.Time, air time.Duration) {
+	d.sent = append(d.sent, txRecord{now, air})
+	d.used += air
+}
+
+// Remaining returns the airtime left in the budget.
+func (d *Cycle) Remaining(now time.Time) time.Duration {
+	d.expire(now)
+	return d.budget - d.used
+}
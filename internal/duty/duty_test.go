@@ -0,0 +1,52 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package duty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCycle(t *testing.T) {
+	air := 1318 * time.Millisecond // a 20 byte LoRa packet at SF12, 27 fit into 36s
+	d := New(0.01, Window)
+	t0 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// Fire packets every 10 seconds until the limiter rejects one.
+	now := t0
+	n := 0
+	for ; n < 100; n++ {
+		if d.Wait(now, air) != 0 {
+			break
+		}
+		d.Record(now, air)
+		now = now.Add(10 * time.Second)
+	}
+	if n != 27 {
+		t.Fatalf("expected 27 packets to be allowed, got %d", n)
+	}
+	if d.used > d.budget {
+		t.Errorf("budget exceeded: used %s, budget %s", d.used, d.budget)
+	}
+
+	// The wait time must be until the first packet leaves the window.
+	if w := d.Wait(now, air); w != t0.Add(time.Hour).Sub(now) {
+		t.Errorf("expected wait until %s, got %s", t0.Add(time.Hour), now.Add(w))
+	}
+	now = t0.Add(time.Hour - time.Millisecond)
+	if d.Wait(now, air) == 0 {
+		t.Errorf("packet allowed before the window expired")
+	}
+	now = t0.Add(time.Hour)
+	if d.Wait(now, air) != 0 {
+		t.Errorf("packet rejected after the window expired")
+	}
+	if len(d.sent) != n-1 {
+		t.Errorf("expected %d packets in window, got %d", n-1, len(d.sent))
+	}
+
+	// A packet longer than the entire budget can never be sent.
+	if w := New(0.0001, time.Hour).Wait(now, air); w != time.Hour {
+		t.Errorf("expected oversize packet to wait the full window, got %s", w)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package max31855
+
+import (
+	"fmt"
+	"math"
+
+	"periph.io/x/periph/devices"
+)
+
+// Type is a thermocouple type, there is a max31855 variant for each one.
+type Type int
+
+// Thermocouple types, the conversion by the chip is the same for all of them but only K and J
+// can be linearized.
+const (
+	TypeK Type = iota // chromel/alumel, max31855K
+	TypeJ             // iron/constantan, max31855J
+	TypeN             // nicrosil/nisil, max31855N
+	TypeT             // copper/constantan, max31855T
+	TypeE             // chromel/constantan, max31855E
+	TypeR             // platinum-rhodium 13%/platinum, max31855R
+	TypeS             // platinum-rhodium 10%/platinum, max31855S
+)
+
+func (t Type) String() string {
+	if t >= 0 && int(t) < len(typeNames) {
+		return typeNames[t : t+1]
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// typeNames holds the letter of each type, in order.
+const typeNames = "KJNTERS"
+
+// poly is a NIST ITS-90 polynomial valid for inputs up to max.
+type poly struct {
+	max float64
+	c   []float64
+}
+
+// thermocouple holds the data needed to linearize the readings of one type of thermocouple.
+type thermocouple struct {
+	sensitivity float64    // linear sensitivity in mV/°C assumed by the max31855
+	emf         []poly     // temperature in °C to voltage in mV, by increasing range
+	temp        []poly     // voltage in mV to temperature in °C, by increasing range
+	exp         [3]float64 // exponential term of the K-type emf above 0°C: a0, a1, a2
+}
+
+// thermocouples holds the NIST ITS-90 coefficients for the supported thermocouple types, see
+// https://srdata.nist.gov/its90/main/ and the max31855 datasheet for the sensitivities.
+var thermocouples = map[Type]*thermocouple{
+	TypeK: {
+		sensitivity: 0.041276,
+		emf: []poly{
+			{0, []float64{0, 0.394501280250e-01, 0.236223735980e-04, -0.328589067840e-06,
+				-0.499048287770e-08, -0.675090591730e-10, -0.574103274280e-12,
+				-0.310888728940e-14, -0.104516093650e-16, -0.198892668780e-19,
+				-0.163226974860e-22}},
+			{1372, []float64{-0.176004136860e-01, 0.389212049750e-01, 0.185587700320e-04,
+				-0.994575928740e-07, 0.318409457190e-09, -0.560728448890e-12,
+				0.560750590590e-15, -0.320207200030e-18, 0.971511471520e-22,
+				-0.121047212750e-25}},
+		},
+		temp: []poly{
+			{0, []float64{0, 2.5173462e+01, -1.1662878e+00, -1.0833638e+00, -8.9773540e-01,
+				-3.7342377e-01, -8.6632643e-02, -1.0450598e-02, -5.1920577e-04}},
+			{20.644, []float64{0, 2.508355e+01, 7.860106e-02, -2.503131e-01, 8.315270e-02,
+				-1.228034e-02, 9.804036e-04, -4.413030e-05, 1.057734e-06, -1.052755e-08}},
+			{54.886, []float64{-1.318058e+02, 4.830222e+01, -1.646031e+00, 5.464731e-02,
+				-9.650715e-04, 8.802193e-06, -3.110810e-08}},
+		},
+		exp: [3]float64{0.118597600000e+00, -0.118343200000e-03, 0.126968600000e+03},
+	},
+	TypeJ: {
+		sensitivity: 0.057953,
+		emf: []poly{
+			{760, []float64{0, 0.503811878150e-01, 0.304758369300e-04, -0.856810657200e-07,
+				0.132281952950e-09, -0.170529583370e-12, 0.209480906970e-15,
+				-0.125383953360e-18, 0.156317256970e-22}},
+		},
+		temp: []poly{
+			{0, []float64{0, 1.9528268e+01, -1.2286185e+00, -1.0752178e+00, -5.9086933e-01,
+				-1.7256713e-01, -2.8131513e-02, -2.3963370e-03, -8.3823321e-05}},
+			{42.919, []float64{0, 1.978425e+01, -2.001204e-01, 1.036969e-02, -2.549687e-04,
+				3.585153e-06, -5.344285e-08, 5.099890e-10}},
+			{69.553, []float64{-3.11358187e+03, 3.00543684e+02, -9.94773230e+00,
+				1.70276630e-01, -1.43033468e-03, 4.73886084e-06}},
+		},
+	},
+}
+
+// eval evaluates the polynomial of the range x falls into, values beyond the last range use the
+// last polynomial.
+func eval(polys []poly, x float64) float64 {
+	p := polys[len(polys)-1]
+	for _, q := range polys {
+		if x <= q.max {
+			p = q
+			break
+		}
+	}
+	y := 0.0
+	for i := len(p.c) - 1; i >= 0; i-- {
+		y = y*x + p.c[i]
+	}
+	return y
+}
+
+// emfOf returns the thermocouple voltage in mV for a temperature in °C, relative to 0°C.
+func (tc *thermocouple) emfOf(t float64) float64 {
+	e := eval(tc.emf, t)
+	if tc.exp[0] != 0 && t > 0 {
+		e += tc.exp[0] * math.Exp(tc.exp[1]*(t-tc.exp[2])*(t-tc.exp[2]))
+	}
+	return e
+}
+
+// linearize corrects the thermocouple temperature calculated by the max31855 using the cold
+// junction temperature. The max31855 assumes a linear thermocouple response, so the voltage it
+// measured is recovered from its result and the non-linear voltage of the cold junction is added
+// to it, then the NIST inverse polynomial yields the actual temperature.
+func (tc *thermocouple) linearize(thermT, intT devices.Celsius) devices.Celsius {
+	t, cj := thermT.Float64(), intT.Float64()
+	mV := (t-cj)*tc.sensitivity + tc.emfOf(cj)
+	return devices.Celsius(math.Floor(eval(tc.temp, mV)*1000 + 0.5))
+}
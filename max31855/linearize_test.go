@@ -0,0 +1,53 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package max31855
+
+import (
+	"math"
+	"testing"
+
+	"periph.io/x/periph/devices"
+)
+
+// nist holds reference voltages in mV from the NIST ITS-90 thermocouple tables.
+var nist = map[Type][]struct{ t, mV float64 }{
+	TypeK: {{-200, -5.891}, {-100, -3.554}, {0, 0}, {25, 1.000}, {100, 4.096},
+		{200, 8.138}, {300, 12.209}, {500, 20.644}, {1000, 41.276}, {1300, 52.410}},
+	TypeJ: {{-200, -7.890}, {-100, -4.633}, {0, 0}, {25, 1.277}, {100, 5.269},
+		{300, 16.327}, {500, 27.393}, {700, 39.132}},
+}
+
+func TestNIST(t *testing.T) {
+	for typ, refs := range nist {
+		tc := thermocouples[typ]
+		for _, ref := range refs {
+			if mV := tc.emfOf(ref.t); math.Abs(mV-ref.mV) > 0.001 {
+				t.Errorf("type %s %.0f°C: got %.3fmV expected %.3fmV", typ, ref.t, mV, ref.mV)
+			}
+			if temp := eval(tc.temp, ref.mV); math.Abs(temp-ref.t) > 0.1 {
+				t.Errorf("type %s %.3fmV: got %.2f°C expected %.0f°C", typ, ref.mV, temp, ref.t)
+			}
+		}
+	}
+}
+
+func TestLinearize(t *testing.T) {
+	// Simulate what the max31855 reports for a hot junction at the reference temperature and a
+	// cold junction at 25°C: the thermocouple voltage divided by the linear sensitivity.
+	const cj = 25
+	for typ, refs := range nist {
+		tc := thermocouples[typ]
+		for _, ref := range refs {
+			if ref.t < -100 {
+				continue // the max31855 itself is only specified down to -40°C
+			}
+			mV := ref.mV - tc.emfOf(cj)
+			raw := devices.Celsius((mV/tc.sensitivity + cj) * 1000)
+			got := tc.linearize(raw, cj*1000).Float64()
+			if math.Abs(got-ref.t) > 0.1 {
+				t.Errorf("type %s %.0f°C: max31855 reports %.2f°C, linearized to %.2f°C",
+					typ, ref.t, raw.Float64(), got)
+			}
+		}
+	}
+}
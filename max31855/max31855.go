@@ -6,7 +6,8 @@
 // The MAX31855 chip contains an analog-to-digital converter that is designed to read the
 // low voltages produced by thermocouples and convert them to degrees centigrate which can
 // be read out using a read-only SPI interface. The MAX31855 comes in a number of variants
-// for the different types of thermocouples (max31855K for K-type, max31855J for J-type, etc).
+// for the different types of thermocouples (max31855K for K-type, max31855J for J-type, etc),
+// the variant in use is specified using Opts.Type, K by default, and recorded in each Reading.
 //
 // The max31855 itself contains a temperature sensor, which is required to perform the temperature
 // conversion and it is important to keep the junction between the thermocouple wires and the copper
@@ -16,61 +17,304 @@
 // temperature to 0.0625°C. The absolute accuracy, however, is +/-2°C for K-type thermocouples in
 // the -200°C..700°C range as well as for the internal temperature sensor.
 //
+// Every now and then the max31855 returns a bad value, depending a lot on noise, so Sense takes
+// the median of a few readings and Start produces a stream of filtered readings, while Run
+// produces the raw readings. Faults detected by the chip are returned as ErrOpenCircuit,
+// ErrShortGND, and ErrShortVCC such that a broken probe can be told apart from SPI errors, Read
+// also returns the individual fault flags.
 //
 // Datasheet: https://datasheets.maximintegrated.com/en/ds/MAX31855.pdf
 package max31855
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"periph.io/x/periph/conn/spi"
 	"periph.io/x/periph/devices"
 )
 
+// Faults detected by the chip, these are persistent until the thermocouple is fixed.
+var (
+	ErrOpenCircuit = errors.New("max31855: thermocouple open circuit error")
+	ErrShortGND    = errors.New("max31855: thermocouple shorted to ground")
+	ErrShortVCC    = errors.New("max31855: thermocouple shorted to VCC")
+)
+
 // Dev represents a MAX31855 device.
 type Dev struct {
-	spi spi.Conn
+	spi    spi.Conn
+	typ    Type               // thermocouple type
+	tc     *thermocouple      // coefficients for linearization, nil: none
+	window int                // number of readings filtered by Start
+	stop   context.CancelFunc // stops the goroutine launched by Start, nil if not running
+}
+
+// Opts holds the options for a max31855.
+type Opts struct {
+	Type      Type // thermocouple type, i.e. the max31855 variant
+	Linearize bool // correct the readings using the NIST polynomials for the type
+	Window    int  // number of readings Start takes the median of, 0: 3
 }
 
-// New returns a
-func New(s spi.Conn) (*Dev, error) {
-	if err := s.Configure(spi.Mode0, 8); err != nil {
-		return nil, fmt.Errorf("max31855: configure error: %v", err)
+// New returns a max31855 device connected to the SPI bus, nil opts default to a K-type
+// thermocouple without linearization.
+//
+// The max31855 assumes a linear thermocouple response, which causes errors of several degrees
+// at high temperatures. With Opts.Linearize set Temperature corrects the thermocouple temperature
+// using the NIST ITS-90 polynomials for the thermocouple type, LinearizedTemperature does so
+// regardless of Opts.Linearize.
+func New(port spi.Port, opts *Opts) (*Dev, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	d := &Dev{typ: opts.Type, window: opts.Window}
+	if d.window <= 0 {
+		d.window = 3
+	}
+	if opts.Linearize {
+		if d.tc = thermocouples[opts.Type]; d.tc == nil {
+			return nil, fmt.Errorf("max31855: no linearization for type %s", opts.Type)
+		}
 	}
-	if err := s.Speed(1 * 1000 * 1000); err != nil {
-		return nil, fmt.Errorf("max31855: speed error: %v", err)
+	conn, err := port.DevParams(1*1000*1000, spi.Mode0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("max31855: cannot set device params: %v", err)
 	}
-	return &Dev{s}, nil
+	d.spi = conn
+	return d, nil
 }
 
-// Temperature returns the themocouple temperature and the internal MAX31855 temperature (in that
-// order).
-func (d *Dev) Temperature() (devices.Celsius, devices.Celsius, error) {
+// Reading is the result of reading the chip. The fault flags are set when the chip detects a
+// problem with the thermocouple, in which case only the internal temperature is valid.
+type Reading struct {
+	Thermocouple devices.Celsius // thermocouple temperature
+	Internal     devices.Celsius // internal temperature of the max31855
+	Fault        bool            // FAULT bit: one of the faults below is present
+	OpenCircuit  bool            // OC bit: thermocouple is open, e.g. broken or disconnected
+	ShortGND     bool            // SCG bit: thermocouple is shorted to ground
+	ShortVCC     bool            // SCV bit: thermocouple is shorted to VCC
+	Raw          uint32          // 32-bit word read from the chip, for logging
+	Type         Type            // thermocouple type, from Opts.Type
+	At           time.Time       // time of the reading
+	Err          error           // error reading the chip, set by Run only
+}
+
+// Read reads the temperatures and the fault flags. If the chip reports a fault the reading is
+// returned together with the corresponding ErrOpenCircuit, ErrShortGND, or ErrShortVCC error.
+// Faults persist until the thermocouple is fixed, while other errors are SPI errors.
+func (d *Dev) Read() (Reading, error) {
+	r, err := d.read()
+	if err == nil && d.tc != nil {
+		r.Thermocouple = d.tc.linearize(r.Thermocouple, r.Internal)
+	}
+	return r, err
+}
+
+// read implements Read without the linearization.
+func (d *Dev) read() (Reading, error) {
 	// Perform a 32-bit read of the device.
 	var wBuf, rBuf [4]byte
 	if err := d.spi.Tx(wBuf[:], rBuf[:]); err != nil {
-		return 0, 0, fmt.Errorf("max31855: txn error: %v", err)
+		return Reading{}, fmt.Errorf("max31855: txn error: %v", err)
 	}
-
-	// Check for various errors.
-	if rBuf[3]&1 != 0 {
-		return 0, 0, fmt.Errorf("max31855: thermocouple open circuit error")
-	}
-	if rBuf[3]&2 != 0 {
-		//fmt.Printf("%#02x %02x %02x %02x\n", rBuf[0], rBuf[1], rBuf[2], rBuf[3])
-		return 0, 0, fmt.Errorf("max31855: thermocouple shorted to ground")
-	}
-	if rBuf[3]&4 != 0 {
-		return 0, 0, fmt.Errorf("max31855: thermocouple shorted to VCC")
+	r := Reading{
+		Raw:         binary.BigEndian.Uint32(rBuf[:]),
+		Type:        d.typ,
+		Fault:       rBuf[1]&1 != 0,
+		OpenCircuit: rBuf[3]&1 != 0,
+		ShortGND:    rBuf[3]&2 != 0,
+		ShortVCC:    rBuf[3]&4 != 0,
+		At:          time.Now(),
 	}
 
 	// Calculate internal temperature.
 	intT := int32((int16(rBuf[2]) << 8) | int16(rBuf[3]&0xf0)) // sign-extension!
-	intT = (intT * 1000) >> 8
+	r.Internal = devices.Celsius((intT * 1000) >> 8)
+
+	// Check for various errors.
+	switch {
+	case r.OpenCircuit:
+		return r, ErrOpenCircuit
+	case r.ShortGND:
+		//fmt.Printf("%#02x %02x %02x %02x\n", rBuf[0], rBuf[1], rBuf[2], rBuf[3])
+		return r, ErrShortGND
+	case r.ShortVCC:
+		return r, ErrShortVCC
+	}
 
 	// Calculate thermocouple temperature.
 	thermT := int32((int16(rBuf[0]) << 8) | int16(rBuf[1]&0xfc))
-	thermT = (thermT * 1000) >> 4
+	r.Thermocouple = devices.Celsius((thermT * 1000) >> 4)
+	return r, nil
+}
+
+// Temperature returns the themocouple temperature and the internal MAX31855 temperature (in that
+// order).
+func (d *Dev) Temperature() (devices.Celsius, devices.Celsius, error) {
+	r, err := d.Read()
+	if err != nil {
+		return 0, 0, err
+	}
+	return r.Thermocouple, r.Internal, nil
+}
+
+// LinearizedTemperature returns the thermocouple temperature corrected using the NIST ITS-90
+// polynomials for the Opts.Type thermocouple, whether Opts.Linearize is set or not. The voltage
+// measured by the chip is back-computed from its reading and the cold junction temperature, the
+// correction is significant above about 500°C. The errors are the same as for Read.
+func (d *Dev) LinearizedTemperature() (devices.Celsius, error) {
+	tc := thermocouples[d.typ]
+	if tc == nil {
+		return 0, fmt.Errorf("max31855: no linearization for type %s", d.typ)
+	}
+	r, err := d.read()
+	if err != nil {
+		return 0, err
+	}
+	return tc.linearize(r.Thermocouple, r.Internal), nil
+}
+
+// SenseOpts specifies how Sense samples the chip.
+type SenseOpts struct {
+	Samples  int           // number of readings to take the median of, 0: 3
+	Interval time.Duration // time between readings, 0: 100ms, the max conversion time
+}
 
-	return devices.Celsius(thermT), devices.Celsius(intT), nil
+// Sense reads the temperatures Samples times, spaced by Interval, and returns the median of each
+// in order to reject the occasional bad value. Failed readings are retried, but if Samples of
+// them fail the last error is returned.
+func (d *Dev) Sense(opts SenseOpts) (devices.Celsius, devices.Celsius, error) {
+	if opts.Samples <= 0 {
+		opts.Samples = 3
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+	var thermT, intT []int
+	for nErr := 0; ; {
+		eT, iT, err := d.Temperature()
+		if err != nil {
+			nErr++
+			if nErr == opts.Samples {
+				return 0, 0, err
+			}
+		} else {
+			thermT = append(thermT, int(eT))
+			intT = append(intT, int(iT))
+			if len(thermT) == opts.Samples {
+				break
+			}
+		}
+		time.Sleep(opts.Interval)
+	}
+	sort.Ints(thermT)
+	sort.Ints(intT)
+	return devices.Celsius(thermT[len(thermT)/2]), devices.Celsius(intT[len(intT)/2]), nil
+}
+
+// Run starts a goroutine that reads the temperatures every interval and sends them on the
+// returned channel, which is closed when the context is done. Failed readings are sent as well,
+// the Err field tells them apart as for the error returned by Read. The goroutine blocks if the
+// readings are not consumed. No other method may be called while Run is active.
+func (d *Dev) Run(ctx context.Context, interval time.Duration) (<-chan Reading, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("max31855: invalid interval %s", interval)
+	}
+	ch := make(chan Reading, 1)
+	go func() {
+		defer close(ch)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			r, err := d.Read()
+			if err != nil && r.At.IsZero() {
+				r.At = time.Now()
+			}
+			r.Err = err
+			select {
+			case ch <- r:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Start launches a goroutine that reads the temperatures every interval (0: 100ms) and sends
+// filtered readings on the returned channel until Stop is called, at which point the channel is
+// closed. Each reading sent is the median of the last Opts.Window readings, which rejects the
+// occasional bad value, so the first one is sent after Window intervals. Failed readings count
+// as outliers, if they are the majority of the window the last one is sent, its Err field tells
+// what failed. The goroutine blocks if the readings are not consumed. No other method except Stop
+// may be called while it is running.
+func (d *Dev) Start(interval time.Duration) <-chan Reading {
+	d.Stop()
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stop = cancel
+	raw, _ := d.Run(ctx, interval)
+	ch := make(chan Reading, 1)
+	go func() {
+		defer close(ch)
+		var window []Reading
+		for r := range raw {
+			window = append(window, r)
+			if len(window) > d.window {
+				window = window[1:]
+			}
+			if len(window) < d.window {
+				continue
+			}
+			select {
+			case ch <- filter(window):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Stop stops the goroutine launched by Start.
+func (d *Dev) Stop() {
+	if d.stop != nil {
+		d.stop()
+		d.stop = nil
+	}
+}
+
+// filter returns the reading with the median thermocouple temperature and the median internal
+// temperature of the valid readings in the window, or the last reading if the majority failed.
+func filter(window []Reading) Reading {
+	var valid []Reading
+	for _, r := range window {
+		if r.Err == nil {
+			valid = append(valid, r)
+		}
+	}
+	if 2*len(valid) <= len(window) {
+		return window[len(window)-1]
+	}
+	intT := make([]int, len(valid))
+	for i, r := range valid {
+		intT[i] = int(r.Internal)
+	}
+	sort.Ints(intT)
+	sort.Slice(valid, func(i, j int) bool { return valid[i].Thermocouple < valid[j].Thermocouple })
+	r := valid[len(valid)/2]
+	r.Internal = devices.Celsius(intT[len(intT)/2])
+	return r
 }
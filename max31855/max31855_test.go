@@ -0,0 +1,188 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package max31855
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn"
+	"periph.io/x/periph/conn/spi"
+	"periph.io/x/periph/devices"
+)
+
+// fakeSPI is a max31855 that returns the scripted 32-bit words, the last one sticks.
+type fakeSPI struct {
+	words []uint32
+}
+
+func (f *fakeSPI) Tx(w, r []byte) error {
+	binary.BigEndian.PutUint32(r, f.words[0])
+	if len(f.words) > 1 {
+		f.words = f.words[1:]
+	}
+	return nil
+}
+
+func (f *fakeSPI) Duplex() conn.Duplex            { return conn.Full }
+func (f *fakeSPI) TxPackets(p []spi.Packet) error { return nil }
+
+// fakePort hands out the fakeSPI.
+type fakePort struct{ f *fakeSPI }
+
+func (p fakePort) DevParams(maxHz int64, mode spi.Mode, bits int) (spi.Conn, error) {
+	return p.f, nil
+}
+
+// The words are built from the examples in the datasheet's temperature data format tables.
+var readings = []struct {
+	word uint32
+	want Reading
+	err  error
+}{
+	// +25°C thermocouple and internal.
+	{0x64<<18 | 0x190<<4, Reading{Thermocouple: 25000, Internal: 25000}, nil},
+	// -250°C thermocouple, -0.0625°C internal.
+	{0x3c18<<18 | 0xfff<<4, Reading{Thermocouple: -250000, Internal: -63}, nil},
+	// +1600°C thermocouple, +127°C internal.
+	{0x1900<<18 | 0x7f0<<4, Reading{Thermocouple: 1600000, Internal: 127000}, nil},
+	// Open thermocouple, the internal temperature is still valid.
+	{0x7ffc<<16 | 1<<16 | 0x190<<4 | 1,
+		Reading{Internal: 25000, Fault: true, OpenCircuit: true}, ErrOpenCircuit},
+	{1<<16 | 0x190<<4 | 2, Reading{Internal: 25000, Fault: true, ShortGND: true}, ErrShortGND},
+	{1<<16 | 0x190<<4 | 4, Reading{Internal: 25000, Fault: true, ShortVCC: true}, ErrShortVCC},
+	// All faults at once are reported, the error is the first one.
+	{1<<16 | 0x190<<4 | 7, Reading{Internal: 25000, Fault: true, OpenCircuit: true,
+		ShortGND: true, ShortVCC: true}, ErrOpenCircuit},
+}
+
+func TestRead(t *testing.T) {
+	f := &fakeSPI{}
+	d, err := New(fakePort{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range readings {
+		f.words = []uint32{r.word, r.word}
+		got, err := d.Read()
+		if err != r.err {
+			t.Errorf("%#08x: expected error %v, got %v", r.word, r.err, err)
+		}
+		if got.At.IsZero() {
+			t.Errorf("%#08x: no time stamp", r.word)
+		}
+		want := r.want
+		want.Raw, want.At = r.word, got.At
+		if got != want {
+			t.Errorf("%#08x: expected %+v, got %+v", r.word, want, got)
+		}
+
+		// Temperature wraps Read.
+		thermT, intT, err := d.Temperature()
+		if err != r.err || err == nil && (thermT != want.Thermocouple || intT != want.Internal) {
+			t.Errorf("%#08x: Temperature returned %s %s %v", r.word, thermT, intT, err)
+		}
+	}
+}
+
+// Linearization corrects the thermocouple temperature only.
+func TestReadLinearized(t *testing.T) {
+	f := &fakeSPI{words: []uint32{0x1388<<18 | 0x190<<4}} // 1250°C
+	d, err := New(fakePort{f}, &Opts{Type: TypeK, Linearize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := d.tc.linearize(1250000, 25000); r.Thermocouple != want || r.Internal != 25000 {
+		t.Errorf("expected %s and 25°C, got %s and %s", want, r.Thermocouple, r.Internal)
+	}
+	if r.Thermocouple == devices.Celsius(1250000) {
+		t.Error("expected the temperature to be corrected")
+	}
+}
+
+func TestType(t *testing.T) {
+	f := &fakeSPI{words: []uint32{0x64<<18 | 0x190<<4}}
+	d, err := New(fakePort{f}, &Opts{Type: TypeT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Read()
+	if err != nil || r.Type != TypeT || r.Thermocouple != 25000 {
+		t.Errorf("expected a 25°C T-type reading, got %+v, err %v", r, err)
+	}
+	if s := r.Type.String(); s != "T" {
+		t.Errorf("expected T, got %s", s)
+	}
+	if s := Type(-1).String(); s != "Type(-1)" {
+		t.Errorf("expected Type(-1), got %s", s)
+	}
+	// Only K and J can be linearized.
+	if _, err := New(fakePort{f}, &Opts{Type: TypeN, Linearize: true}); err == nil {
+		t.Error("expected an error linearizing an N-type thermocouple")
+	}
+}
+
+func TestLinearizedTemperature(t *testing.T) {
+	// The chip reports the thermocouple voltage divided by the linear sensitivity plus the cold
+	// junction temperature, in steps of 0.25°C, which is also the tolerance used.
+	const cj = 25
+	for typ, refs := range nist {
+		f := &fakeSPI{}
+		d, err := New(fakePort{f}, &Opts{Type: typ})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc := thermocouples[typ]
+		for _, ref := range refs {
+			if ref.t < -40 {
+				continue // below the range of the max31855
+			}
+			raw := (ref.mV-tc.emfOf(cj))/tc.sensitivity + cj
+			f.words = []uint32{uint32(int32(math.Floor(raw*4+0.5))&0x3fff)<<18 | cj*16<<4}
+			got, err := d.LinearizedTemperature()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got.Float64()-ref.t) > 0.25 {
+				t.Errorf("type %s %.0f°C: max31855 reports %.2f°C, linearized to %s",
+					typ, ref.t, raw, got)
+			}
+		}
+	}
+
+	d, _ := New(fakePort{&fakeSPI{words: []uint32{0}}}, &Opts{Type: Type(42)})
+	if _, err := d.LinearizedTemperature(); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
+
+func TestStart(t *testing.T) {
+	const c25, c26 = 0x64<<18 | 0x190<<4, 0x68<<18 | 0x1a0<<4
+	const bad, fault = 0x1000<<18 | 0x190<<4, 1<<16 | 0x190<<4 | 1
+	f := &fakeSPI{words: []uint32{c25, c25, bad, c25, c26, fault, c26, c26, fault, fault}}
+	d, err := New(fakePort{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := d.Start(time.Millisecond)
+	want := []devices.Celsius{25000, 25000, 26000, 26000, 26000, 26000, 26000}
+	for i, w := range want {
+		r := <-ch
+		if r.Err != nil || r.Thermocouple != w {
+			t.Errorf("reading %d: expected %s, got %s, err %v", i, w, r.Thermocouple, r.Err)
+		}
+	}
+	// Once the faults are the majority they are reported.
+	if r := <-ch; r.Err != ErrOpenCircuit || r.Internal != 25000 {
+		t.Errorf("expected open circuit, got %+v", r)
+	}
+	d.Stop()
+	for range ch {
+	}
+}
@@ -24,6 +24,9 @@ import (
 // Y0 and Y1 respectively. A pull-down resitor on the A input of the demux is recommended
 // to ensure both CS remain inactive when the SPI CS is not driven.
 //
+// Circuits using an inverting buffer on the select line or a demux with a separate enable input
+// are supported by NewPolarity.
+//
 // A limitation of the current implementation is that the speed setting and the configuration
 // (SPI mode and number of bits) is shared between the two devices, i.e., it is not possible
 // to use different settings.
@@ -33,14 +36,29 @@ type Conn struct {
 	port   spi.Port
 	selPin gpio.PinIO // pin to select between two devices
 	sel    gpio.Level // select value for this device
+	enPin  gpio.PinIO // pin enabling the demux during transactions, nil if none
+	enOn   gpio.Level // value of enPin during transactions
 }
 
 // New returns two connections for the provided SPI Conn, the first one using Low for the
 // select pin, and the second using High.
 func New(port spi.PortCloser, selPin gpio.PinIO) (*Conn, *Conn) {
+	return NewPolarity(port, selPin, gpio.Low, nil, gpio.High)
+}
+
+// NewPolarity is like New but the first connection uses sel0 for the select pin and the second
+// one the opposite level. If enPin is not nil it is driven to enOn for the duration of each
+// transaction and to the opposite level otherwise, starting now, this is for demuxes whose
+// enable input is not driven by the SPI CS.
+func NewPolarity(port spi.PortCloser, selPin gpio.PinIO, sel0 gpio.Level, enPin gpio.PinIO,
+	enOn gpio.Level) (*Conn, *Conn) {
 	mu := sync.Mutex{} // shared mutex
 	var conn spi.Conn  // shared spi.Conn
-	return &Conn{&mu, &conn, port, selPin, gpio.Low}, &Conn{&mu, &conn, port, selPin, gpio.High}
+	if enPin != nil {
+		enPin.Out(!enOn)
+	}
+	return &Conn{&mu, &conn, port, selPin, sel0, enPin, enOn},
+		&Conn{&mu, &conn, port, selPin, !sel0, enPin, enOn}
 }
 
 // DevParams sets the device parameters and returns itself ('cause it's a Port as well as a Conn).
@@ -65,6 +83,11 @@ func (c *Conn) Tx(w, r []byte) error {
 	defer c.mu.Unlock()
 
 	c.selPin.Out(c.sel)
+	if c.enPin == nil {
+		return (*c.conn).Tx(w, r)
+	}
+	c.enPin.Out(c.enOn)
+	defer c.enPin.Out(!c.enOn)
 	return (*c.conn).Tx(w, r)
 }
 
@@ -0,0 +1,68 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package spimux
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tve/devices/devicestest"
+	"periph.io/x/periph/conn/gpio"
+)
+
+// outPin is a simulated output pin that records the levels it is driven to.
+type outPin struct {
+	*devicestest.Pin
+	levels []gpio.Level
+}
+
+func (p *outPin) Out(l gpio.Level) error {
+	p.Set(l)
+	p.levels = append(p.levels, l)
+	return nil
+}
+
+func TestPolarity(t *testing.T) {
+	for _, sel0 := range []gpio.Level{gpio.Low, gpio.High} {
+		s := devicestest.NewSPI()
+		port := &devicestest.Port{Conn: s}
+		sel := &outPin{Pin: devicestest.NewPin("SEL", 1)}
+		en := &outPin{Pin: devicestest.NewPin("EN", 2)}
+		// Record the pin levels during each transaction.
+		var during []gpio.Level
+		s.OnWrite(0x01, func(byte) { during = append(during, sel.Read(), en.Read()) })
+
+		c0, c1 := NewPolarity(port, sel, sel0, en, gpio.Low)
+		if len(en.levels) != 1 || en.levels[0] != gpio.High {
+			t.Errorf("expected the enable pin to start inactive, got %v", en.levels)
+		}
+		for _, c := range []*Conn{c0, c1} {
+			conn, err := c.DevParams(1000000, 0, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Tx([]byte{0x81, 0}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := []gpio.Level{sel0, gpio.Low, !sel0, gpio.Low}
+		if !reflect.DeepEqual(during, want) {
+			t.Errorf("sel0=%v: expected sel/en %v during transactions, got %v",
+				sel0, want, during)
+		}
+		if en.Read() != gpio.High {
+			t.Errorf("sel0=%v: expected the enable pin to be released", sel0)
+		}
+	}
+
+	// New uses Low for the first device and no enable pin.
+	s := devicestest.NewSPI()
+	sel := &outPin{Pin: devicestest.NewPin("SEL", 1)}
+	c0, c1 := New(&devicestest.Port{Conn: s}, sel)
+	c0.DevParams(1000000, 0, 8)
+	c0.Tx([]byte{0x81, 0}, nil)
+	c1.Tx([]byte{0x81, 0}, nil)
+	if !reflect.DeepEqual(sel.levels, []gpio.Level{gpio.Low, gpio.High}) {
+		t.Errorf("unexpected select levels %v", sel.levels)
+	}
+}
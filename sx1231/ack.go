@@ -0,0 +1,147 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defaults used by NewAckHandler.
+const (
+	defAckRetries = 3
+	defAckTimeout = 50 * time.Millisecond
+)
+
+// ErrNoAck is returned by AckHandler.Send when a packet has not been acknowledged after all the
+// retransmissions.
+var ErrNoAck = errors.New("sx1231: packet not acknowledged")
+
+// JLRxPacket holds a decoded JeeLabs packet. The Payload of the embedded RxPacket has the
+// src/dst header bytes stripped.
+type JLRxPacket struct {
+	Src, Dst byte // source and destination nodes from packet header
+	Ack      bool // ACK request bit from packet header
+	RxPacket
+}
+
+// AckHandler implements the JeeLabs ACK protocol on top of a Radio: it replies with an ACK to
+// received packets that request one and retransmits outgoing packets that request an ACK until
+// one arrives.
+//
+// An ACK is a packet from the node a packet was sent to, addressed to this node, and with the
+// ACK request bit clear, any payload it carries is ignored. Since the JeeLabs format does not
+// otherwise distinguish ACKs, a regular packet from that node arriving while Send waits is
+// taken as the ACK.
+//
+// Receive must be called continuously in one goroutine, as for Radio.Receive, while Send is
+// called from another. The parameters may only be changed before the first call to Send.
+type AckHandler struct {
+	Retries   int                            // retransmissions before giving up
+	Timeout   time.Duration                  // time to wait for an ACK after each transmission
+	OnFailure func(dst byte, payload []byte) // optional: called when a packet isn't acked
+
+	radio  *Radio
+	grp    byte          // group, i.e., the second sync byte
+	id     byte          // node ID of this node
+	sendMu sync.Mutex    // serializes Send
+	mu     sync.Mutex    // guards the fields below
+	ackSrc byte          // node from which an ACK is expected
+	ackC   chan struct{} // notified when the ACK arrives, nil when not waiting
+}
+
+// NewAckHandler returns an AckHandler for the given group and node ID with default retry count
+// and timeout, which can be changed before the handler is used.
+func NewAckHandler(radio *Radio, grp, id byte) *AckHandler {
+	return &AckHandler{
+		Retries: defAckRetries,
+		Timeout: defAckTimeout,
+		radio:   radio,
+		grp:     grp,
+		id:      id & 0x3f,
+	}
+}
+
+// Send transmits a packet to the destination node. If ack is true it then waits for an ACK and
+// retransmits the packet up to Retries times, each time waiting Timeout for the ACK. If none
+// arrives it calls OnFailure and returns ErrNoAck. Concurrent calls are serialized, i.e., only
+// one packet waits for an ACK at a time.
+func (h *AckHandler) Send(dst byte, ack bool, payload []byte) error {
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
+	pkt := JLEncode(h.grp, h.id, dst, ack, payload)
+	if !ack {
+		return h.radio.transmitWait(pkt)
+	}
+
+	got := make(chan struct{}, 1)
+	h.mu.Lock()
+	h.ackSrc, h.ackC = dst&0x3f, got
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.ackC = nil
+		h.mu.Unlock()
+	}()
+
+	for i := 0; i <= h.Retries; i++ {
+		if err := h.radio.transmitWait(pkt); err != nil {
+			return err
+		}
+		select {
+		case <-got:
+			return nil
+		case <-time.After(h.Timeout):
+		}
+		h.radio.log("No ACK from node %d (try %d)", dst, i+1)
+	}
+	if h.OnFailure != nil {
+		h.OnFailure(dst, payload)
+	}
+	return ErrNoAck
+}
+
+// Receive returns the next packet received that is not an ACK awaited by Send. If the packet
+// is addressed to this node and requests an ACK one is sent before returning, it has an empty
+// payload. Packets that are not in the JeeLabs format are logged and dropped.
+func (h *AckHandler) Receive() (*JLRxPacket, error) {
+	for {
+		pkt, err := h.radio.Receive()
+		if err != nil {
+			return nil, err
+		}
+		src, dst, ack, payload, err := JLDecode(h.grp, pkt.Payload)
+		if err != nil {
+			h.radio.log("%s", err)
+			continue
+		}
+		if h.gotAck(src, dst, ack) {
+			continue
+		}
+		if ack && dst == h.id {
+			// The TX interrupt gets serviced by the next call to Receive. If the radio is busy
+			// the ACK is dropped and the sender will retransmit.
+			if err := h.radio.Transmit(MakeJLAck(h.grp, pkt.Payload)); err != nil {
+				h.radio.log("Cannot send ACK to node %d: %s", src, err)
+			}
+		}
+		jl := &JLRxPacket{Src: src, Dst: dst, Ack: ack, RxPacket: *pkt}
+		jl.Payload = payload
+		return jl, nil
+	}
+}
+
+// gotAck checks whether a packet is the ACK Send is waiting for and notifies it if so.
+func (h *AckHandler) gotAck(src, dst byte, ack bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ackC == nil || ack || dst != h.id || src != h.ackSrc {
+		return false
+	}
+	select {
+	case h.ackC <- struct{}{}:
+	default:
+	}
+	return true
+}
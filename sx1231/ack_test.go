@@ -0,0 +1,125 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+)
+
+func TestAckHandlerReceive(t *testing.T) {
+	const grp = 6
+	r, f := newFakeRadio(t, RadioOpts{})
+	req := JLEncode(grp, 5, 1, true, []byte("hi"))
+	other := JLEncode(grp, 5, 2, true, []byte("yo"))
+	f.rx = [][]byte{
+		{5, 0x00, 0x00, 1, 2, 3}, // bad group parity
+		append([]byte{byte(len(req))}, req...),
+		append([]byte{byte(len(other))}, other...),
+	}
+	r.intrPin = &fakePin{levels: []gpio.Level{gpio.Low}}
+	r.intrPin.(*fakePin).high = func() bool { return len(f.rx) > 0 }
+	h := NewAckHandler(r, grp, 1)
+
+	pkt, err := h.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Src != 5 || pkt.Dst != 1 || !pkt.Ack || string(pkt.Payload) != "hi" {
+		t.Errorf("unexpected packet: %+v", pkt)
+	}
+	ack := JLEncode(grp, 1, 5, false, nil)
+	if want := append([]byte{byte(len(ack))}, ack...); !bytes.Equal(f.fifo, want) {
+		t.Errorf("expected ACK %x, sent %x", want, f.fifo)
+	}
+
+	// A packet for another node is returned but not acked.
+	r.Lock()
+	f.regs[REG_IRQFLAGS2] = IRQ2_PACKETSENT
+	r.txDone()
+	f.fifo = nil
+	r.Unlock()
+	if pkt, err := h.Receive(); err != nil || pkt.Dst != 2 {
+		t.Fatalf("unexpected packet %+v, err %v", pkt, err)
+	}
+	if len(f.fifo) != 0 {
+		t.Errorf("unexpected ACK %x", f.fifo)
+	}
+}
+
+func TestAckHandlerSend(t *testing.T) {
+	const grp = 6
+	r, f := newFakeRadio(t, RadioOpts{})
+	h := NewAckHandler(r, grp, 1)
+	h.Timeout = 5 * time.Millisecond
+	var failed []byte
+	h.OnFailure = func(dst byte, payload []byte) { failed = payload }
+
+	// Complete transmissions like Receive would and ACK the given transmission.
+	txs, ackAt := 0, 0
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			r.Lock()
+			if r.mode == MODE_TRANSMIT {
+				f.regs[REG_IRQFLAGS2] = IRQ2_PACKETSENT
+				r.txDone()
+				txs++
+				if txs == ackAt {
+					h.gotAck(2, 1, false)
+				}
+			}
+			r.Unlock()
+		}
+	}()
+	sent := func() int {
+		r.Lock()
+		defer r.Unlock()
+		n := 0
+		for fifo := f.fifo; len(fifo) > 0; fifo = fifo[1+fifo[0]:] {
+			n++
+		}
+		f.fifo = nil
+		return n
+	}
+
+	// No ACK: the packet gets retransmitted and then reported as failed.
+	if err := h.Send(2, true, []byte("hello")); err != ErrNoAck {
+		t.Errorf("expected ErrNoAck, got %v", err)
+	}
+	if n := sent(); n != defAckRetries+1 {
+		t.Errorf("expected %d transmissions, got %d", defAckRetries+1, n)
+	}
+	if string(failed) != "hello" {
+		t.Errorf("expected failure callback, got %q", failed)
+	}
+
+	// ACK on the second try.
+	r.Lock()
+	ackAt = txs + 2
+	r.Unlock()
+	failed = nil
+	if err := h.Send(2, true, []byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if n := sent(); n != 2 || failed != nil {
+		t.Errorf("expected 2 transmissions and no failure, got %d, %q", n, failed)
+	}
+
+	// A packet without ACK request is sent once.
+	if err := h.Send(2, false, []byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if n := sent(); n != 1 {
+		t.Errorf("expected 1 transmission, got %d", n)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tve/devices/internal/duty"
+)
+
+func TestDutyCycle(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	payload := make([]byte, 10)
+	air := r.TimeOnAir(len(payload)) // 18 bytes at 50kbps
+	if air != 2880*time.Microsecond {
+		t.Fatalf("expected 2.88ms airtime, got %s", air)
+	}
+	// A budget of 5ms in a 100ms window fits one packet.
+	r.duty = duty.New(0.05, 100*time.Millisecond)
+	send := func() error {
+		err := r.Transmit(payload)
+		if err == nil {
+			f.regs[REG_IRQFLAGS2] = IRQ2_PACKETSENT
+			r.txDone()
+		}
+		return err
+	}
+
+	t0 := time.Now()
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if rem := r.RemainingAirtime(); rem != 5*time.Millisecond-air {
+		t.Errorf("expected %s remaining, got %s", 5*time.Millisecond-air, rem)
+	}
+
+	r.dutyPolicy = DutyError
+	err := send()
+	if _, ok := err.(Temporary); !ok {
+		t.Errorf("expected a temporary error, got %v", err)
+	}
+
+	r.dutyPolicy = DutyWait
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if dt := time.Since(t0); dt < 100*time.Millisecond {
+		t.Errorf("expected Transmit to wait until the first packet left the window, took %s", dt)
+	}
+
+	// A packet longer than the entire budget can never be sent.
+	r.duty = duty.New(0.01, 100*time.Millisecond)
+	if err := send(); err == nil {
+		t.Errorf("expected oversize packet to be refused")
+	}
+}
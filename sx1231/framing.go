@@ -0,0 +1,107 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"errors"
+	"fmt"
+)
+
+// fifoSize is the size of the chip's FIFO, which limits the length of packets.
+const fifoSize = 66
+
+// errBadCRC is returned by unframe when the CRC of a packet with a custom length field doesn't
+// match.
+var errBadCRC = errors.New("sx1231: bad CRC")
+
+// customLen returns whether the options specify a length field other than the chip's 1-byte
+// length at the start of the packet. In that case the packet engine is used in fixed length mode
+// and the length field and the CRC are handled in the driver: on transmission the payload
+// length is programmed for each packet and on reception a full FIFO is received and the packet
+// is extracted from it.
+func (o PacketOpts) customLen() bool {
+	return o.LenOffset != 0 || o.LenSize > 1
+}
+
+// lenSize returns the size of the length field, filling in the default.
+func (o PacketOpts) lenSize() int {
+	if o.LenSize == 0 {
+		return 1
+	}
+	return o.LenSize
+}
+
+// crcLen returns the number of CRC bytes following the packet.
+func (o PacketOpts) crcLen() int {
+	if o.NoCRC {
+		return 0
+	}
+	return 2
+}
+
+// maxPayload returns the max length of a payload, which includes the bytes preceding a custom
+// length field. The CRC doesn't go through the FIFO in the chip's variable length mode but it
+// has to fit when the driver checks it.
+func (o PacketOpts) maxPayload() int {
+	if !o.customLen() {
+		return fifoSize - 1
+	}
+	return fifoSize - o.lenSize() - o.crcLen()
+}
+
+// frame returns the bytes to load into the FIFO to transmit a payload, i.e. the payload with the
+// length field inserted. The length is the number of bytes following the length field, it is
+// big-endian if it has 2 bytes.
+func (o PacketOpts) frame(payload []byte) []byte {
+	off, size := o.LenOffset, o.lenSize()
+	buf := make([]byte, len(payload)+size)
+	copy(buf, payload[:off])
+	n := len(payload) - off
+	if size == 2 {
+		buf[off] = byte(n >> 8)
+	}
+	buf[off+size-1] = byte(n)
+	copy(buf[off+size:], payload[off:])
+	return buf
+}
+
+// unframe extracts the payload from the FIFO contents of a received packet, removing the length
+// field. With a custom length field it also checks the CRC, which the chip doesn't.
+func (o PacketOpts) unframe(buf []byte) ([]byte, error) {
+	if !o.customLen() {
+		if l := int(buf[0]); l > fifoSize-1 {
+			return nil, fmt.Errorf("received packet too long (%d)", l)
+		}
+		return buf[1 : 1+buf[0]], nil
+	}
+	off, size := o.LenOffset, o.lenSize()
+	n := int(buf[off+size-1])
+	if size == 2 {
+		n |= int(buf[off]) << 8
+	}
+	end := off + size + n
+	if end+o.crcLen() > len(buf) {
+		return nil, fmt.Errorf("received packet too long (%d)", n)
+	}
+	if !o.NoCRC && crcCCITT(buf[:end]) != uint16(buf[end])<<8|uint16(buf[end+1]) {
+		return nil, errBadCRC
+	}
+	return append(buf[:off:off], buf[off+size:end]...), nil
+}
+
+// crcCCITT computes the CRC the way the chip does: CCITT polynomial with an initial value of
+// 0x1D0F and an inverted result, which is transmitted MSB first.
+func crcCCITT(data []byte) uint16 {
+	crc := uint16(0x1D0F)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return ^crc
+}
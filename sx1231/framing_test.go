@@ -0,0 +1,73 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCRC(t *testing.T) {
+	// CRC-16/AUG-CCITT of the standard check string is 0xE5CC, the chip inverts it.
+	if crc := crcCCITT([]byte("123456789")); crc != ^uint16(0xE5CC) {
+		t.Errorf("expected %#x, got %#x", ^uint16(0xE5CC), crc)
+	}
+}
+
+func TestCustomLength(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.pkt = PacketOpts{LenOffset: 2, LenSize: 2}
+	if r.pkt.config1()&0x80 != 0 || r.pkt.maxPayload() != 62 {
+		t.Fatalf("expected fixed length mode and 62 byte payloads, got %#x and %d",
+			r.pkt.config1(), r.pkt.maxPayload())
+	}
+
+	// The length field is inserted after the 2 header bytes and the packet length is set.
+	if err := r.Transmit([]byte{0xA1, 0xA2, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	frame := []byte{0xA1, 0xA2, 0x00, 0x03, 1, 2, 3}
+	if !bytes.Equal(f.fifo, frame) || f.regs[REG_PAYLOADLEN] != byte(len(frame)) {
+		t.Errorf("expected frame %x, got %x, length %d", frame, f.fifo, f.regs[REG_PAYLOADLEN])
+	}
+	if err := r.SetPacketOptions(r.pkt); err != nil || f.regs[REG_PAYLOADLEN] != fifoSize {
+		t.Errorf("expected an aborted transmission to restore the length, got %d, err %v",
+			f.regs[REG_PAYLOADLEN], err)
+	}
+	r.Lock()
+	f.regs[REG_IRQFLAGS2] = IRQ2_PACKETSENT
+	r.txDone()
+	r.Unlock()
+	if f.regs[REG_PAYLOADLEN] != fifoSize {
+		t.Errorf("expected a full FIFO to be received, length is %d", f.regs[REG_PAYLOADLEN])
+	}
+	if err := r.Transmit([]byte{0xA1}); err == nil {
+		t.Errorf("expected an error for a payload shorter than the length field offset")
+	}
+
+	// A received packet is extracted from the FIFO and its CRC is checked.
+	crc := crcCCITT(frame)
+	fifo := make([]byte, fifoSize)
+	copy(fifo, append(frame, byte(crc>>8), byte(crc)))
+	f.rx = [][]byte{fifo}
+	pkt, err := r.rx()
+	if err != nil || pkt == nil || !bytes.Equal(pkt.Payload, []byte{0xA1, 0xA2, 1, 2, 3}) {
+		t.Fatalf("unexpected packet %+v, err %v", pkt, err)
+	}
+	fifo[5] ^= 0xff
+	f.rx = [][]byte{fifo}
+	if pkt, err := r.rx(); pkt != nil || err != nil || r.stats.CRCErrors != 1 {
+		t.Errorf("expected a CRC error, got %+v, err %v, stats %+v", pkt, err, r.stats)
+	}
+	fifo[3] = 61
+	f.rx = [][]byte{fifo}
+	if _, err := r.rx(); err == nil {
+		t.Errorf("expected an error for a length exceeding the FIFO")
+	}
+
+	for _, o := range []PacketOpts{{LenSize: 3}, {LenOffset: -1}, {LenOffset: 62, LenSize: 2}} {
+		if err := o.check(); err == nil {
+			t.Errorf("%+v: expected an error", o)
+		}
+	}
+}
@@ -82,64 +82,3 @@ func JLDecode(grp byte, payload []byte) (
 	outPayload = payload[2:]
 	return
 }
-
-/* deprecated in favor of mqttradio GW type of structure
-
-// JLRxPacket holds a decoded JeeLabs packet.
-type JLRxPacket struct {
-	Src, Dst byte // source and destination nodes from packet header
-	Ack      bool // ACK request bit from packet header
-	RxPacket
-}
-
-type JLTxPacket struct {
-	Src, Dst byte // source and destination nodes for packet header
-	Ack      bool // ACK request bit for packet header
-	Payload  []byte
-}
-
-// JLAckHandler spawns a goroutine that mediates the TX and RX channels in order to retransmit
-// outgoing packets that are unacked and to reply with ACKs when incoming packets request so.
-func JLAckHandler(radio *Radio, grp byte) (chan<- *JLTxPacket, <-chan *JLRxPacket) {
-	txChan := make(chan *JLTxPacket, 1)
-	rxChan := make(chan *JLRxPacket, 1)
-	go func() {
-		waitingForAck := false
-		for {
-			if waitingForAck {
-				// Ignore txChan until we get ack or give up.
-				select {
-				case rxPkt := <-radio.RxChan:
-					jlPkt, err := JLDecode(grp, rxPkt)
-					if err != nil {
-						radio.log("%s", err.Error())
-						break
-					}
-					if jlPkt.IsAck() {
-						waitingForAck = false
-						break
-					}
-					rxChan <- jlPkt
-				}
-			} else {
-				// Handle both txChan and rxChan.
-				select {
-				case txPkt := <-txChan:
-					jlPkt := JLEncode(grp, txPkt.Src, txPkt.Dst, txPkt.Ack, txPkt.Payload)
-					radio.txChan <- jlPkt
-					waitingForAck = txPkt.Ack
-				case rxPkt := <-radio.RxChan:
-					jlPkt, err := JLDecode(grp, rxPkt)
-					if err != nil {
-						radio.log("%s", err.Error())
-						break
-					}
-					rxChan <- jlPkt
-				}
-			}
-		}
-	}()
-	return txChan, rxChan
-}
-
-*/
@@ -0,0 +1,56 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"fmt"
+	"time"
+)
+
+// defRateDwell is the time spent on each bit rate when scanning if RadioOpts.RateDwell is 0.
+const defRateDwell = 50 * time.Millisecond
+
+// rateScan cycles the receiver through a list of bit rates, see RadioOpts.Rates.
+type rateScan struct {
+	rates []uint32      // bit rates from the Rates table
+	dwell time.Duration // time spent on each rate
+	cur   int           // index of the rate in use
+	since time.Time     // when the current rate was programmed or last received a packet
+}
+
+// newRateScan checks the rates and returns a rateScan starting with the first one.
+func newRateScan(rates []uint32, dwell time.Duration) (*rateScan, error) {
+	for _, rate := range rates {
+		if _, found := Rates[rate]; !found {
+			return nil, fmt.Errorf("sx1231: rate %dbps is not in the Rates table", rate)
+		}
+	}
+	if dwell <= 0 {
+		dwell = defRateDwell
+	}
+	return &rateScan{rates: rates, dwell: dwell, since: time.Now()}, nil
+}
+
+// scanRates switches the receiver to the next rate once it has dwelled on the current one. It
+// leaves the radio alone while a packet is being received or transmitted, while asleep, and in
+// listen mode. The switch doesn't count as an RX timeout, so it doesn't affect the tuning of the
+// RSSI threshold. It must be called with the mutex held.
+func (r *Radio) scanRates() {
+	s := r.scan
+	if s == nil || r.mode != MODE_RECEIVE || r.listening || time.Since(s.since) < s.dwell ||
+		r.busy() {
+		return
+	}
+	s.cur = (s.cur + 1) % len(s.rates)
+	rate := s.rates[s.cur]
+	r.programRate(rate, Rates[rate])
+	s.since = time.Now()
+}
+
+// wait returns how long Receive may wait for an interrupt before the next rate switch is due.
+func (s *rateScan) wait() time.Duration {
+	if d := s.dwell - time.Since(s.since); d > 0 {
+		return d
+	}
+	return time.Millisecond
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateScan(t *testing.T) {
+	if _, err := newRateScan([]uint32{50000, 12345}, 0); err == nil {
+		t.Errorf("expected an error for a rate not in the Rates table")
+	}
+	r, f := newFakeRadio(t, RadioOpts{})
+	s, err := newRateScan([]uint32{50000, 49230}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.dwell != defRateDwell {
+		t.Errorf("expected the default dwell, got %s", s.dwell)
+	}
+	r.scan = s
+	bitrate := func() int { return int(f.regs[REG_BITRATEMSB])<<8 | int(f.regs[REG_BITRATEMSB+1]) }
+
+	// No switch before the dwell time is up.
+	r.scanRates()
+	if r.rate != 50000 || s.cur != 0 {
+		t.Fatalf("switched rate early to %d", r.rate)
+	}
+
+	// The receiver moves to the next rate and back to the first.
+	s.since = time.Now().Add(-defRateDwell)
+	r.scanRates()
+	if r.rate != 49230 || bitrate() != int(defFxosc/49230) || f.opMode() != MODE_RECEIVE {
+		t.Fatalf("expected 49230bps in RX mode, got %d, bitrate %#x, mode %#x",
+			r.rate, bitrate(), f.opMode())
+	}
+	s.since = time.Now().Add(-defRateDwell)
+	r.scanRates()
+	if r.rate != 50000 {
+		t.Fatalf("expected to wrap around to 50000bps, got %d", r.rate)
+	}
+
+	// A packet being received holds the rate.
+	s.since = time.Now().Add(-defRateDwell)
+	f.regs[REG_IRQFLAGS1] = IRQ1_SYNCMATCH
+	r.scanRates()
+	if r.rate != 50000 {
+		t.Errorf("switched rate during a packet to %d", r.rate)
+	}
+	f.regs[REG_IRQFLAGS1] = 0
+
+	// SetRate turns scanning off.
+	r.SetRate(49230)
+	if r.scan != nil {
+		t.Errorf("SetRate didn't turn scanning off")
+	}
+}
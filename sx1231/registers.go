@@ -9,7 +9,11 @@ const (
 	REG_BITRATEMSB  = 0x03
 	REG_FDEVMSB     = 0x05
 	REG_FRFMSB      = 0x07
+	REG_OSC1        = 0x0A
 	REG_AFCCTRL     = 0x0B
+	REG_LISTEN1     = 0x0D
+	REG_LISTEN2     = 0x0E
+	REG_LISTEN3     = 0x0F
 	REG_VERSION     = 0x10
 	REG_PALEVEL     = 0x11
 	REG_LNAVALUE    = 0x18
@@ -26,14 +30,22 @@ const (
 	REG_IRQFLAGS1   = 0x27
 	REG_IRQFLAGS2   = 0x28
 	REG_RSSITHRES   = 0x29
+	REG_RXTIMEOUT1  = 0x2A
+	REG_RXTIMEOUT2  = 0x2B
+	REG_PREAMBLEMSB = 0x2C
+	REG_PREAMBLELSB = 0x2D
 	REG_SYNCCONFIG  = 0x2E
 	REG_SYNCVALUE1  = 0x2F
 	REG_SYNCVALUE2  = 0x30
+	REG_PKTCONFIG1  = 0x37
+	REG_PAYLOADLEN  = 0x38
 	REG_NODEADDR    = 0x39
 	REG_BCASTADDR   = 0x3A
 	REG_FIFOTHRESH  = 0x3C
 	REG_PKTCONFIG2  = 0x3D
 	REG_AESKEYMSB   = 0x3E
+	REG_TEMP1       = 0x4E
+	REG_TEMP2       = 0x4F
 	REG_TESTPA1     = 0x5A
 	REG_TESTPA2     = 0x5C
 	REG_TESTAFC     = 0x71
@@ -44,10 +56,16 @@ const (
 	MODE_TRANSMIT = 3 << 2
 	MODE_RECEIVE  = 4 << 2
 
+	LISTEN_ON    = 1 << 6
+	LISTEN_ABORT = 1 << 5
+
 	START_TX = 0xC2
 	STOP_TX  = 0x42
 
 	RCCALSTART     = 0x80
+	RCCALDONE      = 0x40
+	TEMPMEASSTART  = 0x08
+	TEMPMEASRUN    = 0x04
 	IRQ1_MODEREADY = 1 << 7
 	IRQ1_RXREADY   = 1 << 6
 	IRQ1_PLLLOCK   = 1 << 4
@@ -67,6 +85,15 @@ const (
 	DIO_PKTSENT  = 0x00
 )
 
+// preambleLen is the default number of preamble bytes, see RadioOpts.Preamble.
+const preambleLen = 5
+
+// defFxosc is the default crystal frequency, see RadioOpts.Fxosc.
+const defFxosc = 32000000
+
+// defRxTimeout is the default value of REG_RXTIMEOUT2, see RadioOpts.RxTimeout.
+const defRxTimeout = 0x40
+
 // register values to initialize the chip, this array has pairs of <address, data>
 var configRegs = []byte{
 	0x01, 0x00, // OpMode = sleep
@@ -77,9 +104,9 @@ var configRegs = []byte{
 	0x26, 0x07, // disable clkout
 	0x29, 0xA8, // RssiThresh (A0=-80dB, B4=-90dB, B8=-92dB)
 	0x2A, 0x00, // disable RxStart timeout
-	0x2B, 0x40, // RssiTimeout after 2*64=128 bytes
-	0x2D, 0x05, // PreambleSize = 5
-	0x37, 0xD8, // PacketConfig1 = variable, white, no filtering, ign crc, no addr filter
+	0x2B, defRxTimeout, // RssiTimeout after 2*64=128 bytes
+	0x2D, preambleLen, // PreambleSize, see RadioOpts.Preamble
+	0x37, 0xD8, // PacketConfig1 = variable, white, crc, ign crc, no addr filter, see RadioOpts
 	0x38, 0x42, // PayloadLength = max 66
 	0x3C, 0x8F, // FifoTresh, not empty, level 15
 	0x3D, 0x12, // PacketConfig2, interpkt = 1, autorxrestart on
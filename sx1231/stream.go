@@ -0,0 +1,115 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"errors"
+	"io"
+)
+
+// Each packet of a stream starts with a header byte holding a 7-bit sequence number and a flag
+// marking the end of the stream, the rest of the packet is data.
+const (
+	streamEnd     = 0x80   // header flag: last packet of the stream
+	streamSeqMask = 0x7f   // header bits holding the sequence number
+	streamMaxData = 65 - 1 // data bytes per packet
+)
+
+// ErrStreamGap is returned by the stream reader when packets of the stream have been lost,
+// reading can continue after it, the data after the gap is returned by the next Read.
+var ErrStreamGap = errors.New("sx1231: packets missing from stream")
+
+// TxWriter returns a writer that sends the data written to it as a stream of packets, which a
+// reader obtained using RxReader on the receiving end reassembles. Close sends an end-of-stream
+// marker, which makes the reader return io.EOF, it does not close the radio.
+//
+// The stream is a simple byte pipe without acknowledgments or retransmissions: lost packets are
+// detected by the reader using sequence numbers but are not recovered, and since the sequence
+// numbers are 7 bits a burst of 128 lost packets goes unnoticed. The transmitter and receiver
+// need to have the channel to themselves, any other packet received is taken as part of the
+// stream. Each Write waits until its packets have been sent, which requires Receive to be
+// running in another goroutine on the transmitting end as for any transmission.
+func (r *Radio) TxWriter() io.WriteCloser {
+	return &txWriter{r: r}
+}
+
+// txWriter implements TxWriter.
+type txWriter struct {
+	r   *Radio
+	seq byte
+}
+
+func (w *txWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		l := len(p)
+		if l > streamMaxData {
+			l = streamMaxData
+		}
+		if err := w.send(0, p[:l]); err != nil {
+			return n, err
+		}
+		p = p[l:]
+		n += l
+	}
+	return n, nil
+}
+
+func (w *txWriter) Close() error {
+	return w.send(streamEnd, nil)
+}
+
+// send transmits one packet of the stream and waits for it to have been sent.
+func (w *txWriter) send(flags byte, data []byte) error {
+	if err := w.r.transmitWait(append([]byte{flags | w.seq}, data...)); err != nil {
+		return err
+	}
+	w.seq = (w.seq + 1) & streamSeqMask
+	return nil
+}
+
+// RxReader returns a reader that receives a stream of packets sent by a writer obtained using
+// TxWriter and returns the data. It calls Receive itself, which must thus not be called
+// concurrently. The reader syncs to the sequence number of the first packet it receives and
+// returns ErrStreamGap if it detects that packets were lost, see TxWriter for the limitations.
+func (r *Radio) RxReader() io.Reader {
+	return &rxReader{r: r}
+}
+
+// rxReader implements RxReader.
+type rxReader struct {
+	r       *Radio
+	started bool   // true: the first packet has been received
+	seq     byte   // sequence number of the next packet expected
+	buf     []byte // data received but not read yet
+	eof     bool   // true: the end of the stream has been received
+}
+
+func (rd *rxReader) Read(p []byte) (int, error) {
+	for len(rd.buf) == 0 && !rd.eof {
+		pkt, err := rd.r.Receive()
+		if err != nil {
+			return 0, err
+		}
+		if len(pkt.Payload) == 0 {
+			continue
+		}
+		hdr := pkt.Payload[0]
+		seq := hdr & streamSeqMask
+		gap := rd.started && seq != rd.seq
+		rd.started = true
+		rd.seq = (seq + 1) & streamSeqMask
+		rd.buf = pkt.Payload[1:]
+		rd.eof = hdr&streamEnd != 0
+		if gap {
+			// Report the gap before the data that follows it.
+			return 0, ErrStreamGap
+		}
+	}
+	if len(rd.buf) == 0 && rd.eof {
+		return 0, io.EOF
+	}
+	n := copy(p, rd.buf)
+	rd.buf = rd.buf[n:]
+	return n, nil
+}
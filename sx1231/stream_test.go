@@ -0,0 +1,92 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+)
+
+func TestStream(t *testing.T) {
+	// Transmit a stream, completing each transmission like Receive would.
+	tx, txf := newFakeRadio(t, RadioOpts{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			tx.Lock()
+			if tx.mode == MODE_TRANSMIT {
+				txf.regs[REG_IRQFLAGS2] = IRQ2_PACKETSENT
+				tx.txDone()
+			}
+			tx.Unlock()
+		}
+	}()
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	w := tx.TxWriter()
+	if n, err := w.Write(data); n != len(data) || err != nil {
+		t.Fatalf("wrote %d bytes, err %v", n, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Split what was sent into packets.
+	tx.Lock()
+	var pkts [][]byte
+	for fifo := txf.fifo; len(fifo) > 0; fifo = fifo[1+fifo[0]:] {
+		pkts = append(pkts, fifo[:1+fifo[0]])
+	}
+	tx.Unlock()
+	if len(pkts) != (len(data)+streamMaxData-1)/streamMaxData+1 {
+		t.Fatalf("unexpected number of packets: %d", len(pkts))
+	}
+
+	// Receive all packets.
+	receive := func(pkts [][]byte) ([]byte, int) {
+		rx, rxf := newFakeRadio(t, RadioOpts{})
+		rxf.rx = pkts
+		rx.intrPin = &fakePin{levels: []gpio.Level{gpio.Low}}
+		rx.intrPin.(*fakePin).high = func() bool { return len(rxf.rx) > 0 }
+		rd := rx.RxReader()
+		var got bytes.Buffer
+		gaps := 0
+		buf := make([]byte, 100)
+		for {
+			n, err := rd.Read(buf)
+			got.Write(buf[:n])
+			switch err {
+			case nil:
+			case ErrStreamGap:
+				gaps++
+			case io.EOF:
+				return got.Bytes(), gaps
+			default:
+				t.Fatal(err)
+			}
+		}
+	}
+	if got, gaps := receive(pkts); !bytes.Equal(got, data) || gaps != 0 {
+		t.Errorf("received %d bytes with %d gaps, expected %d bytes", len(got), gaps, len(data))
+	}
+
+	// Lose a packet.
+	lossy := append(append([][]byte{}, pkts[:3]...), pkts[4:]...)
+	want := append(append([]byte{}, data[:3*streamMaxData]...), data[4*streamMaxData:]...)
+	if got, gaps := receive(lossy); !bytes.Equal(got, want) || gaps != 1 {
+		t.Errorf("received %d bytes with %d gaps, expected %d bytes with 1 gap",
+			len(got), gaps, len(want))
+	}
+}
@@ -17,6 +17,8 @@
 // closed and the error is recorded in the Radio struct where it can be retrieved using the Error
 // function. The object will be unusable for further operation and the client code will have to
 // create and initialize a fresh object which will re-establish communication with the radio chip.
+// Alternatively, Reset re-initializes the chip using the existing SPI connection and interrupt
+// pin.
 //
 // This driver does not do a number of things that other sx1231 drivers tend to do with the
 // goal of leaving these tasks to higher-level drivers. This driver does not use the address
@@ -28,7 +30,49 @@
 // The main limitations of this driver are that it operates the sx1231 in FSK variable-length packet
 // mode and limits the packet size to the 66 bytes that fit into the FIFO, meaning that the payloads
 // pushed into the TX channel must be 65 bytes or less, leaving one byte for the required packet
-// length.
+// length. Protocols that place the length elsewhere in the packet can be handled using
+// PacketOpts.LenOffset and LenSize.
+//
+// The output power is normally set using SetPower. TransmitPacket can be used instead of Transmit
+// to specify a different power for an individual packet, for example to lower the power when
+// replying to a nearby node. Transmit(payload) is equivalent to
+// TransmitPacket(&TxPacket{Payload: payload}) and existing callers do not need to change.
+//
+// Transmit returns as soon as the packet has been loaded into the radio, the actual transmission
+// completes while Receive services interrupts. A client that needs to know when the packet went
+// out can pass a channel in RadioOpts.TxDone: it receives nil after each successful transmission
+// or an error if the radio did not confirm the packet as sent. TxPacket.Done does the same for an
+// individual packet. Notifications are dropped if the channel is not ready to receive, so it
+// should be buffered.
+//
+// Sleep puts the radio into its lowest power state, for example between duty cycles of a battery
+// powered node, and Wake returns it to receive mode. While the radio is asleep Transmit either
+// fails with ErrAsleep or wakes the radio just long enough to send the packet, depending on
+// RadioOpts.SleepTx. In the latter case Receive still needs to be called to complete the
+// transmission.
+//
+// SetListenMode makes the chip cycle between receiving and idling by itself, which is the way to
+// run an always-listening battery powered node. Receive and Transmit work as usual in listen mode
+// but transmitters need to use a preamble longer than the idle time. The idle timer drifts with
+// temperature, which Temperature measures, and CalibrateRC corrects.
+//
+// Nodes with an inaccurate crystal can set RadioOpts.FreqTrim to have Receive correct the
+// frequency based on the frequency error of received packets, the correction can be saved using
+// RadioOpts.OnTrim and restored using RadioOpts.FreqOffset.
+//
+// A gateway serving nodes that use different bit rates can set RadioOpts.Rates to have Receive
+// cycle through them, RxPacket.Rate tells which one a packet was received at.
+//
+// TxWriter and RxReader turn a pair of radios into a lossy byte pipe for bulk transfers, such as
+// logs or firmware images, see TxWriter for the limitations.
+//
+// Receive continuously tunes the RSSI threshold to track the noise floor, which means that a
+// threshold set using SetRSSIThreshold drifts over time unless RadioOpts.NoAutoRSSIThreshold is
+// set.
+//
+// Problems that depend on timing, such as missed interrupts, can be investigated using the
+// in-memory trace enabled by RadioOpts.Trace and printed by DumpTrace, since logging changes the
+// timing too much.
 //
 // The methods on the Radio object are not concurrency safe. Since they all deal with configuration
 // this should not pose difficulties. The Error function may be called from multiple goroutines
@@ -39,9 +83,11 @@ package sx1231
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/tve/devices/internal/duty"
 	"periph.io/x/periph/conn/gpio"
 	"periph.io/x/periph/conn/gpio/gpioreg"
 	"periph.io/x/periph/conn/spi"
@@ -50,29 +96,178 @@ import (
 // Radio represents a Semtech SX1231 radio as used in HopeRF's RFM69 modules.
 type Radio struct {
 	// configuration
-	spi     spi.Conn   // SPI device to access the radio
-	intrPin gpio.PinIn // interrupt pin for RX and TX interrupts
-	intrCnt int        // count interrupts
-	sync    []byte     // sync bytes
-	freq    uint32     // center frequency
-	rate    uint32     // bit rate from table
-	paBoost bool       // true: use PA1+PA2 power amp, else PA0
-	power   byte       // output power in dBm
+	port     spi.Port      // SPI port, closed by Close if it is a PortCloser
+	spi      spi.Conn      // SPI device to access the radio
+	intrPin  gpio.PinIn    // interrupt pin for RX and TX interrupts
+	sync     []byte        // sync bytes
+	freq     uint32        // center frequency
+	rate     uint32        // bit rate from table
+	params   Rate          // parameters for the bit rate
+	paBoost  bool          // true: use PA1+PA2 power amp, else PA0
+	power    int           // output power in dBm
+	defPower int           // output power set using SetPower, power may differ during TX
+	sleepTx  SleepPolicy   // what Transmit does while asleep
+	listen   []byte        // listen mode registers REG_LISTEN1..3, nil: continuous receive
+	noAutoTh bool          // true: leave the RSSI threshold alone in Receive
+	tempOff  int           // calibration offset added to Temperature
+	rxAbort  time.Duration // RX timeout after a signal has been detected, 0: default
+	scan     *rateScan     // bit rates to cycle through, nil if a single rate is used
+	tr       *traceRing    // trace of events, nil if tracing is off
+	pkt      PacketOpts    // packet format
+	fxosc    uint32        // crystal oscillator frequency in Hz
+	autoTrim bool          // true: trim the frequency based on the FEI of received packets
+	onTrim   func(int)     // called when the trim changes
 	// state
-	sync.Mutex           // guard concurrent access to the radio
-	mode       byte      // current operation mode
-	rxTimeout  uint32    // RX timeout counter to tune rssi threshold
-	rssiAdj    time.Time // when the rssi threshold was last adjusted
-	log        LogPrintf // function to use for logging
+	sync.Mutex              // guard concurrent access to the radio
+	mode       byte         // current operation mode
+	err        error        // persistent error, ErrClosed once closed
+	asleep     bool         // true: radio has been put to sleep using Sleep
+	listening  bool         // true: the chip is in listen mode
+	rxTimeout  uint32       // RX timeout counter to tune rssi threshold
+	rssiAdj    time.Time    // when the rssi threshold was last adjusted
+	rxActive   bool         // true: Receive is running
+	stats      Stats        // link statistics
+	txDoneChan chan<- error // notified when a transmission completes
+	txReq      chan<- error // Done channel of the packet being transmitted
+	trim       int          // frequency correction in Hz, see FrequencyTrim
+	feiAvg     float64      // moving average of the FEI of received packets in Hz
+	duty       *duty.Cycle  // duty-cycle limiter, nil if none
+	dutyPolicy DutyPolicy   // what Transmit does when the duty-cycle budget is exhausted
+	log        LogPrintf    // function to use for logging
 }
 
 // RadioOpts contains options used when initilizing a Radio.
 type RadioOpts struct {
-	Sync    []byte    // RF sync bytes
-	Freq    uint32    // frequency in Hz, Khz, or Mhz
-	Rate    uint32    // data bitrate in bits per second, must exist in Rates table
-	PABoost bool      // true: use PA1+PA2, false: use PA0
-	Logger  LogPrintf // function to use for logging
+	Sync []byte // RF sync bytes
+	Freq uint32 // frequency in Hz, Khz, or Mhz
+	Rate uint32 // data bitrate in bits per second, must exist in Rates table
+	// Rates, if not empty, supersedes Rate and makes Receive cycle through the bit rates, which
+	// must exist in the Rates table, to receive from nodes using different rates on the same
+	// frequency. The receiver dwells RateDwell on each rate, 0 for 50ms, and stays on a rate
+	// while a packet is being received, RxPacket.Rate tells which rate was used. After a packet
+	// has been received the receiver dwells on its rate again, so an immediate reply is
+	// transmitted at the rate of the packet. SetRate and ApplyRate turn scanning off.
+	Rates     []uint32
+	RateDwell time.Duration
+	PABoost   bool         // true: use PA1+PA2, false: use PA0
+	TxDone    chan<- error // optional: notified when a transmission completes
+	SleepTx   SleepPolicy  // what Transmit does while the radio is asleep
+	Logger    LogPrintf    // function to use for logging
+	// NoAutoRSSIThreshold disables the automatic tuning of the RSSI threshold by Receive, see
+	// SetRSSIThreshold.
+	NoAutoRSSIThreshold bool
+	// DutyCycle is the max fraction of time spent transmitting, e.g. 0.01 for 1%, 0: no limit.
+	DutyCycle  float64
+	DutyPolicy DutyPolicy // what Transmit does when the duty-cycle budget is exhausted
+	// TempOffset is added to the temperature measured by the chip, which is only accurate to
+	// a few degrees, it can be determined by comparing Temperature to a reference thermometer.
+	TempOffset int
+	// RxTimeout is the max time from detecting a signal to having received a complete packet,
+	// after which the receiver is restarted. This keeps the receiver from getting stuck on noise
+	// or on a packet it lost track of. It is programmed into the chip based on the bit rate in
+	// units of 16 bits and limited to 255 units. The default, 0, is the time for 128 bytes, i.e.
+	// a maximum length packet plus some margin, or twice that with manchester encoding.
+	RxTimeout time.Duration
+	// Fxosc is the frequency in Hz of the crystal or TCXO clocking the chip, 0: 32MHz, which is
+	// what most modules use. The frequency, bit rate, and frequency deviation registers as well
+	// as the frequency error reported in RxPacket are derived from it.
+	Fxosc uint32
+	// FreqTrim enables the automatic correction of the frequency for the offset of the crystal:
+	// the frequency error of received packets is averaged and when it exceeds a fifth of the RX
+	// bandwidth the frequency is adjusted by that amount, see FrequencyTrim. This is intended
+	// for nodes that communicate with a gateway, whose crystal serves as reference.
+	FreqTrim bool
+	// FreqOffset is the initial frequency correction in Hz, typically the FrequencyTrim of a
+	// previous run.
+	FreqOffset int
+	// OnTrim is called with the new FrequencyTrim each time it is adjusted, e.g. to save
+	// it to disk. It is called from Receive with the mutex held, so it must not call any
+	// methods of the Radio.
+	OnTrim func(offset int)
+	// Trace is the number of events kept in an in-memory trace, 0 for none. The trace records
+	// mode changes, interrupts with the IRQ flags, RX restarts and timeouts, received and
+	// transmitted packets, and RSSI threshold adjustments with timestamps, without allocating
+	// and with much less effect on the timing than logging. Use DumpTrace to print it.
+	Trace int
+	// PacketOpts sets the format of the packets, the zero value uses 5 preamble bytes, data
+	// whitening, and a CRC. It can be changed later using SetPacketOptions.
+	PacketOpts
+}
+
+// Encoding is the DC-free encoding applied to the packet bytes following the sync bytes. Both
+// sides of a link must use the same encoding.
+type Encoding byte
+
+const (
+	Whitening  Encoding = iota // data whitening, the default
+	Manchester                 // manchester encoding, which halves the effective data rate
+	NoEncoding                 // no encoding
+)
+
+// PacketOpts describes the format of the packets on the air.
+type PacketOpts struct {
+	Preamble int      // number of preamble bytes, 1..65535, 0: default of 5
+	Encoding Encoding // DC-free encoding of the packets
+	NoCRC    bool     // true: neither append a CRC when transmitting nor check it on reception
+	// LenOffset and LenSize locate the length field for protocols that don't put a 1-byte
+	// length at the start of the packet, as the chip does. LenOffset is the number of bytes
+	// preceding the length field and LenSize its size, 1 or 2 for a big-endian 16-bit length, 0
+	// meaning 1. The length counts the bytes following the length field. The driver inserts the
+	// length field into the payload on transmission and removes it on reception, so the bytes
+	// preceding it are part of the payload, which must be at least LenOffset bytes long.
+	//
+	// With a custom length field the driver handles the packets in software: it receives a
+	// full FIFO of 66 bytes and extracts the packet from it, so received packets are only
+	// reported after the time needed to receive a maximum length packet, and the packet plus
+	// its CRC must fit into the FIFO.
+	LenOffset int
+	LenSize   int
+}
+
+// preamble returns the number of preamble bytes, filling in the default.
+func (o PacketOpts) preamble() int {
+	if o.Preamble == 0 {
+		return preambleLen
+	}
+	return o.Preamble
+}
+
+// config1 returns the value for REG_PKTCONFIG1: variable length packets, unless the length field
+// is custom, the encoding, the CRC, no automatic clearing of the FIFO on CRC errors, and no
+// address filtering.
+func (o PacketOpts) config1() byte {
+	v := byte(0x88)
+	if o.customLen() {
+		v = 0x08
+	}
+	switch o.Encoding {
+	case Whitening:
+		v |= 0x40
+	case Manchester:
+		v |= 0x20
+	}
+	if !o.NoCRC {
+		v |= 0x10
+	}
+	return v
+}
+
+// check validates the options.
+func (o PacketOpts) check() error {
+	if o.Preamble < 0 || o.Preamble > 0xffff {
+		return fmt.Errorf("sx1231: invalid preamble length: %d, must be 1..65535", o.Preamble)
+	}
+	if o.Encoding > NoEncoding {
+		return fmt.Errorf("sx1231: invalid encoding: %d", o.Encoding)
+	}
+	if o.LenSize < 0 || o.LenSize > 2 {
+		return fmt.Errorf("sx1231: invalid length field size: %d, must be 1 or 2", o.LenSize)
+	}
+	if o.LenOffset < 0 || o.LenOffset >= o.maxPayload() {
+		return fmt.Errorf("sx1231: invalid length field offset: %d, must be 0..%d",
+			o.LenOffset, o.maxPayload()-1)
+	}
+	return nil
 }
 
 // Rate describes the SX1231 configuration to achieve a specific bit rate.
@@ -123,7 +318,8 @@ type RxPacket struct {
 	Rssi    int       // rssi value for current packet
 	Snr     int       // rssi - noise floor for current packet
 	Fei     int       // frequency error for current packet
-	At      time.Time // time of rx interrupt
+	Rate    uint32    // bit rate at which the packet was received
+	At      time.Time // start of the packet on the air, estimated using its time on air
 }
 
 // Temporary is an interface implemented by errors that are temporary and thus worth retrying.
@@ -136,7 +332,7 @@ type busyError struct{ e string }
 func (b busyError) Error() string   { return b.e }
 func (b busyError) Temporary() bool { return true }
 
-var debugPin gpio.PinOut
+var debugPin gpio.PinOut = gpio.INVALID
 
 // New initializes an sx1231 Radio given an spi.Conn and an interrupt pin, and places the radio
 // in receive mode.
@@ -153,31 +349,89 @@ var debugPin gpio.PinOut
 // communicating with the device, use the Error() function to retrieve the error.
 func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 	r := &Radio{
-		intrPin: intr,
-		mode:    255,
-		paBoost: opts.PABoost,
-		log:     func(format string, v ...interface{}) {},
+		intrPin:    intr,
+		mode:       255,
+		paBoost:    opts.PABoost,
+		txDoneChan: opts.TxDone,
+		sleepTx:    opts.SleepTx,
+		noAutoTh:   opts.NoAutoRSSIThreshold,
+		tempOff:    opts.TempOffset,
+		autoTrim:   opts.FreqTrim,
+		onTrim:     opts.OnTrim,
+		trim:       opts.FreqOffset,
+		log:        func(format string, v ...interface{}) {},
 	}
 	if opts.Logger != nil {
 		r.log = func(format string, v ...interface{}) {
 			opts.Logger("sx1231: "+format, v...)
 		}
 	}
+	if opts.DutyCycle > 0 {
+		r.duty = duty.New(opts.DutyCycle, duty.Window)
+		r.dutyPolicy = opts.DutyPolicy
+	}
+	if opts.Trace > 0 {
+		r.tr = &traceRing{events: make([]traceEvent, opts.Trace)}
+	}
 
 	// Set SPI parameters and get a connection.
 	conn, err := port.DevParams(4*1000*1000, spi.Mode0, 8)
 	if err != nil {
 		return nil, fmt.Errorf("sx1231: cannot set device params: %v", err)
 	}
-	r.spi = conn
+	r.port, r.spi = port, conn
+
+	// Check and record the configuration, the registers are programmed by setup.
+	if len(opts.Sync) < 1 || len(opts.Sync) > 8 {
+		return nil, fmt.Errorf("sx1231: invalid number of sync bytes: %d, must be 1..8",
+			len(opts.Sync))
+	}
+	r.sync = opts.Sync
+	if len(opts.Rates) > 0 {
+		if r.scan, err = newRateScan(opts.Rates, opts.RateDwell); err != nil {
+			return nil, err
+		}
+		opts.Rate = opts.Rates[0]
+	}
+	if params, found := Rates[opts.Rate]; found {
+		r.rate, r.params = opts.Rate, params
+	}
+	r.freq = opts.Freq
+	r.fxosc = opts.Fxosc
+	if r.fxosc == 0 {
+		r.fxosc = defFxosc
+	}
+	r.defPower = 13
+	r.rxAbort = opts.RxTimeout
+	if err := opts.PacketOpts.check(); err != nil {
+		return nil, err
+	}
+	r.pkt = opts.PacketOpts
+
+	if p := gpioreg.ByName("CSID1"); p != nil {
+		debugPin = p
+	} else {
+		r.log("Cannot find debug pin")
+	}
+	debugPin.Out(gpio.High)
+
+	if err := r.setup(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
+// setup synchronizes with the chip, programs all the registers according to the configuration
+// recorded in the Radio, tests the interrupt, and turns on the receiver. It is used by New and
+// Reset.
+func (r *Radio) setup() error {
 	// Try to synchronize communication with the sx1231.
 	sync := func(pattern byte) error {
 		var v byte
 		for n := 10; n > 0; n-- {
 			// Doing write transactions explicitly to get OS errors.
 			r.writeReg(REG_SYNCVALUE1, pattern)
-			if err := conn.Tx([]byte{REG_SYNCVALUE1 | 0x80, pattern}, []byte{0, 0}); err != nil {
+			if err := r.spi.Tx([]byte{REG_SYNCVALUE1 | 0x80, pattern}, []byte{0, 0}); err != nil {
 				return fmt.Errorf("sx1231: %s", err)
 			}
 			// Read same thing back, we hope...
@@ -189,10 +443,10 @@ func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 		return fmt.Errorf("sx1231: cannot sync with chip, sent %#x got %#x", pattern, v)
 	}
 	if err := sync(0xaa); err != nil {
-		return nil, err
+		return err
 	}
 	if err := sync(0x55); err != nil {
-		return nil, err
+		return err
 	}
 
 	r.setMode(MODE_SLEEP)
@@ -206,25 +460,14 @@ func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 		r.writeReg(configRegs[i], configRegs[i+1])
 	}
 	r.setMode(MODE_STANDBY)
-	// Debug: read config regs back and make sure they are correct.
-	//for i := 0; i < len(configRegs)-1; i += 2 {
-	//	if r.readReg(configRegs[i]) != configRegs[i+1] {
-	//		r.log("error writing config reg %#x: got %#x expected %#x",
-	//			configRegs[i], r.readReg(configRegs[i]), configRegs[i+1])
-	//	}
-	//}
+	r.applyPacket()
 
 	// Configure the bit rate and frequency.
-	r.SetRate(opts.Rate)
-	r.SetFrequency(opts.Freq)
-	r.SetPower(13)
+	r.applyRate(r.rate, r.params)
+	r.setFrequency(r.freq)
+	r.defPower = r.setPower(r.defPower)
 
 	// Configure the sync bytes.
-	if len(opts.Sync) < 1 || len(opts.Sync) > 8 {
-		return nil, fmt.Errorf("sx1231: invalid number of sync bytes: %d, must be 1..8",
-			len(r.sync))
-	}
-	r.sync = opts.Sync
 	wBuf := make([]byte, len(r.sync)+2)
 	rBuf := make([]byte, len(r.sync)+2)
 	wBuf[0] = REG_SYNCCONFIG | 0x80
@@ -232,17 +475,11 @@ func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 	copy(wBuf[2:], r.sync)
 	r.spi.Tx(wBuf, rBuf)
 
-	debugPin = gpioreg.ByName("CSID1")
-	if debugPin == nil {
-		r.log("Cannot find debug pin")
-	}
-	debugPin.Out(gpio.High)
-
 	count := 0
 repeat:
 	// Initialize interrupt pin.
 	if err := r.intrPin.In(gpio.Float, gpio.RisingEdge); err != nil {
-		return nil, fmt.Errorf("sx1231: error initializing interrupt pin: %s", err)
+		return fmt.Errorf("sx1231: error initializing interrupt pin: %s", err)
 	}
 	r.log("Interrupt pin is %v", r.intrPin.Read())
 
@@ -262,7 +499,7 @@ repeat:
 			count++
 			goto repeat
 		}
-		return nil, fmt.Errorf("sx1231: interrupts from radio do not work, try unexporting gpio%d", r.intrPin.Number())
+		return fmt.Errorf("sx1231: interrupts from radio do not work, try unexporting gpio%d", r.intrPin.Number())
 	}
 	r.writeReg(REG_DIOMAPPING1, DIO_MAPPING)
 	// Flush any addt'l interrupts.
@@ -273,37 +510,101 @@ repeat:
 	r.logRegs()
 
 	// Finally turn on the receiver.
-	r.setMode(MODE_RECEIVE)
+	r.receive()
+	return nil
+}
 
-	return r, nil
+// Reset re-initializes the radio chip using the existing SPI connection and interrupt pin, for
+// example to recover from a brown-out or glitches on the SPI bus that corrupted the chip's
+// registers, see VerifyConfig. It performs the same steps as New and restores the frequency,
+// rate, power, sync bytes, and listen mode last set, the radio ends up receiving, even if it had
+// been put to sleep. The RSSI threshold starts out again at its initial value.
+//
+// Reset needs the interrupt pin for itself and returns an error if Receive is running, the
+// receive loop thus has to be stopped before calling Reset.
+func (r *Radio) Reset() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.rxActive {
+		return errors.New("sx1231: cannot reset while Receive is running")
+	}
+	r.log("Reset")
+	if r.mode == MODE_TRANSMIT {
+		r.txNotify(errors.New("sx1231: transmission aborted by Reset"))
+	}
+	r.mode, r.listening, r.asleep = 255, false, false
+	r.rxTimeout = 0
+	r.rssiAdj = time.Now()
+	return r.setup()
 }
 
 // SetFrequency changes the center frequency at which the radio transmits and receives. The
 // frequency can be specified at any scale (hz, khz, mhz). The frequency value is not checked
-// and invalid values will simply cause the radio not to work particularly well.
+// and invalid values will simply cause the radio not to work particularly well. The
+// FrequencyTrim is applied on top of it.
 func (r *Radio) SetFrequency(freq uint32) {
 	r.Lock()
 	defer r.Unlock()
+	r.setFrequency(freq)
+}
 
+// setFrequency implements SetFrequency, it must be called with the mutex held.
+func (r *Radio) setFrequency(freq uint32) {
 	// accept any frequency scale as input, including KHz and MHz
 	// multiply by 10 until freq >= 100 MHz
 	for freq > 0 && freq < 100000000 {
 		freq = freq * 10
 	}
-	r.log("SetFrequency: %dHz", freq)
+	r.log("SetFrequency: %dHz, trim %dHz", freq, r.trim)
 
-	mode := r.mode
+	mode, listening := r.mode, r.listening
 	r.setMode(MODE_STANDBY)
-	// Frequency steps are in units of (32,000,000 >> 19) = 61.03515625 Hz
-	// use multiples of 64 to avoid multi-precision arithmetic, i.e. 3906.25 Hz
-	// due to this, the lower 6 bits of the calculated factor will always be 0
-	// this is still 4 ppm, i.e. well below the radio's 32 MHz crystal accuracy
-	// 868.0 MHz = 0xD90000, 868.3 MHz = 0xD91300, 915.0 MHz = 0xE4C000
-	frf := (freq << 2) / (32000000 >> 11)
-	//log.Printf("SetFreq: %d %d %02x %02x %02x", freq, uint32(frf<<6),
-	//	byte(frf>>10), byte(frf>>2), byte(frf<<6))
-	r.writeReg(REG_FRFMSB, byte(frf>>10), byte(frf>>2), byte(frf<<6))
-	r.setMode(mode)
+	// Frequency steps are in units of Fxosc >> 19, i.e. 61.03515625 Hz with a 32MHz crystal:
+	// 868.0 MHz = 0xD90000, 868.3 MHz = 0xD91333, 915.0 MHz = 0xE4C000
+	r.freq = freq
+	r.writeReg(REG_FRFMSB, frfRegs(r.carrier(), r.fxosc)...)
+	r.resume(mode, listening)
+}
+
+// SetPacketOptions changes the format of the packets, see RadioOpts.PacketOpts. Like the
+// other settings it takes effect immediately, which may corrupt a packet being received.
+func (r *Radio) SetPacketOptions(opts PacketOpts) error {
+	if err := opts.check(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.log("SetPacketOptions: %+v", opts)
+	r.pkt = opts
+	mode, listening := r.mode, r.listening
+	r.setMode(MODE_STANDBY)
+	r.applyPacket()
+	r.resume(mode, listening)
+	return nil
+}
+
+// applyPacket programs the registers that depend on the packet format, it must be called with
+// the mutex held and the radio in standby.
+func (r *Radio) applyPacket() {
+	n := r.pkt.preamble()
+	r.writeReg(REG_PREAMBLEMSB, byte(n>>8), byte(n))
+	r.writeReg(REG_PKTCONFIG1, r.pkt.config1())
+	r.writeReg(REG_PAYLOADLEN, fifoSize) // in case a transmission with a custom length was aborted
+	r.writeReg(REG_RXTIMEOUT2, r.rssiTimeout())
+}
+
+// Frequency returns the center frequency in Hz, excluding the FrequencyTrim.
+func (r *Radio) Frequency() uint32 {
+	r.Lock()
+	defer r.Unlock()
+	return r.freq
+}
+
+// frfRegs returns the values of the 3 frequency registers for the given frequency and crystal
+// frequency in Hz.
+func frfRegs(freq, fxosc uint32) []byte {
+	frf := (uint64(freq) << 19) / uint64(fxosc)
+	return []byte{byte(frf >> 16), byte(frf >> 8), byte(frf)}
 }
 
 // SetRate sets the bit rate according to the Rates table. The rate requested must use one of
@@ -313,78 +614,263 @@ func (r *Radio) SetRate(rate uint32) {
 	if !found {
 		return
 	}
-	bw := func(v byte) int {
-		return 32000000 / (int(16+(v&0x18>>1)) * (1 << ((v & 0x7) + 2)))
-	}
-	r.log("SetRate %dbps, Fdev:%dHz, RxBw:%dHz(%#x), AfcBw:%dHz(%#x) AFC off:%dHz", rate,
-		params.Fdev, bw(params.RxBw), params.RxBw, bw(params.AfcBw), params.AfcBw,
-		(params.Fdev/10/488)*488)
+	r.ApplyRate(rate, params)
+}
+
+// CurrentRate returns the bit rate and the corresponding parameters currently in use.
+func (r *Radio) CurrentRate() (uint32, Rate) {
+	r.Lock()
+	defer r.Unlock()
+	return r.rate, r.params
+}
 
+// ApplyRate sets the bit rate and programs the radio using the provided parameters, bypassing
+// the Rates table. This is primarily intended for experimentation with new rates. It turns off
+// the scanning of RadioOpts.Rates.
+func (r *Radio) ApplyRate(rate uint32, params Rate) {
 	r.Lock()
 	defer r.Unlock()
+	r.scan = nil
+	r.applyRate(rate, params)
+}
+
+// applyRate implements ApplyRate, it must be called with the mutex held.
+func (r *Radio) applyRate(rate uint32, params Rate) {
+	if rate == 0 {
+		return
+	}
+	bw := func(v byte) int { return bandwidth(v, r.fxosc) }
+	afcStep := afcOffsetStep(r.fxosc)
+	r.log("SetRate %dbps, Fdev:%dHz, RxBw:%dHz(%#x), AfcBw:%dHz(%#x) AFC off:%dHz", rate,
+		params.Fdev, bw(params.RxBw), params.RxBw, bw(params.AfcBw), params.AfcBw,
+		(params.Fdev/10/afcStep)*afcStep)
+	r.programRate(rate, params)
+}
 
+// programRate switches to the bit rate and programs the radio, it must be called with the mutex
+// held.
+func (r *Radio) programRate(rate uint32, params Rate) {
 	r.rate = rate
-	mode := r.mode
+	r.params = params
+	mode, listening := r.mode, r.listening
 	r.setMode(MODE_STANDBY)
-	// program bit rate, assume a 32Mhz osc
-	var rateVal uint32 = (32000000 + rate/2) / rate
-	r.writeReg(REG_BITRATEMSB, byte(rateVal>>8), byte(rateVal&0xff))
-	// program frequency deviation
-	var fStep float64 = 32000000.0 / 524288 // 32Mhz osc / 2^19 = 61.03515625 Hz
-	fdevVal := uint32((float64(params.Fdev) + fStep/2) / fStep)
-	r.writeReg(REG_FDEVMSB, byte(fdevVal>>8), byte(fdevVal&0xFF))
-	// program data modulation register
-	r.writeReg(REG_DATAMODUL, params.Shaping&0x3)
-	// program RX bandwidth and AFC bandwidth
-	r.writeReg(REG_RXBW, params.RxBw, params.AfcBw)
-	// program AFC offset to be 10% of Fdev
-	r.writeReg(REG_TESTAFC, byte(params.Fdev/10/488))
+	regs := rateRegs(rate, params, r.fxosc)
+	for i := 0; i < len(regs)-1; i += 2 {
+		r.writeReg(regs[i], regs[i+1])
+	}
+	r.writeReg(REG_RXTIMEOUT2, r.rssiTimeout())
 	if r.readReg(REG_AFCCTRL) != 0x00 {
 		r.setMode(MODE_FS)            // required to write REG_AFCCTRL, undocumented
 		r.writeReg(REG_AFCCTRL, 0x00) // 0->AFC, 20->AFC w/low-beta offset
 	}
-	r.setMode(mode)
+	r.resume(mode, listening)
+}
+
+// bandwidth returns the single-sided bandwidth in Hz corresponding to the value of the RxBw or
+// AfcBw register.
+func bandwidth(v byte, fxosc uint32) int {
+	return int(fxosc) / (int(16+(v&0x18>>1)) * (1 << ((v & 0x7) + 2)))
+}
+
+// rssiTimeout returns the value for REG_RXTIMEOUT2 to implement RadioOpts.RxTimeout at the
+// current bit rate. The default is doubled with manchester encoding.
+func (r *Radio) rssiTimeout() byte {
+	if r.rxAbort <= 0 || r.rate == 0 {
+		if r.pkt.Encoding == Manchester {
+			return 2 * defRxTimeout
+		}
+		return defRxTimeout
+	}
+	unit := 16 * time.Second / time.Duration(r.rate)
+	n := (r.rxAbort + unit - 1) / unit
+	if n > 255 {
+		r.log("RX timeout %s too long at %dbps, using %s", r.rxAbort, r.rate, 255*unit)
+		n = 255
+	}
+	return byte(n)
+}
+
+// rateRegs returns the register settings for the given bit rate as address/value pairs, given
+// the crystal frequency.
+func rateRegs(rate uint32, params Rate, fxosc uint32) []byte {
+	// bit rate
+	var rateVal uint32 = (fxosc + rate/2) / rate
+	// frequency deviation
+	var fStep float64 = float64(fxosc) / 524288 // fxosc / 2^19, 61.03515625 Hz at 32MHz
+	fdevVal := uint32((float64(params.Fdev) + fStep/2) / fStep)
+	return []byte{
+		REG_BITRATEMSB, byte(rateVal >> 8),
+		REG_BITRATEMSB + 1, byte(rateVal & 0xff),
+		REG_FDEVMSB, byte(fdevVal >> 8),
+		REG_FDEVMSB + 1, byte(fdevVal & 0xFF),
+		REG_DATAMODUL, params.Shaping & 0x3, // data modulation
+		REG_RXBW, params.RxBw, // RX bandwidth
+		REG_AFCBW, params.AfcBw, // AFC bandwidth
+		REG_TESTAFC, byte(params.Fdev / 10 / afcOffsetStep(fxosc)), // AFC offset: 10% of Fdev
+	}
+}
+
+// afcOffsetStep returns the unit of REG_TESTAFC in Hz, 488Hz with a 32MHz crystal.
+func afcOffsetStep(fxosc uint32) int {
+	return int(fxosc >> 16)
 }
 
-// SetPower configures the radio for the specified output power (TODO: should be in dBm).
-func (r *Radio) SetPower(dbm byte) {
+// SetPower configures the radio for the specified output power in dBm and returns the power
+// actually applied. The requested power is clamped to the range supported by the power amplifier
+// configuration: -18dBm..+13dBm using PA0, or -2dBm..+20dBm using PA1 and PA2 (RadioOpts.PABoost).
+// If it had to be clamped a PowerRangeError is returned in addition to applying the clamped
+// power, so callers doing link-budget calculations know the request wasn't achieved.
+func (r *Radio) SetPower(dBm int) (int, error) {
 	r.Lock()
 	defer r.Unlock()
+	r.defPower = r.setPower(dBm)
+	if r.defPower != dBm {
+		min, max := r.powerRange()
+		return r.defPower, PowerRangeError{Requested: dBm, Min: min, Max: max}
+	}
+	return r.defPower, nil
+}
+
+// PowerRangeError is returned by SetPower when the requested power is outside of the range
+// supported by the power amplifier configuration.
+type PowerRangeError struct {
+	Requested int // requested power in dBm
+	Min, Max  int // supported range in dBm
+}
+
+func (e PowerRangeError) Error() string {
+	return fmt.Sprintf("sx1231: power %ddBm outside of supported range %d..%ddBm",
+		e.Requested, e.Min, e.Max)
+}
 
+// Power returns the output power in dBm set using SetPower, as clamped to the range supported by
+// the power amplifier configuration.
+func (r *Radio) Power() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.defPower
+}
+
+// setPower implements SetPower, it must be called with the mutex held.
+func (r *Radio) setPower(dBm int) int {
 	// Save current mode.
-	mode := r.mode
+	mode, listening := r.mode, r.listening
 	r.setMode(MODE_STANDBY)
 
-	if r.paBoost {
-		// rfm69H with external antenna switch.
-		if dbm > 20 {
-			dbm = 20
-		}
-		switch {
-		case dbm <= 13:
-			r.writeReg(REG_PALEVEL, 0x40+18+dbm) // PA1
-		case dbm <= 17:
-			r.writeReg(REG_PALEVEL, 0x60+14+dbm) // PA1+PA2
-		default:
-			r.writeReg(REG_PALEVEL, 0x60+11+dbm) // PA1+PA2+HIGH_POWER
-		}
-	} else {
-		// rfm69 without external antenna switch.
-		if dbm > 13 {
-			dbm = 13
-		}
-		r.writeReg(REG_PALEVEL, 0x80+18+dbm) // PA0
-	}
+	var paLevel byte
+	paLevel, dBm = r.paLevel(dBm)
+	r.writeReg(REG_PALEVEL, paLevel)
 	// Technically the following two lines are for <=17dBm, but if we're set higher
 	// then the registers get writte with the correct value each time the mode is switched
 	// into Tx or Rx, so it's safe to do it unconditionally here.
 	r.writeReg(REG_TESTPA1, 0x55)
 	r.writeReg(REG_TESTPA2, 0x70)
-	r.log("SetPower %ddBm", dbm)
-	r.power = dbm
+	r.log("SetPower %ddBm", dBm)
+	r.power = dBm
 
 	// Restore operating mode.
-	r.setMode(mode)
+	r.resume(mode, listening)
+	return dBm
+}
+
+// powerRange returns the min and max power in dBm supported by the power amplifier configuration.
+func (r *Radio) powerRange() (int, int) {
+	if r.paBoost {
+		return -2, 20 // rfm69H with external antenna switch
+	}
+	return -18, 13 // rfm69 without external antenna switch
+}
+
+// paLevel clamps the requested power to the range supported by the power amplifier configuration
+// and returns the corresponding value of the PALEVEL register as well as the clamped power.
+func (r *Radio) paLevel(dBm int) (byte, int) {
+	min, max := r.powerRange()
+	switch {
+	case dBm < min:
+		dBm = min
+	case dBm > max:
+		dBm = max
+	}
+	if r.paBoost {
+		switch {
+		case dBm <= 13:
+			return byte(0x40 + 18 + dBm), dBm // PA1
+		case dBm <= 17:
+			return byte(0x60 + 14 + dBm), dBm // PA1+PA2
+		default:
+			return byte(0x60 + 11 + dBm), dBm // PA1+PA2+HIGH_POWER
+		}
+	}
+	return byte(0x80 + 18 + dBm), dBm // PA0
+}
+
+// configMask lists the bits of the configRegs that VerifyConfig checks. Registers not listed are
+// checked in full, a zero mask excludes registers that the driver changes dynamically.
+var configMask = map[byte]byte{
+	REG_OPMODE:      0x00, // changes with the operating mode
+	REG_PALEVEL:     0x00, // set by SetPower, checked separately
+	REG_AFCFEI:      0x0C, // other bits are commands and status
+	REG_DIOMAPPING1: 0x00, // changes with the operating mode
+	REG_RSSITHRES:   0x00, // set by SetRSSIThreshold and adjusted automatically by Receive
+	REG_RXTIMEOUT2:  0x00, // set according to RadioOpts.RxTimeout, checked separately
+	REG_PREAMBLELSB: 0x00, // set according to RadioOpts.PacketOpts, checked separately
+	REG_PKTCONFIG1:  0x00, // set according to RadioOpts.PacketOpts, checked separately
+	REG_PAYLOADLEN:  0x00, // set for each packet with a custom length field, checked separately
+}
+
+// VerifyConfig reads back the configuration registers as well as the registers set according to
+// the current rate, frequency, power, and sync bytes and returns an error listing all registers
+// that do not hold the expected value. This is intended to be called periodically in order to
+// detect register corruption, e.g. due to brown-outs or noise on the SPI bus, in which case the
+// radio should be reinitialized.
+func (r *Radio) VerifyConfig() error {
+	r.Lock()
+	defer r.Unlock()
+
+	var drift []string
+	check := func(addr, want, mask byte) {
+		if got := r.readReg(addr); got&mask != want&mask {
+			drift = append(drift, fmt.Sprintf("%#x:%#x!=%#x", addr, got, want))
+		}
+	}
+
+	for i := 0; i < len(configRegs)-1; i += 2 {
+		mask, found := configMask[configRegs[i]]
+		if !found {
+			mask = 0xff
+		}
+		if mask != 0 {
+			check(configRegs[i], configRegs[i+1], mask)
+		}
+	}
+	if r.rate != 0 {
+		regs := rateRegs(r.rate, r.params, r.fxosc)
+		for i := 0; i < len(regs)-1; i += 2 {
+			check(regs[i], regs[i+1], 0xff)
+		}
+	}
+	for i, v := range frfRegs(r.carrier(), r.fxosc) {
+		check(REG_FRFMSB+byte(i), v, 0xff)
+	}
+	paLevel, _ := r.paLevel(r.power)
+	check(REG_PALEVEL, paLevel, 0xff)
+	check(REG_RXTIMEOUT2, r.rssiTimeout(), 0xff)
+	check(REG_PREAMBLEMSB, byte(r.pkt.preamble()>>8), 0xff)
+	check(REG_PREAMBLELSB, byte(r.pkt.preamble()), 0xff)
+	check(REG_PKTCONFIG1, r.pkt.config1(), 0xff)
+	if r.mode != MODE_TRANSMIT {
+		check(REG_PAYLOADLEN, fifoSize, 0xff)
+	}
+	check(REG_SYNCCONFIG, byte(0x80+((len(r.sync)-1)<<3)), 0xff)
+	for i, v := range r.sync {
+		check(REG_SYNCVALUE1+byte(i), v, 0xff)
+	}
+
+	if len(drift) > 0 {
+		return fmt.Errorf("sx1231: config registers drifted (reg:got!=expected): %s",
+			strings.Join(drift, " "))
+	}
+	return nil
 }
 
 // LogPrintf is a function used by the driver to print logging info.
@@ -397,6 +883,16 @@ type LogPrintf func(format string, v ...interface{})
 func (r *Radio) setMode(mode byte) {
 	mode = mode & 0x1c
 
+	// Listen mode has to be aborted before the mode can be changed, this leaves the radio in
+	// standby.
+	if r.listening {
+		r.writeReg(REG_DIOMAPPING1, DIO_MAPPING)
+		r.writeReg(REG_OPMODE, LISTEN_ABORT|MODE_STANDBY)
+		r.writeReg(REG_OPMODE, MODE_STANDBY)
+		r.listening = false
+		r.mode = MODE_STANDBY
+	}
+
 	// If we're in the right mode then don't do anything.
 	if r.mode == mode {
 		return
@@ -439,12 +935,37 @@ func (r *Radio) setMode(mode byte) {
 	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
 		if val := r.readReg(REG_IRQFLAGS1); val&IRQ1_MODEREADY != 0 {
 			r.mode = mode
+			r.trace(traceMode, int(modeOf(mode)), 0)
 			return
 		}
 	}
 	//r.err = errors.New("sx1231: timeout switching modes")
 }
 
+// receive puts the radio into receive mode, which is listen mode if it has been enabled using
+// SetListenMode.
+func (r *Radio) receive() {
+	if r.listen == nil {
+		r.setMode(MODE_RECEIVE)
+		return
+	}
+	r.setMode(MODE_STANDBY) // also restarts listen mode if it's on
+	r.writeReg(REG_LISTEN1, r.listen...)
+	r.writeReg(REG_DIOMAPPING1, DIO_MAPPING+DIO_RSSI)
+	r.writeReg(REG_OPMODE, LISTEN_ON|MODE_STANDBY)
+	r.listening = true
+}
+
+// resume returns the radio to the mode saved before a configuration change, listening
+// indicates whether the radio was in listen mode.
+func (r *Radio) resume(mode byte, listening bool) {
+	if listening {
+		r.receive()
+		return
+	}
+	r.setMode(mode)
+}
+
 // busy checks whether a transmission or a reception is currently in progress.
 // For rx it uses the sync match flag as earliest indication that something is coming
 // in that is not noise. It also protects from a packet sitting in RX that hasn't been
@@ -453,7 +974,7 @@ func (r *Radio) busy() bool {
 	switch {
 	case r.mode == MODE_TRANSMIT:
 		return true
-	case r.mode == MODE_RECEIVE:
+	case r.mode == MODE_RECEIVE || r.listening:
 		irq1 := r.readReg(REG_IRQFLAGS1)
 		return irq1&IRQ1_SYNCMATCH != 0
 	default:
@@ -470,15 +991,24 @@ func (r *Radio) Receive() (*RxPacket, error) {
 
 	r.Lock()
 	defer r.Unlock()
+	r.rxActive = true
+	defer func() { r.rxActive = false }()
 
 	// Loop over interrupts & timeouts.
 	for {
+		if r.err != nil {
+			return nil, r.err
+		}
 		// Make sure we're not missing an initial edge due to a race condition.
 		intr := r.intrPin.Read() == gpio.High
 
 		if !intr {
+			wait := time.Second
+			if r.scan != nil {
+				wait = r.scan.wait()
+			}
 			r.Unlock()
-			intr = r.intrPin.WaitForEdge(1 * time.Second)
+			intr = r.intrPin.WaitForEdge(wait)
 			r.Lock()
 		}
 
@@ -487,13 +1017,22 @@ func (r *Radio) Receive() (*RxPacket, error) {
 			// active, this means the driver or epoll failed us.
 			// Need to understand this better.
 			r.log("Interrupt was missed!")
+			r.traceIRQ(traceMissed)
 			// If we don't get interrupts it messes with the rx threshold adjustemnt.
 			r.rxTimeout = 0
 			r.rssiAdj = time.Now()
 		}
+		// In listen mode the chip ends up in standby when it detects a signal that doesn't
+		// turn into a packet before the interrupt is serviced, so restart listen mode
+		// periodically to be safe.
+		if !intr && r.listening && r.intrPin.Read() == gpio.Low {
+			r.receive()
+		}
 		intr = false
 
 		if r.intrPin.Read() == gpio.High {
+			r.stats.Interrupts++
+			r.traceIRQ(traceIntr)
 			switch {
 			case r.mode == MODE_RECEIVE:
 				pkt, err := r.rx()
@@ -501,10 +1040,21 @@ func (r *Radio) Receive() (*RxPacket, error) {
 				if pkt != nil || err != nil {
 					return pkt, err
 				}
+			case r.listening:
+				// The chip stays in RX after detecting a signal until it has received a
+				// packet or timed out, it then goes to standby and listen mode needs to be
+				// restarted.
+				pkt, err := r.rx()
+				r.receive()
+				if pkt != nil || err != nil {
+					return pkt, err
+				}
 			case r.mode == MODE_TRANSMIT:
 				r.txDone()
+			case r.asleep:
+				// Nothing to do.
 			default:
-				r.setMode(MODE_RECEIVE) // clears intr
+				r.receive() // clears intr
 			}
 		}
 
@@ -516,76 +1066,578 @@ func (r *Radio) Receive() (*RxPacket, error) {
 				//r.log("Rx restart -- mode: %#x, mapping: %#x, IRQ flags: %#x %#x",
 				//	r.readReg(REG_OPMODE), r.readReg(REG_DIOMAPPING1),
 				//	irq1, r.readReg(REG_IRQFLAGS2))
+				r.stats.RxRestarts++
+				r.traceIRQ(traceRestart)
 				r.setMode(MODE_FS)
 				r.setMode(MODE_RECEIVE)
 			}
 		}
-		// Adjust RSSI threshold
-		if dt := time.Since(r.rssiAdj); dt > 10*time.Second {
-			timeoutPerSec := float64(r.rxTimeout) / dt.Seconds()
-			switch {
-			case timeoutPerSec > 10:
-				r.writeReg(REG_RSSITHRES, r.readReg(REG_RSSITHRES)-1)
-				r.log("RSSI threshold raised: %.2f timeout/sec, %.1fdBm",
+		if !r.noAutoTh {
+			r.tuneThreshold()
+		}
+		r.scanRates()
+	}
+}
+
+// tuneThreshold adjusts the RSSI threshold based on the rate of RX timeouts: a threshold that
+// is too low causes frequent timeouts because the receiver keeps triggering on noise, one that is
+// too high causes weak packets to be missed, which doesn't cause timeouts. The goal is thus to
+// keep the rate of timeouts between 5 and 10 per second.
+func (r *Radio) tuneThreshold() {
+	// The receiver isn't running while asleep.
+	if r.asleep {
+		r.rxTimeout = 0
+		r.rssiAdj = time.Now()
+	}
+	if dt := time.Since(r.rssiAdj); dt > 10*time.Second {
+		timeoutPerSec := float64(r.rxTimeout) / dt.Seconds()
+		switch {
+		case timeoutPerSec > 10:
+			r.writeReg(REG_RSSITHRES, r.readReg(REG_RSSITHRES)-1)
+			r.log("RSSI threshold raised: %.2f timeout/sec, %.1fdBm",
+				timeoutPerSec, -float64(r.readReg(REG_RSSITHRES))/2)
+			r.trace(traceThreshold, int(r.readReg(REG_RSSITHRES)), int(timeoutPerSec))
+		case timeoutPerSec < 5:
+			r.writeReg(REG_RSSITHRES, r.readReg(REG_RSSITHRES)+1)
+			thres := -float64(r.readReg(REG_RSSITHRES)) / 2
+			if thres < -105 {
+				// This is getting absurd, something is not working here
+				// let's reset to a more reasonable value.
+				r.writeReg(REG_RSSITHRES, 2*95)
+				r.log("RSSI threshold reset: %.2f timeout/sec, %.1fdBm",
+					timeoutPerSec, -float64(r.readReg(REG_RSSITHRES))/2)
+			} else {
+				r.log("RSSI threshold lowered: %.2f timeout/sec, %.1fdBm",
 					timeoutPerSec, -float64(r.readReg(REG_RSSITHRES))/2)
-			case timeoutPerSec < 5:
-				r.writeReg(REG_RSSITHRES, r.readReg(REG_RSSITHRES)+1)
-				thres := -float64(r.readReg(REG_RSSITHRES)) / 2
-				if thres < -105 {
-					// This is getting absurd, something is not working here
-					// let's reset to a more reasonable value.
-					r.writeReg(REG_RSSITHRES, 2*95)
-					r.log("RSSI threshold reset: %.2f timeout/sec, %.1fdBm",
-						timeoutPerSec, -float64(r.readReg(REG_RSSITHRES))/2)
-				} else {
-					r.log("RSSI threshold lowered: %.2f timeout/sec, %.1fdBm",
-						timeoutPerSec, -float64(r.readReg(REG_RSSITHRES))/2)
-				}
 			}
-			r.rxTimeout = 0
-			r.rssiAdj = time.Now()
+			r.trace(traceThreshold, int(r.readReg(REG_RSSITHRES)), int(timeoutPerSec))
 		}
+		r.rxTimeout = 0
+		r.rssiAdj = time.Now()
 	}
 }
 
-// Transmit switches the radio's mode and starts transmitting a packet.
-func (r *Radio) Transmit(payload []byte) error {
+// SetRSSIThreshold sets the signal strength in dBm above which the receiver starts looking for
+// a packet, the initial threshold is -84dBm. Unless RadioOpts.NoAutoRSSIThreshold is set,
+// Receive tunes the threshold continuously such that the receiver triggers on noise a few times
+// per second, so the threshold drifts away from the value set here and tracks the noise floor.
+// Turning tuning off makes the threshold stick, which is preferable when the noise floor is
+// known or when a strong noise source would otherwise push the threshold up and deafen the
+// receiver to weak nodes.
+func (r *Radio) SetRSSIThreshold(dBm int) {
+	switch {
+	case dBm > 0:
+		dBm = 0
+	case dBm < -127:
+		dBm = -127
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.writeReg(REG_RSSITHRES, byte(-2*dBm))
+	r.log("SetRSSIThreshold %ddBm", dBm)
+	// Restart the timeout accounting so tuning starts out from the new threshold.
+	r.rxTimeout = 0
+	r.rssiAdj = time.Now()
+}
+
+// Stats contains counters that describe the health of the radio link. They count from the time
+// the radio is initialized.
+type Stats struct {
+	Interrupts int // interrupts serviced by Receive
+	RxPackets  int // packets received
+	CRCErrors  int // packets dropped due to a bad CRC
+	RxTimeouts int // receptions abandoned because no packet completed after a signal was detected
+	RxRestarts int // receiver restarts due to the chip's RX timeout
+}
+
+// Stats returns the current link statistics.
+func (r *Radio) Stats() Stats {
+	r.Lock()
+	defer r.Unlock()
+	return r.stats
+}
+
+// Mode is an operating mode of the radio, see Radio.Mode.
+type Mode int
+
+// Operating modes.
+const (
+	ModeUnknown  Mode = iota // not initialized yet or the last mode switch timed out
+	ModeSleep                // asleep, see Sleep
+	ModeStandby              // oscillator running, e.g. while reconfiguring
+	ModeFS                   // frequency synthesizer running, e.g. while switching to TX
+	ModeTransmit             // transmitting a packet
+	ModeReceive              // continuous receive
+	ModeListen               // listen mode, see SetListenMode
+)
+
+var modeNames = []string{"unknown", "sleep", "standby", "FS", "transmit", "receive", "listen"}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return modeNames[m]
+}
+
+// Mode returns the current operating mode of the radio as tracked by the driver, which helps
+// diagnose a radio that is stuck, for example in transmit.
+func (r *Radio) Mode() Mode {
+	r.Lock()
+	defer r.Unlock()
+	if r.listening {
+		return ModeListen
+	}
+	return modeOf(r.mode)
+}
+
+// modeOf returns the Mode corresponding to the mode bits of REG_OPMODE.
+func modeOf(mode byte) Mode {
+	switch mode {
+	case MODE_SLEEP:
+		return ModeSleep
+	case MODE_STANDBY:
+		return ModeStandby
+	case MODE_FS:
+		return ModeFS
+	case MODE_TRANSMIT:
+		return ModeTransmit
+	case MODE_RECEIVE:
+		return ModeReceive
+	default:
+		return ModeUnknown
+	}
+}
+
+// SleepPolicy determines what Transmit does while the radio is asleep.
+type SleepPolicy int
+
+// Sleep policies.
+const (
+	SleepTxError SleepPolicy = iota // Transmit returns ErrAsleep
+	SleepTxWake                     // Transmit wakes the radio, transmits, and goes back to sleep
+)
+
+// ErrAsleep is returned by Transmit if the radio is asleep and the SleepTxError policy is used.
+var ErrAsleep = errors.New("sx1231: radio is asleep")
+
+// Sleep puts the radio into its lowest power mode, in which it doesn't receive. The radio stays
+// asleep until Wake is called, except for packets transmitted under the SleepTxWake policy.
+func (r *Radio) Sleep() {
+	r.Lock()
+	defer r.Unlock()
+	r.log("Sleep")
+	r.asleep = true
+	if r.mode != MODE_TRANSMIT {
+		r.setMode(MODE_SLEEP)
+	} // else txDone puts the radio to sleep when the packet has been sent
+}
+
+// ErrClosed is the persistent error of a radio that has been closed.
+var ErrClosed = errors.New("sx1231: radio is closed")
+
+// Close puts the radio to sleep and releases the interrupt pin and the SPI port, the latter is
+// closed if it is an spi.PortCloser. Afterwards Receive and Transmit fail with ErrClosed, which
+// includes a Receive blocked waiting for an interrupt: it returns within a second. Closing a
+// closed radio does nothing.
+func (r *Radio) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.err == ErrClosed {
+		return nil
+	}
+	r.log("Close")
+	r.setMode(MODE_SLEEP)
+	r.err = ErrClosed
+
+	err := r.intrPin.In(gpio.Float, gpio.NoEdge)
+	if err != nil {
+		err = fmt.Errorf("sx1231: error releasing interrupt pin: %s", err)
+	}
+	if pc, ok := r.port.(spi.PortCloser); ok {
+		if e := pc.Close(); e != nil && err == nil {
+			err = fmt.Errorf("sx1231: error closing SPI port: %s", e)
+		}
+	}
+	return err
+}
+
+// Wake takes the radio out of sleep and makes it receive again.
+func (r *Radio) Wake() {
+	r.Lock()
+	defer r.Unlock()
+	r.log("Wake")
+	r.asleep = false
+	if r.mode != MODE_TRANSMIT {
+		r.setMode(MODE_STANDBY)
+		r.receive()
+	}
+}
+
+// listenResolutions are the timer resolutions available in listen mode with the corresponding
+// ListenResol register values.
+var listenResolutions = []struct {
+	res time.Duration
+	val byte
+}{
+	{64 * time.Microsecond, 1},
+	{4100 * time.Microsecond, 2},
+	{262 * time.Millisecond, 3},
+}
+
+// listenTime returns the ListenResol and ListenCoef register values that most closely produce
+// the duration.
+func listenTime(d time.Duration) (byte, byte, error) {
+	for _, lr := range listenResolutions {
+		coef := (d + lr.res/2) / lr.res
+		switch {
+		case coef == 0:
+			return 0, 0, fmt.Errorf("sx1231: listen time %s too short, min is %s", d, lr.res)
+		case coef <= 255:
+			return lr.val, byte(coef), nil
+		}
+	}
+	max := 255 * listenResolutions[len(listenResolutions)-1].res
+	return 0, 0, fmt.Errorf("sx1231: listen time %s too long, max is %s", d, max)
+}
+
+// SetListenMode switches the receiver to listen mode, in which the chip itself cycles between
+// listening for rxTime and idling for idleTime, which cuts the average current drastically.
+// If a signal above the RSSI threshold is detected the receiver stays on until a packet has been
+// received or the RX timeout expires. Receive handles listen mode transparently and Transmit
+// interrupts it for the duration of the transmission. SetListenMode(0, 0) returns to continuous
+// receive.
+//
+// The times are rounded to the resolution supported by the chip: 64us up to 16ms, 4.1ms up to
+// 1s, and 262ms up to 66s. To receive packets reliably the transmitter's preamble must be longer
+// than idleTime and rxTime must be long enough to measure the RSSI, i.e., a few bit times. The
+// idle timer runs off the chip's RC oscillator, which is only accurate to a few percent.
+//
+// The tradeoff is between current and latency: the receiver draws about 16mA while it listens
+// and 1.2uA while idle, so the average current is roughly 16mA*rxTime/(rxTime+idleTime), while
+// each packet has to be preceded by at least idleTime of preamble, which the transmitter pays
+// for in airtime and current.
+func (r *Radio) SetListenMode(rxTime, idleTime time.Duration) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if rxTime == 0 && idleTime == 0 {
+		r.log("Listen mode off")
+		r.listen = nil
+	} else {
+		rxRes, rxCoef, err := listenTime(rxTime)
+		if err != nil {
+			return err
+		}
+		idleRes, idleCoef, err := listenTime(idleTime)
+		if err != nil {
+			return err
+		}
+		// ListenCriteria: RSSI above threshold, ListenEnd: go to standby after RX.
+		r.listen = []byte{idleRes<<6 | rxRes<<4 | 0x01<<1, idleCoef, rxCoef}
+		r.log("Listen mode rx=%s idle=%s: %#x", rxTime, idleTime, r.listen)
+	}
+	if !r.asleep && r.mode != MODE_TRANSMIT {
+		r.receive()
+	}
+	return nil
+}
+
+// EnterListenMode switches the receiver to listen mode, alternating between idle and rx, see
+// SetListenMode. Note that the idle time comes first, unlike for SetListenMode.
+func (r *Radio) EnterListenMode(idle, rx time.Duration) error {
+	if idle <= 0 || rx <= 0 {
+		return fmt.Errorf("sx1231: invalid listen mode times idle=%s rx=%s", idle, rx)
+	}
+	return r.SetListenMode(rx, idle)
+}
+
+// ExitListenMode returns to continuous receive, see SetListenMode.
+func (r *Radio) ExitListenMode() error {
+	return r.SetListenMode(0, 0)
+}
+
+// errTxBusy is returned by operations that cannot be performed while a packet is being sent.
+var errTxBusy = errors.New("sx1231: transmission in progress")
+
+// Temperature measures the temperature of the chip and returns it in degrees C, corrected by
+// RadioOpts.TempOffset. The measurement needs the receiver to be off, so a reception in progress
+// is lost, and it fails if a transmission is in progress.
+func (r *Radio) Temperature() (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.mode == MODE_TRANSMIT {
+		return 0, errTxBusy
+	}
+
+	mode, listening := r.mode, r.listening
+	r.setMode(MODE_STANDBY)
+	defer r.resume(mode, listening)
+	r.writeReg(REG_TEMP1, TEMPMEASSTART)
+	// The measurement takes less than 100us.
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+		if r.readReg(REG_TEMP1)&TEMPMEASRUN == 0 {
+			// The raw value decreases by one per degree, 165 is the nominal offset.
+			temp := 165 - int(r.readReg(REG_TEMP2)) + r.tempOff
+			r.log("Temperature %dC", temp)
+			return temp, nil
+		}
+	}
+	return 0, errors.New("sx1231: timeout measuring temperature")
+}
+
+// CalibrateRC calibrates the chip's RC oscillator, which times listen mode. The chip calibrates
+// the oscillator when it powers up but its frequency drifts with temperature, so a node that uses
+// listen mode over a wide temperature range should recalibrate occasionally, for example when
+// Temperature reports a significant change. As for Temperature, the receiver is turned off
+// during the calibration, which fails if a transmission is in progress.
+func (r *Radio) CalibrateRC() error {
 	r.Lock()
 	defer r.Unlock()
+	if r.mode == MODE_TRANSMIT {
+		return errTxBusy
+	}
+
+	mode, listening := r.mode, r.listening
+	r.setMode(MODE_STANDBY)
+	defer r.resume(mode, listening)
+	r.writeReg(REG_OSC1, RCCALSTART)
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+		if r.readReg(REG_OSC1)&RCCALDONE != 0 {
+			r.log("RC oscillator calibrated")
+			return nil
+		}
+	}
+	return errors.New("sx1231: timeout calibrating RC oscillator")
+}
+
+// DutyPolicy determines what Transmit does when sending a packet would exceed the duty-cycle
+// limit set using RadioOpts.DutyCycle.
+type DutyPolicy int
+
+// Duty-cycle policies.
+const (
+	DutyWait  DutyPolicy = iota // Transmit waits until the packet fits into the budget
+	DutyError                   // Transmit returns a Temporary error
+)
+
+// TimeOnAir returns the time it takes to transmit a packet with a payload of the given length at
+// the current bit rate and packet format, including preamble, sync bytes, length byte, and CRC.
+// This can be used to keep within duty-cycle limits.
+func (r *Radio) TimeOnAir(payloadLen int) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.timeOnAir(payloadLen)
+}
+
+// timeOnAir implements TimeOnAir.
+func (r *Radio) timeOnAir(payloadLen int) time.Duration {
+	return r.airtime(r.pkt.lenSize() + payloadLen + r.pkt.crcLen())
+}
+
+// airtime returns the time on air of a packet given the number of bytes following the sync
+// bytes.
+func (r *Radio) airtime(data int) time.Duration {
+	if r.rate == 0 {
+		return 0
+	}
+	// The length field, the payload, and the CRC are encoded, manchester doubles their length.
+	if r.pkt.Encoding == Manchester {
+		data *= 2
+	}
+	bytes := r.pkt.preamble() + len(r.sync) + data
+	return time.Duration(bytes*8) * time.Second / time.Duration(r.rate)
+}
+
+// RemainingAirtime returns the airtime left in the duty-cycle budget, which callers can use to
+// back off before Transmit has to delay or refuse packets. Without a duty-cycle limit it returns
+// the max duration.
+func (r *Radio) RemainingAirtime() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if r.duty == nil {
+		return 1<<63 - 1
+	}
+	return r.duty.Remaining(time.Now())
+}
+
+// Timing of transmitWait.
+const (
+	txRetry   = 5 * time.Millisecond // back-off when the radio is busy
+	txMaxWait = time.Second          // max time to wait for a packet to be sent
+)
+
+// TxPacket is a packet to be transmitted together with per-packet transmit options.
+type TxPacket struct {
+	Payload []byte       // payload, from address to last data byte, excluding length & crc
+	Power   int          // output power in dBm, 0 uses the power set using SetPower
+	Done    chan<- error // optional: notified when this packet has been transmitted
+}
+
+// Transmit switches the radio's mode and starts transmitting a packet using the power set using
+// SetPower.
+func (r *Radio) Transmit(payload []byte) error {
+	return r.TransmitPacket(&TxPacket{Payload: payload})
+}
 
-	if r.busy() {
-		return busyError{"radio is busy"}
+// TransmitPacket switches the radio's mode and starts transmitting a packet. If the packet
+// specifies a power level it is applied for the duration of this one packet after which the
+// power set using SetPower is restored. Note that this means 0dBm cannot be requested on a
+// per-packet basis, SetPower(0) has to be used for that.
+//
+// If the packet has a Done channel it receives the result of the transmission once Receive has
+// serviced the TX interrupt: nil if the packet was sent or an error if the radio did not confirm
+// it, the same as RadioOpts.TxDone. This is the moment the packet has left the air, which allows
+// a receive window to be timed precisely. As for TxDone the notification is dropped if the
+// channel is not ready, so it should be buffered. Done is not notified if TransmitPacket returns
+// an error.
+//
+// If a duty cycle is specified in RadioOpts the airtime of all packets sent during the past hour
+// is accounted for and a packet that would exceed the budget is delayed or refused with a
+// Temporary error, depending on RadioOpts.DutyPolicy.
+func (r *Radio) TransmitPacket(pkt *TxPacket) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return r.err
 	}
+
+	payload := pkt.Payload
 	// limit the payload to valid lengths
 	switch {
-	case len(payload) > 65:
-		payload = payload[:65]
+	case len(payload) > r.pkt.maxPayload():
+		payload = payload[:r.pkt.maxPayload()]
 	case len(payload) == 0:
 		return errors.New("invalid payload length")
+	case len(payload) < r.pkt.LenOffset:
+		return fmt.Errorf("sx1231: payload shorter than the length field offset (%d)",
+			r.pkt.LenOffset)
+	}
+
+	for {
+		if r.busy() {
+			return busyError{"radio is busy"}
+		}
+		if r.asleep && r.sleepTx == SleepTxError {
+			return ErrAsleep
+		}
+		if r.duty == nil {
+			break
+		}
+		now := time.Now()
+		air := r.timeOnAir(len(payload))
+		if air > r.duty.Budget() {
+			return fmt.Errorf("sx1231: packet airtime %s exceeds duty-cycle budget %s",
+				air, r.duty.Budget())
+		}
+		wait := r.duty.Wait(now, air)
+		if wait == 0 {
+			r.duty.Record(now, air)
+			break
+		}
+		if r.dutyPolicy == DutyError {
+			return busyError{fmt.Sprintf("duty-cycle budget exhausted, retry in %s", wait)}
+		}
+		// Wait without holding the lock so Receive can run, the radio's state needs to be
+		// checked again afterwards.
+		r.log("Duty-cycle budget exhausted, waiting %s", wait)
+		r.Unlock()
+		time.Sleep(wait)
+		r.Lock()
 	}
 	r.setMode(MODE_FS)
 	//r.writeReg(0x2D, 0x01) // set preamble to 1 (too short)
 	//r.writeReg(0x2F, 0x00) // set wrong sync value
 
 	// push the message into the FIFO.
-	buf := make([]byte, len(payload)+1)
-	buf[0] = byte(len(payload))
-	copy(buf[1:], payload)
+	buf := r.pkt.frame(payload)
 	r.writeReg(REG_FIFO|0x80, buf...)
+	if r.pkt.customLen() {
+		r.writeReg(REG_PAYLOADLEN, byte(len(buf)))
+	}
+	if pkt.Power != 0 && pkt.Power != r.power {
+		r.setPower(pkt.Power)
+	}
 	debugPin.Out(gpio.High)
+	r.trace(traceTx, len(payload), 0)
 	r.setMode(MODE_TRANSMIT)
+	if r.mode != MODE_TRANSMIT {
+		// setMode timed out, there won't be a TX interrupt.
+		debugPin.Out(gpio.Low)
+		r.txEnd()
+		return errors.New("sx1231: timeout switching to transmit mode")
+	}
+	r.txReq = pkt.Done
 	return nil
 }
 
+// transmitWait transmits a packet and waits for it to have been sent, retrying while the radio
+// is busy. It requires Receive to be running in another goroutine to service the TX interrupt.
+func (r *Radio) transmitWait(payload []byte) error {
+	done := make(chan error, 1)
+	for {
+		err := r.TransmitPacket(&TxPacket{Payload: payload, Done: done})
+		if err == nil {
+			break
+		}
+		if _, ok := err.(Temporary); !ok {
+			return err
+		}
+		time.Sleep(txRetry)
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(txMaxWait):
+		return errors.New("sx1231: packet not sent, is Receive running?")
+	}
+}
+
 // txDone handles an interrupt after transmitting.
 func (r *Radio) txDone() {
 	// Double-check that the packet got transmitted.
-	if irq2 := r.readReg(REG_IRQFLAGS2); irq2&IRQ2_PACKETSENT == 0 {
+	var err error
+	irq2 := r.readReg(REG_IRQFLAGS2)
+	r.trace(traceTxDone, int(irq2), 0)
+	if irq2&IRQ2_PACKETSENT == 0 {
 		r.log("TX done interrupt, but packet not transmitted? %#x", irq2)
+		err = fmt.Errorf("sx1231: TX done interrupt, but packet not transmitted (%#x)", irq2)
 	}
+	r.txNotify(err)
 	//r.log("TX done")
-	// Now receive.
-	r.setMode(MODE_RECEIVE)
+	r.txEnd()
+}
+
+// txNotify notifies the client of the result of a transmission without blocking if nobody is
+// listening.
+func (r *Radio) txNotify(err error) {
+	for _, c := range []chan<- error{r.txDoneChan, r.txReq} {
+		if c != nil {
+			select {
+			case c <- err:
+			default:
+			}
+		}
+	}
+	r.txReq = nil
+}
+
+// txEnd returns the radio to its state from before a transmission.
+func (r *Radio) txEnd() {
+	// Restore the default power if the packet used its own.
+	if r.power != r.defPower {
+		r.setMode(MODE_STANDBY)
+		r.setPower(r.defPower)
+	}
+	if r.pkt.customLen() {
+		r.writeReg(REG_PAYLOADLEN, fifoSize) // receive a full FIFO
+	}
+	// Now receive, or go back to sleep if the packet was sent while asleep.
+	if r.asleep {
+		r.setMode(MODE_SLEEP)
+		return
+	}
+	r.receive()
 }
 
 // rx handles a receive interrupt. See the notes in the README about the various
@@ -595,6 +1647,12 @@ func (r *Radio) rx() (*RxPacket, error) {
 	// packet takes 12.3ms.
 	t0 := time.Now()
 	tOut := t0.Add(time.Second * 80 * 8 / time.Duration(r.rate)) // time for 80 bytes
+	if r.pkt.Encoding == Manchester {
+		tOut = tOut.Add(tOut.Sub(t0))
+	}
+	if t := t0.Add(r.rxAbort); t.After(tOut) {
+		tOut = t // the chip's timeout, see RadioOpts.RxTimeout, should trigger first
+	}
 
 	// Helper function to empty FIFO. It's faster to read the whole thing than to first look at
 	// the length.
@@ -608,12 +1666,18 @@ func (r *Radio) rx() (*RxPacket, error) {
 	// Loop until we have the full packet, or things go south. Grab RSSI & AFC after
 	// sync match and only if we can get them before the packet is fully received.
 	var rssi, fei int
+	var done time.Time
 	for {
 		// See whether we have a full packet.
 		irq2 := r.readReg(REG_IRQFLAGS2)
 		if irq2&IRQ2_PAYLOADREADY != 0 {
-			if irq2&IRQ2_CRCOK == 0 {
+			done = time.Now()
+			// With a custom length field the chip checks the CRC over the full FIFO, so
+			// unframe checks it instead.
+			if !r.pkt.NoCRC && !r.pkt.customLen() && irq2&IRQ2_CRCOK == 0 {
 				r.log("Rx bad CRC")
+				r.trace(traceRxCRC, int(irq2), 0)
+				r.stats.CRCErrors++
 				readFifo()
 				return nil, nil
 			}
@@ -625,7 +1689,8 @@ func (r *Radio) rx() (*RxPacket, error) {
 		// Bail out if we're not actually receiving a packet. This happens when the
 		// receiver restarts because RSSI went away or no SYNC was found before timeout.
 		irq1 := r.readReg(REG_IRQFLAGS1)
-		if irq1&(IRQ1_RXREADY|IRQ1_RSSI) != IRQ1_RXREADY|IRQ1_RSSI {
+		chipTimeout := irq1&IRQ1_TIMEOUT != 0
+		if !chipTimeout && irq1&(IRQ1_RXREADY|IRQ1_RSSI) != IRQ1_RXREADY|IRQ1_RSSI {
 			//r.log("... not receiving? IRQ=%t mode=%#02x irq1=%#02x irq2=%02x",
 			//	r.intrPin.Read(), r.readReg(REG_OPMODE), irq1, irq2)
 			return nil, nil
@@ -636,14 +1701,16 @@ func (r *Radio) rx() (*RxPacket, error) {
 			rssi = 0 - int(r.readReg(REG_RSSIVALUE))/2
 			// Get freq error detected, caution: signed 16-bit value.
 			f := int(int16(r.readReg16(REG_AFCMSB)))
-			fei = (f * (32000000 >> 13)) >> 6
+			fei = int(int64(f) * int64(r.fxosc) >> 19)
 		}
-		// Timeout so we don't get stuck here.
-		if time.Now().After(tOut) {
+		// Timeout so we don't get stuck here, either signaled by the chip or measured here.
+		if chipTimeout || time.Now().After(tOut) {
 			//r.log("RX timeout! irq1=%#02x irq2=%02x, rssi=%ddBm fei=%dHz", irq1, irq2,
 			//	0-int(r.readReg(REG_RSSIVALUE))/2,
 			//	(int(int16(r.readReg16(REG_AFCMSB)))*(32000000>>13))>>6)
 			r.rxTimeout++
+			r.stats.RxTimeouts++
+			r.trace(traceRxTimeout, int(irq1), int(irq2))
 			// Make sure the FIFO is empty (not sure this is necessary).
 			if irq2&IRQ2_FIFONOTEMPTY != 0 {
 				//r.log("RX timeout! irq1=%#02x irq2=%02x, rssi=%ddBm afc=%dHz", irq1, irq2,
@@ -664,10 +1731,16 @@ func (r *Radio) rx() (*RxPacket, error) {
 	buf := readFifo()
 
 	// Construct RxPacket and return it.
-	l := buf[0]
-	if l > 65 {
-		r.log("Rx packet too long (%d)", l)
-		return nil, fmt.Errorf("received packet too long (%d)", l)
+	payload, err := r.pkt.unframe(buf)
+	switch {
+	case err == errBadCRC:
+		r.log("Rx bad CRC")
+		r.stats.CRCErrors++
+		r.trace(traceRxCRC, int(r.readReg(REG_IRQFLAGS2)), 0)
+		return nil, nil
+	case err != nil:
+		r.log("Rx %s", err)
+		return nil, err
 	}
 	var snr int
 	if rssi != 0 {
@@ -675,7 +1748,20 @@ func (r *Radio) rx() (*RxPacket, error) {
 		snr = rssi - floor
 		r.log("RX Rssi=%d Floor=%d SNR=%d", rssi, floor, snr)
 	}
-	return &RxPacket{Payload: buf[1 : 1+l], Rssi: rssi, Snr: snr, Fei: fei}, nil
+	r.stats.RxPackets++
+	r.trace(traceRxPacket, len(payload), rssi)
+	if rssi != 0 {
+		r.trackFEI(fei)
+	}
+	if r.scan != nil {
+		r.scan.since = done // dwell on the rate for a reply
+	}
+	air := r.timeOnAir(len(payload))
+	if r.pkt.customLen() {
+		air = r.airtime(fifoSize + r.pkt.crcLen()) // the full FIFO has been received
+	}
+	return &RxPacket{Payload: payload, Rssi: rssi, Snr: snr, Fei: fei, Rate: r.rate,
+		At: done.Add(-air)}, nil
 }
 
 // logRegs is a debug helper function to print almost all the sx1231's registers.
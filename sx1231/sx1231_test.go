@@ -0,0 +1,743 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tve/devices/devicestest"
+	"periph.io/x/periph/conn"
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/spi"
+)
+
+// fakeSPI simulates the sx1231 register file. Mode changes, temperature measurements, and RC
+// calibrations complete instantly and the FIFO contents written are recorded. Packets queued in
+// rx, including their length byte, are read from the FIFO one after the other.
+type fakeSPI struct {
+	regs [0x80]byte
+	fifo []byte
+	rx   [][]byte
+}
+
+func (f *fakeSPI) Tx(w, r []byte) error {
+	addr := w[0] & 0x7f
+	data := w[1:]
+	switch {
+	case addr == REG_FIFO && w[0]&0x80 != 0:
+		f.fifo = append(f.fifo, data...)
+	case addr == REG_FIFO:
+		if len(f.rx) > 0 {
+			copy(r[1:], f.rx[0])
+			f.rx = f.rx[1:]
+		}
+	case w[0]&0x80 != 0:
+		copy(f.regs[addr:], data)
+		switch addr {
+		case REG_TEMP1:
+			f.regs[REG_TEMP1] &^= TEMPMEASSTART
+		case REG_OSC1:
+			f.regs[REG_OSC1] = RCCALDONE
+		}
+	default:
+		copy(r[1:], f.regs[addr:])
+		switch {
+		case addr == REG_IRQFLAGS1:
+			r[1] |= IRQ1_MODEREADY
+		case addr == REG_IRQFLAGS2 && len(f.rx) > 0:
+			r[1] |= IRQ2_PAYLOADREADY | IRQ2_CRCOK
+		}
+	}
+	return nil
+}
+
+func (f *fakeSPI) Duplex() conn.Duplex            { return conn.Full }
+func (f *fakeSPI) TxPackets(p []spi.Packet) error { return nil }
+
+// fakePin is an interrupt pin that returns the scripted levels, the last one sticks, unless high
+// returns true. Waiting for an edge returns the result of edge, or times out immediately if it's
+// nil.
+type fakePin struct {
+	gpio.PinIn
+	levels []gpio.Level
+	edge   func() bool
+	high   func() bool
+}
+
+func (p *fakePin) In(pull gpio.Pull, edge gpio.Edge) error { return nil }
+func (p *fakePin) Number() int                             { return 0 }
+
+func (p *fakePin) Read() gpio.Level {
+	if p.high != nil && p.high() {
+		return gpio.High
+	}
+	l := p.levels[0]
+	if len(p.levels) > 1 {
+		p.levels = p.levels[1:]
+	}
+	return l
+}
+
+func (p *fakePin) WaitForEdge(timeout time.Duration) bool {
+	return p.edge != nil && p.edge()
+}
+
+// newFakeRadio returns a Radio in receive mode connected to a fakeSPI.
+func newFakeRadio(t *testing.T, opts RadioOpts) (*Radio, *fakeSPI) {
+	f := &fakeSPI{}
+	r := &Radio{spi: f, mode: 255, rate: 50000, fxosc: defFxosc, sleepTx: opts.SleepTx,
+		log: t.Logf}
+	r.setMode(MODE_RECEIVE)
+	return r, f
+}
+
+// opMode returns the mode the fake radio has been put into.
+func (f *fakeSPI) opMode() byte { return f.regs[REG_OPMODE] & 0x1c }
+
+func TestSleepWake(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.Sleep()
+	if f.opMode() != MODE_SLEEP {
+		t.Fatalf("expected sleep mode, got %#x", f.opMode())
+	}
+	if err := r.Transmit([]byte{1, 2, 3}); err != ErrAsleep {
+		t.Errorf("expected ErrAsleep, got %v", err)
+	}
+	if f.opMode() != MODE_SLEEP || len(f.fifo) != 0 {
+		t.Errorf("radio woke up or transmitted: mode %#x, fifo %v", f.opMode(), f.fifo)
+	}
+	r.Wake()
+	if f.opMode() != MODE_RECEIVE {
+		t.Errorf("expected receive mode, got %#x", f.opMode())
+	}
+}
+
+// closingPort is an SPI port that records whether it has been closed.
+type closingPort struct {
+	spi.PortCloser
+	closed bool
+}
+
+func (p *closingPort) Close() error { p.closed = true; return nil }
+
+func TestClose(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	port := &closingPort{}
+	r.port, r.intrPin = port, &fakePin{levels: []gpio.Level{gpio.Low}}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.opMode() != MODE_SLEEP || !port.closed {
+		t.Errorf("expected sleep mode and a closed port, got mode %#x", f.opMode())
+	}
+	if _, err := r.Receive(); err != ErrClosed {
+		t.Errorf("expected Receive to fail with ErrClosed, got %v", err)
+	}
+	if err := r.Transmit([]byte{1, 2, 3}); err != ErrClosed {
+		t.Errorf("expected Transmit to fail with ErrClosed, got %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("closing again: %v", err)
+	}
+}
+
+func TestMode(t *testing.T) {
+	r, _ := newFakeRadio(t, RadioOpts{})
+	if m := r.Mode(); m != ModeReceive {
+		t.Errorf("expected %s, got %s", ModeReceive, m)
+	}
+	r.Sleep()
+	if m := r.Mode(); m != ModeSleep {
+		t.Errorf("expected %s, got %s", ModeSleep, m)
+	}
+	r.Wake()
+	if err := r.SetListenMode(10*time.Millisecond, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if m := r.Mode(); m != ModeListen {
+		t.Errorf("expected %s, got %s", ModeListen, m)
+	}
+	if err := r.Transmit([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if m := r.Mode(); m != ModeTransmit {
+		t.Errorf("expected %s, got %s", ModeTransmit, m)
+	}
+	if s := Mode(42).String(); s != "Mode(42)" {
+		t.Errorf("unexpected name %q", s)
+	}
+}
+
+func TestSleepTxWake(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{SleepTx: SleepTxWake})
+	r.Sleep()
+	if err := r.Transmit([]byte{1, 2, 3}); err != nil {
+		t.Fatalf("Transmit: %s", err)
+	}
+	if f.opMode() != MODE_TRANSMIT || len(f.fifo) != 4 {
+		t.Fatalf("expected transmission: mode %#x, fifo %v", f.opMode(), f.fifo)
+	}
+	// Complete the transmission, the radio must go back to sleep.
+	f.regs[REG_IRQFLAGS2] |= IRQ2_PACKETSENT
+	r.txDone()
+	if f.opMode() != MODE_SLEEP {
+		t.Errorf("expected sleep mode after TX, got %#x", f.opMode())
+	}
+	// Without sleep the radio returns to receive mode.
+	r.Wake()
+	if err := r.Transmit([]byte{1, 2, 3}); err != nil {
+		t.Fatalf("Transmit: %s", err)
+	}
+	r.txDone()
+	if f.opMode() != MODE_RECEIVE {
+		t.Errorf("expected receive mode after TX, got %#x", f.opMode())
+	}
+}
+
+func TestApplyRate(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.SetRate(49230)
+	if rate, params := r.CurrentRate(); rate != 49230 || params != Rates[49230] {
+		t.Errorf("CurrentRate after SetRate: got %d %+v", rate, params)
+	}
+
+	custom := Rate{Fdev: 20000, Shaping: 2, RxBw: 0x53, AfcBw: 0x52}
+	r.ApplyRate(19200, custom)
+	if rate, params := r.CurrentRate(); rate != 19200 || params != custom {
+		t.Errorf("CurrentRate after ApplyRate: got %d %+v", rate, params)
+	}
+	if br := int(f.regs[REG_BITRATEMSB])<<8 | int(f.regs[REG_BITRATEMSB+1]); br != 1667 {
+		t.Errorf("expected bitrate divider 1667, got %d", br)
+	}
+	if f.regs[REG_DATAMODUL] != 2 || f.regs[REG_RXBW] != 0x53 || f.regs[REG_AFCBW] != 0x52 {
+		t.Errorf("rate registers not programmed: %#x %#x %#x",
+			f.regs[REG_DATAMODUL], f.regs[REG_RXBW], f.regs[REG_AFCBW])
+	}
+}
+
+func TestSetPower(t *testing.T) {
+	for _, tc := range []struct {
+		paBoost   bool
+		dBm, want int
+		paLevel   byte
+	}{
+		{false, 0, 0, 0x80 + 18},
+		{false, -18, -18, 0x80},
+		{false, -30, -18, 0x80},
+		{false, 13, 13, 0x80 + 31},
+		{false, 17, 13, 0x80 + 31},
+		{true, -5, -2, 0x40 + 16},
+		{true, 13, 13, 0x40 + 31},
+		{true, 17, 17, 0x60 + 31},
+		{true, 20, 20, 0x60 + 31},
+		{true, 25, 20, 0x60 + 31},
+	} {
+		r, f := newFakeRadio(t, RadioOpts{})
+		r.paBoost = tc.paBoost
+		got, err := r.SetPower(tc.dBm)
+		if got != tc.want {
+			t.Errorf("SetPower(%d) boost=%v: got %d expected %d", tc.dBm, tc.paBoost, got, tc.want)
+		}
+		if _, ok := err.(PowerRangeError); ok != (tc.dBm != tc.want) {
+			t.Errorf("SetPower(%d) boost=%v: unexpected error %v", tc.dBm, tc.paBoost, err)
+		}
+		if got := r.Power(); got != tc.want {
+			t.Errorf("Power() after SetPower(%d): got %d expected %d", tc.dBm, got, tc.want)
+		}
+		if f.regs[REG_PALEVEL] != tc.paLevel {
+			t.Errorf("SetPower(%d) boost=%v: PALEVEL %#x expected %#x",
+				tc.dBm, tc.paBoost, f.regs[REG_PALEVEL], tc.paLevel)
+		}
+	}
+}
+
+func TestListenMode(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	for _, tc := range []struct{ rx, idle time.Duration }{
+		{10 * time.Microsecond, time.Second},
+		{time.Millisecond, 70 * time.Second},
+	} {
+		if err := r.SetListenMode(tc.rx, tc.idle); err == nil {
+			t.Errorf("SetListenMode(%s, %s): expected error", tc.rx, tc.idle)
+		}
+	}
+	if f.opMode() != MODE_RECEIVE || f.regs[REG_OPMODE]&LISTEN_ON != 0 {
+		t.Fatalf("invalid listen mode changed the mode: %#x", f.regs[REG_OPMODE])
+	}
+
+	if err := r.SetListenMode(time.Millisecond, 500*time.Millisecond); err != nil {
+		t.Fatalf("SetListenMode: %s", err)
+	}
+	// 1ms = 16*64us, 500ms = 122*4.1ms
+	want := []byte{2<<6 | 1<<4 | 1<<1, 122, 16}
+	if got := f.regs[REG_LISTEN1 : REG_LISTEN1+3]; !bytes.Equal(got, want) {
+		t.Errorf("expected listen registers %#x, got %#x", want, got)
+	}
+	if f.regs[REG_OPMODE] != LISTEN_ON|MODE_STANDBY || !r.listening {
+		t.Fatalf("expected listen mode, got %#x", f.regs[REG_OPMODE])
+	}
+
+	// Transmitting aborts listen mode and resumes it afterwards.
+	if err := r.Transmit([]byte{1, 2, 3}); err != nil {
+		t.Fatalf("Transmit: %s", err)
+	}
+	if f.regs[REG_OPMODE] != MODE_TRANSMIT || r.listening {
+		t.Fatalf("expected transmit mode, got %#x", f.regs[REG_OPMODE])
+	}
+	f.regs[REG_IRQFLAGS2] |= IRQ2_PACKETSENT
+	r.txDone()
+	if f.regs[REG_OPMODE] != LISTEN_ON|MODE_STANDBY {
+		t.Errorf("expected listen mode after TX, got %#x", f.regs[REG_OPMODE])
+	}
+
+	// Configuration changes keep listen mode.
+	r.SetPower(10)
+	if f.regs[REG_OPMODE] != LISTEN_ON|MODE_STANDBY {
+		t.Errorf("expected listen mode after SetPower, got %#x", f.regs[REG_OPMODE])
+	}
+
+	// Sleep and Wake.
+	r.Sleep()
+	if f.regs[REG_OPMODE] != MODE_SLEEP {
+		t.Errorf("expected sleep mode, got %#x", f.regs[REG_OPMODE])
+	}
+	r.Wake()
+	if f.regs[REG_OPMODE] != LISTEN_ON|MODE_STANDBY {
+		t.Errorf("expected listen mode after Wake, got %#x", f.regs[REG_OPMODE])
+	}
+
+	// Back to continuous receive.
+	if err := r.SetListenMode(0, 0); err != nil {
+		t.Fatalf("SetListenMode: %s", err)
+	}
+	if f.regs[REG_OPMODE] != MODE_RECEIVE || r.listening {
+		t.Errorf("expected receive mode, got %#x", f.regs[REG_OPMODE])
+	}
+}
+
+func TestEnterListenMode(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	if err := r.EnterListenMode(0, time.Millisecond); err == nil {
+		t.Error("expected an error for a zero idle time")
+	}
+	if err := r.EnterListenMode(500*time.Millisecond, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{2<<6 | 1<<4 | 1<<1, 122, 16}
+	if got := f.regs[REG_LISTEN1 : REG_LISTEN1+3]; !bytes.Equal(got, want) {
+		t.Errorf("expected listen registers %#x, got %#x", want, got)
+	}
+	if f.regs[REG_OPMODE] != LISTEN_ON|MODE_STANDBY || !r.listening {
+		t.Fatalf("expected listen mode, got %#x", f.regs[REG_OPMODE])
+	}
+	if err := r.ExitListenMode(); err != nil {
+		t.Fatal(err)
+	}
+	if f.regs[REG_OPMODE] != MODE_RECEIVE || r.listening {
+		t.Errorf("expected receive mode, got %#x", f.regs[REG_OPMODE])
+	}
+}
+
+func TestStats(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+
+	// Good packet.
+	f.regs[REG_IRQFLAGS2] = IRQ2_PAYLOADREADY | IRQ2_CRCOK
+	if pkt, err := r.rx(); pkt == nil || err != nil {
+		t.Fatalf("expected packet, got %+v, err %v", pkt, err)
+	}
+	// Bad CRC.
+	f.regs[REG_IRQFLAGS2] = IRQ2_PAYLOADREADY
+	if pkt, err := r.rx(); pkt != nil || err != nil {
+		t.Fatalf("expected CRC error, got %+v, err %v", pkt, err)
+	}
+	// Signal detected but no packet.
+	f.regs[REG_IRQFLAGS2] = 0
+	f.regs[REG_IRQFLAGS1] = IRQ1_RXREADY | IRQ1_RSSI
+	if pkt, err := r.rx(); pkt != nil || err != nil {
+		t.Fatalf("expected timeout, got %+v, err %v", pkt, err)
+	}
+
+	want := Stats{RxPackets: 1, CRCErrors: 1, RxTimeouts: 1}
+	if got := r.Stats(); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestRxTimeout(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.ApplyRate(50000, Rates[50000])
+	if f.regs[REG_RXTIMEOUT2] != defRxTimeout {
+		t.Errorf("expected default RX timeout, got %#x", f.regs[REG_RXTIMEOUT2])
+	}
+	r.rxAbort = time.Second
+	r.ApplyRate(50000, Rates[50000])
+	if f.regs[REG_RXTIMEOUT2] != 255 {
+		t.Errorf("expected RX timeout to be limited to 255, got %d", f.regs[REG_RXTIMEOUT2])
+	}
+	r.rxAbort = 10 * time.Millisecond
+	r.ApplyRate(50000, Rates[50000])
+	if f.regs[REG_RXTIMEOUT2] != 32 { // 10ms in units of 16 bits at 50kbps, rounded up
+		t.Errorf("expected RX timeout of 32, got %d", f.regs[REG_RXTIMEOUT2])
+	}
+	if err := r.VerifyConfig(); err != nil && strings.Contains(err.Error(), "0x2b:") {
+		t.Errorf("RX timeout flagged as drifted: %s", err)
+	}
+
+	// The chip's timeout aborts the reception well before the software timeout.
+	r.rxAbort = time.Second
+	f.regs[REG_IRQFLAGS1] = IRQ1_RXREADY | IRQ1_RSSI | IRQ1_TIMEOUT
+	f.regs[REG_PKTCONFIG2] = 0
+	t0 := time.Now()
+	if pkt, err := r.rx(); pkt != nil || err != nil {
+		t.Fatalf("expected timeout, got %+v, err %v", pkt, err)
+	}
+	if d := time.Since(t0); d > 100*time.Millisecond {
+		t.Errorf("chip timeout took %s to be handled", d)
+	}
+	if f.regs[REG_PKTCONFIG2] != 0x16 || r.Stats().RxTimeouts != 1 {
+		t.Errorf("expected receiver restart, PKTCONFIG2 %#x, stats %+v",
+			f.regs[REG_PKTCONFIG2], r.Stats())
+	}
+}
+
+func TestRSSIThreshold(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.SetRSSIThreshold(-90)
+	if th := f.regs[REG_RSSITHRES]; th != 180 {
+		t.Fatalf("expected threshold register 180, got %d", th)
+	}
+
+	// No timeouts for a while: auto tuning lowers the threshold.
+	r.rssiAdj = time.Now().Add(-11 * time.Second)
+	r.tuneThreshold()
+	if th := f.regs[REG_RSSITHRES]; th != 181 {
+		t.Errorf("expected threshold to be lowered to 181, got %d", th)
+	}
+
+	// With tuning turned off Receive leaves the threshold alone.
+	r, f = newFakeRadio(t, RadioOpts{})
+	r.noAutoTh = true
+	// Receive times out once, which is when it tunes, and then services the packet.
+	r.intrPin = &fakePin{levels: []gpio.Level{gpio.Low, gpio.Low, gpio.Low, gpio.High}}
+	r.SetRSSIThreshold(-90)
+	r.rssiAdj = time.Now().Add(-11 * time.Second)
+	f.regs[REG_IRQFLAGS2] = IRQ2_PAYLOADREADY | IRQ2_CRCOK
+	if pkt, err := r.Receive(); pkt == nil || err != nil {
+		t.Fatalf("expected packet, got %+v, err %v", pkt, err)
+	}
+	if th := f.regs[REG_RSSITHRES]; th != 180 {
+		t.Errorf("expected threshold register to stay at 180, got %d", th)
+	}
+}
+
+func TestTemperature(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.tempOff = -2
+	f.regs[REG_TEMP2] = 140
+	if temp, err := r.Temperature(); temp != 23 || err != nil {
+		t.Errorf("expected 23C, got %dC, err %v", temp, err)
+	}
+	if f.opMode() != MODE_RECEIVE {
+		t.Errorf("expected receive mode to be restored, got %#x", f.opMode())
+	}
+
+	if err := r.CalibrateRC(); err != nil {
+		t.Errorf("calibration failed: %v", err)
+	}
+
+	// Listen mode is restored.
+	if err := r.SetListenMode(time.Millisecond, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CalibrateRC(); err != nil {
+		t.Errorf("calibration failed: %v", err)
+	}
+	if !r.listening || f.regs[REG_OPMODE] != LISTEN_ON|MODE_STANDBY {
+		t.Errorf("expected listen mode to be restored, got %#x", f.regs[REG_OPMODE])
+	}
+
+	// Neither may interrupt a transmission.
+	r.setMode(MODE_TRANSMIT)
+	if _, err := r.Temperature(); err != errTxBusy {
+		t.Errorf("expected errTxBusy, got %v", err)
+	}
+	if err := r.CalibrateRC(); err != errTxBusy {
+		t.Errorf("expected errTxBusy, got %v", err)
+	}
+	if f.opMode() != MODE_TRANSMIT {
+		t.Errorf("transmission was interrupted, mode %#x", f.opMode())
+	}
+}
+
+func TestReset(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.sync = []byte{0x2d, 0x06}
+	r.SetRate(50000)
+	r.SetFrequency(868300000)
+	r.SetPower(10)
+	if err := r.SetListenMode(time.Millisecond, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// The interrupt test maps DIO0 to the PLL lock in FS mode.
+	r.intrPin = &fakePin{
+		levels: []gpio.Level{gpio.Low},
+		edge:   func() bool { return f.regs[REG_DIOMAPPING1] == DIO_MAPPING+0xC0 },
+	}
+	want := f.regs
+
+	// Corrupt the registers and reset.
+	f.regs = [0x80]byte{}
+	if err := r.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	for _, reg := range []byte{REG_BITRATEMSB, REG_FRFMSB, REG_FRFMSB + 1, REG_FRFMSB + 2,
+		REG_PALEVEL, REG_LISTEN1, REG_LISTEN2, REG_LISTEN3} {
+		if f.regs[reg] != want[reg] {
+			t.Errorf("register %#x: expected %#x, got %#x", reg, want[reg], f.regs[reg])
+		}
+	}
+	if !bytes.Equal(f.regs[REG_SYNCVALUE1:REG_SYNCVALUE1+2], r.sync) {
+		t.Errorf("expected sync bytes %#x, got %#x", r.sync, f.regs[REG_SYNCVALUE1:][:2])
+	}
+	if !r.listening || f.regs[REG_OPMODE] != LISTEN_ON|MODE_STANDBY {
+		t.Errorf("expected listen mode, got %#x", f.regs[REG_OPMODE])
+	}
+	if err := r.VerifyConfig(); err != nil {
+		t.Errorf("config does not verify after reset: %v", err)
+	}
+
+	// The interrupt test must work.
+	r.intrPin = &fakePin{levels: []gpio.Level{gpio.Low}}
+	if err := r.Reset(); err == nil {
+		t.Errorf("expected reset to fail without interrupts")
+	}
+
+	// Reset refuses to run concurrently with Receive.
+	r.rxActive = true
+	if err := r.Reset(); err == nil {
+		t.Errorf("expected reset to fail while receiving")
+	}
+}
+
+func TestTxPacketDone(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	all := make(chan error, 2)
+	r.txDoneChan = all
+
+	done := make(chan error, 1)
+	if err := r.TransmitPacket(&TxPacket{Payload: []byte{1, 2, 3}, Done: done}); err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 0 {
+		t.Fatalf("Done notified before the packet was sent")
+	}
+	f.regs[REG_IRQFLAGS2] = IRQ2_PACKETSENT
+	r.txDone()
+	if err := <-done; err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if err := <-all; err != nil {
+		t.Errorf("expected success on TxDone, got %v", err)
+	}
+
+	// The next packet fails and doesn't have its own channel.
+	if err := r.Transmit([]byte{4, 5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	f.regs[REG_IRQFLAGS2] = 0
+	r.txDone()
+	if err := <-all; err == nil {
+		t.Errorf("expected an error on TxDone")
+	}
+	if len(done) != 0 {
+		t.Errorf("previous packet's Done was notified again")
+	}
+}
+
+// newSimRadio returns a simulated chip and interrupt pin for testing New. The chip raises the
+// interrupt when the driver maps DIO0 to ModeReady in FS mode for the interrupt test, as long as
+// intr returns true.
+func newSimRadio(intr func() bool) (*devicestest.Port, *devicestest.SPI, *devicestest.Pin) {
+	s := devicestest.NewSPI()
+	s.SetFIFO(REG_FIFO)
+	s.SetReg(REG_IRQFLAGS1, IRQ1_MODEREADY)
+	pin := devicestest.NewPin("GPIO7", 7)
+	s.OnWrite(REG_DIOMAPPING1, func(v byte) {
+		if v == DIO_MAPPING+0xC0 && s.Reg(REG_OPMODE)&0x1c == MODE_FS && intr() {
+			pin.Trigger(gpio.High)
+		} else {
+			pin.Set(gpio.Low)
+		}
+	})
+	return &devicestest.Port{Conn: s}, s, pin
+}
+
+var simOpts = RadioOpts{Sync: []byte{0x2d, 0x06}, Freq: 912500, Rate: 50000}
+
+func TestNewSync(t *testing.T) {
+	// The chip returns garbage the first two times, New keeps trying.
+	port, s, pin := newSimRadio(func() bool { return true })
+	s.Respond(REG_SYNCVALUE1, 0x00, 0xff)
+	if _, err := New(port, pin, simOpts); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0x55, 0x55}
+	if got := s.Written(REG_SYNCVALUE1)[:len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("expected sync pattern writes %x, got %x", want, got)
+	}
+	if port.MaxHz != 4000000 || port.Mode != spi.Mode0 || port.Bits != 8 {
+		t.Errorf("unexpected SPI params %+v", port)
+	}
+
+	// The chip never responds.
+	port, s, pin = newSimRadio(func() bool { return true })
+	s.Respond(REG_SYNCVALUE1, make([]byte, 10)...)
+	if _, err := New(port, pin, simOpts); err == nil || !strings.Contains(err.Error(), "sync") {
+		t.Errorf("expected sync error, got %v", err)
+	}
+}
+
+func TestNewInterrupt(t *testing.T) {
+	// The first interrupt test fails, the retry succeeds.
+	tests := 0
+	port, _, pin := newSimRadio(func() bool { tests++; return tests > 1 })
+	if _, err := New(port, pin, simOpts); err != nil {
+		t.Fatal(err)
+	}
+	if tests != 2 || pin.Edge() != gpio.RisingEdge {
+		t.Errorf("expected 2 interrupt tests on the rising edge, got %d on %s", tests, pin.Edge())
+	}
+
+	// The interrupt doesn't work.
+	port, _, pin = newSimRadio(func() bool { return false })
+	if _, err := New(port, pin, simOpts); err == nil || !strings.Contains(err.Error(), "gpio7") {
+		t.Errorf("expected interrupt error, got %v", err)
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	port, s, pin := newSimRadio(func() bool { return true })
+	r, err := New(port, pin, simOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(configRegs)-1; i += 2 {
+		addr, value := configRegs[i], configRegs[i+1]
+		if !bytes.Contains(s.Written(addr), []byte{value}) {
+			t.Errorf("register %#x: expected %#x to be written, got %x", addr, value,
+				s.Written(addr))
+		}
+	}
+	sync := []byte{s.Reg(REG_SYNCCONFIG), s.Reg(REG_SYNCVALUE1), s.Reg(REG_SYNCVALUE1 + 1)}
+	if !bytes.Equal(sync, []byte{0x88, 0x2d, 0x06}) {
+		t.Errorf("unexpected sync config %x", sync)
+	}
+	frf := []byte{s.Reg(REG_FRFMSB), s.Reg(REG_FRFMSB + 1), s.Reg(REG_FRFMSB + 2)}
+	if want := frfRegs(912500000, defFxosc); !bytes.Equal(frf, want) {
+		t.Errorf("expected FRF %x, got %x", want, frf)
+	}
+	if rate, _ := r.CurrentRate(); rate != 50000 || r.Frequency() != 912500000 {
+		t.Errorf("unexpected rate %d or frequency %d", rate, r.Frequency())
+	}
+	if m := s.Reg(REG_OPMODE) & 0x1c; m != MODE_RECEIVE || r.Mode() != ModeReceive {
+		t.Errorf("expected the radio to be receiving, got mode %#x", m)
+	}
+}
+
+func TestFxosc(t *testing.T) {
+	for _, tc := range []struct {
+		fxosc, freq uint32
+		frf, rate   []byte
+	}{
+		{0, 915000000, []byte{0xe4, 0xc0, 0x00}, []byte{0x02, 0x80}},
+		{32000000, 868300000, []byte{0xd9, 0x13, 0x33}, []byte{0x02, 0x80}},
+		{30000000, 915000000, []byte{0xf4, 0x00, 0x00}, []byte{0x02, 0x58}},
+		{30000000, 868300000, []byte{0xe7, 0x8b, 0xf2}, []byte{0x02, 0x58}},
+	} {
+		port, s, pin := newSimRadio(func() bool { return true })
+		opts := simOpts
+		opts.Freq, opts.Fxosc = tc.freq, tc.fxosc
+		r, err := New(port, pin, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frf := []byte{s.Reg(REG_FRFMSB), s.Reg(REG_FRFMSB + 1), s.Reg(REG_FRFMSB + 2)}
+		rate := []byte{s.Reg(REG_BITRATEMSB), s.Reg(REG_BITRATEMSB + 1)}
+		if !bytes.Equal(frf, tc.frf) || !bytes.Equal(rate, tc.rate) {
+			t.Errorf("%dHz at %dHz: expected FRF %x and bit rate %x, got %x and %x", tc.freq,
+				tc.fxosc, tc.frf, tc.rate, frf, rate)
+		}
+		if err := r.VerifyConfig(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPacketOptions(t *testing.T) {
+	port, s, pin := newSimRadio(func() bool { return true })
+	opts := simOpts
+	opts.PacketOpts = PacketOpts{Preamble: 3, Encoding: Manchester}
+	r, err := New(port, pin, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs := []byte{s.Reg(REG_PREAMBLEMSB), s.Reg(REG_PREAMBLELSB), s.Reg(REG_PKTCONFIG1)}
+	if !bytes.Equal(regs, []byte{0x00, 0x03, 0xB8}) {
+		t.Errorf("unexpected preamble and packet config %x", regs)
+	}
+	if v := s.Reg(REG_RXTIMEOUT2); v != 2*defRxTimeout {
+		t.Errorf("expected RX timeout %#x with manchester, got %#x", 2*defRxTimeout, v)
+	}
+	if err := r.VerifyConfig(); err != nil {
+		t.Error(err)
+	}
+	// 3 preamble + 2 sync + 2*(1 length + 10 payload + 2 crc) = 31 bytes at 50kbps.
+	if d := r.TimeOnAir(10); d != 4960*time.Microsecond {
+		t.Errorf("expected time on air of 4.96ms, got %s", d)
+	}
+
+	opts.PacketOpts = PacketOpts{Preamble: 300, Encoding: NoEncoding, NoCRC: true}
+	if err := r.SetPacketOptions(opts.PacketOpts); err != nil {
+		t.Fatal(err)
+	}
+	regs = []byte{s.Reg(REG_PREAMBLEMSB), s.Reg(REG_PREAMBLELSB), s.Reg(REG_PKTCONFIG1)}
+	if !bytes.Equal(regs, []byte{0x01, 0x2C, 0x88}) {
+		t.Errorf("unexpected preamble and packet config %x", regs)
+	}
+	if m := s.Reg(REG_OPMODE) & 0x1c; m != MODE_RECEIVE {
+		t.Errorf("expected the radio to be receiving, got mode %#x", m)
+	}
+	if err := r.VerifyConfig(); err != nil {
+		t.Error(err)
+	}
+
+	for _, o := range []PacketOpts{{Preamble: -1}, {Preamble: 0x10000}, {Encoding: 3}} {
+		if err := r.SetPacketOptions(o); err == nil {
+			t.Errorf("%+v: expected an error", o)
+		}
+	}
+}
+
+func TestRxPacketAt(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.pkt.NoCRC = true
+
+	// Without CRC the packet is accepted even though the CRC OK flag isn't set.
+	// The FIFO holds an empty packet.
+	f.regs[REG_IRQFLAGS2] = IRQ2_PAYLOADREADY
+	before := time.Now()
+	pkt, err := r.rx()
+	if pkt == nil || err != nil {
+		t.Fatalf("expected packet, got %+v, err %v", pkt, err)
+	}
+	// 5 preamble + 0 sync + 1 length = 6 bytes at 50kbps.
+	air := 960 * time.Microsecond
+	if pkt.At.Before(before.Add(-air)) || pkt.At.After(time.Now().Add(-air)) {
+		t.Errorf("expected the packet to start %s before it was received, got %s before",
+			air, time.Since(pkt.At))
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// traceKind is the type of an event recorded in the trace, see RadioOpts.Trace.
+type traceKind byte
+
+const (
+	traceMode      traceKind = iota // mode reached: a=Mode
+	traceIntr                       // interrupt being serviced: a=irq1, b=irq2
+	traceMissed                     // WaitForEdge timed out with the interrupt active: a, b=irqs
+	traceRestart                    // receiver restarted after a chip timeout: a, b=irqs
+	traceRxTimeout                  // packet not received in time: a, b=irqs
+	traceRxCRC                      // packet with bad CRC: a=irq2
+	traceRxPacket                   // packet received: a=length, b=rssi
+	traceTx                         // transmission started: a=length
+	traceTxDone                     // transmission done: a=irq2
+	traceThreshold                  // RSSI threshold adjusted: a=REG_RSSITHRES, b=timeouts/sec
+)
+
+var traceNames = [...]string{"mode", "intr", "missed", "restart", "rx-timeout", "rx-crc",
+	"rx", "tx", "tx-done", "threshold"}
+
+// traceEvent is an event recorded in the trace, it doesn't hold any pointer other than the
+// time's location so recording an event doesn't allocate.
+type traceEvent struct {
+	at   time.Time
+	kind traceKind
+	a, b int
+}
+
+// traceRing is a fixed-size ring of trace events.
+type traceRing struct {
+	events []traceEvent
+	n      int // number of events recorded since the start
+}
+
+// trace records an event if tracing is on, it must be called with the mutex held.
+func (r *Radio) trace(kind traceKind, a, b int) {
+	t := r.tr
+	if t == nil {
+		return
+	}
+	t.events[t.n%len(t.events)] = traceEvent{at: time.Now(), kind: kind, a: a, b: b}
+	t.n++
+}
+
+// traceIRQ records an event with a snapshot of the IRQ flags if tracing is on, which costs two
+// register reads, it must be called with the mutex held.
+func (r *Radio) traceIRQ(kind traceKind) {
+	if r.tr != nil {
+		r.trace(kind, int(r.readReg(REG_IRQFLAGS1)), int(r.readReg(REG_IRQFLAGS2)))
+	}
+}
+
+// DumpTrace prints the events recorded in the trace enabled using RadioOpts.Trace to w, oldest
+// first, with the time since the previous event. It prints nothing if tracing is off.
+func (r *Radio) DumpTrace(w io.Writer) error {
+	r.Lock()
+	defer r.Unlock()
+	t := r.tr
+	if t == nil {
+		return nil
+	}
+	first := 0
+	if t.n > len(t.events) {
+		first = t.n - len(t.events)
+	}
+	var prev time.Time
+	for i := first; i < t.n; i++ {
+		ev := t.events[i%len(t.events)]
+		dt := time.Duration(0)
+		if i > first {
+			dt = ev.at.Sub(prev)
+		}
+		prev = ev.at
+		_, err := fmt.Fprintf(w, "%s %+10.3fms %-10s %s\n", ev.at.Format("15:04:05.000000"),
+			float64(dt)/float64(time.Millisecond), traceNames[ev.kind], ev.details())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// details formats the arguments of an event according to its kind.
+func (ev traceEvent) details() string {
+	switch ev.kind {
+	case traceMode:
+		return Mode(ev.a).String()
+	case traceIntr, traceMissed, traceRestart, traceRxTimeout:
+		return fmt.Sprintf("irq1=%#02x irq2=%#02x", ev.a, ev.b)
+	case traceRxCRC, traceTxDone:
+		return fmt.Sprintf("irq2=%#02x", ev.a)
+	case traceRxPacket:
+		return fmt.Sprintf("%d bytes, %ddBm", ev.a, ev.b)
+	case traceTx:
+		return fmt.Sprintf("%d bytes", ev.a)
+	case traceThreshold:
+		return fmt.Sprintf("%.1fdBm, %d timeouts/sec", -float64(ev.a)/2, ev.b)
+	}
+	return ""
+}
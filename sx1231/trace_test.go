@@ -0,0 +1,60 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	r, f := newFakeRadio(t, RadioOpts{})
+	var buf bytes.Buffer
+	if err := r.DumpTrace(&buf); err != nil || buf.Len() != 0 {
+		t.Fatalf("expected no trace, got %q, err %v", buf.String(), err)
+	}
+
+	r.tr = &traceRing{events: make([]traceEvent, 5)}
+	if err := r.Transmit([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	r.Lock()
+	f.regs[REG_IRQFLAGS2] = IRQ2_PACKETSENT
+	r.txDone()
+	r.Unlock()
+	buf.Reset()
+	if err := r.DumpTrace(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{"mode       FS", "tx         3 bytes", "mode       transmit",
+		"tx-done    irq2=0x08", "mode       receive"}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d events, got:\n%s", len(want), buf.String())
+	}
+	for i, w := range want {
+		if !strings.HasSuffix(lines[i], w) {
+			t.Errorf("event %d: expected %q, got %q", i, w, lines[i])
+		}
+	}
+
+	// The ring keeps the latest events.
+	r.Lock()
+	r.setMode(MODE_STANDBY)
+	r.Unlock()
+	buf.Reset()
+	r.DumpTrace(&buf)
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 || !strings.HasSuffix(lines[4], "mode       standby") ||
+		!strings.HasSuffix(lines[0], "tx         3 bytes") {
+		t.Errorf("unexpected trace after wrap-around:\n%s", buf.String())
+	}
+
+	// Recording doesn't allocate.
+	r.Lock()
+	defer r.Unlock()
+	if n := testing.AllocsPerRun(100, func() { r.trace(traceRxPacket, 10, -70) }); n != 0 {
+		t.Errorf("trace allocates %.0f times", n)
+	}
+}
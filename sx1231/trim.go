@@ -0,0 +1,43 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import "math"
+
+// trimWeight is the weight of the FEI of each packet in the moving average used to trim the
+// frequency.
+const trimWeight = 1.0 / 8
+
+// FrequencyTrim returns the correction in Hz applied to the center frequency to compensate for
+// the offset of the crystal, see RadioOpts.FreqTrim. It can be saved and passed back in
+// RadioOpts.FreqOffset when the radio is next initialized.
+func (r *Radio) FrequencyTrim() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.trim
+}
+
+// carrier returns the frequency programmed into the chip, i.e., the center frequency corrected
+// by the trim.
+func (r *Radio) carrier() uint32 {
+	return uint32(int64(r.freq) + int64(r.trim))
+}
+
+// trackFEI updates the moving average of the frequency error of received packets and trims the
+// frequency when it exceeds a fifth of the RX bandwidth, it must be called with the mutex held.
+func (r *Radio) trackFEI(fei int) {
+	if !r.autoTrim {
+		return
+	}
+	r.feiAvg += (float64(fei) - r.feiAvg) * trimWeight
+	if math.Abs(r.feiAvg) <= 0.2*float64(bandwidth(r.params.RxBw, r.fxosc)) {
+		return
+	}
+	r.trim += int(math.Floor(r.feiAvg + 0.5))
+	r.feiAvg = 0
+	r.log("Frequency trim: %dHz", r.trim)
+	r.setFrequency(r.freq)
+	if r.onTrim != nil {
+		r.onTrim(r.trim)
+	}
+}
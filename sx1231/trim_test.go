@@ -0,0 +1,79 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1231
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrequencyTrim(t *testing.T) {
+	var saved []int
+	r, f := newFakeRadio(t, RadioOpts{})
+	r.freq, r.params = 912500000, Rates[50000] // RxBw is 125kHz
+	r.autoTrim, r.onTrim = true, func(offset int) { saved = append(saved, offset) }
+	frf := func() []byte { return f.regs[REG_FRFMSB : REG_FRFMSB+3] }
+
+	// The average of a steady 40kHz error exceeds 25kHz after 8 packets.
+	for i := 0; i < 7; i++ {
+		r.trackFEI(40000)
+	}
+	if r.FrequencyTrim() != 0 || len(saved) != 0 {
+		t.Fatalf("expected no trim yet, got %dHz", r.FrequencyTrim())
+	}
+	r.trackFEI(40000)
+	trim := r.FrequencyTrim()
+	if trim < 25000 || trim > 27000 || len(saved) != 1 || saved[0] != trim {
+		t.Fatalf("expected a trim of about 26kHz, got %dHz, saved %v", trim, saved)
+	}
+	if !bytes.Equal(frf(), frfRegs(912500000+uint32(trim), defFxosc)) {
+		t.Errorf("trimmed frequency not programmed: %x", frf())
+	}
+	if r.Frequency() != 912500000 || f.opMode() != MODE_RECEIVE {
+		t.Errorf("unexpected frequency %d or mode %#x", r.Frequency(), f.opMode())
+	}
+
+	// The average restarts from scratch and the trim follows negative errors.
+	for i := 0; i < 8; i++ {
+		r.trackFEI(-40000)
+	}
+	if r.FrequencyTrim() != 0 || len(saved) != 2 {
+		t.Errorf("expected the trim to return to 0, got %dHz, saved %v", r.FrequencyTrim(), saved)
+	}
+
+	// The trim applies to new frequencies.
+	r.trim = -1000
+	r.SetFrequency(868300000)
+	if !bytes.Equal(frf(), frfRegs(868299000, defFxosc)) {
+		t.Errorf("trimmed frequency not programmed: %x", frf())
+	}
+
+	// Without FreqTrim nothing happens.
+	r.autoTrim = false
+	for i := 0; i < 20; i++ {
+		r.trackFEI(40000)
+	}
+	if r.FrequencyTrim() != -1000 || len(saved) != 2 {
+		t.Errorf("unexpected trim %dHz, saved %v", r.FrequencyTrim(), saved)
+	}
+}
+
+func TestFreqOffset(t *testing.T) {
+	port, s, pin := newSimRadio(func() bool { return true })
+	opts := simOpts
+	opts.FreqOffset = -2500
+	r, err := New(port, pin, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frf := []byte{s.Reg(REG_FRFMSB), s.Reg(REG_FRFMSB + 1), s.Reg(REG_FRFMSB + 2)}
+	if want := frfRegs(912497500, defFxosc); !bytes.Equal(frf, want) {
+		t.Errorf("expected FRF %x, got %x", want, frf)
+	}
+	if r.FrequencyTrim() != -2500 || r.Frequency() != 912500000 {
+		t.Errorf("unexpected trim %d or frequency %d", r.FrequencyTrim(), r.Frequency())
+	}
+	if err := r.VerifyConfig(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import "sort"
+
+const (
+	afcWindow  = 8   // number of FEI samples per correction step
+	afcMinSNR  = -5  // min packet SNR in dB for its FEI to be used
+	afcMinStep = 200 // min correction applied in Hz, smaller errors are left alone
+)
+
+// afc tracks the frequency error estimated by the modem on received packets and calculates a
+// correction to the center frequency that keeps the receiver centered on the transmitters.
+type afc struct {
+	samples []int // FEI of recent packets in Hz, relative to the current correction
+	offset  int   // current correction in Hz
+}
+
+// update adds the FEI of a packet and returns true if the correction has changed. Packets with
+// an SNR below afcMinSNR are ignored because their FEI is too noisy. The correction is only
+// changed once afcWindow samples have been collected and it moves by the median of the samples,
+// which rejects the occasional outlier. The total correction is limited to +/-maxOffset.
+func (a *afc) update(fei, snr, maxOffset int) bool {
+	if snr < afcMinSNR {
+		return false
+	}
+	a.samples = append(a.samples, fei)
+	if len(a.samples) < afcWindow {
+		return false
+	}
+	sort.Ints(a.samples)
+	median := a.samples[len(a.samples)/2]
+	// The samples were measured relative to the current correction and are thus stale after it
+	// changes: start collecting afresh.
+	a.samples = a.samples[:0]
+	if median > -afcMinStep && median < afcMinStep {
+		return false
+	}
+	offset := a.offset + median
+	switch {
+	case offset > maxOffset:
+		offset = maxOffset
+	case offset < -maxOffset:
+		offset = -maxOffset
+	}
+	if offset == a.offset {
+		return false
+	}
+	a.offset = offset
+	return true
+}
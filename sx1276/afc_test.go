@@ -0,0 +1,71 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"testing"
+	"time"
+)
+
+// receiveFrom places a packet into the fake's FIFO as if it had been sent by a transmitter on
+// the given frequency, setting the FEI the modem would estimate and the SNR.
+func (f *fakeSPI) receiveFrom(txFreq, snr int) {
+	f.receivePacket([]byte("hello"))
+	fei := (txFreq - f.rxFreq()) * 953674 / 125000
+	f.regs[REG_FEI] = byte(fei>>16) & 0x0f
+	f.regs[REG_FEI+1] = byte(fei >> 8)
+	f.regs[REG_FEI+2] = byte(fei)
+	f.regs[REG_PKTSNR] = byte(int8(snr * 4))
+}
+
+func TestAFC(t *testing.T) {
+	const nominal = 868100000
+	const txOffset = 3000 // transmitter's crystal is off by 3.5ppm
+	r, f := newFakeRadio(t)
+	r.SetFrequency(nominal)
+	r.SetAFC(true)
+
+	for i := 0; i < 10*afcWindow; i++ {
+		switch {
+		case i%5 == 1:
+			f.receiveFrom(nominal+30000, -12) // weak packet with bogus FEI
+		case i%13 == 2:
+			f.receiveFrom(nominal-20000, 8) // strong outlier
+		default:
+			f.receiveFrom(nominal+txOffset+(i%3-1)*100, 8)
+		}
+		if pkt, err := r.rx(time.Now()); pkt == nil || err != nil {
+			t.Fatalf("expected packet, got %+v, err %v", pkt, err)
+		}
+	}
+	if off := r.AFCOffset(); off < txOffset-afcMinStep || off > txOffset+afcMinStep {
+		t.Errorf("expected correction to converge to %dHz, got %dHz", txOffset, off)
+	}
+	if d := f.rxFreq() - nominal - r.AFCOffset(); d < -61 || d > 61 {
+		t.Errorf("FRF is off from the corrected frequency by %dHz", d)
+	}
+
+	// Changing the frequency keeps the correction.
+	r.SetFrequency(nominal + 200000)
+	if d := f.rxFreq() - nominal - 200000 - r.AFCOffset(); d < -61 || d > 61 {
+		t.Errorf("FRF is off from the corrected frequency by %dHz after SetFrequency", d)
+	}
+
+	// Disabling AFC returns to the nominal frequency.
+	r.SetAFC(false)
+	if d := f.rxFreq() - nominal - 200000; r.AFCOffset() != 0 || d < -61 || d > 61 {
+		t.Errorf("expected nominal frequency, FRF is off by %dHz, correction %dHz",
+			d, r.AFCOffset())
+	}
+
+	// The correction is limited to a quarter of the bandwidth.
+	r.SetFrequency(nominal)
+	r.SetAFC(true)
+	for i := 0; i < 10*afcWindow; i++ {
+		f.receiveFrom(nominal+60000, 8)
+		r.rx(time.Now())
+	}
+	if off := r.AFCOffset(); off != 125000/4 {
+		t.Errorf("expected correction to be limited to %dHz, got %dHz", 125000/4, off)
+	}
+}
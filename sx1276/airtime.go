@@ -0,0 +1,58 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"errors"
+	"time"
+)
+
+// txPoll is the interval at which the IRQ flags are polled while measuring a transmission.
+const txPoll = 100 * time.Microsecond
+
+// MeasureTimeOnAir transmits a packet with a payload of payloadLen zero bytes and measures the
+// time from switching the radio to TX mode until the chip signals TX done, which allows the
+// airtime computed by TimeOnAir, returned as predicted, to be validated against the hardware.
+// The measurement polls the IRQ flags instead of waiting for the interrupt so it doesn't get
+// into the way of a running Receive, its resolution is on the order of 100us plus the SPI
+// latency and it includes the start-up of the transmitter.
+//
+// Caution: this radiates a real packet using the current frequency, configuration, and power,
+// the packet counts towards the duty-cycle budget like any other. The considerations of Transmit
+// apply, in addition a Temporary error is returned if a transmission is in progress. The radio
+// returns to the mode it was in afterwards.
+func (r *Radio) MeasureTimeOnAir(payloadLen int) (measured, predicted time.Duration, err error) {
+	r.Lock()
+	defer r.Unlock()
+	switch {
+	case r.err != nil:
+		return 0, 0, r.err
+	case r.mode == MODE_TX:
+		return 0, 0, busyError{"radio is busy"}
+	}
+	predicted = r.TimeOnAir(payloadLen)
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	r.writeReg(REG_IRQFLAGS, IRQ_TXDONE) // clear stale IRQ
+	if err := r.transmit(make([]byte, payloadLen)); err != nil {
+		r.setMode(mode)
+		return 0, predicted, err
+	}
+	t0 := time.Now()
+	defer func() {
+		r.setMode(MODE_STANDBY)
+		r.writeReg(REG_IRQFLAGS, IRQ_TXDONE) // clear IRQ
+		r.restoreFreq()
+		r.setMode(mode)
+	}()
+	deadline := t0.Add(2*predicted + 10*time.Millisecond)
+	for {
+		if r.readReg(REG_IRQFLAGS)&IRQ_TXDONE != 0 {
+			return time.Since(t0), predicted, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, predicted, errors.New("sx1276: timeout waiting for transmission to complete")
+		}
+		time.Sleep(txPoll)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasureTimeOnAir(t *testing.T) {
+	r, f := newFakeRadio(t)
+	f.onTx = func() { f.regs[REG_IRQFLAGS] |= IRQ_TXDONE }
+
+	measured, predicted, err := r.MeasureTimeOnAir(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if predicted != r.TimeOnAir(20) {
+		t.Errorf("expected prediction %s, got %s", r.TimeOnAir(20), predicted)
+	}
+	if measured < 0 || measured > 10*time.Millisecond {
+		t.Errorf("expected immediate TX done, measured %s", measured)
+	}
+	if f.regs[REG_PAYLENGTH] != 20 {
+		t.Errorf("expected a 20 byte packet, sent %d bytes", f.regs[REG_PAYLENGTH])
+	}
+	if r.mode != MODE_RX_CONT || f.regs[REG_IRQFLAGS] != 0 {
+		t.Errorf("expected continuous RX and no IRQ, got mode %d, IRQ %#x", r.mode,
+			f.regs[REG_IRQFLAGS])
+	}
+
+	// A transmission that doesn't complete times out.
+	f.onTx = nil
+	if _, _, err := r.MeasureTimeOnAir(1); err == nil {
+		t.Error("expected timeout error")
+	}
+	if r.mode != MODE_RX_CONT {
+		t.Errorf("expected continuous RX to be restored, mode %d", r.mode)
+	}
+
+	// Invalid lengths are refused.
+	if _, _, err := r.MeasureTimeOnAir(0); err == nil {
+		t.Error("expected payload length error")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"errors"
+	"time"
+)
+
+// cadPoll is the interval at which the IRQ flags are polled while waiting for a CAD to complete.
+const cadPoll = 100 * time.Microsecond
+
+// symbolTime returns the duration of a LoRa symbol.
+func (c Config) symbolTime() time.Duration {
+	bw := c.Bandwidth()
+	if bw == 0 {
+		return 0
+	}
+	return (time.Second << uint(c.SpreadingFactor())) / time.Duration(bw)
+}
+
+// CADDuration returns the approximate time a channel activity detection takes using the current
+// configuration, which is about two symbols, i.e., 2ms at SF7/125kHz and 66ms at SF12/125kHz.
+func (r *Radio) CADDuration() time.Duration {
+	return 2 * r.conf.symbolTime()
+}
+
+// DetectActivity performs a channel activity detection (CAD) on the current frequency and
+// reports whether a LoRa preamble using the current configuration was detected. This is much
+// faster and uses less power than attempting to receive a packet, see CADDuration. It returns a
+// Temporary error if a packet is being received or transmitted. The radio returns to the mode it
+// was in afterwards, note that a packet arriving during the CAD is not received.
+func (r *Radio) DetectActivity() (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.cadStart(); err != nil {
+		return false, err
+	}
+	mode := r.mode
+	defer func() { r.setMode(mode) }()
+	return r.cad()
+}
+
+// CADScan performs a channel activity detection on each of the frequencies, which can be given
+// at any scale like for SetFrequency, and reports for each one whether LoRa activity was
+// detected. This allows a clear channel to be picked before transmitting. The scan takes about
+// len(freqs)*CADDuration(). The center frequency and the mode are restored afterwards, the
+// considerations of DetectActivity apply.
+func (r *Radio) CADScan(freqs []uint32) ([]bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.cadStart(); err != nil {
+		return nil, err
+	}
+	mode := r.mode
+	defer func() {
+		r.setMode(MODE_STANDBY)
+		r.writeFreq(r.corrected(r.freq))
+		r.setMode(mode)
+	}()
+	busy := make([]bool, len(freqs))
+	for i, f := range freqs {
+		r.setMode(MODE_STANDBY)
+		r.writeFreq(r.corrected(scaleFreq(f)))
+		var err error
+		if busy[i], err = r.cad(); err != nil {
+			return nil, err
+		}
+	}
+	return busy, nil
+}
+
+// cadStart checks that a CAD can be performed, the lock must be held.
+func (r *Radio) cadStart() error {
+	switch {
+	case r.err != nil:
+		return r.err
+	case r.mode == MODE_TX || r.receiving():
+		return busyError{"radio is busy"}
+	}
+	return nil
+}
+
+// cad performs a CAD on the current frequency and leaves the radio in standby, the lock must be
+// held. The CAD done interrupt is not mapped to a DIO, instead the IRQ flags are polled.
+func (r *Radio) cad() (bool, error) {
+	const flags = IRQ_CADDONE | IRQ_CADDETECT
+	r.setMode(MODE_STANDBY)
+	r.writeReg(REG_IRQFLAGS, flags) // clear stale IRQ
+	r.setMode(MODE_CAD)
+	deadline := time.Now().Add(2*r.CADDuration() + 10*time.Millisecond)
+	for {
+		irq := r.readReg(REG_IRQFLAGS)
+		if irq&IRQ_CADDONE != 0 {
+			r.writeReg(REG_IRQFLAGS, flags)
+			r.setMode(MODE_STANDBY)
+			return irq&IRQ_CADDETECT != 0, nil
+		}
+		if time.Now().After(deadline) {
+			r.setMode(MODE_STANDBY)
+			return false, errors.New("sx1276: timeout waiting for channel activity detection")
+		}
+		time.Sleep(cadPoll)
+	}
+}
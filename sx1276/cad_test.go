@@ -0,0 +1,44 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import "testing"
+
+func TestCADScan(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.SetFrequency(868100000)
+	f.cad = func(freq int) bool { return freq > 868200000 && freq < 868400000 }
+
+	busy, err := r.CADScan([]uint32{868100, 868300, 868500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(busy) != 3 || busy[0] || !busy[1] || busy[2] {
+		t.Errorf("expected only the second channel to be busy, got %v", busy)
+	}
+	if d := f.rxFreq() - 868100000; d < -61 || d > 61 {
+		t.Errorf("center frequency not restored, FRF is off by %dHz", d)
+	}
+	if r.mode != MODE_RX_CONT || f.regs[REG_OPMODE]&0x07 != MODE_RX_CONT {
+		t.Errorf("expected continuous RX to be restored, mode %d", r.mode)
+	}
+	if f.regs[REG_IRQFLAGS] != 0 {
+		t.Errorf("CAD IRQ flags not cleared: %#x", f.regs[REG_IRQFLAGS])
+	}
+
+	if act, err := r.DetectActivity(); act || err != nil {
+		t.Errorf("expected no activity, got %v, err %v", act, err)
+	}
+
+	// A CAD that doesn't complete times out.
+	f.cad = nil
+	if _, err := r.DetectActivity(); err == nil {
+		t.Error("expected timeout error")
+	}
+
+	// No CAD while transmitting.
+	r.setMode(MODE_TX)
+	if _, err := r.CADScan([]uint32{868100}); err == nil {
+		t.Error("expected busy error while transmitting")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+)
+
+// MaxHops is the max number of frequencies in a hop table, the chip counts the hops using a
+// 6-bit channel number.
+const MaxHops = 64
+
+// SetHopTable turns on frequency hopping spread spectrum (FHSS): each packet starts on the first
+// frequency of the table, which becomes the center frequency, and moves to the next frequency
+// every hopPeriod symbols, wrapping around at the end of the table. The frequencies can be given
+// at any scale like for SetFrequency, the AFC correction applies to them. Transmitter and
+// receiver must use the same table and period, and the receiver hops only once it has decoded
+// the header, so hopping requires the explicit header mode.
+//
+// The FhssChangeChannel interrupt is signaled on DIO2, which must be connected to
+// RadioOpts.HopPin. A nil or empty table turns hopping off, which is the default, and returns to
+// the center frequency set using SetFrequency.
+func (r *Radio) SetHopTable(freqs []uint32, hopPeriod byte) error {
+	r.Lock()
+	defer r.Unlock()
+	if len(freqs) == 0 {
+		if r.hops == nil {
+			return nil
+		}
+		r.log("SetHopTable: off")
+		r.hops = nil
+		mode := r.mode
+		r.setMode(MODE_STANDBY)
+		r.writeReg(REG_HOPPERIOD, 0)
+		r.writeReg(REG_IRQMASK, r.readReg(REG_IRQMASK)|IRQ_FHSCHG)
+		r.restoreFreq()
+		r.setMode(mode)
+		return nil
+	}
+	switch {
+	case r.hopPin == nil:
+		return errors.New("sx1276: frequency hopping requires RadioOpts.HopPin")
+	case r.fixLen > 0:
+		return errors.New("sx1276: frequency hopping requires explicit header mode")
+	case len(freqs) > MaxHops:
+		return fmt.Errorf("sx1276: hop table has %d frequencies, max is %d", len(freqs), MaxHops)
+	case hopPeriod == 0:
+		return errors.New("sx1276: hop period must be at least 1 symbol")
+	}
+	r.log("SetHopTable: %d frequencies every %d symbols", len(freqs), hopPeriod)
+	r.hops = make([]uint32, len(freqs))
+	for i, f := range freqs {
+		r.hops[i] = scaleFreq(f)
+	}
+	r.freq = r.hops[0]
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	r.writeReg(REG_HOPPERIOD, hopPeriod)
+	r.writeReg(REG_IRQFLAGS, IRQ_FHSCHG) // clear stale IRQ
+	r.writeReg(REG_IRQMASK, r.readReg(REG_IRQMASK)&^IRQ_FHSCHG)
+	r.writeFreq(r.corrected(r.freq))
+	r.hopped = false
+	r.setMode(mode)
+	return nil
+}
+
+// HopChannel returns the index in the hop table of the frequency currently in use, which is 0
+// between packets, or -1 if frequency hopping is off. This is intended for debugging.
+func (r *Radio) HopChannel() int {
+	r.Lock()
+	defer r.Unlock()
+	switch {
+	case r.hops == nil:
+		return -1
+	case !r.hopped:
+		return 0
+	}
+	return int(r.readReg(REG_HOPCHAN)&0x3f) % len(r.hops)
+}
+
+// initHop configures the pin connected to DIO2 for the FhssChangeChannel interrupt and starts a
+// goroutine that services it. The lock must be held.
+func (r *Radio) initHop(pin gpio.PinIn) error {
+	if err := pin.In(gpio.Float, gpio.RisingEdge); err != nil {
+		return fmt.Errorf("sx1276: error initializing hop pin: %s", err)
+	}
+	r.hopPin = pin
+	go r.watchHop()
+	return nil
+}
+
+// watchHop services the FhssChangeChannel interrupt until the radio is closed or fails.
+func (r *Radio) watchHop() {
+	for {
+		edge := r.hopPin.WaitForEdge(time.Second)
+		r.Lock()
+		if r.err != nil {
+			r.Unlock()
+			return
+		}
+		if edge || r.hopPin.Read() == gpio.High {
+			r.hop()
+		}
+		r.Unlock()
+	}
+}
+
+// hop handles a FhssChangeChannel interrupt by programming the frequency of the channel the chip
+// is moving to, the flag is only cleared afterwards because it holds the chip on the old channel.
+// The mode is left alone: the frequency registers may be written during TX and RX while hopping.
+func (r *Radio) hop() {
+	if r.readReg(REG_IRQFLAGS)&IRQ_FHSCHG == 0 || r.hops == nil {
+		return
+	}
+	ch := int(r.readReg(REG_HOPCHAN) & 0x3f)
+	r.writeReg(REG_FRFMSB, frfRegs(r.corrected(r.hops[ch%len(r.hops)]))...)
+	r.writeReg(REG_IRQFLAGS, IRQ_FHSCHG) // clear IRQ
+	r.hopped = true
+}
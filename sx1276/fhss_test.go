@@ -0,0 +1,69 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHopTable(t *testing.T) {
+	r, f := newFakeRadio(t)
+	f.regs[REG_IRQMASK] = 0x12
+	table := []uint32{902300000, 902500000, 902700000}
+	if err := r.SetHopTable(table, 10); err == nil {
+		t.Fatal("expected an error without hop pin")
+	}
+	r.hopPin = &fakePin{}
+	if err := r.SetHopTable(table, 0); err == nil {
+		t.Fatal("expected an error with a zero hop period")
+	}
+	if err := r.SetHopTable([]uint32{9023, 9025, 9027}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if f.regs[REG_HOPPERIOD] != 10 || f.regs[REG_IRQMASK]&IRQ_FHSCHG != 0 {
+		t.Errorf("hopping not enabled: period %d, IRQ mask %#x", f.regs[REG_HOPPERIOD],
+			f.regs[REG_IRQMASK])
+	}
+	if r.freq != table[0] || !near(f.rxFreq(), table[0]) {
+		t.Errorf("expected center frequency %d, got %d", table[0], f.rxFreq())
+	}
+
+	// The packet hops through the table and wraps around.
+	for ch, want := range []uint32{table[1], table[2], table[0], table[1]} {
+		f.regs[REG_HOPCHAN] = byte(ch + 1)
+		f.regs[REG_IRQFLAGS] |= IRQ_FHSCHG
+		r.hop()
+		if got := r.HopChannel(); got != (ch+1)%len(table) {
+			t.Errorf("hop to channel %d: expected index %d, got %d", ch+1, (ch+1)%len(table),
+				got)
+		}
+		if !near(f.rxFreq(), want) || f.regs[REG_IRQFLAGS]&IRQ_FHSCHG != 0 {
+			t.Errorf("hop to channel %d: expected %dHz, got %dHz, IRQ %#x", ch+1, want,
+				f.rxFreq(), f.regs[REG_IRQFLAGS])
+		}
+	}
+	// At the end of the packet the radio returns to the first frequency.
+	f.receivePacket([]byte{1, 2, 3})
+	if pkt, err := r.rx(time.Now()); pkt == nil || err != nil {
+		t.Fatalf("expected packet, got %+v, err %v", pkt, err)
+	}
+	if r.HopChannel() != 0 || !near(f.rxFreq(), table[0]) || r.mode != MODE_RX_CONT {
+		t.Errorf("expected to receive on %dHz, got %dHz in mode %d", table[0], f.rxFreq(), r.mode)
+	}
+
+	if err := r.SetHopTable(nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if r.HopChannel() != -1 || f.regs[REG_HOPPERIOD] != 0 || f.regs[REG_IRQMASK]&IRQ_FHSCHG == 0 {
+		t.Errorf("hopping not disabled: period %d, IRQ mask %#x", f.regs[REG_HOPPERIOD],
+			f.regs[REG_IRQMASK])
+	}
+}
+
+// near reports whether the frequency programmed into the FRF registers is within one step of
+// the expected frequency.
+func near(got int, want uint32) bool {
+	d := got - int(want)
+	return d > -62 && d < 62
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"fmt"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+)
+
+// Header describes the header of a packet that is being received, it is sent on the
+// RadioOpts.ValidHeader channel as soon as the header has been decoded, which is long before the
+// packet is complete for large payloads.
+type Header struct {
+	Length int       // payload length announced by the header
+	CRC    bool      // true: the payload is followed by a CRC
+	At     time.Time // time of the valid header interrupt
+}
+
+// headerDIO is the REG_DIOMAPPING1 value that maps DIO3 to ValidHeader.
+const headerDIO = 0x01
+
+// initHeader enables the valid header interrupt on DIO3, which is connected to pin, and starts
+// a goroutine that services it. The lock must be held.
+func (r *Radio) initHeader(pin gpio.PinIn, ch chan<- Header) error {
+	if err := pin.In(gpio.Float, gpio.RisingEdge); err != nil {
+		return fmt.Errorf("sx1276: error initializing header pin: %s", err)
+	}
+	r.hdrPin = pin
+	r.hdrChan = ch
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	r.writeReg(REG_IRQMASK, r.readReg(REG_IRQMASK)&^IRQ_VALIDHDR)
+	r.setMode(mode)
+	go r.watchHeader()
+	return nil
+}
+
+// watchHeader services the valid header interrupt until the radio is closed or fails.
+func (r *Radio) watchHeader() {
+	for {
+		edge := r.hdrPin.WaitForEdge(time.Second)
+		r.Lock()
+		if r.err != nil {
+			r.Unlock()
+			return
+		}
+		if edge || r.hdrPin.Read() == gpio.High {
+			r.header(time.Now())
+		}
+		r.Unlock()
+	}
+}
+
+// header handles a valid header interrupt. Rx also clears the flag when the packet is complete,
+// so by the time header runs the header may be gone, in which case nothing is sent.
+func (r *Radio) header(at time.Time) {
+	if r.readReg(REG_IRQFLAGS)&IRQ_VALIDHDR == 0 {
+		return
+	}
+	r.writeReg(REG_IRQFLAGS, IRQ_VALIDHDR) // clear IRQ
+	h := Header{
+		Length: int(r.readReg(REG_RXBYTES)),
+		CRC:    r.readReg(REG_HOPCHAN)&0x40 != 0,
+		At:     at,
+	}
+	select {
+	case r.hdrChan <- h:
+	default:
+		r.log("ValidHeader notification dropped, channel not ready")
+	}
+}
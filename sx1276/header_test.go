@@ -0,0 +1,52 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidHeader(t *testing.T) {
+	r, f := newFakeRadio(t)
+	pin := &fakePin{edges: make(chan struct{}, 1)}
+	hdrs := make(chan Header, 1)
+	r.Lock()
+	if err := r.initHeader(pin, hdrs); err != nil {
+		t.Fatal(err)
+	}
+	r.Unlock()
+	if f.regs[REG_IRQMASK]&IRQ_VALIDHDR != 0 {
+		t.Errorf("valid header interrupt is masked: %#x", f.regs[REG_IRQMASK])
+	}
+	if f.regs[REG_DIOMAPPING1] != headerDIO {
+		t.Errorf("expected DIO mapping %#x, got %#x", headerDIO, f.regs[REG_DIOMAPPING1])
+	}
+
+	// The header of a packet arrives.
+	r.Lock()
+	f.receivePacket(make([]byte, 200))
+	f.regs[REG_IRQFLAGS] = IRQ_VALIDHDR
+	r.Unlock()
+	pin.edges <- struct{}{}
+	select {
+	case h := <-hdrs:
+		if h.Length != 200 || !h.CRC {
+			t.Errorf("expected 200 byte header with CRC, got %+v", h)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no header notification")
+	}
+
+	// Closing stops the goroutine within one poll of the pin.
+	r.intrPin = pin
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	pin.edges <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	if len(pin.edges) == 0 {
+		t.Errorf("header goroutine did not stop")
+	}
+}
@@ -2,7 +2,11 @@
 
 package sx1276
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // JLLEncode encodes a JeeLabs LoRa (JLL) packet.
 //
@@ -30,9 +34,10 @@ import "fmt"
 // The top bit of the RSSI byte is unused.
 //
 // Two packet types are reserved:
-//  0: empty packet, typically used for acks, may have an info trailer.
-//  1: node details: Vstart[mV], Vend[mV], Temp[cC], PktSent, PktRecv, Pout[dBm],
-//     Fadj[Hz], RSSIavg[dBm].
+//
+//	0: empty packet, typically used for acks, may have an info trailer.
+//	1: node details: Vstart[mV], Vend[mV], Temp[cC], PktSent, PktRecv, Pout[dBm],
+//	   Fadj[Hz], RSSIavg[dBm].
 func JLLEncode(kind byte, toGW bool, node byte, fmt byte, payload []byte, rssi, fei int) []byte {
 	pkt := make([]byte, len(payload)+4)
 	// Header.
@@ -122,57 +127,155 @@ func JLLDecode(packet *RxPacket) (*JLLRxPacket, error) {
 	return &jlPkt, nil
 }
 
-/*
+// Defaults used by NewJLLAckHandler.
+const (
+	defJLLRetries = 3
+	defJLLTimeout = 500 * time.Millisecond
+)
+
+// JLLTxPacket is a packet to be sent by a JLLAckHandler.
 type JLLTxPacket struct {
-	Src, Dst byte // source and destination nodes for packet header
-	Ack      bool // ACK request bit for packet header
-	Payload  []byte
+	Node    byte   // destination node when sent by the gateway, ignored when sent by a node
+	Ack     bool   // request an ACK
+	Fmt     byte   // packet format
+	Payload []byte // payload, excluding header and packet type bytes
+	Rssi    int    // RSSI for the info trailer, 0 for none, see JLLEncode
+	Fei     int    // FEI for the info trailer
+}
+
+// JLLAckHandler implements the JLL ACK protocol on top of a Radio: it replies with an ACK to
+// received packets that request one and retransmits outgoing packets that request an ACK until
+// one arrives. An ACK is an empty packet of kind Ack going in the opposite direction for the same
+// node number, it carries an info trailer with the RSSI and FEI of the acked packet.
+//
+// The handler takes over reception using RxChan, so Receive must not be called while it runs.
+// The parameters may only be changed before calling Run.
+type JLLAckHandler struct {
+	Retries   int                    // retransmissions before giving up
+	Timeout   time.Duration          // time to wait for an ACK after each transmission
+	OnFailure func(pkt *JLLTxPacket) // optional: called when a packet isn't acked
+
+	radio *Radio
+	gw    bool // this end is the gateway
+	node  byte // node number of this end if it's not the gateway
 }
 
-// IsAck returns true if the packet is an ACK.
-func (p *JLRxPacket) IsAck() bool { return false }
+// NewJLLAckHandler returns a JLLAckHandler with default retry count and timeout, which can be
+// changed before the handler is run. If gw is true the handler acts as gateway, acking packets
+// sent to the gateway, otherwise it acts as the given node and acks packets from the gateway to
+// that node.
+func NewJLLAckHandler(radio *Radio, gw bool, node byte) *JLLAckHandler {
+	return &JLLAckHandler{
+		Retries: defJLLRetries,
+		Timeout: defJLLTimeout,
+		radio:   radio,
+		gw:      gw,
+		node:    node & 0x1f,
+	}
+}
 
-// JLAckHandler spawns a goroutine that mediates the TX and RX channels in order to retransmit
-// outgoing packets that are unacked and to reply with ACKs when incoming packets request so.
-func JLAckHandler(radio *Radio, grp byte) (chan<- *JLTxPacket, <-chan *JLRxPacket) {
-	txChan := make(chan *JLTxPacket, 1)
-	rxChan := make(chan *JLRxPacket, 1)
+// Run starts a goroutine that encodes and transmits the packets sent on the returned TX channel
+// and decodes received packets into the returned RX channel, which has the depth set using
+// RadioOpts.RxBuffer. Packets that are not in the JLL format and ACKs are not forwarded, and a
+// packet is dropped if the RX channel is full. While waiting for the ACK of a packet the TX
+// channel is not read, so only one packet is in flight at a time. The RX channel is closed when
+// ctx is done or when the radio fails.
+func (h *JLLAckHandler) Run(ctx context.Context) (chan<- *JLLTxPacket, <-chan *JLLRxPacket) {
+	txChan := make(chan *JLLTxPacket, 1)
+	rxChan := make(chan *JLLRxPacket, h.radio.rxDepth)
+	radioRx := h.radio.RxChan(ctx)
 	go func() {
-		waitingForAck := false
+		defer close(rxChan)
+		var pending *JLLTxPacket     // packet waiting for an ACK
+		var tries int                // transmissions of the pending packet
+		var timeout <-chan time.Time // fires when it's time to retransmit
+		txIn := txChan               // nil while a packet is pending
 		for {
-			if waitingForAck {
-				// Ignore txChan until we get ack or give up.
-				select {
-				case rxPkt := <-radio.RxChan:
-					jlPkt, err := JLDecode(grp, rxPkt)
-					if err != nil {
-						radio.log("%s", err.Error())
-						break
-					}
-					if jlPkt.IsAck() {
-						waitingForAck = false
-						break
+			select {
+			case <-ctx.Done():
+				return
+			case pkt, ok := <-radioRx:
+				if !ok {
+					return
+				}
+				jl, err := JLLDecode(pkt)
+				if err != nil {
+					h.radio.log("%s", err)
+					break
+				}
+				if jl.Kind == Ack {
+					if pending != nil && h.isAck(pending, jl) {
+						pending, timeout, txIn = nil, nil, txChan
 					}
-					rxChan <- jlPkt
+					break
+				}
+				if jl.Kind == DataAck && h.forUs(jl) {
+					h.radio.log("JLL: sending ACK to node %d", jl.Node)
+					h.transmit(JLLEncode(Ack, !h.gw, jl.Node, 0, nil, jl.Rssi, jl.Fei))
 				}
-			} else {
-				// Handle both txChan and rxChan.
 				select {
-				case txPkt := <-txChan:
-					jlPkt := JLEncode(grp, txPkt.Src, txPkt.Dst, txPkt.Ack, txPkt.Payload)
-					radio.txChan <- jlPkt
-					waitingForAck = txPkt.Ack
-				case rxPkt := <-radio.RxChan:
-					jlPkt, err := JLDecode(grp, rxPkt)
-					if err != nil {
-						radio.log("%s", err.Error())
-						break
+				case rxChan <- jl:
+				default:
+					h.radio.log("JLL: RX channel full, dropping packet")
+				}
+			case tx := <-txIn:
+				h.transmit(h.encode(tx))
+				if tx.Ack {
+					pending, tries, txIn = tx, 1, nil
+					timeout = time.After(h.Timeout)
+				}
+			case <-timeout:
+				if tries > h.Retries {
+					h.radio.log("JLL: no ACK from node %d after %d tries", pending.Node, tries)
+					if h.OnFailure != nil {
+						h.OnFailure(pending)
 					}
-					rxChan <- jlPkt
+					pending, timeout, txIn = nil, nil, txChan
+					break
 				}
+				tries++
+				h.transmit(h.encode(pending))
+				timeout = time.After(h.Timeout)
 			}
 		}
 	}()
 	return txChan, rxChan
 }
-*/
+
+// encode returns the JLL encoding of a packet sent by this end.
+func (h *JLLAckHandler) encode(tx *JLLTxPacket) []byte {
+	kind := byte(DataNoAck)
+	if tx.Ack {
+		kind = DataAck
+	}
+	node := h.node
+	if h.gw {
+		node = tx.Node
+	}
+	return JLLEncode(kind, !h.gw, node, tx.Fmt, tx.Payload, tx.Rssi, tx.Fei)
+}
+
+// transmit sends a packet, errors are logged since the ACK protocol deals with lost packets.
+func (h *JLLAckHandler) transmit(pkt []byte) {
+	if err := h.radio.Transmit(pkt); err != nil {
+		h.radio.log("JLL: cannot transmit: %s", err)
+	}
+}
+
+// forUs returns whether a received packet is addressed to this end and may thus be acked, the
+// broadcast and anonymous node numbers are never acked.
+func (h *JLLAckHandler) forUs(jl *JLLRxPacket) bool {
+	if jl.Node == 0 || jl.Node == 31 || jl.ToGW != h.gw {
+		return false
+	}
+	return h.gw || jl.Node == h.node
+}
+
+// isAck returns whether a received ACK is the one expected for the pending packet.
+func (h *JLLAckHandler) isAck(pending *JLLTxPacket, ack *JLLRxPacket) bool {
+	node := h.node
+	if h.gw {
+		node = pending.Node & 0x1f
+	}
+	return ack.ToGW == h.gw && ack.Node == node
+}
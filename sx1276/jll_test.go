@@ -2,10 +2,15 @@
 
 package sx1276
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
 
 var encodings = map[string]struct {
-	hdr, node, kind byte
+	kind, node, fmt byte
 	toGW            bool
 	rssi, fei       int
 	payload         []byte
@@ -21,7 +26,7 @@ var encodings = map[string]struct {
 
 func Test_JLLEncode(t *testing.T) {
 	for n, tc := range encodings {
-		got := JLLEncode(tc.hdr, tc.toGW, tc.node, tc.kind, tc.payload, tc.rssi, tc.fei)
+		got := JLLEncode(tc.kind, tc.toGW, tc.node, tc.fmt, tc.payload, tc.rssi, tc.fei)
 		if len(got) != len(tc.pkt) {
 			t.Fatalf("Encoding %s length mismatch got %+v expected %+v", n, got, tc.pkt)
 		}
@@ -39,17 +44,17 @@ func Test_JLLDecode(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Unexpected error %v", err)
 		}
-		if got.Hdr != tc.hdr {
-			t.Errorf("Decoding %s hdr mismatch, got %d expected %d", n, got.Hdr, tc.hdr)
+		if got.Kind != tc.kind {
+			t.Errorf("Decoding %s kind mismatch, got %d expected %d", n, got.Kind, tc.kind)
 		}
 		if got.Node != tc.node {
 			t.Errorf("Decoding %s node mismatch, got %d expected %d", n, got.Node, tc.node)
 		}
-		if got.Kind != tc.kind {
-			t.Errorf("Decoding %s kind mismatch, got %d expected %d", n, got.Kind, tc.kind)
+		if got.Fmt != tc.fmt {
+			t.Errorf("Decoding %s fmt mismatch, got %d expected %d", n, got.Fmt, tc.fmt)
 		}
 		if got.ToGW != tc.toGW {
-			t.Errorf("Decoding %s toGW mismatch, got %d expected %d", n, got.ToGW, tc.toGW)
+			t.Errorf("Decoding %s toGW mismatch, got %v expected %v", n, got.ToGW, tc.toGW)
 		}
 
 		tcRssi := tc.rssi
@@ -89,3 +94,145 @@ func Test_JLLDecode(t *testing.T) {
 		t.Fatalf("Unexpected error %v", err)
 	}
 }
+
+// newJLLRadio returns a fake radio for JLLAckHandler tests. Packets sent on the air channel are
+// received by the radio and packets it transmits are sent on the returned channel.
+func newJLLRadio(t *testing.T) (*Radio, chan<- []byte, <-chan []byte) {
+	r, f := newFakeRadio(t)
+	r.rxDepth = 4
+	air, sent := make(chan []byte, 4), make(chan []byte, 16)
+	pin := newFakePin(f)
+	pin.high = func() bool { return f.regs[REG_IRQFLAGS]&(IRQ_RXDONE|IRQ_TXDONE) != 0 }
+	pin.onWait = func() {
+		select {
+		case pkt := <-air:
+			r.Lock()
+			f.receivePacket(pkt)
+			r.Unlock()
+		default:
+		}
+	}
+	f.onTx = func() {
+		sent <- append([]byte(nil), f.fifo[f.regs[REG_FIFOTXBASE]:][:f.regs[REG_PAYLENGTH]]...)
+		f.regs[REG_IRQFLAGS] |= IRQ_TXDONE
+		select {
+		case pin.edges <- struct{}{}:
+		default:
+		}
+	}
+	r.intrPin = pin
+	return r, air, sent
+}
+
+// expectSent returns the next packet transmitted, decoded.
+func expectSent(t *testing.T, sent <-chan []byte) *JLLRxPacket {
+	select {
+	case pkt := <-sent:
+		jl, err := JLLDecode(&RxPacket{Payload: pkt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jl
+	case <-time.After(time.Second):
+		t.Fatal("no packet transmitted")
+	}
+	return nil
+}
+
+func TestJLLAckHandlerReceive(t *testing.T) {
+	r, air, sent := newJLLRadio(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rxChan := NewJLLAckHandler(r, true, 0).Run(ctx)
+
+	// A packet that is too short is dropped, one from node 5 requesting an ACK is decoded and
+	// acked.
+	air <- []byte{0x05}
+	air <- JLLEncode(DataAck, true, 5, 9, []byte("hi"), -60, 300)
+	select {
+	case pkt := <-rxChan:
+		if pkt.Kind != DataAck || !pkt.ToGW || pkt.Node != 5 || pkt.Fmt != 9 ||
+			string(pkt.Payload) != "hi" || pkt.RemRSSI != -60 {
+			t.Errorf("unexpected packet %+v", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no packet received")
+	}
+	ack := expectSent(t, sent)
+	if ack.Kind != Ack || ack.ToGW || ack.Node != 5 || len(ack.Payload) != 0 || ack.Fmt != 0 {
+		t.Errorf("unexpected ACK %+v", ack)
+	}
+
+	// Packets without ACK request and ACKs that aren't expected are not acked.
+	air <- JLLEncode(Ack, true, 6, 0, nil, 0, 0)
+	air <- JLLEncode(DataNoAck, true, 6, 1, []byte{42}, 0, 0)
+	select {
+	case pkt := <-rxChan:
+		if pkt.Kind != DataNoAck || !bytes.Equal(pkt.Payload, []byte{42}) {
+			t.Errorf("unexpected packet %+v", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no packet received")
+	}
+	select {
+	case pkt := <-sent:
+		t.Errorf("unexpected transmission %x", pkt)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestJLLAckHandlerSend(t *testing.T) {
+	r, air, sent := newJLLRadio(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewJLLAckHandler(r, false, 7)
+	h.Retries, h.Timeout = 2, 20*time.Millisecond
+	failed := make(chan *JLLTxPacket, 1)
+	h.OnFailure = func(pkt *JLLTxPacket) { failed <- pkt }
+	txChan, rxChan := h.Run(ctx)
+
+	// The packet is retransmitted until the ACK from the gateway arrives.
+	txChan <- &JLLTxPacket{Node: 3, Ack: true, Fmt: 4, Payload: []byte("hello")}
+	for i := 0; i < 2; i++ {
+		pkt := expectSent(t, sent)
+		if pkt.Kind != DataAck || !pkt.ToGW || pkt.Node != 7 || pkt.Fmt != 4 ||
+			string(pkt.Payload) != "hello" {
+			t.Fatalf("unexpected packet %+v", pkt)
+		}
+	}
+	air <- JLLEncode(Ack, false, 7, 0, nil, -80, 0)
+	txChan <- &JLLTxPacket{Fmt: 5, Payload: []byte("next")}
+	pkt := expectSent(t, sent)
+	for string(pkt.Payload) == "hello" { // retransmitted before the ACK got through
+		pkt = expectSent(t, sent)
+	}
+	if pkt.Kind != DataNoAck || string(pkt.Payload) != "next" {
+		t.Fatalf("expected the next packet, got %+v", pkt)
+	}
+	select {
+	case pkt := <-rxChan:
+		t.Errorf("ACK was forwarded: %+v", pkt)
+	default:
+	}
+
+	// Without ACK the packet is sent Retries+1 times and OnFailure is called.
+	txChan <- &JLLTxPacket{Ack: true, Payload: []byte("lost")}
+	for i := 0; i < 3; i++ {
+		if pkt := expectSent(t, sent); string(pkt.Payload) != "lost" {
+			t.Fatalf("expected retransmission, got %+v", pkt)
+		}
+	}
+	select {
+	case pkt := <-failed:
+		if string(pkt.Payload) != "lost" {
+			t.Errorf("unexpected failed packet %+v", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnFailure not called")
+	}
+	select {
+	case pkt := <-sent:
+		t.Errorf("unexpected retransmission %x", pkt)
+	default:
+	}
+}
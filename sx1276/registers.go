@@ -2,11 +2,14 @@
 
 package sx1276
 
+import "time"
+
 const (
 	REG_FIFO        = 0x00
 	REG_OPMODE      = 0x01
 	REG_FRFMSB      = 0x06
 	REG_PACONFIG    = 0x09
+	REG_PARAMP      = 0x0A
 	REG_OCP         = 0x0B
 	REG_LNA         = 0x0C
 	REG_FIFOPTR     = 0x0D
@@ -24,16 +27,20 @@ const (
 	REG_MODEMCONF1  = 0x1D
 	REG_MODEMCONF2  = 0x1E
 	REG_SYMBTIMEOUT = 0x1F
-	REG_PREAMBLE    = 0x21
+	REG_PREAMBLEMSB = 0x20
+	REG_PREAMBLE    = 0x21 // LSB
 	REG_PAYLENGTH   = 0x22
 	REG_PAYMAX      = 0x23
+	REG_HOPPERIOD   = 0x24
 	REG_FIFORXLAST  = 0x25
 	REG_MODEMCONF3  = 0x26
 	REG_PPMCORR     = 0x27
 	REG_FEI         = 0x28
 	REG_DETECTOPT   = 0x31
+	REG_INVERTIQ    = 0x33
 	REG_DETECTTHR   = 0x37
 	REG_SYNC        = 0x39
+	REG_INVERTIQ2   = 0x3B
 	REG_DIOMAPPING1 = 0x40
 	REG_DIOMAPPING2 = 0x41
 	REG_VERSION     = 0x42
@@ -42,6 +49,30 @@ const (
 	REG_FORMERTEMP  = 0x5B
 )
 
+// preambleLen is the default number of preamble symbols, see RadioOpts.PreambleLength. The radio
+// adds 4.25 symbols of sync.
+const preambleLen = 10
+
+// minPreamble is the minimum preamble length supported by the chip in symbols.
+const minPreamble = 6
+
+const (
+	// REG_INVERTIQ bits, the TX bit is active low
+	INVERTIQ_RX = 1 << 6
+	INVERTIQ_TX = 1 << 0
+
+	// REG_INVERTIQ2 values for normal and inverted RX I/Q
+	INVERTIQ2_OFF = 0x1D
+	INVERTIQ2_ON  = 0x19
+)
+
+const (
+	TCXO_INPUT_ON = 1 << 4 // REG_TCXO: clock from TCXO on XTA pin
+
+	// time for a TCXO to start up and stabilize
+	tcxoSettle = 10 * time.Millisecond
+)
+
 const (
 	MODE_SLEEP = iota
 	MODE_STANDBY
@@ -77,12 +108,13 @@ var configRegs = []byte{
 	0x10, 0x00, // FIFO RX current = 0
 	0x11, 0x12, // mask valid header and FHSS change interrupts
 	0x1f, 0xff, // RX timeout at 255 bytes
-	0x20, 0x00, 0x21, 0x0A, // preamble of 8
+	0x20, 0x00, 0x21, preambleLen, // preamble length
 	0x23, 0xFF, // max payload of 255 bytes
-	0x24, 0x00, // no freq hopping
+	0x24, 0x00, // no freq hopping, see SetHopTable
 	0x27, 0x00, // no ppm freq correction
 	0x31, 0x03, // detection optimize for SF7-12
-	0x33, 0x27, // no I/Q invert
+	0x33, 0x27, // no I/Q invert, see SetInvertIQ
+	0x3B, 0x1D, // no I/Q invert
 	0x37, 0x0A, // detection threshold for SF7-12
 	0x40, 0x00, // DIO mapping 1
 	0x41, 0x00, // DIO mapping 2
@@ -90,6 +122,26 @@ var configRegs = []byte{
 	//0x70, 0xd0, // default PLL threshold
 }
 
+// FSK mode registers and flags as used by the Sweeper, the addresses of the registers in
+// common with LoRa mode are the same.
+const (
+	REG_FSK_RSSIVALUE  = 0x11
+	REG_FSK_FEIMSB     = 0x1D
+	REG_FSK_PKTCONFIG2 = 0x31
+	REG_FSK_IMAGECAL   = 0x3B
+	REG_FSK_TEMP       = 0x3C
+	REG_FSK_IRQFLAGS1  = 0x3E
+	REG_FSK_IRQFLAGS2  = 0x3F
+
+	FSK_PACKET_MODE  = 1 << 6 // REG_FSK_PKTCONFIG2: packet mode, else continuous mode
+	TEMP_MONITOR_OFF = 1 << 0 // REG_FSK_IMAGECAL: temperature sensor off
+
+	IRQ1_MODEREADY    = 1 << 7
+	IRQ1_SYNCMATCH    = 1 << 0
+	IRQ2_PACKETSENT   = 1 << 3
+	IRQ2_PAYLOADREADY = 1 << 2
+)
+
 // register values to initialize the chip in FSK mode to sweep the spectrum for antenna
 // tuning, for example.
 var sweepRegs = []byte{
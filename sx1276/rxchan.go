@@ -0,0 +1,43 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import "context"
+
+// defRxBuffer is the depth of the channel returned by RxChan if RadioOpts.RxBuffer is 0.
+const defRxBuffer = 4
+
+// RxChan starts a goroutine that receives packets and sends them on the returned channel, which
+// has the depth set using RadioOpts.RxBuffer. The goroutine calls ReceiveContext, which must thus
+// not be called concurrently. If the consumer falls behind and the channel is full the packet is
+// dropped and counted, see Dropped. The channel is closed when ctx is done or when a persistent
+// error occurs, use Error to retrieve it.
+func (r *Radio) RxChan(ctx context.Context) <-chan *RxPacket {
+	rxChan := make(chan *RxPacket, r.rxDepth)
+	go func() {
+		defer close(rxChan)
+		for {
+			pkt, err := r.ReceiveContext(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case rxChan <- pkt:
+			default:
+				r.Lock()
+				r.dropped++
+				r.log("rxChan full, dropping packet (%d dropped)", r.dropped)
+				r.Unlock()
+			}
+		}
+	}()
+	return rxChan
+}
+
+// Dropped returns the number of packets dropped since the radio was initialized because the
+// channel returned by RxChan was full.
+func (r *Radio) Dropped() uint64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.dropped
+}
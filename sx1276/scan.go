@@ -0,0 +1,106 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// monitorBuffer is the depth of the channel returned by MonitorRSSI.
+const monitorBuffer = 16
+
+// RssiSample is a measurement of the signal strength taken by MonitorRSSI.
+type RssiSample struct {
+	Rssi   int       // signal strength in dBm
+	At     time.Time // time of the measurement
+	Freq   uint32    // center frequency in Hz
+	Config string    // entry in the Configs table in use
+}
+
+// ScanChannels measures the signal strength on each of the frequencies, which can be given at
+// any scale like for SetFrequency, and returns the max RSSI in dBm seen on each one during
+// dwell, which is sampled every millisecond. This allows a quiet channel to be picked or a
+// crude spectrum display to be built. The scan takes about len(freqs)*dwell, a dwell of 0 takes a
+// single sample per frequency. It returns a Temporary error if a packet is being received or
+// transmitted. The center frequency and the mode are restored afterwards, packets arriving
+// during the scan are lost.
+func (r *Radio) ScanChannels(freqs []uint32, dwell time.Duration) ([]int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.cadStart(); err != nil {
+		return nil, err
+	}
+	mode := r.mode
+	defer func() {
+		r.setMode(MODE_STANDBY)
+		r.writeFreq(r.corrected(r.freq))
+		r.writeReg(REG_IRQFLAGS, 0xff) // drop anything received during the scan
+		r.setMode(mode)
+	}()
+	rssi := make([]int, len(freqs))
+	for i, f := range freqs {
+		r.setMode(MODE_STANDBY)
+		r.writeFreq(r.corrected(scaleFreq(f)))
+		r.setMode(MODE_RX_CONT)
+		time.Sleep(rssiSettle)
+		rssi[i] = r.currentRSSI()
+		for end := time.Now().Add(dwell - rssiSettle); time.Now().Before(end); {
+			time.Sleep(rssiSettle)
+			if v := r.currentRSSI(); v > rssi[i] {
+				rssi[i] = v
+			}
+		}
+	}
+	return rssi, nil
+}
+
+// MonitorRSSI starts a goroutine that samples the signal strength every interval while the radio
+// is in continuous receive mode and sends the samples on the returned channel, e.g. to record the
+// noise floor of a channel over time. No samples are taken while a packet is being received or
+// transmitted, or while the radio is in another mode, so the radio operates normally and
+// Receive must be running to receive packets. If the consumer falls behind and the channel is
+// full samples are dropped. The channel is closed when ctx is done or when a persistent error
+// occurs, use Error to retrieve it.
+func (r *Radio) MonitorRSSI(ctx context.Context, interval time.Duration) (<-chan RssiSample,
+	error) {
+	if interval <= 0 {
+		return nil, errors.New("sx1276: RSSI monitoring interval must be positive")
+	}
+	r.Lock()
+	err := r.err
+	r.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	samples := make(chan RssiSample, monitorBuffer)
+	go func() {
+		defer close(samples)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				r.Lock()
+				if r.err != nil {
+					r.Unlock()
+					return
+				}
+				if r.mode != MODE_RX_CONT || r.receiving() {
+					r.Unlock()
+					continue
+				}
+				s := RssiSample{Rssi: r.currentRSSI(), At: now, Freq: r.freq, Config: r.config}
+				r.Unlock()
+				select {
+				case samples <- s:
+				default:
+				}
+			}
+		}
+	}()
+	return samples, nil
+}
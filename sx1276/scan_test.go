@@ -0,0 +1,99 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScanChannels(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.SetFrequency(868100000)
+	f.rssi = func(freq int) byte {
+		if freq > 868200000 && freq < 868400000 {
+			return 100
+		}
+		return 40
+	}
+
+	rssi, err := r.ScanChannels([]uint32{868100, 868300, 868500}, 3*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rssi) != 3 || rssi[0] != rssi[2] || rssi[1]-rssi[0] != 60 {
+		t.Errorf("expected the second channel to be 60dB stronger, got %v", rssi)
+	}
+	if d := f.rxFreq() - 868100000; d < -61 || d > 61 {
+		t.Errorf("center frequency not restored, FRF is off by %dHz", d)
+	}
+	if r.mode != MODE_RX_CONT || f.regs[REG_OPMODE]&0x07 != MODE_RX_CONT {
+		t.Errorf("expected continuous RX to be restored, mode %d", r.mode)
+	}
+
+	if v, err := r.ReadRSSI(); err != nil || v != rssi[0] {
+		t.Errorf("expected ReadRSSI to return %d, got %d, err %v", rssi[0], v, err)
+	}
+
+	// No scan or RSSI while transmitting.
+	r.setMode(MODE_TX)
+	if _, err := r.ScanChannels([]uint32{868100}, 0); err == nil {
+		t.Error("expected busy error while transmitting")
+	}
+	if _, err := r.ReadRSSI(); err == nil {
+		t.Error("expected busy error while transmitting")
+	}
+}
+
+func TestMonitorRSSI(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.SetFrequency(868100000)
+	f.rssi = func(freq int) byte { return 40 }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	samples, err := r.MonitorRSSI(ctx, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-samples
+	if s.Rssi != rssiOffset+40 || s.Freq != 868100000 || s.Config != "lorawan.bw125sf7" ||
+		s.At.IsZero() {
+		t.Errorf("unexpected sample %+v", s)
+	}
+
+	// No samples while a packet is being received or transmitted.
+	r.Lock()
+	f.regs[REG_MODEMSTAT] = 0x0B // signal detected, synchronized, header valid
+	r.Unlock()
+	for len(samples) > 0 {
+		<-samples
+	}
+	time.Sleep(10 * time.Millisecond)
+	r.Lock()
+	if n := len(samples); n > 1 { // one may have been taken before the packet
+		t.Errorf("expected no samples during reception, got %d", n)
+	}
+	f.regs[REG_MODEMSTAT] = 0
+	r.setMode(MODE_TX)
+	r.Unlock()
+	for len(samples) > 0 {
+		<-samples
+	}
+	time.Sleep(10 * time.Millisecond)
+	r.Lock()
+	if n := len(samples); n > 1 {
+		t.Errorf("expected no samples during transmission, got %d", n)
+	}
+	r.setMode(MODE_RX_CONT)
+	r.Unlock()
+	<-samples
+
+	cancel()
+	for range samples {
+	}
+
+	if _, err := r.MonitorRSSI(context.Background(), 0); err == nil {
+		t.Error("expected error for zero interval")
+	}
+}
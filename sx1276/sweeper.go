@@ -0,0 +1,150 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"periph.io/x/periph/conn/spi"
+)
+
+// sweepLen is the fixed packet length configured in sweepRegs.
+const sweepLen = 10
+
+// Sweeper operates an SX1276 in FSK mode in order to sweep the spectrum, for example for
+// antenna tuning. It can transmit a continuous carrier or exchange fixed-length packets and
+// report the RSSI and frequency error with which they are received. The Sweeper polls the
+// radio instead of using interrupts and its methods are not concurrency safe.
+type Sweeper struct {
+	dev  Radio // register access, none of the LoRa state is used
+	mode byte  // current operation mode
+}
+
+// NewSweeper initializes the radio connected to the SPI port in FSK mode and sets the
+// frequency, which can be specified at any scale (hz, khz, mhz).
+func NewSweeper(port spi.Port, freq uint32, log LogPrintf) (*Sweeper, error) {
+	s := &Sweeper{mode: 255}
+	s.dev.SetLogger(log)
+
+	conn, err := port.DevParams(4*1000*1000, spi.Mode0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("sx1276: cannot set device params: %v", err)
+	}
+	s.dev.spi = conn
+	s.dev.log("SX1276 version %#x", s.dev.readReg(REG_VERSION))
+
+	// The modulation can only be switched in sleep mode, which has to be entered first.
+	s.dev.writeReg(REG_OPMODE, 0x80+MODE_SLEEP)
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < len(sweepRegs)-1; i += 2 {
+		s.dev.writeReg(sweepRegs[i], sweepRegs[i+1])
+	}
+	if m := s.dev.readReg(REG_OPMODE); m != 0x08+MODE_SLEEP {
+		return nil, fmt.Errorf("sx1276: can't put radio into FSK mode: %#x", m)
+	}
+	s.setMode(MODE_STANDBY)
+	s.SetFrequency(freq)
+	return s, s.dev.err
+}
+
+// SetFrequency changes the center frequency, which can be specified at any scale (hz, khz,
+// mhz). The frequency can be changed while transmitting a carrier.
+func (s *Sweeper) SetFrequency(freq uint32) {
+	freq = scaleFreq(freq)
+	frf := frfRegs(freq)
+	s.dev.writeReg(REG_FRFMSB, frf...)
+	s.dev.log("SetFreq %dHz -> %#x", freq, frf)
+}
+
+// SetPower configures the output power in dBm, see Radio.SetPower.
+func (s *Sweeper) SetPower(dBm byte) {
+	paConfig, paDac, dBm := paRegs(dBm)
+	s.dev.log("SetPower %ddBm", dBm)
+	mode := s.mode
+	s.setMode(MODE_STANDBY)
+	s.dev.writeReg(REG_PACONFIG, paConfig)
+	s.dev.writeReg(REG_PADAC, paDac)
+	s.setMode(mode)
+}
+
+// StartTx starts transmitting a continuous carrier. The radio is switched to continuous mode
+// where it modulates the carrier with the DIO2 pin, so the carrier is offset by the frequency
+// deviation in the direction given by the level of the pin.
+func (s *Sweeper) StartTx() {
+	s.setMode(MODE_STANDBY)
+	s.dev.writeReg(REG_FSK_PKTCONFIG2, s.dev.readReg(REG_FSK_PKTCONFIG2)&^FSK_PACKET_MODE)
+	s.setMode(MODE_TX)
+}
+
+// StopTx stops transmitting the carrier started by StartTx.
+func (s *Sweeper) StopTx() {
+	s.setMode(MODE_STANDBY)
+	s.dev.writeReg(REG_FSK_PKTCONFIG2, s.dev.readReg(REG_FSK_PKTCONFIG2)|FSK_PACKET_MODE)
+}
+
+// TxPacket transmits a fixed-length packet and waits for the transmission to complete.
+func (s *Sweeper) TxPacket() {
+	s.setMode(MODE_STANDBY)
+	var payload [sweepLen]byte
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	s.dev.writeReg(REG_FIFO, payload[:]...)
+	s.setMode(MODE_TX)
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+		if s.dev.readReg(REG_FSK_IRQFLAGS2)&IRQ2_PACKETSENT != 0 {
+			s.setMode(MODE_STANDBY)
+			return
+		}
+	}
+	s.dev.err = errors.New("sx1276: timeout transmitting packet")
+	s.setMode(MODE_STANDBY)
+}
+
+// RxPacket waits for a fixed-length packet to be received and returns the frequency error in
+// Hz and the RSSI in dBm measured when it was received.
+func (s *Sweeper) RxPacket() (fei, rssi int) {
+	s.setMode(MODE_RX_CONT) // RX in FSK mode
+	for {
+		irq1 := s.dev.readReg(REG_FSK_IRQFLAGS1)
+		// As soon as we have sync match, grab RSSI and FEI.
+		if rssi == 0 && irq1&IRQ1_SYNCMATCH != 0 {
+			rssi = -int(s.dev.readReg(REG_FSK_RSSIVALUE)) / 2
+			// Caution: signed 16-bit value in units of 61.03515625Hz.
+			fei = int(int64(int16(s.dev.readReg16(REG_FSK_FEIMSB))) * 32000000 >> 19)
+		}
+		if s.dev.readReg(REG_FSK_IRQFLAGS2)&IRQ2_PAYLOADREADY != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var wBuf, rBuf [sweepLen + 1]byte
+	wBuf[0] = REG_FIFO
+	s.dev.spi.Tx(wBuf[:], rBuf[:])
+	s.setMode(MODE_STANDBY)
+	return fei, rssi
+}
+
+// LogRegs logs the contents of the radio's registers.
+func (s *Sweeper) LogRegs() { s.dev.logRegs() }
+
+// Error returns any persistent error that may have been encountered.
+func (s *Sweeper) Error() error { return s.dev.err }
+
+// setMode changes the radio's operating mode and waits for the new mode to be reached.
+func (s *Sweeper) setMode(mode byte) {
+	mode = mode & 0x07
+	if s.mode == mode {
+		return
+	}
+	s.dev.writeReg(REG_OPMODE, 0x08+mode) // FSK mode & LF
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+		if s.dev.readReg(REG_FSK_IRQFLAGS1)&IRQ1_MODEREADY != 0 {
+			s.mode = mode
+			return
+		}
+	}
+	s.dev.err = errors.New("sx1276: timeout switching modes")
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSweeper(t *testing.T) {
+	f := &fakeSPI{}
+	f.regs[REG_FSK_IRQFLAGS1] = IRQ1_MODEREADY
+	s := &Sweeper{dev: Radio{spi: f, log: t.Logf}, mode: 255}
+
+	s.SetFrequency(434000)
+	if !bytes.Equal(f.regs[REG_FRFMSB:REG_FRFMSB+3], []byte{0x6c, 0x80, 0x00}) {
+		t.Errorf("unexpected FRF for 434MHz: %#x", f.regs[REG_FRFMSB:REG_FRFMSB+3])
+	}
+	s.SetPower(20)
+	if f.regs[REG_PACONFIG] != 0xff || f.regs[REG_PADAC] != 0x87 {
+		t.Errorf("unexpected PA config for 20dBm: %#x %#x",
+			f.regs[REG_PACONFIG], f.regs[REG_PADAC])
+	}
+
+	// Continuous carrier.
+	f.regs[REG_FSK_PKTCONFIG2] = 0x40
+	s.StartTx()
+	if f.regs[REG_OPMODE] != 0x08+MODE_TX || f.regs[REG_FSK_PKTCONFIG2] != 0 {
+		t.Errorf("expected continuous TX: opmode %#x pktconfig2 %#x",
+			f.regs[REG_OPMODE], f.regs[REG_FSK_PKTCONFIG2])
+	}
+	s.StopTx()
+	if f.regs[REG_OPMODE] != 0x08+MODE_STANDBY || f.regs[REG_FSK_PKTCONFIG2] != 0x40 {
+		t.Errorf("expected packet mode standby: opmode %#x pktconfig2 %#x",
+			f.regs[REG_OPMODE], f.regs[REG_FSK_PKTCONFIG2])
+	}
+
+	// Packet exchange.
+	f.regs[REG_FSK_IRQFLAGS2] = IRQ2_PACKETSENT
+	s.TxPacket()
+	if err := s.Error(); err != nil || f.regs[REG_FIFOPTR] != sweepLen {
+		t.Errorf("expected %d-byte packet to be sent, got %d, err %v",
+			sweepLen, f.regs[REG_FIFOPTR], err)
+	}
+
+	f.regs[REG_FSK_IRQFLAGS1] |= IRQ1_SYNCMATCH
+	f.regs[REG_FSK_IRQFLAGS2] = IRQ2_PAYLOADREADY
+	f.regs[REG_FSK_RSSIVALUE] = 170
+	f.regs[REG_FSK_FEIMSB], f.regs[REG_FSK_FEIMSB+1] = 0xff, 0x9c // -100 steps
+	if fei, rssi := s.RxPacket(); fei != -6104 || rssi != -85 {
+		t.Errorf("expected fei -6104Hz and rssi -85dBm, got %dHz %ddBm", fei, rssi)
+	}
+}
@@ -18,12 +18,21 @@
 // function. The object will be unusable for further operation and the client code will have to
 // create and initialize a fresh object which will re-establish communication with the radio chip.
 //
+// Oscillator
+//
+// Most RFM9x modules use a crystal, but some clones and long-range boards use a
+// temperature-compensated oscillator (TCXO) wired to the XTA pin. Whether a TCXO is present
+// depends entirely on the board, it cannot be detected, and it must be specified using
+// RadioOpts.TCXO. Without it the radio runs off a free-running clock and the frequency is off by
+// several kHz, which also makes the FEI reported for received packets look wrong.
+//
 // Limitations
 //
 // This driver uses the SX1276 in LoRA mode only.
 //
-// Only the explicit header mode is supported, this means that spreading factor 6 cannot be
-// used and thus the maximum data rate available is 21875bps.
+// The explicit header mode is used by default. Spreading factor 6, which allows data rates up to
+// 37500bps, requires the implicit header mode, in which all packets have the fixed length set
+// using RadioOpts.PayloadLength and there are no valid header interrupts.
 //
 // The methods on the Radio object are not concurrency safe. Since they all deal with configuration
 // this should not pose difficulties. The Error function may be called from multiple goroutines
@@ -31,11 +40,13 @@
 package sx1276
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/tve/devices/internal/duty"
 	"periph.io/x/periph/conn/gpio"
 	"periph.io/x/periph/conn/spi"
 )
@@ -43,25 +54,101 @@ import (
 // Radio represents a Semtech SX127x LoRA radio.
 type Radio struct {
 	// configuration
-	spi     spi.Conn   // SPI device to access the radio
-	intrPin gpio.PinIn // interrupt pin for RX and TX interrupts
-	intrCnt int        // count interrupts
-	sync    byte       // sync byte
-	freq    uint32     // center frequency in Hz
-	config  string     // entry in Configs table being used
+	port     spi.Port   // SPI port, closed by Close if it is a PortCloser
+	spi      spi.Conn   // SPI device to access the radio
+	intrPin  gpio.PinIn // interrupt pin for RX and TX interrupts
+	intrCnt  int        // count interrupts
+	sync     byte       // sync byte
+	freq     uint32     // center frequency in Hz
+	config   string     // name of the modem configuration being used, see Config
+	conf     Config     // modem configuration being used
+	crc      bool       // true: CRC is generated and required on received packets
+	paGain   int        // gain in dB of an external PA, see RadioOpts.PAGainOffset
+	lnaGain  int        // gain in dB of an external LNA, see RadioOpts.LNAGainOffset
+	power    int        // output power in dBm applied by SetPower, incl. the external PA
+	outPin   OutputPin  // pin the antenna is connected to
+	rxDepth  int        // depth of the channel returned by RxChan
+	fixLen   int        // payload length in implicit header mode, 0 for explicit header mode
+	rxIdle   bool       // ReceiveTimeout leaves the radio in standby, see RadioOpts.RxStandby
+	iqRx     bool       // I/Q inverted when receiving
+	iqTx     bool       // I/Q inverted when transmitting
+	preamble int        // preamble length in symbols
+	tempOff  int        // calibration offset added to Temperature
 	// state
-	sync.Mutex           // guard concurrent access to the radio
-	mode       byte      // current operation mode
-	err        error     // persistent error
-	log        LogPrintf // function to use for logging
+	sync.Mutex               // guard concurrent access to the radio
+	mode       byte          // current operation mode
+	err        error         // persistent error
+	duty       *duty.Cycle   // duty-cycle limiter, nil if none
+	afc        *afc          // automatic frequency correction, nil if disabled
+	txRestore  bool          // restore the center frequency when TX completes
+	txConfig   string        // config to restore when TX completes, "" if none
+	txConf     Config        // configuration named txConfig
+	txDoneChan chan<- error  // notified when a transmission completes
+	hdrPin     gpio.PinIn    // pin connected to DIO3 for valid header interrupts, nil if none
+	hdrChan    chan<- Header // notified when a valid header has been received
+	hopPin     gpio.PinIn    // pin connected to DIO2 for FHSS change interrupts, nil if none
+	hops       []uint32      // FHSS hop table, nil if hopping is off
+	hopped     bool          // the current packet hopped away from the center frequency
+	dropped    uint64        // packets dropped because the RxChan channel was full
+	log        LogPrintf     // function to use for logging
 }
 
 // RadioOpts contains options used when initilizing a Radio.
 type RadioOpts struct {
-	Sync   byte      // RF sync byte
-	Freq   uint32    // center frequency in Hz, Khz, or Mhz
-	Config string    // entry in Configs table to use
-	Logger LogPrintf // function to use for logging
+	Sync      byte    // RF sync byte
+	Freq      uint32  // center frequency in Hz, Khz, or Mhz
+	Config    string  // entry in Configs table to use
+	TCXO      bool    // true: clock is provided by a TCXO on the XTA pin instead of a crystal
+	DutyCycle float64 // max fraction of time spent transmitting, e.g. 0.01 for 1%, 0: no limit
+	NoCRC     bool    // true: disable payload CRC generation and checking (default: CRC on)
+	// TxDone, if not nil, receives nil each time a transmission completes, or an error if the
+	// TX done interrupt fired but the radio did not flag the packet as sent. The interrupt is
+	// serviced by Receive (or ReceiveTimeout), which must be running for TxDone to be notified.
+	// Notifications are dropped if the channel is not ready to receive, so it should be
+	// buffered.
+	TxDone chan<- error
+	// ValidHeader, if not nil, is notified of the header of each packet being received. This
+	// requires the radio's DIO3 pin to be connected to HeaderPin. Notifications are dropped if
+	// the channel is not ready to receive.
+	ValidHeader chan<- Header
+	HeaderPin   gpio.PinIn
+	// HopPin is connected to the radio's DIO2 pin, which signals FHSS channel changes, and is
+	// required by SetHopTable.
+	HopPin gpio.PinIn
+	// OutputPin selects the pin the antenna is connected to, this determines the power range of
+	// SetPower. The default is PABoost, which is correct for RFM9x modules.
+	OutputPin OutputPin
+	// PAGainOffset and LNAGainOffset are the gains in dB of an external power amplifier and
+	// low-noise amplifier between the chip and the antenna. They do not change the hardware
+	// behavior, they only make the power passed to SetPower and the RSSI reported in RxPacket
+	// and by CurrentRSSI refer to the antenna instead of the chip.
+	PAGainOffset  int
+	LNAGainOffset int
+	RxBuffer      int // depth of the channel returned by RxChan, 0 for default
+	// ImplicitHeader selects the implicit header mode, in which packets have no header and all
+	// have the length PayloadLength. Transmitter and receiver must agree on the length and on
+	// whether there is a CRC. It is required for the SF6 configurations.
+	ImplicitHeader bool
+	PayloadLength  int
+	// RxStandby makes ReceiveTimeout leave the radio in standby instead of returning it to the
+	// mode it was in, which saves power between the receive windows of a battery powered node.
+	// The radio stays in standby until the next ReceiveTimeout or transmission.
+	RxStandby bool
+	// InvertIQRx and InvertIQTx invert the I and Q signals when receiving and transmitting,
+	// respectively. LoRaWAN gateways transmit downlinks with inverted I/Q and receive uplinks
+	// with normal I/Q, so a node talking to a gateway sets InvertIQRx while a single-channel
+	// gateway sets InvertIQTx. Both ends of a link must agree.
+	InvertIQRx bool
+	InvertIQTx bool
+	// PreambleLength is the number of preamble symbols, 0 for the default of 10, LoRaWAN uses 8.
+	// A longer preamble gives a receiver more time to detect a packet. The receiver's preamble
+	// length must be at least that of the transmitter. The chip requires at least 6 symbols,
+	// New returns an error for shorter lengths.
+	PreambleLength uint16
+	// TempOffset is added to the temperature measured by the chip, which only measures changes
+	// accurately, it can be determined by comparing Temperature to a reference thermometer.
+	TempOffset int
+	Logger     LogPrintf // function to use for logging
 }
 
 // Config describes the SX127x configuration to achieve a specific bandwidth, spreading factor,
@@ -82,10 +169,14 @@ var Configs = map[string]Config{
 	"lora.bw500cr45sf7":  {0x92, 0x74, 0x04, "31250bps, 20B in   14ms"},
 	"lora.bw125cr45sf7":  {0x72, 0x74, 0x04, " 7813bps, 20B in   57ms"},
 	"lora.bw125cr48sf12": {0x78, 0xc4, 0x04, "  183bps, 20B in 1712ms"},
-	"lora.bw31cr48sf9":   {0x48, 0x94, 0x04, "  275bps, 20B in  987ms"},
+	"lora.bw31cr48sf9":   {0x48, 0x94, 0x04, "  275bps, 20B in 1118ms"},
+	// Spreading factor 6 configurations, these require RadioOpts.ImplicitHeader.
+	"lora.bw500cr45sf6": {0x92, 0x64, 0x04, "37500bps, 20B in    7ms, implicit header"},
+	"lora.bw250cr45sf6": {0x82, 0x64, 0x04, "18750bps, 20B in   14ms, implicit header"},
+	"lora.bw125cr45sf6": {0x72, 0x64, 0x04, " 9375bps, 20B in   28ms, implicit header"},
 	// Configurations from LoRaWAN standard.
 	"lorawan.bw125sf12": {0x72, 0xc4, 0x0C, "  250bps, 20B in 1319ms, -137dBm"},
-	"lorawan.bw125sf11": {0x72, 0xb4, 0x0C, "  440bps, 20B in  660ms, -136dBm"},
+	"lorawan.bw125sf11": {0x72, 0xb4, 0x0C, "  440bps, 20B in  741ms, -136dBm"},
 	"lorawan.bw125sf10": {0x72, 0xa4, 0x04, "  980bps, 20B in  370ms, -134dBm"},
 	"lorawan.bw125sf9":  {0x72, 0x94, 0x04, " 1760bps, 20B in  185ms, -131dBm"},
 	"lorawan.bw125sf8":  {0x72, 0x84, 0x04, " 3125bps, 20B in  103ms, -128dBm"},
@@ -100,7 +191,12 @@ type RxPacket struct {
 	Rssi    int       // rssi in dB for packet
 	Fei     int       // frequency error in Hz for packet
 	Lna     int       // dB of LNA applied
-	At      time.Time // time of recv interrupt
+	At      time.Time // same as AtStart
+	// AtStart is the time the packet started, computed from the time of the RX done interrupt,
+	// AtDone, and the airtime of the packet assuming the transmitter uses the same preamble
+	// length.
+	AtStart time.Time
+	AtDone  time.Time
 }
 
 // Temporary is an interface implemented by errors that are temporary and thus worth retrying.
@@ -124,14 +220,34 @@ var debugPin gpio.PinOut
 // communicating with the device, use the Error() function to retrieve the error.
 func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 	r := &Radio{
-		intrPin: intr,
-		mode:    255,
-		err:     fmt.Errorf("sx1276 is not initialized"),
-		log:     func(format string, v ...interface{}) {},
+		port:       port,
+		intrPin:    intr,
+		mode:       255,
+		txDoneChan: opts.TxDone,
+		err:        fmt.Errorf("sx1276 is not initialized"),
+		log:        func(format string, v ...interface{}) {},
 	}
 	if opts.Logger != nil {
 		r.log = opts.Logger
 	}
+	if opts.DutyCycle > 0 {
+		r.duty = duty.New(opts.DutyCycle, duty.Window)
+	}
+	r.rxIdle = opts.RxStandby
+	r.tempOff = opts.TempOffset
+	if opts.ImplicitHeader {
+		if opts.PayloadLength < 1 || opts.PayloadLength > MaxPayload {
+			return nil, fmt.Errorf("sx1276: implicit header mode requires a payload length "+
+				"of 1..%d bytes", MaxPayload)
+		}
+		r.fixLen = opts.PayloadLength
+	} else if c, ok := Configs[opts.Config]; ok && c.SpreadingFactor() == 6 {
+		return nil, errors.New("sx1276: spreading factor 6 requires implicit header mode")
+	}
+	if opts.PreambleLength > 0 && opts.PreambleLength < minPreamble {
+		return nil, fmt.Errorf("sx1276: preamble length must be at least %d symbols",
+			minPreamble)
+	}
 
 	// Set SPI parameters and get a connection.
 	conn, err := port.DevParams(4*1000*1000, spi.Mode0, 8)
@@ -166,6 +282,14 @@ func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 	// Try to get the chip out of any mode it may be stuck in...
 	r.setMode(MODE_SLEEP)
 	time.Sleep(10 * time.Millisecond)
+
+	// Switch the clock input to the TCXO, if there is one. This has to happen in sleep mode
+	// and before the frequency is programmed, and the oscillator needs time to settle before
+	// the radio can be operated reliably.
+	if opts.TCXO {
+		r.writeReg(REG_TCXO, r.readReg(REG_TCXO)|TCXO_INPUT_ON)
+		time.Sleep(tcxoSettle)
+	}
 	r.setMode(MODE_STANDBY)
 
 	// Detect chip version.
@@ -183,9 +307,23 @@ func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 	}
 
 	// Configure the transmission parameters.
+	r.crc = !opts.NoCRC
+	r.paGain, r.lnaGain = opts.PAGainOffset, opts.LNAGainOffset
+	r.outPin = opts.OutputPin
+	r.rxDepth = opts.RxBuffer
+	if r.rxDepth <= 0 {
+		r.rxDepth = defRxBuffer
+	}
 	r.SetConfig(opts.Config)
 	r.SetFrequency(opts.Freq)
 	r.SetPower(17)
+	r.preamble = preambleLen
+	if opts.PreambleLength > 0 {
+		r.SetPreambleLength(opts.PreambleLength)
+	}
+	if opts.InvertIQRx || opts.InvertIQTx {
+		r.SetInvertIQ(opts.InvertIQRx, opts.InvertIQTx)
+	}
 
 	//r.sync = opts.Sync
 	r.spi.Tx([]byte{REG_SYNC | 0x80, opts.Sync}, []byte{0, 0})
@@ -202,7 +340,7 @@ func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 	}
 	// Tx a packet
 	r.log("Interrupt pin is %v", r.intrPin.Read())
-	if err := r.Transmit([]byte{0}); err != nil {
+	if err := r.transmit([]byte{0}); err != nil {
 		return nil, fmt.Errorf("sx1276: cannot perform test transmit: %s", err)
 	}
 	if !r.intrPin.WaitForEdge(time.Second) {
@@ -227,6 +365,25 @@ func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 	r.err = nil // can get an interrupt anytime now...
 	r.setMode(MODE_RX_CONT)
 
+	// Enable the valid header interrupt, this starts a goroutine so it has to be done once the
+	// radio is fully operational.
+	if opts.ValidHeader != nil && opts.HeaderPin != nil {
+		r.Lock()
+		err := r.initHeader(opts.HeaderPin, opts.ValidHeader)
+		r.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.HopPin != nil {
+		r.Lock()
+		err := r.initHop(opts.HopPin)
+		r.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return r, nil
 }
 
@@ -234,77 +391,517 @@ func New(port spi.Port, intr gpio.PinIn, opts RadioOpts) (*Radio, error) {
 // frequency can be specified at any scale (hz, khz, mhz). The frequency value is not checked
 // and invalid values will simply cause the radio not to work particularly well.
 func (r *Radio) SetFrequency(freq uint32) {
-	// accept any frequency scale as input, including KHz and MHz
+	r.freq = scaleFreq(freq)
+	r.writeFreq(r.corrected(r.freq))
+}
+
+// scaleFreq accepts any frequency scale as input, including KHz and MHz, and returns the
+// frequency in Hz.
+func scaleFreq(freq uint32) uint32 {
 	// multiply by 10 until freq >= 100 MHz
 	for freq > 0 && freq < 100000000 {
 		freq = freq * 10
 	}
+	return freq
+}
 
-	// Frequency steps are in units of (32,000,000 >> 19) = 61.03515625 Hz
-	// use multiples of 64 to avoid multi-precision arithmetic, i.e. 3906.25 Hz
-	// due to this, the lower 6 bits of the calculated factor will always be 0
-	// this is still 4 ppm, i.e. below the radio's 32 MHz crystal accuracy
-	// 868.0 MHz = 0xD90000, 868.3 MHz = 0xD91300, 915.0 MHz = 0xE4C000
-	frf := (freq << 2) / (32000000 >> 11)
-	//log.Printf("SetFreq: %d %d %02x %02x %02x", freq, uint32(frf<<6),
-	//	byte(frf>>10), byte(frf>>2), byte(frf<<6))
+// writeFreq programs the radio's FRF registers with the frequency in Hz.
+func (r *Radio) writeFreq(freq uint32) {
+	// Frequency steps are in units of (32,000,000 >> 19) = 61.03515625 Hz, the full resolution
+	// is used so AFC can make small corrections.
+	// 868.0 MHz = 0xD90000, 868.3 MHz = 0xD91333, 915.0 MHz = 0xE4C000
 	mode := r.mode
 	r.setMode(MODE_STANDBY)
-	r.writeReg(REG_FRFMSB, byte(frf>>10), byte(frf>>2), byte(frf<<6))
-	r.log("SetFreq %dHz -> %#x %#x %#x", freq, byte(frf>>10), byte(frf>>2), byte(frf<<6))
+	frf := frfRegs(freq)
+	r.writeReg(REG_FRFMSB, frf...)
+	r.log("SetFreq %dHz -> %#x", freq, frf)
 	r.setMode(mode)
-	r.freq = freq
+}
+
+// frfRegs returns the values of the 3 frequency registers for the given frequency in Hz.
+func frfRegs(freq uint32) []byte {
+	frf := (uint64(freq) << 19) / 32000000
+	return []byte{byte(frf >> 16), byte(frf >> 8), byte(frf)}
+}
+
+// corrected returns the frequency with the AFC correction applied.
+func (r *Radio) corrected(freq uint32) uint32 {
+	if r.afc == nil {
+		return freq
+	}
+	return uint32(int(freq) + r.afc.offset)
+}
+
+// SetAFC enables or disables automatic frequency correction. With AFC enabled the frequency
+// error estimated by the modem on received packets is tracked and the center frequency is
+// nudged to keep the receiver centered on the transmitters, which counters crystal drift over
+// long deployments. The frequency is corrected in steps using the median error of the last
+// afcWindow packets, packets with a low SNR are ignored, and the total correction is limited to a
+// quarter of the bandwidth. The correction also applies to transmissions. Disabling AFC returns
+// the radio to the nominal center frequency.
+func (r *Radio) SetAFC(enabled bool) {
+	r.log("SetAFC %v", enabled)
+	switch {
+	case enabled && r.afc == nil:
+		r.afc = &afc{}
+	case !enabled && r.afc != nil:
+		offset := r.afc.offset
+		r.afc = nil
+		if offset != 0 {
+			r.writeFreq(r.freq)
+		}
+	}
+}
+
+// AFCOffset returns the correction in Hz currently applied to the center frequency by AFC, a
+// positive value means that the transmitters are above the nominal center frequency. It returns
+// 0 if AFC is disabled.
+func (r *Radio) AFCOffset() int {
+	if r.afc == nil {
+		return 0
+	}
+	return r.afc.offset
 }
 
 // SetConfig sets the modem configuration using one of the entries in the Configs table.
-// If the entry specified does not exist, nothing is changed.
+// If the entry specified does not exist, or if it uses spreading factor 6 and the radio is not
+// in implicit header mode, nothing is changed. The low data rate optimization is turned on when
+// the symbol time exceeds 16ms, as required by the datasheet, even if the entry doesn't set it.
 func (r *Radio) SetConfig(config string) {
 	conf, found := Configs[config]
 	if !found {
 		return
 	}
+	r.setConfig(config, conf)
+}
+
+// setConfig implements SetConfig and SetConfigParams, programming the configuration and
+// recording it under the name.
+func (r *Radio) setConfig(config string, conf Config) {
+	sf6 := conf.SpreadingFactor() == 6
+	if sf6 && r.fixLen == 0 {
+		r.log("SetConfig %s: SF6 requires implicit header mode", config)
+		return
+	}
 	r.log("SetConfig %s", config)
 
 	mode := r.mode
 	r.setMode(MODE_STANDBY)
-	r.writeReg(REG_MODEMCONF1, conf.Conf1&^1)        // Explicit header mode
-	r.writeReg(REG_MODEMCONF2, conf.Conf2&0xf0|0x04) // TxSingle, CRC enable
-	r.writeReg(REG_MODEMCONF3, conf.Conf3|0x04)      // enable LNA AGC
+	conf1 := conf.Conf1 &^ 1 // Explicit header mode
+	if r.fixLen > 0 {
+		conf1 |= 1 // Implicit header mode
+		r.writeReg(REG_PAYLENGTH, byte(r.fixLen))
+	}
+	conf2 := conf.Conf2 & 0xf0 // TxSingle
+	if r.crc {
+		conf2 |= 0x04 // CRC enable
+	}
+	conf3 := conf.Conf3 | 0x04 // enable LNA AGC
+	if conf.lowDataRateOpt() {
+		conf3 |= 0x08 // required with symbols longer than 16ms
+	}
+	detectOpt, detectThr := byte(0x03), byte(0x0A) // SF7..SF12
+	if sf6 {
+		detectOpt, detectThr = 0x05, 0x0C
+	}
+	r.writeReg(REG_MODEMCONF1, conf1) // Bandwidth, coding rate, header mode
+	r.writeReg(REG_MODEMCONF2, conf2) // Spreading factor, TxSingle, CRC
+	r.writeReg(REG_MODEMCONF3, conf3) // Low data rate optimization, LNA AGC
+	r.writeReg(REG_DETECTOPT, r.readReg(REG_DETECTOPT)&^0x07|detectOpt)
+	r.writeReg(REG_DETECTTHR, detectThr)
 	r.setMode(mode)
-	r.config = config
+	r.config, r.conf = config, conf
 }
 
-// bandwidth returns the current signal bandwidth in Hz
-func (r *Radio) bandwidth() int {
+// SetConfigParams sets the modem configuration from a bandwidth in Hz, a spreading factor, and
+// a coding rate denominator, see MakeConfig. Config then returns a name like those of the
+// entries of the Configs table, e.g., "lora.bw125cr45sf7", but the configuration isn't added to
+// the table.
+func (r *Radio) SetConfigParams(bw, sf, cr int) error {
+	conf, err := MakeConfig(bw, sf, cr, false)
+	if err != nil {
+		return err
+	}
+	r.setConfig(fmt.Sprintf("lora.bw%dcr4%dsf%d", bw/1000, cr, sf), conf)
+	return nil
+}
+
+// SetCRC enables or disables the generation of a payload CRC when transmitting and the
+// requirement for a valid CRC when receiving. CRC is enabled by default. Due to the explicit
+// header the receiver can tell whether a packet carries a CRC, but with CRC enabled packets
+// without CRC are dropped silently (except for a log message), so transmitter and receiver need
+// to agree.
+func (r *Radio) SetCRC(on bool) {
+	r.log("SetCRC %v", on)
+	r.crc = on
+
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	conf2 := r.readReg(REG_MODEMCONF2) &^ 0x04
+	if on {
+		conf2 |= 0x04
+	}
+	r.writeReg(REG_MODEMCONF2, conf2)
+	r.setMode(mode)
+}
+
+// SetInvertIQ selects whether the I and Q signals are inverted when receiving and when
+// transmitting, see RadioOpts.InvertIQRx. Packets sent with the opposite polarity are not
+// received. By default neither is inverted.
+func (r *Radio) SetInvertIQ(rx, tx bool) {
+	r.log("SetInvertIQ rx:%v tx:%v", rx, tx)
+	r.iqRx, r.iqTx = rx, tx
+
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	iq, iq2 := r.readReg(REG_INVERTIQ)&^(INVERTIQ_RX|INVERTIQ_TX), byte(INVERTIQ2_OFF)
+	if rx {
+		iq |= INVERTIQ_RX
+		iq2 = INVERTIQ2_ON
+	}
+	if !tx {
+		iq |= INVERTIQ_TX
+	}
+	r.writeReg(REG_INVERTIQ, iq)
+	r.writeReg(REG_INVERTIQ2, iq2)
+	r.setMode(mode)
+}
+
+// SetPreambleLength sets the number of preamble symbols, see RadioOpts.PreambleLength. The chip
+// requires at least 6 symbols, shorter lengths are raised to that.
+func (r *Radio) SetPreambleLength(n uint16) {
+	if n < minPreamble {
+		n = minPreamble
+	}
+	r.log("SetPreambleLength %d", n)
+	r.preamble = int(n)
+
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	r.writeReg(REG_PREAMBLEMSB, byte(n>>8), byte(n))
+	r.setMode(mode)
+}
+
+// Bandwidth returns the signal bandwidth in Hz.
+func (c Config) Bandwidth() int {
 	return []int{
 		7800, 10400, 15600, 20800, 31250, 41700, 62500, 125000, 250000, 500000,
 		0, 0, 0, 0, 0, 0, // invalid settings
-	}[Configs[r.config].Conf1>>4]
+	}[c.Conf1>>4]
+}
+
+// SpreadingFactor returns the spreading factor, 6..12.
+func (c Config) SpreadingFactor() int {
+	return int(c.Conf2 >> 4)
+}
+
+// CodingRate returns the denominator of the coding rate, i.e., 5..8 for 4/5..4/8.
+func (c Config) CodingRate() int {
+	return int(c.Conf1>>1&0x7) + 4
+}
+
+// lowDataRateOpt returns whether the low data rate optimization is used, either because it is
+// set in Conf3 or because the symbol time exceeds 16ms, which requires it.
+func (c Config) lowDataRateOpt() bool {
+	return c.Conf3&0x08 != 0 || c.symbolTime() > 16*time.Millisecond
+}
+
+// ParseConfig looks up the named entry of the Configs table and returns its spreading factor,
+// bandwidth in Hz, and coding rate denominator, ok is false if the entry doesn't exist.
+func ParseConfig(name string) (sf, bw, cr int, ok bool) {
+	c, ok := Configs[name]
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return c.SpreadingFactor(), c.Bandwidth(), c.CodingRate(), true
 }
 
-// SetPower configures the radio for the specified output power. It only supports the high-power
-// amp because RFM9x modules don't have the lower-power amps connected to anything.
+// MakeConfig computes the register settings for a bandwidth in Hz, which must be one of the
+// values supported by the chip, i.e., 7800, 10400, 15600, 20800, 31250, 41700, 62500, 125000,
+// 250000, or 500000, a spreading factor of 7..12, and a coding rate denominator of 5..8 for
+// 4/5..4/8. The low data rate optimization is forced on when the symbol time exceeds 16ms, as
+// required by the datasheet. Spreading factor 6 is not supported because it requires the
+// implicit header mode, use one of the SF6 entries of the Configs table instead. The Info of
+// the result shows the bit rate and the airtime of a 20 byte packet.
+func MakeConfig(bwHz, sf, cr int, lowDataRateOpt bool) (Config, error) {
+	bw := -1
+	for i := 0; i < 16; i++ {
+		if (Config{Conf1: byte(i << 4)}).Bandwidth() == bwHz && bwHz != 0 {
+			bw = i
+			break
+		}
+	}
+	switch {
+	case bw < 0:
+		return Config{}, fmt.Errorf("sx1276: unsupported bandwidth %dHz", bwHz)
+	case sf == 6:
+		return Config{}, errors.New("sx1276: spreading factor 6 requires implicit header mode")
+	case sf < 7 || sf > 12:
+		return Config{}, fmt.Errorf("sx1276: invalid spreading factor %d", sf)
+	case cr < 5 || cr > 8:
+		return Config{}, fmt.Errorf("sx1276: invalid coding rate 4/%d", cr)
+	}
+	c := Config{
+		Conf1: byte(bw<<4 | (cr-4)<<1),
+		Conf2: byte(sf<<4 | 0x04), // CRC enable
+		Conf3: 0x04,               // LNA AGC
+	}
+	if lowDataRateOpt || c.lowDataRateOpt() {
+		c.Conf3 |= 0x08
+	}
+	bps := sf * bwHz * 4 / (cr << uint(sf))
+	ms := c.TimeOnAir(preambleLen, 20) / time.Millisecond
+	c.Info = fmt.Sprintf("%5dbps, 20B in %4dms", bps, ms)
+	return c, nil
+}
+
+// TimeOnAir returns the time it takes to transmit a packet with a payload of the given length
+// and a preamble of the given number of symbols using the Semtech formula from the datasheet
+// (section 4.1.1.7). It accounts for a payload CRC, which is on by default, and for the explicit
+// header, except with spreading factor 6, which requires the implicit header mode.
+func (c Config) TimeOnAir(preambleLen, payloadLen int) time.Duration {
+	return c.timeOnAir(preambleLen, payloadLen, true, c.SpreadingFactor() == 6)
+}
+
+// Airtime returns the time it takes to transmit a packet with a payload of the given length
+// using the named entry of the Configs table and the default preamble length, see
+// Config.TimeOnAir. It returns 0 if the entry doesn't exist.
+func Airtime(config string, payloadLen int) time.Duration {
+	c, found := Configs[config]
+	if !found {
+		return 0
+	}
+	return c.TimeOnAir(preambleLen, payloadLen)
+}
+
+// timeOnAir implements TimeOnAir with or without payload CRC and header.
+func (c Config) timeOnAir(preambleLen, payloadLen int, crcOn, implicit bool) time.Duration {
+	bw := c.Bandwidth()
+	if bw == 0 {
+		return 0
+	}
+	sf := c.SpreadingFactor()
+	cr := c.CodingRate() - 4 // 1..4 for 4/5..4/8
+	de := 0                  // low data rate optimization
+	if c.lowDataRateOpt() {
+		de = 1
+	}
+	ih, crc := 0, 0
+	if implicit {
+		ih = 1
+	}
+	if crcOn {
+		crc = 1
+	}
+
+	num := 8*payloadLen - 4*sf + 28 + 16*crc - 20*ih
+	den := 4 * (sf - 2*de)
+	symbols := 8
+	if num > 0 {
+		symbols += (num + den - 1) / den * (cr + 4)
+	}
+	// The preamble is followed by 4.25 symbols of sync word, hence the scaling by 4.
+	symbols4 := 4*(preambleLen+symbols) + 17
+	return time.Duration(symbols4) * (time.Second << uint(sf)) / time.Duration(4*bw)
+}
+
+// bandwidth returns the current signal bandwidth in Hz
+func (r *Radio) bandwidth() int {
+	return r.conf.Bandwidth()
+}
+
+// Bandwidth returns the current signal bandwidth in Hz.
+func (r *Radio) Bandwidth() int {
+	return r.bandwidth()
+}
+
+// Frequency returns the center frequency in Hz, without the correction applied by the AFC.
+func (r *Radio) Frequency() uint32 {
+	return r.freq
+}
+
+// Config returns the name of the entry in the Configs table currently in use.
+func (r *Radio) Config() string {
+	return r.config
+}
+
+// Power returns the output power in dBm applied by SetPower, which may differ from the power
+// requested due to clamping.
+func (r *Radio) Power() int {
+	return r.power
+}
+
+// SpreadingFactor returns the current spreading factor.
+func (r *Radio) SpreadingFactor() int {
+	return r.conf.SpreadingFactor()
+}
+
+// CodingRate returns the denominator of the current coding rate, i.e., 5..8 for 4/5..4/8.
+func (r *Radio) CodingRate() int {
+	return r.conf.CodingRate()
+}
+
+// TimeOnAir returns the time it takes to transmit a packet with a payload of the given length
+// using the current configuration. This can be used to keep within duty-cycle limits.
+func (r *Radio) TimeOnAir(payloadLen int) time.Duration {
+	return r.conf.timeOnAir(r.preamble, payloadLen, r.crc, r.fixLen > 0)
+}
+
+// SetPower configures the radio for the specified output power. By default it uses the
+// high-power amp because RFM9x modules don't have the lower-power amps connected to anything,
+// modules that have the RFO pin wired to the antenna instead need RadioOpts.OutputPin.
 //
 // The datasheet is confusing about how PaConfig gets set and the formula for OutputPower
 // looks incorrect. Fortunately Semtech provides reference code...
+//
+// With RadioOpts.PAGainOffset the power is the one at the antenna, the chip is set to the power
+// minus the gain of the external amplifier, clamped to the range of the output pin, i.e.,
+// 2dBm..20dBm for PA_BOOST and 0dBm..15dBm for RFO.
 func (r *Radio) SetPower(dBm byte) {
+	chip, max := int(dBm)-r.paGain, 20
+	if r.outPin == RFO {
+		max = 15
+	}
+	switch {
+	case chip < 0:
+		chip = 0
+	case chip > max:
+		chip = max
+	}
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	var chipDBm byte
+	if r.outPin == RFO {
+		var paConfig byte
+		paConfig, chipDBm = rfoRegs(byte(chip))
+		r.writeReg(REG_PACONFIG, paConfig)
+	} else {
+		var paConfig, paDac byte
+		paConfig, paDac, chipDBm = paRegs(byte(chip))
+		r.writeReg(REG_PACONFIG, paConfig)
+		r.writeReg(REG_PADAC, paDac)
+	}
+	r.setMode(mode)
+	r.power = int(chipDBm) + r.paGain
+	r.log("SetPower %ddBm (chip %ddBm %s)", r.power, chipDBm, r.outPin)
+}
+
+// SetOCP sets the current limit of the over-current protection of the power amplifier in mA and
+// returns the limit actually applied. The default of 150mA can cause +20dBm transmissions to
+// brown out on some boards while battery powered nodes benefit from a lower limit. The limit is
+// rounded down to what the chip can represent and clamped to 45mA..240mA.
+func (r *Radio) SetOCP(milliamps int) int {
+	trim, milliamps := ocpTrim(milliamps)
+	r.log("SetOCP %dmA", milliamps)
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	r.writeReg(REG_OCP, 0x20|trim) // OcpOn
+	r.setMode(mode)
+	return milliamps
+}
+
+// paRamps are the PA ramp times selected by the values 0..15 of the PaRamp field of REG_PARAMP.
+var paRamps = []time.Duration{
+	3400 * time.Microsecond, 2000 * time.Microsecond, 1000 * time.Microsecond,
+	500 * time.Microsecond, 250 * time.Microsecond, 125 * time.Microsecond,
+	100 * time.Microsecond, 62 * time.Microsecond, 50 * time.Microsecond,
+	40 * time.Microsecond, 31 * time.Microsecond, 25 * time.Microsecond,
+	20 * time.Microsecond, 15 * time.Microsecond, 12 * time.Microsecond,
+	10 * time.Microsecond,
+}
+
+// SetPARamp sets the ramp-up and ramp-down time of the power amplifier, which some spectral
+// mask requirements constrain, and returns the ramp time actually applied. The chip supports 16
+// discrete settings from 10us to 3.4ms (default 40us), the nearest one is used and values out of
+// that range are clamped.
+func (r *Radio) SetPARamp(d time.Duration) time.Duration {
+	code := paRampCode(d)
+	r.log("SetPARamp %s", paRamps[code])
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	r.writeReg(REG_PARAMP, r.readReg(REG_PARAMP)&0xf0|code)
+	r.setMode(mode)
+	return paRamps[code]
+}
+
+// paRampCode returns the PaRamp value for the ramp time nearest to d.
+func paRampCode(d time.Duration) byte {
+	best := 0
+	for i, ramp := range paRamps {
+		if abs(d-ramp) < abs(d-paRamps[best]) {
+			best = i
+		}
+	}
+	return byte(best)
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// ocpTrim returns the OcpTrim value for a current limit using the formula from the datasheet:
+// Imax = 45+5*OcpTrim for OcpTrim <= 15 (120mA), Imax = -30+10*OcpTrim for OcpTrim <= 27
+// (240mA), as well as the limit it results in.
+func ocpTrim(mA int) (byte, int) {
+	switch {
+	case mA < 45:
+		mA = 45
+	case mA > 240:
+		mA = 240
+	}
+	if mA < 130 {
+		trim := (mA - 45) / 5
+		if trim > 15 {
+			trim = 15
+		}
+		return byte(trim), 45 + 5*trim
+	}
+	trim := (mA + 30) / 10
+	return byte(trim), -30 + 10*trim
+}
+
+// paRegs returns the values of the PACONFIG and PADAC registers to produce the output power
+// using the high-power amp, as well as the power clamped to the supported range of 2..20dBm.
+func paRegs(dBm byte) (byte, byte, byte) {
 	switch {
 	case dBm < 2:
 		dBm = 2
 	case dBm > 20:
 		dBm = 20
 	}
-	r.log("SetPower %ddBm", dBm)
-	mode := r.mode
-	r.setMode(MODE_STANDBY)
 	if dBm > 17 {
-		r.writeReg(REG_PADAC, 0x87) // turn 20dBm mode on, this offsets the PACONFIG by 3
-		r.writeReg(REG_PACONFIG, 0xf0+dBm-5)
-	} else {
-		r.writeReg(REG_PACONFIG, 0xf0+dBm-2)
-		r.writeReg(REG_PADAC, 0x84)
+		// turn 20dBm mode on, this offsets the PACONFIG by 3
+		return 0xf0 + dBm - 5, 0x87, dBm
 	}
-	r.setMode(mode)
+	return 0xf0 + dBm - 2, 0x84, dBm
+}
+
+// rfoRegs returns the value of the PACONFIG register to produce the output power using the RFO
+// pin, as well as the power clamped to the supported range of 0..15dBm. With MaxPower at 7 the
+// max power is 15dBm and the output power is simply OutputPower.
+func rfoRegs(dBm byte) (byte, byte) {
+	if dBm > 15 {
+		dBm = 15
+	}
+	return 0x70 | dBm, dBm
+}
+
+// OutputPin selects the pin of the chip that the antenna is connected to.
+type OutputPin byte
+
+const (
+	PABoost OutputPin = iota // PA_BOOST pin, +2..+20dBm, used by the RFM9x modules
+	RFO                      // RFO_LF or RFO_HF pin, 0..+15dBm, used by some bare modules
+)
+
+func (p OutputPin) String() string {
+	if p == RFO {
+		return "RFO"
+	}
+	return "PA_BOOST"
 }
 
 // LogPrintf is a function used by the driver to print logging info.
@@ -322,6 +919,45 @@ func (r *Radio) SetLogger(l LogPrintf) {
 // Error returns any persistent error that may have been encountered.
 func (r *Radio) Error() error { return r.err }
 
+// ErrClosed is the persistent error of a radio that has been closed.
+var ErrClosed = errors.New("sx1276: radio is closed")
+
+// Close puts the radio to sleep and releases the interrupt pins and the SPI port, the latter is
+// closed if it is an spi.PortCloser. Afterwards Receive and Transmit fail with ErrClosed, which
+// includes a Receive blocked waiting for an interrupt: it returns within a second. Closing a
+// closed radio does nothing.
+func (r *Radio) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.err == ErrClosed {
+		return nil
+	}
+	r.log("Close")
+	r.setMode(MODE_SLEEP)
+	r.err = ErrClosed
+
+	err := r.intrPin.In(gpio.Float, gpio.NoEdge)
+	if err != nil {
+		err = fmt.Errorf("sx1276: error releasing interrupt pin: %s", err)
+	}
+	if r.hdrPin != nil {
+		if e := r.hdrPin.In(gpio.Float, gpio.NoEdge); e != nil && err == nil {
+			err = fmt.Errorf("sx1276: error releasing header pin: %s", e)
+		}
+	}
+	if r.hopPin != nil {
+		if e := r.hopPin.In(gpio.Float, gpio.NoEdge); e != nil && err == nil {
+			err = fmt.Errorf("sx1276: error releasing hop pin: %s", e)
+		}
+	}
+	if pc, ok := r.port.(spi.PortCloser); ok {
+		if e := pc.Close(); e != nil && err == nil {
+			err = fmt.Errorf("sx1276: error closing SPI port: %s", e)
+		}
+	}
+	return err
+}
+
 //
 
 // setMode changes the radio's operating mode and changes the interrupt cause (if necessary).
@@ -338,7 +974,11 @@ func (r *Radio) setMode(mode byte) {
 	case MODE_TX:
 		r.writeReg(REG_DIOMAPPING1, 0x40) // TxDone
 	case MODE_RX_CONT, MODE_RX_SINGLE:
-		r.writeReg(REG_DIOMAPPING1, 0x00) // RxDone
+		dio := byte(0x00) // RxDone
+		if r.hdrPin != nil {
+			dio |= headerDIO
+		}
+		r.writeReg(REG_DIOMAPPING1, dio)
 	default:
 		// Mode used when switching, make sure we don't get an interupt.
 		r.writeReg(REG_DIOMAPPING1, 0xc0) // No intr
@@ -355,7 +995,7 @@ func (r *Radio) setMode(mode byte) {
 // interrupt handler.
 func (r *Radio) receiving() bool {
 	// Can't be receiving if we're not in the right mode...
-	if r.mode != MODE_RX_CONT {
+	if r.mode != MODE_RX_CONT && r.mode != MODE_RX_SINGLE {
 		return false
 	}
 	st := r.readReg(REG_MODEMSTAT)
@@ -363,9 +1003,15 @@ func (r *Radio) receiving() bool {
 	return st&0xA != 0 || irq&IRQ_RXDONE != 0
 }
 
-// worker is an endless loop that processes interrupts for reception as well as packets
-// enqueued for transmit.
+// Receive services the radio's interrupts until a packet has been received or an error occurs.
+// It must be called continuously, also in order to complete transmissions.
 func (r *Radio) Receive() (*RxPacket, error) {
+	return r.ReceiveContext(context.Background())
+}
+
+// ReceiveContext is like Receive but also returns ctx.Err() when ctx is done, which is checked
+// before waiting for an interrupt, i.e., at least once a second.
+func (r *Radio) ReceiveContext(ctx context.Context) (*RxPacket, error) {
 	r.Lock()
 	defer r.Unlock()
 
@@ -374,10 +1020,18 @@ func (r *Radio) Receive() (*RxPacket, error) {
 	intr := r.intrPin.Read() == gpio.High
 	for {
 		if !intr {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+			}
 			r.Unlock()
 			intr = r.intrPin.WaitForEdge(1 * time.Second)
 			r.Lock()
 		}
+		if r.err != nil {
+			return nil, r.err
+		}
 
 		if !intr && r.intrPin.Read() == gpio.High {
 			// Sometimes WaitForEdge times out yet the interrupt pin is
@@ -390,31 +1044,310 @@ func (r *Radio) Receive() (*RxPacket, error) {
 		if r.intrPin.Read() == gpio.High {
 			switch {
 			case r.mode == MODE_RX_CONT:
+				// rx clears the IRQ itself so it doesn't lose a packet
+				// that arrives while it's running.
 				pkt, err := r.rx(time.Now())
 				if pkt != nil || err != nil {
 					return pkt, err
 				}
 			case r.mode == MODE_TX:
-				r.setMode(MODE_RX_CONT)
+				r.txDone()
 			default:
 				r.log("Spurious interrupt in mode=%x", r.mode)
+				r.writeReg(REG_IRQFLAGS, 0xff) // clear IRQ
+			}
+		}
+	}
+}
+
+// rssiOffset converts the RSSI registers to dBm, the datasheet specifies -164 for the low
+// frequency port (RFI_LF) of the frequency bands used by this driver.
+const rssiOffset = -164
+
+// rssiSettle is the time it takes after the start of RX for the RSSI reading to be valid.
+const rssiSettle = time.Millisecond
+
+// CurrentRSSI returns the instantaneous signal strength in dBm on the current frequency, for
+// example to pick a quiet channel before transmitting. The radio has to be receiving to measure
+// the RSSI: if it isn't, it is switched to continuous receive just long enough to take a
+// reading, without servicing any packet that might arrive in the meantime. While transmitting the
+// RSSI cannot be measured and 0 is returned.
+func (r *Radio) CurrentRSSI() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.currentRSSI()
+}
+
+// ReadRSSI returns the instantaneous signal strength like CurrentRSSI but returns the persistent
+// error, if any, and a Temporary error while transmitting.
+func (r *Radio) ReadRSSI() (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	switch {
+	case r.err != nil:
+		return 0, r.err
+	case r.mode == MODE_TX:
+		return 0, busyError{"radio is busy"}
+	}
+	return r.currentRSSI(), nil
+}
+
+// currentRSSI implements CurrentRSSI, the lock must be held.
+func (r *Radio) currentRSSI() int {
+	switch r.mode {
+	case MODE_TX:
+		return 0
+	case MODE_RX_CONT, MODE_RX_SINGLE:
+	default:
+		mode := r.mode
+		r.setMode(MODE_RX_CONT)
+		time.Sleep(rssiSettle)
+		defer r.setMode(mode)
+	}
+	return rssiOffset + int(r.readReg(REG_CURRSSI)) - r.lnaGain
+}
+
+// RxTimeoutError is returned by ReceiveTimeout if no packet has been received in time.
+type RxTimeoutError struct {
+	Timeout time.Duration // the timeout passed to ReceiveTimeout
+}
+
+func (e RxTimeoutError) Error() string {
+	return fmt.Sprintf("sx1276: no packet received within %s", e.Timeout)
+}
+
+func (e RxTimeoutError) Temporary() bool { return true }
+
+// maxSymbTimeout is the max value of the 10-bit symbol timeout of the single receive mode.
+const maxSymbTimeout = 1023
+
+// ReceiveTimeout receives a packet like Receive but returns an RxTimeoutError if no packet has
+// started to arrive within d, which suits a protocol where a reply is expected within a known
+// window. If a transmission is in progress, for example the request just passed to Transmit, the
+// window starts once it completes. When d fits into the chip's symbol timeout (1023 symbols,
+// i.e., about 1s at SF7 and 125kHz) the single receive mode is used, in which the chip itself
+// stops listening at the end of the window, otherwise continuous receive mode with a deadline
+// is used. Either way a packet that arrives by the end of the window is received in full and the
+// radio returns to the mode it was in before, or to continuous receive if it was transmitting,
+// unless RadioOpts.RxStandby is set, in which case it is left in standby.
+func (r *Radio) ReceiveTimeout(d time.Duration) (*RxPacket, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	mode := r.mode
+	switch {
+	case r.rxIdle:
+		mode = MODE_STANDBY
+	case mode == MODE_TX:
+		mode = MODE_RX_CONT // where txDone goes
+	}
+	defer func() {
+		if r.err == nil {
+			r.setMode(mode)
+		}
+	}()
+
+	var deadline time.Time
+	start := func() {
+		deadline = time.Now().Add(d)
+		symb := r.conf.symbolTime()
+		n := (d + symb - 1) / symb
+		if n > maxSymbTimeout {
+			r.setMode(MODE_RX_CONT)
+			return
+		}
+		if n < 4 {
+			n = 4 // minimum supported by the chip
+		}
+		r.setMode(MODE_STANDBY)
+		r.writeReg(REG_MODEMCONF2, r.readReg(REG_MODEMCONF2)&^0x03|byte(n>>8))
+		r.writeReg(REG_SYMBTIMEOUT, byte(n))
+		r.writeReg(REG_IRQFLAGS, IRQ_RXTIMEOUT) // clear stale IRQ
+		r.setMode(MODE_RX_SINGLE)
+	}
+	if r.mode != MODE_TX {
+		start()
+	}
+
+	for {
+		wait := time.Second
+		if !deadline.IsZero() {
+			wait = time.Until(deadline)
+			if r.mode == MODE_RX_SINGLE && r.readReg(REG_IRQFLAGS)&IRQ_RXTIMEOUT != 0 {
+				// The chip has given up and gone back to standby.
+				r.writeReg(REG_IRQFLAGS, IRQ_RXTIMEOUT)
+				r.mode = MODE_STANDBY
+				wait = 0
+			}
+			if wait <= 0 {
+				if !r.receiving() {
+					return nil, RxTimeoutError{d}
+				}
+				// A packet is arriving, poll until it's complete.
+				wait = 10 * time.Millisecond
+			}
+			if wait > time.Second {
+				wait = time.Second
+			}
+		}
+
+		if r.intrPin.Read() != gpio.High {
+			r.Unlock()
+			r.intrPin.WaitForEdge(wait)
+			r.Lock()
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		if r.intrPin.Read() != gpio.High {
+			continue
+		}
+		switch r.mode {
+		case MODE_RX_CONT, MODE_RX_SINGLE:
+			pkt, err := r.rx(time.Now())
+			if pkt != nil || err != nil {
+				return pkt, err
 			}
+			if r.mode == MODE_RX_SINGLE {
+				// The chip went to standby after the bad packet, continue in continuous
+				// mode for the rest of the window.
+				r.mode = MODE_STANDBY
+				r.setMode(MODE_RX_CONT)
+			}
+		case MODE_TX:
+			r.txDone()
+			start()
+		default:
+			r.log("Spurious interrupt in mode=%x", r.mode)
 			r.writeReg(REG_IRQFLAGS, 0xff) // clear IRQ
 		}
 	}
 }
 
-// Transmit switches the radio's mode and starts transmitting a packet.
+// Transmit switches the radio's mode and starts transmitting a packet. The payload must be 1 to
+// MaxPayload bytes long, or exactly RadioOpts.PayloadLength bytes long in implicit header mode,
+// otherwise a PayloadLenError is returned. Transmit returns as soon as the packet has been loaded
+// into the radio, RadioOpts.TxDone signals when it has been sent.
+//
+// If a duty cycle is specified in RadioOpts the airtime of all packets sent during the past hour
+// is accounted for and Transmit returns a Temporary error if sending the packet now would exceed
+// the budget.
 func (r *Radio) Transmit(payload []byte) error {
 	r.Lock()
 	defer r.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return r.transmit(payload)
+}
+
+// TransmitOn transmits a packet like Transmit but on the specified frequency, which can be
+// given at any scale like for SetFrequency. The center frequency is restored once the
+// transmission completes, which is detected by Receive, so a receive loop must be running.
+// Changing the frequency adds a few SPI transactions, i.e. on the order of 100us, to the
+// latency of Transmit; the synthesizer settles as part of the normal TX ramp-up. The AFC
+// correction, if any, also applies to freq.
+func (r *Radio) TransmitOn(freq uint32, payload []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return r.err
+	}
 
 	if r.receiving() {
 		return busyError{"radio is busy"}
 	}
-	// limit the payload to valid lengths
-	if len(payload) > 250 {
-		payload = payload[:250]
+	freq = scaleFreq(freq)
+	mode := r.mode
+	r.setMode(MODE_STANDBY)
+	r.writeFreq(r.corrected(freq))
+	r.txRestore = freq != r.freq
+	if err := r.transmit(payload); err != nil {
+		r.restoreFreq()
+		r.setMode(mode)
+		return err
+	}
+	return nil
+}
+
+// TransmitWithConfig transmits a packet like Transmit but using the specified entry of the
+// Configs table, for example to experiment with adaptive data rates. The previous configuration
+// is restored once the transmission completes, which is detected by Receive, so a receive loop
+// must be running. An error is returned if the entry doesn't exist or if it cannot be used, i.e.
+// spreading factor 6 in explicit header mode. The duty-cycle accounting uses the airtime at the
+// specified configuration.
+func (r *Radio) TransmitWithConfig(payload []byte, config string) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	conf, found := Configs[config]
+	switch {
+	case !found:
+		return fmt.Errorf("sx1276: unknown config %q", config)
+	case conf.SpreadingFactor() == 6 && r.fixLen == 0:
+		return errors.New("sx1276: spreading factor 6 requires implicit header mode")
+	}
+
+	if r.receiving() {
+		return busyError{"radio is busy"}
+	}
+	prev, prevConf, mode := r.config, r.conf, r.mode
+	r.setMode(MODE_STANDBY)
+	r.setConfig(config, conf)
+	if config != prev && r.txConfig == "" {
+		r.txConfig, r.txConf = prev, prevConf // else a previous TransmitWithConfig is pending
+	}
+	if err := r.transmit(payload); err != nil {
+		r.restoreConfig()
+		r.setMode(mode)
+		return err
+	}
+	return nil
+}
+
+// MaxPayload is the max length of a packet's payload.
+const MaxPayload = 255
+
+// PayloadLenError is returned when transmitting a payload that is empty or longer than
+// MaxPayload, or that doesn't have the fixed length in implicit header mode.
+type PayloadLenError struct {
+	Len   int // length of the payload
+	Fixed int // length required in implicit header mode, 0 in explicit header mode
+}
+
+func (e PayloadLenError) Error() string {
+	if e.Fixed > 0 {
+		return fmt.Sprintf("sx1276: invalid payload length %d, must be %d", e.Len, e.Fixed)
+	}
+	return fmt.Sprintf("sx1276: invalid payload length %d, must be 1..%d", e.Len, MaxPayload)
+}
+
+// transmit starts the transmission of a packet, the lock must be held.
+func (r *Radio) transmit(payload []byte) error {
+	switch {
+	case r.fixLen > 0 && len(payload) != r.fixLen:
+		return PayloadLenError{len(payload), r.fixLen}
+	case len(payload) == 0 || len(payload) > MaxPayload:
+		return PayloadLenError{Len: len(payload)}
+	}
+	if r.receiving() {
+		return busyError{"radio is busy"}
+	}
+	if r.duty != nil {
+		now := time.Now()
+		air := r.TimeOnAir(len(payload))
+		if air > r.duty.Budget() {
+			return fmt.Errorf("sx1276: packet airtime %s exceeds duty-cycle budget %s",
+				air, r.duty.Budget())
+		}
+		if wait := r.duty.Wait(now, air); wait > 0 {
+			return busyError{fmt.Sprintf("duty-cycle budget exhausted, retry in %s", wait)}
+		}
+		r.duty.Record(now, air)
 	}
 	r.setMode(MODE_STANDBY)
 
@@ -427,8 +1360,49 @@ func (r *Radio) Transmit(payload []byte) error {
 	return nil
 }
 
+// txDone handles the TX done interrupt, notifies RadioOpts.TxDone, and returns to continuous
+// receive mode.
+func (r *Radio) txDone() {
+	if r.txDoneChan != nil {
+		var err error
+		if irq := r.readReg(REG_IRQFLAGS); irq&IRQ_TXDONE == 0 {
+			err = fmt.Errorf("sx1276: TX done interrupt, but packet not transmitted (%#x)", irq)
+		}
+		select {
+		case r.txDoneChan <- err:
+		default:
+		}
+	}
+	r.setMode(MODE_STANDBY)
+	r.restoreFreq()
+	r.restoreConfig()
+	r.setMode(MODE_RX_CONT)
+	r.writeReg(REG_IRQFLAGS, 0xff) // clear IRQ
+}
+
+// restoreFreq switches back to the center frequency after TransmitOn or after a packet hopped
+// to other frequencies.
+func (r *Radio) restoreFreq() {
+	if r.txRestore || r.hopped {
+		r.writeFreq(r.corrected(r.freq))
+		r.txRestore, r.hopped = false, false
+	}
+}
+
+// restoreConfig switches back to the modem configuration after TransmitWithConfig.
+func (r *Radio) restoreConfig() {
+	if r.txConfig != "" {
+		r.setConfig(r.txConfig, r.txConf)
+		r.txConfig = ""
+	}
+}
+
+// rx handles a receive interrupt that occurred at the given time. It clears the interrupt flags
+// it has seen such that a packet arriving while it runs raises the interrupt again.
 func (r *Radio) rx(at time.Time) (*RxPacket, error) {
 	irq := r.readReg(REG_IRQFLAGS)
+	r.writeReg(REG_IRQFLAGS, irq) // clear IRQ
+	r.restoreFreq()               // be ready for the next packet if this one hopped
 	switch {
 	case irq&IRQ_CRCERR != 0:
 		r.log("RX CRC error (%#x)", irq)
@@ -439,23 +1413,40 @@ func (r *Radio) rx(at time.Time) (*RxPacket, error) {
 	case irq != 0x40:
 		r.log("RX OK??? (%#x)", irq)
 	}
-	if (r.readReg(REG_HOPCHAN) & 0x40) == 0 {
+	if r.crc && r.fixLen == 0 && (r.readReg(REG_HOPCHAN)&0x40) == 0 {
 		r.log("RX packet without CRC")
 		return nil, nil
 	}
 
 	// Grab the payload
-	len := r.readReg(REG_RXBYTES)
+	n := r.rxBytes()
+	if n == 0 {
+		r.log("RX packet with zero length")
+		return nil, nil
+	}
 	ptr := r.readReg(REG_FIFORXCURR)
 	r.writeReg(REG_FIFOPTR, ptr)
-	var wBuf, rBuf [257]byte
+	var wBuf, rBuf [MaxPayload + 1]byte
 	wBuf[0] = REG_FIFO
-	r.spi.Tx(wBuf[:len+1], rBuf[:len+1])
+	r.spi.Tx(wBuf[:int(n)+1], rBuf[:int(n)+1])
+
+	// In continuous RX mode the next packet may be coming in while the FIFO is being read. If it
+	// completed, the byte count and pointer read above may be inconsistent with the FIFO
+	// contents, and if it is long enough it may have wrapped around the FIFO and overwritten
+	// the bytes just read. Either way the packet cannot be trusted.
+	if r.readReg(REG_FIFORXCURR) != ptr || r.rxBytes() != n {
+		r.log("RX FIFO changed while reading packet, dropping it")
+		return nil, nil
+	}
+	if next := r.readReg(REG_FIFORXLAST) - (ptr + n - 1); int(next)+int(n) > 256 {
+		r.log("RX FIFO overrun by next packet, dropping it")
+		return nil, nil
+	}
 
 	// Grab SNR, RSSI and FEI
 	snr := int(int8(r.readReg(REG_PKTSNR))) / 4
 	rssi := int(r.readReg(REG_PKTRSSI))
-	rssi = -164 + rssi + rssi>>4
+	rssi = rssiOffset + rssi + rssi>>4 - r.lnaGain
 	if snr < 0 {
 		rssi += snr
 	}
@@ -467,17 +1458,53 @@ func (r *Radio) rx(at time.Time) (*RxPacket, error) {
 	fei := int(f2 * int64(r.bandwidth()) / 953674) // 953674=32Mhz*500/2^24
 	lna := int(r.readReg(REG_LNA) >> 5)
 
+	if r.afc != nil && r.afc.update(fei, snr, r.bandwidth()/4) {
+		r.log("AFC correction %dHz", r.afc.offset)
+		r.writeFreq(r.corrected(r.freq))
+	}
+
 	// Construct RxPacket and return it.
-	pkt := RxPacket{Payload: rBuf[1 : len+1], Snr: snr, Rssi: rssi, Fei: fei, Lna: lna, At: at}
+	start := at.Add(-r.TimeOnAir(int(n)))
+	pkt := RxPacket{Payload: rBuf[1 : int(n)+1], Snr: snr, Rssi: rssi, Fei: fei, Lna: lna,
+		At: start, AtStart: start, AtDone: at}
 	return &pkt, nil
 }
 
-// logRegs is a debug helper function to print almost all the sx1276's registers.
-func (r *Radio) logRegs() {
+// rxBytes returns the length of the packet received, which is fixed in implicit header mode.
+func (r *Radio) rxBytes() byte {
+	if r.fixLen > 0 {
+		return byte(r.fixLen)
+	}
+	return r.readReg(REG_RXBYTES)
+}
+
+// DumpRegisters reads registers 0x01 through 0x70 and returns their values indexed by address,
+// for example to compare modem configurations or for diagnostics. The FIFO register, 0x00, is
+// left out since reading it would consume data.
+func (r *Radio) DumpRegisters() map[byte]byte {
+	r.Lock()
+	defer r.Unlock()
+	regs := r.readRegs()
+	m := make(map[byte]byte, len(regs)-1)
+	for addr := 1; addr < len(regs); addr++ {
+		m[byte(addr)] = regs[addr]
+	}
+	return m
+}
+
+// readRegs reads registers 0x01 through 0x70 in one burst, the result is indexed by address and
+// its first element is 0.
+func (r *Radio) readRegs() [0x71]byte {
 	var buf, regs [0x71]byte
 	buf[0] = 1
 	r.spi.Tx(buf[:], regs[:])
 	regs[0] = 0 // no real data there
+	return regs
+}
+
+// logRegs is a debug helper function to print almost all the sx1276's registers.
+func (r *Radio) logRegs() {
+	regs := r.readRegs()
 	r.log("     0  1  2  3  4  5  6  7  8  9  A  B  C  D  E  F")
 	for i := 0; i < len(regs); i += 16 {
 		line := fmt.Sprintf("%02x:", i)
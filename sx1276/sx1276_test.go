@@ -0,0 +1,1018 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tve/devices/internal/duty"
+	"periph.io/x/periph/conn"
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/spi"
+)
+
+// fakeSPI simulates the sx1276 register file and FIFO.
+type fakeSPI struct {
+	regs       [0x80]byte
+	fifo       [256]byte
+	onFifoRead func(f *fakeSPI)    // called after the FIFO has been read
+	onTx       func()              // called when the radio is switched to TX mode
+	cad        func(freq int) bool // reports activity on the frequency for a CAD
+	rssi       func(freq int) byte // returns REG_CURRSSI for the frequency
+	opModes    []byte              // values written to REG_OPMODE
+}
+
+func (f *fakeSPI) Tx(w, r []byte) error {
+	addr := w[0] & 0x7f
+	data := w[1:]
+	switch {
+	case addr == REG_FIFO && w[0]&0x80 != 0:
+		for _, b := range data {
+			f.fifo[f.regs[REG_FIFOPTR]] = b
+			f.regs[REG_FIFOPTR]++
+		}
+	case addr == REG_FIFO:
+		for i := range data {
+			r[i+1] = f.fifo[f.regs[REG_FIFOPTR]]
+			f.regs[REG_FIFOPTR]++
+		}
+		if f.onFifoRead != nil {
+			f.onFifoRead(f)
+		}
+	case addr == REG_IRQFLAGS && w[0]&0x80 != 0:
+		f.regs[addr] &^= data[0] // write 1 to clear
+	case addr == REG_OPMODE && w[0]&0x80 != 0:
+		f.regs[addr] = data[0]
+		f.opModes = append(f.opModes, data[0])
+		if data[0]&0x07 == MODE_TX && f.onTx != nil {
+			f.onTx()
+		}
+		if data[0]&0x07 == MODE_CAD && f.cad != nil {
+			f.regs[REG_IRQFLAGS] |= IRQ_CADDONE
+			if f.cad(f.rxFreq()) {
+				f.regs[REG_IRQFLAGS] |= IRQ_CADDETECT
+			}
+		}
+	case w[0]&0x80 != 0:
+		copy(f.regs[addr:], data)
+	default:
+		copy(r[1:], f.regs[addr:])
+		if addr == REG_CURRSSI && f.rssi != nil {
+			r[1] = f.rssi(f.rxFreq())
+		}
+	}
+	return nil
+}
+
+func (f *fakeSPI) Duplex() conn.Duplex            { return conn.Full }
+func (f *fakeSPI) TxPackets(p []spi.Packet) error { return nil }
+
+// receivePacket places a packet with CRC into the fake's FIFO as if the radio had received it.
+func (f *fakeSPI) receivePacket(payload []byte) {
+	f.receive(payload, true)
+}
+
+// receive places a packet into the fake's FIFO as if the radio had received it, crc indicates
+// whether the packet header signaled a payload CRC.
+func (f *fakeSPI) receive(payload []byte, crc bool) {
+	ptr := f.regs[REG_FIFORXLAST] + 1
+	for i, b := range payload {
+		f.fifo[ptr+byte(i)] = b
+	}
+	f.regs[REG_FIFORXCURR] = ptr
+	f.regs[REG_RXBYTES] = byte(len(payload))
+	f.regs[REG_FIFORXLAST] = ptr + byte(len(payload)) - 1
+	f.regs[REG_IRQFLAGS] |= IRQ_RXDONE
+	f.regs[REG_HOPCHAN] &^= 0x40
+	if crc {
+		f.regs[REG_HOPCHAN] |= 0x40 // CRC on
+	}
+}
+
+// transmitTo sends the packet that has been loaded into the fake's FIFO to another fake as if it
+// had been transmitted over the air.
+func (f *fakeSPI) transmitTo(rx *fakeSPI) {
+	pkt := f.fifo[f.regs[REG_FIFOTXBASE]:][:f.regs[REG_PAYLENGTH]]
+	rx.receive(pkt, f.regs[REG_MODEMCONF2]&0x04 != 0)
+}
+
+// rxFreq returns the frequency programmed into the fake's FRF registers.
+func (f *fakeSPI) rxFreq() int {
+	frf := uint64(f.regs[REG_FRFMSB])<<16 | uint64(f.regs[REG_FRFMSB+1])<<8 |
+		uint64(f.regs[REG_FRFMSB+2])
+	return int((frf * 32000000) >> 19)
+}
+
+// newFakeRadio returns a Radio in continuous receive mode connected to a fakeSPI.
+func newFakeRadio(t *testing.T) (*Radio, *fakeSPI) {
+	f := &fakeSPI{}
+	f.regs[REG_FIFORXLAST] = 0xff
+	r := &Radio{spi: f, config: "lorawan.bw125sf7", conf: Configs["lorawan.bw125sf7"], crc: true,
+		mode: MODE_RX_CONT, log: t.Logf, preamble: preambleLen}
+	return r, f
+}
+
+// airtimes are the times for a 20 byte payload with a preamble of 8 as calculated by Semtech's
+// LoRa modem calculator, rounded to the millisecond, with the low data rate optimization on when
+// the symbol time exceeds 16ms.
+var airtimes = map[string]time.Duration{
+	"lora.bw500cr45sf7":  14 * time.Millisecond,
+	"lora.bw125cr45sf7":  57 * time.Millisecond,
+	"lora.bw125cr48sf12": 1712 * time.Millisecond,
+	"lora.bw31cr48sf9":   1118 * time.Millisecond,
+	"lorawan.bw125sf12":  1319 * time.Millisecond,
+	"lorawan.bw125sf11":  741 * time.Millisecond,
+	"lorawan.bw125sf10":  371 * time.Millisecond,
+	"lorawan.bw125sf9":   185 * time.Millisecond,
+	"lorawan.bw125sf8":   103 * time.Millisecond,
+	"lorawan.bw125sf7":   57 * time.Millisecond,
+	"lorawan.bw250sf7":   28 * time.Millisecond,
+}
+
+func TestTimeOnAir(t *testing.T) {
+	for n, want := range airtimes {
+		conf, found := Configs[n]
+		if !found {
+			t.Fatalf("Config %s not found", n)
+		}
+		got := conf.TimeOnAir(8, 20).Round(time.Millisecond)
+		if got != want {
+			t.Errorf("TimeOnAir %s: got %s expected %s", n, got, want)
+		}
+	}
+}
+
+func TestAirtime(t *testing.T) {
+	// The driver's preamble is 2 symbols longer than the one used for the airtimes table.
+	for n, want := range airtimes {
+		want += 2 * Configs[n].symbolTime()
+		if got := Airtime(n, 20); got-want > time.Millisecond || want-got > time.Millisecond {
+			t.Errorf("Airtime %s: got %s expected %s", n, got, want)
+		}
+	}
+	// SF7/125kHz: (10+4.25) preamble + 8+7*5 payload symbols of 1.024ms.
+	if got := Airtime("lorawan.bw125sf7", 20); got != 58624*time.Microsecond {
+		t.Errorf("Airtime: got %s expected 58.624ms", got)
+	}
+	if got := Airtime("lora.bogus", 20); got != 0 {
+		t.Errorf("expected 0 for an unknown config, got %s", got)
+	}
+}
+
+func TestRxPacketAt(t *testing.T) {
+	r, f := newFakeRadio(t)
+	f.receivePacket([]byte("hello"))
+	done := time.Now()
+	pkt, err := r.rx(done)
+	if pkt == nil || err != nil {
+		t.Fatalf("expected packet, got %+v, err %v", pkt, err)
+	}
+	start := done.Add(-Airtime("lorawan.bw125sf7", 5))
+	if !pkt.AtDone.Equal(done) || !pkt.AtStart.Equal(start) || !pkt.At.Equal(start) {
+		t.Errorf("expected packet from %s to %s, got %+v", start, done, pkt)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	// The names spell out the bandwidth in kHz (truncated), the coding rate (LoRaWAN uses 4/5),
+	// and the spreading factor.
+	re := regexp.MustCompile(`^(lora|lorawan)\.bw(\d+)(?:cr4(\d))?sf(\d+)$`)
+	for name := range Configs {
+		m := re.FindStringSubmatch(name)
+		if m == nil {
+			t.Errorf("%s: cannot parse name", name)
+			continue
+		}
+		wantBW, _ := strconv.Atoi(m[2])
+		wantCR, _ := strconv.Atoi(m[3])
+		if wantCR == 0 {
+			wantCR = 5
+		}
+		wantSF, _ := strconv.Atoi(m[4])
+		sf, bw, cr, ok := ParseConfig(name)
+		if !ok || sf != wantSF || bw/1000 != wantBW || cr != wantCR {
+			t.Errorf("%s: got sf=%d bw=%d cr=4/%d ok=%v", name, sf, bw, cr, ok)
+		}
+	}
+	if _, _, _, ok := ParseConfig("lora.bw125cr45sf13"); ok {
+		t.Error("expected unknown config not to be found")
+	}
+
+	r, _ := newFakeRadio(t)
+	r.SetConfig("lora.bw125cr48sf12")
+	if r.SpreadingFactor() != 12 || r.Bandwidth() != 125000 || r.CodingRate() != 8 {
+		t.Errorf("got sf=%d bw=%d cr=4/%d", r.SpreadingFactor(), r.Bandwidth(), r.CodingRate())
+	}
+}
+
+func TestMakeConfig(t *testing.T) {
+	// The LoRaWAN entries of the table must be reproduced, including the low data rate
+	// optimization at SF11 and SF12.
+	for sf := 7; sf <= 12; sf++ {
+		want := Configs["lorawan.bw125sf"+strconv.Itoa(sf)]
+		c, err := MakeConfig(125000, sf, 5, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Conf1 != want.Conf1 || c.Conf2 != want.Conf2 || c.Conf3 != want.Conf3 {
+			t.Errorf("SF%d: got %#x %#x %#x, want %#x %#x %#x", sf, c.Conf1, c.Conf2, c.Conf3,
+				want.Conf1, want.Conf2, want.Conf3)
+		}
+	}
+	c, _ := MakeConfig(125000, 7, 5, false)
+	if c.Info != " 5468bps, 20B in   58ms" {
+		t.Errorf("unexpected info %q", c.Info)
+	}
+	if c, _ := MakeConfig(500000, 7, 5, true); c.Conf3&0x08 == 0 {
+		t.Error("expected low data rate optimization to be on when requested")
+	}
+	for _, p := range [][3]int{{100000, 7, 5}, {125000, 6, 5}, {125000, 13, 5}, {125000, 7, 9}} {
+		if _, err := MakeConfig(p[0], p[1], p[2], false); err == nil {
+			t.Errorf("%v: expected error", p)
+		}
+	}
+
+	r, f := newFakeRadio(t)
+	if err := r.SetConfigParams(62500, 9, 6); err != nil {
+		t.Fatal(err)
+	}
+	if r.config != "lora.bw62cr46sf9" || f.regs[REG_MODEMCONF1] != 0x64 ||
+		f.regs[REG_MODEMCONF2] != 0x94 {
+		t.Errorf("config %s not applied: %#x %#x", r.config, f.regs[REG_MODEMCONF1],
+			f.regs[REG_MODEMCONF2])
+	}
+	if _, found := Configs[r.config]; found || r.Bandwidth() != 62500 {
+		t.Errorf("expected the config to be used without adding it to Configs")
+	}
+	if err := r.SetConfigParams(125000, 6, 5); err == nil {
+		t.Error("expected error for SF6")
+	}
+}
+
+func TestLowDataRateOpt(t *testing.T) {
+	r, f := newFakeRadio(t)
+	// The symbol time of SF12/125kHz is 32ms, which requires the optimization even if the
+	// table entry doesn't set it.
+	Configs["test.bw125sf12"] = Config{0x72, 0xc4, 0x04, "no low data rate opt"}
+	defer delete(Configs, "test.bw125sf12")
+	for _, c := range []string{"lorawan.bw125sf12", "test.bw125sf12"} {
+		r.SetConfig(c)
+		if f.regs[REG_MODEMCONF3] != 0x0C {
+			t.Errorf("%s: expected low data rate optimization, got %#x", c, f.regs[REG_MODEMCONF3])
+		}
+	}
+	if Configs["test.bw125sf12"].TimeOnAir(8, 20) != Configs["lorawan.bw125sf12"].TimeOnAir(8, 20) {
+		t.Error("expected the airtime to account for the low data rate optimization")
+	}
+	// The symbol time of SF7/500kHz is 256us.
+	r.SetConfig("lora.bw500cr45sf7")
+	if f.regs[REG_MODEMCONF3] != 0x04 {
+		t.Errorf("expected no low data rate optimization, got %#x", f.regs[REG_MODEMCONF3])
+	}
+}
+
+func TestInvertIQ(t *testing.T) {
+	r, f := newFakeRadio(t)
+	f.regs[REG_INVERTIQ] = 0x27 // reset value, no I/Q invert
+	r.SetInvertIQ(true, false)
+	if f.regs[REG_INVERTIQ] != 0x67 || f.regs[REG_INVERTIQ2] != INVERTIQ2_ON {
+		t.Errorf("expected inverted RX I/Q: %#x %#x", f.regs[REG_INVERTIQ], f.regs[REG_INVERTIQ2])
+	}
+	r.SetInvertIQ(false, true)
+	if f.regs[REG_INVERTIQ] != 0x26 || f.regs[REG_INVERTIQ2] != INVERTIQ2_OFF {
+		t.Errorf("expected inverted TX I/Q: %#x %#x", f.regs[REG_INVERTIQ], f.regs[REG_INVERTIQ2])
+	}
+	if r.mode != MODE_RX_CONT {
+		t.Errorf("expected continuous RX to be restored, mode %d", r.mode)
+	}
+}
+
+func TestPreambleLength(t *testing.T) {
+	r, f := newFakeRadio(t)
+	air := r.TimeOnAir(20)
+	r.SetPreambleLength(0x108)
+	if f.regs[REG_PREAMBLEMSB] != 1 || f.regs[REG_PREAMBLE] != 8 {
+		t.Errorf("preamble length not written: %#x %#x", f.regs[REG_PREAMBLEMSB],
+			f.regs[REG_PREAMBLE])
+	}
+	sym := Configs[r.config].symbolTime()
+	if d := r.TimeOnAir(20) - air; d != (0x108-preambleLen)*sym {
+		t.Errorf("expected airtime to grow by %s, got %s", (0x108-preambleLen)*sym, d)
+	}
+	r.SetPreambleLength(2)
+	if f.regs[REG_PREAMBLEMSB] != 0 || f.regs[REG_PREAMBLE] != minPreamble {
+		t.Errorf("expected min preamble length, got %d", f.regs[REG_PREAMBLE])
+	}
+
+	// New refuses a preamble length below the chip's minimum.
+	f = &fakeSPI{}
+	_, err := New(&fakePort{f: f}, newFakePin(f), RadioOpts{Config: "lorawan.bw125sf7",
+		PreambleLength: 5})
+	if err == nil {
+		t.Error("expected preamble length of 5 to fail")
+	}
+}
+
+func TestRxFifo(t *testing.T) {
+	pkt1 := bytes.Repeat([]byte{0x11}, 200)
+	pkt2 := bytes.Repeat([]byte{0x22}, 100)
+
+	// Undisturbed read.
+	r, f := newFakeRadio(t)
+	f.receivePacket(pkt1)
+	got, err := r.rx(time.Now())
+	if err != nil || got == nil || !bytes.Equal(got.Payload, pkt1) {
+		t.Fatalf("expected packet, got %+v, err %v", got, err)
+	}
+	if f.regs[REG_IRQFLAGS] != 0 {
+		t.Errorf("IRQ flags not cleared: %#x", f.regs[REG_IRQFLAGS])
+	}
+
+	// Next packet completes while the FIFO is being read.
+	r, f = newFakeRadio(t)
+	f.receivePacket(pkt1)
+	f.onFifoRead = func(f *fakeSPI) { f.onFifoRead = nil; f.receivePacket(pkt2) }
+	if got, err := r.rx(time.Now()); got != nil || err != nil {
+		t.Errorf("expected packet to be dropped, got %+v, err %v", got, err)
+	}
+	if f.regs[REG_IRQFLAGS]&IRQ_RXDONE == 0 {
+		t.Errorf("IRQ for the next packet was cleared")
+	}
+	// The next packet must then be received fine.
+	if got, err := r.rx(time.Now()); err != nil || got == nil || !bytes.Equal(got.Payload, pkt2) {
+		t.Errorf("expected next packet, got %+v, err %v", got, err)
+	}
+
+	// Next packet is still being received but has wrapped around into the packet being read.
+	r, f = newFakeRadio(t)
+	f.receivePacket(pkt1)
+	f.onFifoRead = func(f *fakeSPI) { f.regs[REG_FIFORXLAST] += 60 }
+	if got, err := r.rx(time.Now()); got != nil || err != nil {
+		t.Errorf("expected overrun packet to be dropped, got %+v, err %v", got, err)
+	}
+
+	// Next packet is being received but hasn't reached the packet being read.
+	r, f = newFakeRadio(t)
+	f.receivePacket(pkt1)
+	f.onFifoRead = func(f *fakeSPI) { f.regs[REG_FIFORXLAST] += 50 }
+	if got, err := r.rx(time.Now()); err != nil || got == nil || !bytes.Equal(got.Payload, pkt1) {
+		t.Errorf("expected packet, got %+v, err %v", got, err)
+	}
+}
+
+func TestNoCRC(t *testing.T) {
+	payload := []byte("hello there")
+	for _, tc := range []struct {
+		txCRC, rxCRC, ok bool
+	}{
+		{true, true, true},
+		{false, false, true},
+		{false, true, false}, // receiver requires CRC
+		{true, false, true},  // receiver doesn't require CRC but the radio checks it anyway
+	} {
+		tx, txF := newFakeRadio(t)
+		tx.SetCRC(tc.txCRC)
+		rx, rxF := newFakeRadio(t)
+		rx.SetCRC(tc.rxCRC)
+
+		if err := tx.Transmit(payload); err != nil {
+			t.Fatalf("Transmit: %s", err)
+		}
+		txF.transmitTo(rxF)
+		got, err := rx.rx(time.Now())
+		switch {
+		case err != nil:
+			t.Errorf("%+v: unexpected error %s", tc, err)
+		case tc.ok && (got == nil || !bytes.Equal(got.Payload, payload)):
+			t.Errorf("%+v: expected packet, got %+v", tc, got)
+		case !tc.ok && got != nil:
+			t.Errorf("%+v: expected packet to be dropped, got %+v", tc, got)
+		}
+	}
+
+	// Dropping the CRC shortens the packet by 2 bytes.
+	r, _ := newFakeRadio(t)
+	r.SetCRC(false)
+	noCRC := r.TimeOnAir(100)
+	r.SetCRC(true)
+	if crc := r.TimeOnAir(100); crc <= noCRC {
+		t.Errorf("expected airtime with CRC %s to be longer than without %s", crc, noCRC)
+	}
+}
+
+func TestSetOCP(t *testing.T) {
+	for _, tc := range []struct {
+		mA, want int
+		reg      byte
+	}{
+		{0, 45, 0x20},
+		{45, 45, 0x20},
+		{100, 100, 0x2b}, // chip default
+		{103, 100, 0x2b},
+		{120, 120, 0x2f},
+		{125, 120, 0x2f},
+		{130, 130, 0x30},
+		{150, 150, 0x32}, // driver default
+		{240, 240, 0x3b},
+		{500, 240, 0x3b},
+	} {
+		r, f := newFakeRadio(t)
+		if got := r.SetOCP(tc.mA); got != tc.want {
+			t.Errorf("SetOCP(%d): got %dmA expected %dmA", tc.mA, got, tc.want)
+		}
+		if f.regs[REG_OCP] != tc.reg {
+			t.Errorf("SetOCP(%d): REG_OCP %#x expected %#x", tc.mA, f.regs[REG_OCP], tc.reg)
+		}
+		if r.mode != MODE_RX_CONT {
+			t.Errorf("SetOCP(%d): mode not restored: %d", tc.mA, r.mode)
+		}
+	}
+}
+
+func TestOutputPin(t *testing.T) {
+	r, f := newFakeRadio(t)
+	f.regs[REG_PADAC] = 0x84
+	r.outPin = RFO
+	for _, tc := range []struct {
+		dBm, power int
+		paConfig   byte
+	}{{14, 14, 0x7e}, {17, 15, 0x7f}, {0, 0, 0x70}} {
+		r.SetPower(byte(tc.dBm))
+		if f.regs[REG_PACONFIG] != tc.paConfig || r.Power() != tc.power {
+			t.Errorf("SetPower(%d): expected PACONFIG %#x and %ddBm, got %#x and %ddBm",
+				tc.dBm, tc.paConfig, tc.power, f.regs[REG_PACONFIG], r.Power())
+		}
+	}
+	if f.regs[REG_PADAC] != 0x84 {
+		t.Errorf("PADAC changed using RFO: %#x", f.regs[REG_PADAC])
+	}
+
+	// PA_BOOST supports 20dBm.
+	r.outPin = PABoost
+	r.SetPower(20)
+	if f.regs[REG_PACONFIG] != 0xff || f.regs[REG_PADAC] != 0x87 || r.Power() != 20 {
+		t.Errorf("unexpected PA_BOOST settings %#x %#x", f.regs[REG_PACONFIG], f.regs[REG_PADAC])
+	}
+}
+
+func TestGainOffsets(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.paGain, r.lnaGain = 10, 15
+
+	// The chip gets set to 10dB less than requested.
+	r.SetPower(20)
+	if want, _, _ := paRegs(10); f.regs[REG_PACONFIG] != want {
+		t.Errorf("expected PACONFIG %#x for 10dBm, got %#x", want, f.regs[REG_PACONFIG])
+	}
+	r.SetPower(5)
+	if want, _, _ := paRegs(2); f.regs[REG_PACONFIG] != want {
+		t.Errorf("expected PACONFIG %#x for 2dBm, got %#x", want, f.regs[REG_PACONFIG])
+	}
+	if r.Power() != 12 {
+		t.Errorf("expected applied power of 12dBm, got %ddBm", r.Power())
+	}
+
+	// The RSSI is reduced by the LNA gain.
+	f.receivePacket([]byte("hello"))
+	f.regs[REG_PKTRSSI] = 64
+	f.regs[REG_PKTSNR] = 8 * 4
+	pkt, err := r.rx(time.Now())
+	if err != nil || pkt == nil {
+		t.Fatalf("expected packet, got %+v, err %v", pkt, err)
+	}
+	if want := rssiOffset + 64 + 4 - 15; pkt.Rssi != want {
+		t.Errorf("expected RSSI %ddBm, got %ddBm", want, pkt.Rssi)
+	}
+	f.regs[REG_CURRSSI] = 60
+	if got, want := r.CurrentRSSI(), rssiOffset+60-15; got != want {
+		t.Errorf("expected current RSSI %ddBm, got %ddBm", want, got)
+	}
+}
+
+func TestDumpRegisters(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.SetConfig("lorawan.bw125sf9")
+	regs := r.DumpRegisters()
+	if len(regs) != 0x70 {
+		t.Errorf("expected 0x70 registers, got %#x", len(regs))
+	}
+	if _, found := regs[REG_FIFO]; found {
+		t.Errorf("FIFO register included")
+	}
+	for addr, v := range regs {
+		if v != f.regs[addr] {
+			t.Errorf("register %#02x: expected %#02x, got %#02x", addr, f.regs[addr], v)
+		}
+	}
+	conf := Configs["lorawan.bw125sf9"]
+	if regs[REG_MODEMCONF1] != conf.Conf1 || regs[REG_MODEMCONF2]&0xf0 != conf.Conf2&0xf0 {
+		t.Errorf("config not programmed: %#02x %#02x", regs[REG_MODEMCONF1],
+			regs[REG_MODEMCONF2])
+	}
+}
+
+func TestSetPARamp(t *testing.T) {
+	for _, tc := range []struct {
+		d, want time.Duration
+		code    byte
+	}{
+		{0, 10 * time.Microsecond, 0x0f},
+		{10 * time.Microsecond, 10 * time.Microsecond, 0x0f},
+		{40 * time.Microsecond, 40 * time.Microsecond, 0x09}, // chip default
+		{44 * time.Microsecond, 40 * time.Microsecond, 0x09},
+		{46 * time.Microsecond, 50 * time.Microsecond, 0x08},
+		{time.Millisecond, time.Millisecond, 0x02},
+		{3400 * time.Microsecond, 3400 * time.Microsecond, 0x00},
+		{time.Second, 3400 * time.Microsecond, 0x00},
+	} {
+		r, f := newFakeRadio(t)
+		f.regs[REG_PARAMP] = 0x69
+		if got := r.SetPARamp(tc.d); got != tc.want {
+			t.Errorf("SetPARamp(%s): got %s expected %s", tc.d, got, tc.want)
+		}
+		if f.regs[REG_PARAMP] != 0x60|tc.code {
+			t.Errorf("SetPARamp(%s): REG_PARAMP %#x expected %#x", tc.d, f.regs[REG_PARAMP],
+				0x60|tc.code)
+		}
+	}
+}
+
+func TestPayloadLength(t *testing.T) {
+	// Full-size packets make it across.
+	payload := bytes.Repeat([]byte{0x5a}, MaxPayload)
+	tx, txF := newFakeRadio(t)
+	tx.SetCRC(true)
+	if err := tx.Transmit(payload); err != nil {
+		t.Fatalf("Transmit: %s", err)
+	}
+	rx, rxF := newFakeRadio(t)
+	txF.transmitTo(rxF)
+	if got, err := rx.rx(time.Now()); err != nil || got == nil || !bytes.Equal(got.Payload, payload) {
+		t.Errorf("expected %d byte packet, got %+v, err %v", MaxPayload, got, err)
+	}
+
+	// Payloads that don't fit are rejected.
+	for _, l := range []int{0, MaxPayload + 1} {
+		tx, _ := newFakeRadio(t)
+		err := tx.Transmit(make([]byte, l))
+		if e, ok := err.(PayloadLenError); !ok || e.Len != l {
+			t.Errorf("%d bytes: expected PayloadLenError, got %v", l, err)
+		}
+		if tx.mode != MODE_RX_CONT {
+			t.Errorf("%d bytes: expected radio to keep receiving, mode %d", l, tx.mode)
+		}
+	}
+
+	// A packet with zero length is dropped.
+	r, f := newFakeRadio(t)
+	f.regs[REG_IRQFLAGS] = IRQ_RXDONE
+	f.regs[REG_HOPCHAN] = 0x40
+	if got, err := r.rx(time.Now()); got != nil || err != nil {
+		t.Errorf("expected empty packet to be dropped, got %+v, err %v", got, err)
+	}
+}
+
+func TestTransmitOn(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.SetFrequency(868100000)
+
+	if err := r.TransmitOn(869525, []byte("hello")); err != nil {
+		t.Fatalf("TransmitOn: %s", err)
+	}
+	if r.mode != MODE_TX {
+		t.Errorf("expected TX mode, got %#x", r.mode)
+	}
+	if d := f.rxFreq() - 869525000; d < -61 || d > 61 {
+		t.Errorf("expected TX on 869525000Hz, FRF is off by %dHz", d)
+	}
+	r.txDone()
+	if r.mode != MODE_RX_CONT {
+		t.Errorf("expected RX mode after TX, got %#x", r.mode)
+	}
+	if d := f.rxFreq() - 868100000; d < -61 || d > 61 {
+		t.Errorf("expected center frequency to be restored, FRF is off by %dHz", d)
+	}
+
+	// A failed transmission restores the frequency right away.
+	r.duty = duty.New(0.00001, duty.Window)
+	if err := r.TransmitOn(869525000, bytes.Repeat([]byte{0x55}, 200)); err == nil {
+		t.Fatalf("expected TransmitOn to exceed the duty-cycle budget")
+	}
+	if r.mode != MODE_RX_CONT {
+		t.Errorf("expected RX mode after failed TX, got %#x", r.mode)
+	}
+	if d := f.rxFreq() - 868100000; d < -61 || d > 61 {
+		t.Errorf("expected center frequency to be restored, FRF is off by %dHz", d)
+	}
+}
+
+// fakePort is an SPI port that hands out a fakeSPI and records whether it has been closed.
+type fakePort struct {
+	spi.PortCloser
+	f      *fakeSPI
+	closed int
+}
+
+func (p *fakePort) DevParams(maxHz int64, mode spi.Mode, bits int) (spi.Conn, error) {
+	return p.f, nil
+}
+
+func (p *fakePort) Close() error {
+	p.closed++
+	return nil
+}
+
+// fakePin is an interrupt pin that signals an edge each time the fake radio starts to transmit,
+// which is enough for New's interrupt test. It is high while high returns true and onWait is
+// called each time WaitForEdge is.
+type fakePin struct {
+	gpio.PinIn
+	edges  chan struct{}
+	edge   gpio.Edge // edge detection configured using In
+	high   func() bool
+	onWait func()
+}
+
+func newFakePin(f *fakeSPI) *fakePin {
+	p := &fakePin{edges: make(chan struct{}, 1)}
+	f.onTx = func() { p.edges <- struct{}{} }
+	return p
+}
+
+func (p *fakePin) In(pull gpio.Pull, edge gpio.Edge) error {
+	p.edge = edge
+	return nil
+}
+
+func (p *fakePin) Read() gpio.Level {
+	if p.high != nil && p.high() {
+		return gpio.High
+	}
+	return gpio.Low
+}
+
+// WaitForEdge waits at most 10ms, just to keep tests quick.
+func (p *fakePin) WaitForEdge(timeout time.Duration) bool {
+	if timeout > 10*time.Millisecond {
+		timeout = 10 * time.Millisecond
+	}
+	if p.onWait != nil {
+		p.onWait()
+	}
+	select {
+	case <-p.edges:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		f := &fakeSPI{}
+		port := &fakePort{f: f}
+		pin := newFakePin(f)
+		r, err := New(port, pin, RadioOpts{Freq: 868, Config: "lorawan.bw125sf7"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetLogger(nil)
+		if pin.edge != gpio.RisingEdge {
+			t.Fatalf("expected interrupt on rising edge, got %s", pin.edge)
+		}
+
+		rxErr := make(chan error)
+		go func() {
+			_, err := r.Receive()
+			rxErr <- err
+		}()
+		time.Sleep(time.Millisecond)
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-rxErr:
+			if err != ErrClosed {
+				t.Errorf("expected Receive to fail with ErrClosed, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Receive did not return after Close")
+		}
+		if err := r.Transmit([]byte("hello")); err != ErrClosed {
+			t.Errorf("expected Transmit to fail with ErrClosed, got %v", err)
+		}
+
+		if m := f.regs[REG_OPMODE] & 0x07; m != MODE_SLEEP {
+			t.Errorf("expected sleep mode, got %#x", m)
+		}
+		if pin.edge != gpio.NoEdge {
+			t.Errorf("expected edge detection to be off, got %s", pin.edge)
+		}
+		if err := r.Close(); err != nil || port.closed != 1 {
+			t.Errorf("expected the port to be closed once, got %d, err %v", port.closed, err)
+		}
+	}
+	// Allow the runtime to reap the goroutines that have exited.
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("leaked %d goroutines", n-before)
+	}
+}
+
+func TestReceiveContext(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.intrPin = newFakePin(f)
+	ctx, cancel := context.WithCancel(context.Background())
+	rxErr := make(chan error)
+	go func() {
+		_, err := r.ReceiveContext(ctx)
+		rxErr <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-rxErr:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("ReceiveContext did not return promptly")
+	}
+
+	// The mutex has been released and deadlines work too.
+	if err := r.Transmit([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.ReceiveContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestReceiveTimeout(t *testing.T) {
+	r, f := newFakeRadio(t)
+	pin := newFakePin(f)
+	pin.high = func() bool { return f.regs[REG_IRQFLAGS]&(IRQ_RXDONE|IRQ_TXDONE) != 0 }
+	r.intrPin = pin
+
+	// Nothing arrives: at SF7 and 125kHz the symbol time is 1.024ms and the chip's timeout is
+	// used.
+	start := time.Now()
+	_, err := r.ReceiveTimeout(50 * time.Millisecond)
+	if _, ok := err.(RxTimeoutError); !ok {
+		t.Fatalf("expected RxTimeoutError, got %v", err)
+	}
+	if _, ok := err.(Temporary); !ok {
+		t.Errorf("RxTimeoutError is not Temporary")
+	}
+	if dt := time.Since(start); dt < 50*time.Millisecond || dt > 100*time.Millisecond {
+		t.Errorf("expected timeout after 50ms, took %s", dt)
+	}
+	if n := f.regs[REG_SYMBTIMEOUT]; n != 49 || f.regs[REG_MODEMCONF2]&0x03 != 0 {
+		t.Errorf("expected symbol timeout 49, got %d", n)
+	}
+	if m := f.regs[REG_OPMODE] & 0x07; m != MODE_RX_CONT {
+		t.Errorf("expected continuous receive to be restored, got mode %#x", m)
+	}
+
+	// A reply arrives after a transmission, with a window too long for the chip's timeout.
+	if err := r.Transmit([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	waits := 0
+	pin.onWait = func() {
+		waits++
+		switch {
+		case waits == 1:
+			f.regs[REG_IRQFLAGS] |= IRQ_TXDONE
+		case waits == 3:
+			if m := f.regs[REG_OPMODE] & 0x07; m != MODE_RX_CONT {
+				t.Errorf("expected continuous receive for a long window, got mode %#x", m)
+			}
+			f.receivePacket([]byte("pong"))
+		}
+	}
+	pkt, err := r.ReceiveTimeout(10 * time.Second)
+	if err != nil || pkt == nil || string(pkt.Payload) != "pong" {
+		t.Fatalf("expected pong, got %+v, err %v", pkt, err)
+	}
+	if m := f.regs[REG_OPMODE] & 0x07; m != MODE_RX_CONT {
+		t.Errorf("expected continuous receive, got mode %#x", m)
+	}
+
+	// With RxStandby the radio is left in standby, also when a packet is received.
+	r.rxIdle = true
+	pin.onWait = nil
+	if _, err := r.ReceiveTimeout(5 * time.Millisecond); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if m := f.regs[REG_OPMODE] & 0x07; m != MODE_STANDBY || r.mode != MODE_STANDBY {
+		t.Errorf("expected standby, got mode %#x", m)
+	}
+	f.receivePacket([]byte("pong"))
+	if pkt, err := r.ReceiveTimeout(5 * time.Millisecond); err != nil || pkt == nil {
+		t.Fatalf("expected pong, got %+v, err %v", pkt, err)
+	}
+	if m := f.regs[REG_OPMODE] & 0x07; m != MODE_STANDBY {
+		t.Errorf("expected standby, got mode %#x", m)
+	}
+}
+
+func TestCurrentRSSI(t *testing.T) {
+	r, f := newFakeRadio(t)
+	f.regs[REG_CURRSSI] = 40 // typical reading on an idle channel
+	if rssi := r.CurrentRSSI(); rssi != -124 {
+		t.Errorf("expected -124dBm on an idle channel, got %ddBm", rssi)
+	}
+
+	// The radio is put into receive mode for the duration of the reading.
+	r.setMode(MODE_STANDBY)
+	f.regs[REG_CURRSSI] = 0
+	if rssi := r.CurrentRSSI(); rssi > -100 {
+		t.Errorf("expected a very negative RSSI, got %ddBm", rssi)
+	}
+	if m := f.regs[REG_OPMODE] & 0x07; m != MODE_STANDBY {
+		t.Errorf("expected standby mode to be restored, got %#x", m)
+	}
+}
+
+func TestRxChan(t *testing.T) {
+	const packets = 10
+	r, f := newFakeRadio(t)
+	r.rxDepth = 2
+	pin := newFakePin(f)
+	pin.high = func() bool { return f.regs[REG_IRQFLAGS]&IRQ_RXDONE != 0 }
+	sent := 0
+	pin.onWait = func() {
+		if sent < packets {
+			sent++
+			f.receivePacket([]byte{byte(sent)})
+		}
+	}
+	r.intrPin = pin
+
+	// Flood the radio without draining the channel.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rxChan := r.RxChan(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Dropped() < packets-2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := r.Dropped(); n != packets-2 {
+		t.Fatalf("expected %d dropped packets, got %d", packets-2, n)
+	}
+
+	// The first packets are queued and the channel is closed when the context is done.
+	cancel()
+	var got []byte
+	for pkt := range rxChan {
+		got = append(got, pkt.Payload...)
+	}
+	if !bytes.Equal(got, []byte{1, 2}) {
+		t.Errorf("expected packets 1 and 2, got %v", got)
+	}
+}
+
+func TestImplicitHeader(t *testing.T) {
+	// SF6 requires the implicit header mode.
+	f := &fakeSPI{}
+	_, err := New(&fakePort{f: f}, newFakePin(f), RadioOpts{Config: "lora.bw500cr45sf6"})
+	if err == nil {
+		t.Error("expected SF6 with explicit header to fail")
+	}
+	r, f := newFakeRadio(t)
+	r.SetConfig("lora.bw500cr45sf6")
+	if r.config != "lorawan.bw125sf7" {
+		t.Errorf("expected SF6 config to be refused, got %s", r.config)
+	}
+	r.SetConfig("lorawan.bw125sf7")
+	if f.regs[REG_DETECTOPT]&0x07 != 0x03 || f.regs[REG_DETECTTHR] != 0x0A {
+		t.Errorf("unexpected detection settings %#x %#x", f.regs[REG_DETECTOPT],
+			f.regs[REG_DETECTTHR])
+	}
+
+	r.fixLen = 4
+	f.regs[REG_DETECTOPT] = 0xc3
+	r.SetConfig("lora.bw500cr45sf6")
+	if f.regs[REG_MODEMCONF1] != 0x93 || f.regs[REG_MODEMCONF2]>>4 != 6 {
+		t.Errorf("expected implicit header and SF6, got %#x %#x", f.regs[REG_MODEMCONF1],
+			f.regs[REG_MODEMCONF2])
+	}
+	if f.regs[REG_DETECTOPT] != 0xc5 || f.regs[REG_DETECTTHR] != 0x0C {
+		t.Errorf("unexpected SF6 detection settings %#x %#x", f.regs[REG_DETECTOPT],
+			f.regs[REG_DETECTTHR])
+	}
+	if f.regs[REG_PAYLENGTH] != 4 {
+		t.Errorf("expected payload length 4, got %d", f.regs[REG_PAYLENGTH])
+	}
+
+	// Received packets have the fixed length, there is no header with length or CRC flag.
+	f.receive([]byte("pong"), false)
+	f.regs[REG_RXBYTES] = 0
+	pkt, err := r.rx(time.Now())
+	if err != nil || pkt == nil || string(pkt.Payload) != "pong" {
+		t.Fatalf("expected pong, got %+v, err %v", pkt, err)
+	}
+
+	r.mode = MODE_STANDBY
+	if err := r.Transmit([]byte("hello")); err != (PayloadLenError{5, 4}) {
+		t.Errorf("expected PayloadLenError, got %v", err)
+	}
+	if err := r.Transmit([]byte("ping")); err != nil {
+		t.Error(err)
+	}
+	if d := r.TimeOnAir(4); d != Configs["lora.bw500cr45sf6"].TimeOnAir(preambleLen, 4) {
+		t.Errorf("unexpected time on air %s", d)
+	}
+}
+
+func TestTransmitWithConfig(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.SetConfig("lorawan.bw125sf7")
+
+	if err := r.TransmitWithConfig([]byte("hello"), "lorawan.bw125sf12"); err != nil {
+		t.Fatalf("TransmitWithConfig: %s", err)
+	}
+	if r.mode != MODE_TX || r.config != "lorawan.bw125sf12" || f.regs[REG_MODEMCONF2]>>4 != 12 {
+		t.Errorf("expected TX at SF12, got mode %#x, config %s, conf2 %#x", r.mode, r.config,
+			f.regs[REG_MODEMCONF2])
+	}
+	r.txDone()
+	if r.mode != MODE_RX_CONT || r.config != "lorawan.bw125sf7" || f.regs[REG_MODEMCONF2]>>4 != 7 {
+		t.Errorf("expected RX at SF7 after TX, got mode %#x, config %s, conf2 %#x", r.mode,
+			r.config, f.regs[REG_MODEMCONF2])
+	}
+
+	// Unknown and unusable configs are refused without changing anything.
+	for _, c := range []string{"lora.bogus", "lora.bw125cr45sf6"} {
+		if err := r.TransmitWithConfig([]byte("hello"), c); err == nil {
+			t.Errorf("%s: expected an error", c)
+		}
+		if r.mode != MODE_RX_CONT || r.config != "lorawan.bw125sf7" {
+			t.Errorf("%s: expected RX at SF7, got mode %#x, config %s", c, r.mode, r.config)
+		}
+	}
+
+	// A failed transmission restores the config right away.
+	if err := r.TransmitWithConfig(nil, "lorawan.bw125sf12"); err == nil {
+		t.Fatal("expected an error for an empty payload")
+	}
+	if r.mode != MODE_RX_CONT || r.config != "lorawan.bw125sf7" || f.regs[REG_MODEMCONF2]>>4 != 7 {
+		t.Errorf("expected RX at SF7 after failed TX, got mode %#x, config %s", r.mode, r.config)
+	}
+}
+
+func TestTxDone(t *testing.T) {
+	r, f := newFakeRadio(t)
+	done := make(chan error, 1)
+	r.txDoneChan = done
+	pin := newFakePin(f)
+	pin.high = func() bool { return f.regs[REG_IRQFLAGS]&IRQ_TXDONE != 0 }
+	r.intrPin = pin
+	f.onTx = func() { f.regs[REG_IRQFLAGS] |= IRQ_TXDONE }
+
+	// Receive services the TX done interrupt.
+	if err := r.Transmit([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.ReceiveContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline, got %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected success, got %v", err)
+		}
+	default:
+		t.Fatal("no TX done notification")
+	}
+	if r.mode != MODE_RX_CONT {
+		t.Errorf("expected RX mode after TX, got %#x", r.mode)
+	}
+
+	// An interrupt without the TX done flag is reported as an error, and nobody listening
+	// doesn't block.
+	f.onTx = nil
+	r.setMode(MODE_TX)
+	r.txDone()
+	if err := <-done; err == nil {
+		t.Error("expected an error without TX done flag")
+	}
+	r.setMode(MODE_TX)
+	r.txDone()
+	r.setMode(MODE_TX)
+	r.txDone()
+}
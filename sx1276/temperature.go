@@ -0,0 +1,42 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import "time"
+
+// tempSettle is the time the temperature sensor needs to perform a measurement, the datasheet
+// specifies 140us.
+const tempSettle = time.Millisecond
+
+// Temperature measures the temperature of the chip and returns it in degrees C, corrected by
+// RadioOpts.TempOffset. The sensor is only available in FSK mode, so the radio briefly leaves
+// LoRa mode, which interrupts reception for about a millisecond, and returns to the mode it was
+// in afterwards. It returns a Temporary error if a packet is being received or transmitted.
+func (r *Radio) Temperature() (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.cadStart(); err != nil {
+		return 0, err
+	}
+	mode := r.mode
+	// The FSK image calibration register shares its address with REG_INVERTIQ2.
+	iq2 := r.readReg(REG_INVERTIQ2)
+
+	// The modulation can only be switched in sleep mode.
+	r.setMode(MODE_SLEEP)
+	r.writeReg(REG_OPMODE, 0x08+MODE_SLEEP) // FSK mode & LF
+	r.writeReg(REG_OPMODE, 0x08+MODE_FS_RX)
+	cal := r.readReg(REG_FSK_IMAGECAL)
+	r.writeReg(REG_FSK_IMAGECAL, cal&^TEMP_MONITOR_OFF)
+	time.Sleep(tempSettle)
+	r.writeReg(REG_FSK_IMAGECAL, cal|TEMP_MONITOR_OFF)
+	r.writeReg(REG_OPMODE, 0x08+MODE_SLEEP)
+	// The raw value is signed and decreases by one per degree.
+	temp := -int(int8(r.readReg(REG_FSK_TEMP))) + r.tempOff
+
+	r.writeReg(REG_OPMODE, 0x88+MODE_SLEEP) // back to LoRa mode
+	r.writeReg(REG_INVERTIQ2, iq2)
+	r.setMode(mode)
+	r.log("Temperature %dC", temp)
+	return temp, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package sx1276
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTemperature(t *testing.T) {
+	r, f := newFakeRadio(t)
+	r.tempOff = 3
+	f.regs[REG_INVERTIQ2] = INVERTIQ2_ON
+	f.regs[REG_FSK_TEMP] = 0xE7 // -25: 25C
+	temp, err := r.Temperature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if temp != 28 {
+		t.Errorf("expected 28C, got %dC", temp)
+	}
+	// The sensor is enabled in FSK FS RX mode and the radio returns to LoRa RX mode.
+	want := []byte{0x88 + MODE_SLEEP, 0x08 + MODE_SLEEP, 0x08 + MODE_FS_RX, 0x08 + MODE_SLEEP,
+		0x88 + MODE_SLEEP, 0x88 + MODE_RX_CONT}
+	if !bytes.Equal(f.opModes, want) {
+		t.Errorf("expected modes %x, got %x", want, f.opModes)
+	}
+	if r.mode != MODE_RX_CONT || f.regs[REG_INVERTIQ2] != INVERTIQ2_ON {
+		t.Errorf("radio not restored: mode %d, invert IQ %#x", r.mode, f.regs[REG_INVERTIQ2])
+	}
+
+	// Negative temperatures.
+	f.regs[REG_FSK_TEMP] = 0x0A
+	if temp, _ := r.Temperature(); temp != -7 {
+		t.Errorf("expected -7C, got %dC", temp)
+	}
+
+	// The measurement is refused while transmitting.
+	r.mode = MODE_TX
+	if _, err := r.Temperature(); err == nil {
+		t.Error("expected error while transmitting")
+	}
+}
@@ -0,0 +1,43 @@
+package thread
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Realtime locks the calling goroutine to its own kernel thread and elevates that
+// thread's priority to realtime. It sets the round-robin schduling policy and uses
+// priority level 10 (somewhere in the lower middle of the range).
+func Realtime() error {
+	// First pin goroutine to its own kernel thread.
+	runtime.LockOSThread()
+	// Get the ID of the thread.
+	tid := syscall.Gettid()
+	// Give this thread realtime priority.
+	res, _, err := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, uintptr(tid),
+		uintptr(RR), uintptr(unsafe.Pointer(&schedParam{10})))
+	if res == 0 {
+		return nil
+	}
+	return err
+}
+
+// Normal undoes Realtime: it resets the calling thread to the default time-sharing scheduling
+// policy and unlocks the goroutine from it. It must be called on the goroutine that called
+// Realtime, for example to run a radio goroutine at realtime priority only while it's actively
+// receiving or transmitting.
+func Normal() error {
+	tid := syscall.Gettid()
+	res, _, err := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, uintptr(tid),
+		uintptr(OTHER), uintptr(unsafe.Pointer(&schedParam{0})))
+	if res != 0 {
+		return err
+	}
+	runtime.UnlockOSThread()
+	return nil
+}
+
+type schedParam struct {
+	Priority int
+}
@@ -0,0 +1,37 @@
+package thread
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// policy returns the scheduling policy of the calling thread.
+func policy(t *testing.T) int {
+	res, _, err := syscall.RawSyscall(syscall.SYS_SCHED_GETSCHEDULER, 0, 0, 0)
+	if int(res) < 0 {
+		t.Fatalf("sched_getscheduler: %s", err)
+	}
+	return int(res)
+}
+
+func TestRealtimeNormal(t *testing.T) {
+	// Stay on the thread after Normal to check its policy, the locks nest.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := Realtime(); err != nil {
+		if err == syscall.EPERM {
+			t.Skip("realtime scheduling not permitted")
+		}
+		t.Fatal(err)
+	}
+	if p := policy(t); p != RR {
+		t.Errorf("expected policy %d after Realtime, got %d", RR, p)
+	}
+	if err := Normal(); err != nil {
+		t.Fatal(err)
+	}
+	if p := policy(t); p != OTHER {
+		t.Errorf("expected policy %d after Normal, got %d", OTHER, p)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package thread
+
+// Realtime returns ErrNotSupported.
+func Realtime() error { return ErrNotSupported }
+
+// Normal returns ErrNotSupported.
+func Normal() error { return ErrNotSupported }
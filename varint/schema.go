@@ -0,0 +1,177 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package varint
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// FieldSpec describes the encoding of one value of a payload.
+type FieldSpec struct {
+	Name     string  // name of the field, not used by the codec, e.g. to label JSON output
+	Unsigned bool    // value is encoded without zig-zag, see EncodeUint
+	Scale    float64 // value is the integer sent times Scale, e.g. 0.01 for cC in °C, 0: none
+}
+
+// Marshal encodes the values in v according to the schema, one field spec per value. The value
+// can be a struct, or a pointer to one, whose exported fields are used in order, or a
+// []interface{}. The values must be integers, or floats for fields with a Scale, which are
+// divided by the scale and rounded to the nearest integer before being encoded.
+func Marshal(schema []FieldSpec, v interface{}) ([]byte, error) {
+	values, err := schemaValues(schema, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	res := []byte{}
+	for i, fs := range schema {
+		x := values[i]
+		if x.Kind() == reflect.Interface {
+			x = x.Elem()
+		}
+		var f float64
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f = float64(x.Int())
+			if fs.Scale == 0 {
+				if fs.Unsigned && x.Int() < 0 {
+					return nil, fmt.Errorf("varint: field %d is unsigned but value is %d",
+						i, x.Int())
+				}
+				res = appendEncoded(res, fs, x.Int(), uint64(x.Int()))
+				continue
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Uintptr:
+			f = float64(x.Uint())
+			if fs.Scale == 0 {
+				if !fs.Unsigned && x.Uint() > math.MaxInt64 {
+					return nil, fmt.Errorf("varint: field %d out of range", i)
+				}
+				res = appendEncoded(res, fs, int64(x.Uint()), x.Uint())
+				continue
+			}
+		case reflect.Float32, reflect.Float64:
+			f = x.Float()
+		default:
+			return nil, fmt.Errorf("varint: field %d has unsupported type %s", i, x.Kind())
+		}
+		if fs.Scale != 0 {
+			f /= fs.Scale
+		}
+		f = math.Floor(f + 0.5)
+		switch {
+		case fs.Unsigned && (f < 0 || f >= 1<<64):
+			return nil, fmt.Errorf("varint: field %d out of range for unsigned", i)
+		case !fs.Unsigned && (f < -1<<63 || f >= 1<<63):
+			return nil, fmt.Errorf("varint: field %d out of range", i)
+		}
+		res = appendEncoded(res, fs, int64(f), uint64(f))
+	}
+	return res, nil
+}
+
+// appendEncoded appends u to buf if the field is unsigned and i otherwise.
+func appendEncoded(buf []byte, fs FieldSpec, i int64, u uint64) []byte {
+	if fs.Unsigned {
+		return appendUvarint(buf, u)
+	}
+	return AppendVarint(buf, int(i))
+}
+
+// Unmarshal decodes the values in buf according to the schema and stores them in v, which must
+// be a pointer to a struct, whose exported fields are set in order, or a pointer to a
+// []interface{}. Struct fields may be integers, or floats for fields with a Scale. The elements
+// of a []interface{} are int64 for signed fields, uint64 for unsigned fields, and float64 for
+// fields with a Scale. It returns ErrTruncated if buf holds fewer values than the schema and
+// ErrOverflow if a value exceeds 64 bits, values following the last field are ignored.
+func Unmarshal(schema []FieldSpec, buf []byte, v interface{}) error {
+	p := reflect.ValueOf(v)
+	if p.Kind() != reflect.Ptr || p.IsNil() {
+		return fmt.Errorf("varint: Unmarshal requires a non-nil pointer, got %T", v)
+	}
+	if s, ok := v.(*[]interface{}); ok {
+		*s = make([]interface{}, len(schema))
+	}
+	values, err := schemaValues(schema, p.Elem())
+	if err != nil {
+		return err
+	}
+	for i, fs := range schema {
+		u, l, err := decodeUvarint(buf)
+		if err != nil {
+			return err
+		}
+		buf = buf[l:]
+		i64 := int64(u)
+		if !fs.Unsigned {
+			i64 = int64(unzigzag(u))
+		}
+		f := float64(i64)
+		if fs.Unsigned {
+			f = float64(u)
+		}
+		if fs.Scale != 0 {
+			f *= fs.Scale
+		}
+
+		x := values[i]
+		switch {
+		case x.Kind() == reflect.Interface && fs.Scale != 0:
+			x.Set(reflect.ValueOf(f))
+		case x.Kind() == reflect.Interface && fs.Unsigned:
+			x.Set(reflect.ValueOf(u))
+		case x.Kind() == reflect.Interface:
+			x.Set(reflect.ValueOf(i64))
+		case x.Kind() == reflect.Float32 || x.Kind() == reflect.Float64:
+			x.SetFloat(f)
+		case fs.Scale != 0:
+			return fmt.Errorf("varint: field %d has a scale but is not a float", i)
+		case x.Kind() >= reflect.Int && x.Kind() <= reflect.Int64:
+			if fs.Unsigned && i64 < 0 || x.OverflowInt(i64) {
+				return fmt.Errorf("varint: field %d overflows %s", i, x.Type())
+			}
+			x.SetInt(i64)
+		case x.Kind() >= reflect.Uint && x.Kind() <= reflect.Uintptr:
+			if !fs.Unsigned && i64 < 0 || x.OverflowUint(uint64(i64)) {
+				return fmt.Errorf("varint: field %d overflows %s", i, x.Type())
+			}
+			x.SetUint(uint64(i64))
+		default:
+			return fmt.Errorf("varint: field %d has unsupported type %s", i, x.Kind())
+		}
+	}
+	return nil
+}
+
+// schemaValues returns the values corresponding to the fields of the schema, i.e., the
+// elements of a []interface{} or the exported fields of a struct.
+func schemaValues(schema []FieldSpec, v reflect.Value) ([]reflect.Value, error) {
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	var values []reflect.Value
+	switch {
+	case !v.IsValid():
+		return nil, fmt.Errorf("varint: unsupported nil value, need a struct or []interface{}")
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Interface:
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, v.Index(i))
+		}
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" { // exported
+				values = append(values, v.Field(i))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("varint: unsupported type %s, need a struct or []interface{}",
+			v.Type())
+	}
+	if len(values) != len(schema) {
+		return nil, fmt.Errorf("varint: %d values for a schema of %d fields",
+			len(values), len(schema))
+	}
+	return values, nil
+}
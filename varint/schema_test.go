@@ -0,0 +1,104 @@
+// Copyright 2017 by Thorsten von Eicken, see LICENSE file
+
+package varint
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var sensorSchema = []FieldSpec{
+	{Name: "count", Unsigned: true},
+	{Name: "temp", Scale: 0.01},
+	{Name: "vbat", Unsigned: true, Scale: 0.001},
+	{Name: "rssi"},
+}
+
+type sensor struct {
+	Count uint32
+	Temp  float64
+	VBat  float32
+	Rssi  int
+	other int // unexported fields are skipped
+}
+
+func TestSchema(t *testing.T) {
+	// The same values as unsigned and signed varints, temp is in cC and vbat in mV.
+	enc := append(EncodeUint([]uint64{200}), Encode([]int{-1250})...)
+	enc = append(append(enc, EncodeUint([]uint64{3300})...), Encode([]int{-87})...)
+
+	s := sensor{Count: 200, Temp: -12.5, VBat: 3.3, Rssi: -87}
+	for _, v := range []interface{}{s, &s, []interface{}{200, -12.5, 3.3, int8(-87)}} {
+		got, err := Marshal(sensorSchema, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, enc) {
+			t.Errorf("Marshal %v: got %v, expected %v", v, got, enc)
+		}
+	}
+
+	var gotS sensor
+	if err := Unmarshal(sensorSchema, enc, &gotS); err != nil {
+		t.Fatal(err)
+	}
+	if gotS.Count != 200 || gotS.Temp != -12.5 || gotS.VBat < 3.2999 || gotS.VBat > 3.3001 ||
+		gotS.Rssi != -87 {
+		t.Errorf("Unmarshal struct: got %+v", gotS)
+	}
+	var gotI []interface{}
+	if err := Unmarshal(sensorSchema, enc, &gotI); err != nil {
+		t.Fatal(err)
+	}
+	gotI[2] = float32(gotI[2].(float64)) // 3300 * 0.001 is not exactly 3.3
+	want := []interface{}{uint64(200), -12.5, float32(3.3), int64(-87)}
+	if !reflect.DeepEqual(gotI, want) {
+		t.Errorf("Unmarshal []interface{}: got %#v, expected %#v", gotI, want)
+	}
+	// Trailing values are ignored.
+	if err := Unmarshal(sensorSchema, append(enc, 0x80), &gotI); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	schema := []FieldSpec{{Unsigned: true}, {}}
+	marshal := []interface{}{
+		[]interface{}{1},                  // too few values
+		[]interface{}{-1, 1},              // negative unsigned
+		[]interface{}{1, uint64(1 << 63)}, // overflows int64
+		[]interface{}{1, "x"},             // unsupported type
+		[]int{1, 2},                       // unsupported type
+		nil,
+	}
+	for _, v := range marshal {
+		if _, err := Marshal(schema, v); err == nil {
+			t.Errorf("Marshal %#v: expected error", v)
+		}
+	}
+
+	var s struct{ A, B int8 }
+	unmarshal := []struct {
+		buf []byte
+		v   interface{}
+		err error // expected error, nil for any
+	}{
+		{[]byte{0x81}, &s, ErrTruncated},
+		{[]byte{0x81, 0x02, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0xff}, &s, ErrOverflow},
+		{[]byte{0x02, 0x80, 0x80}, &s, nil},           // 256 overflows int8
+		{[]byte{0x81, 0x80}, s, nil},                  // not a pointer
+		{[]byte{0x81, 0x80}, &struct{ A int }{}, nil}, // too few fields
+		{[]byte{0x81, 0x80}, &struct{ A, B string }{}, nil},
+	}
+	for i, tc := range unmarshal {
+		err := Unmarshal(schema, tc.buf, tc.v)
+		if err == nil || tc.err != nil && err != tc.err {
+			t.Errorf("Unmarshal %d: got %v, expected %v", i, err, tc.err)
+		}
+	}
+	// A scaled field must be decoded into a float.
+	if err := Unmarshal([]FieldSpec{{Scale: 0.1}}, []byte{0x82}, &struct{ A int }{}); err == nil {
+		t.Error("expected error for scaled int field")
+	}
+}
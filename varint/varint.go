@@ -2,49 +2,220 @@
 
 package varint
 
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
 // Encode encodes an array of signed ints into a buffer of varint bytes.
 //
 // Reference: http://jeelabs.org/article/1620c/
 func Encode(arr []int) []byte {
 	res := []byte{}
 	for _, v := range arr {
-		u := uint64(v << 1)
-		switch {
-		case v == 0:
-			res = append(res, 0x80)
-			continue
-		case v < 0:
-			u = ^u
-		}
-		var temp [10]byte
-		var i int
-		for i = 9; u != 0; i-- {
-			temp[i] = byte(u & 0x7f)
-			u >>= 7
-		}
-		temp[9] |= 0x80
-		res = append(res, temp[i+1:]...)
+		res = AppendVarint(res, v)
+	}
+	return res
+}
+
+// EncodeUint encodes an array of unsigned ints into a buffer of varint bytes. The format is the
+// same as for Encode except that the values are not zig-zag encoded, which saves a bit per
+// value, and thus a byte for values of 64..127, 8192..16383, and so on. It suits values that are
+// never negative, such as counters, sequence numbers, and voltages, while Encode suits values
+// that may be negative. The receiver has to know which of the two encodings was used.
+func EncodeUint(arr []uint64) []byte {
+	res := []byte{}
+	for _, v := range arr {
+		res = appendUvarint(res, v)
 	}
 	return res
 }
 
-// Decode decodes buffer of varint bytes into an array of signed ints.
+// AppendVarint appends the encoding of v to buf and returns the extended buffer, like the
+// built-in append. This allows a payload to be built incrementally without allocating.
+func AppendVarint(buf []byte, v int) []byte {
+	// Zig-zag encode using 64 bits so the sign bit isn't shifted out on 32-bit platforms.
+	x := int64(v)
+	return appendUvarint(buf, uint64(x<<1)^uint64(x>>63))
+}
+
+// appendUvarint appends the encoding of u to buf, without zig-zag encoding.
+func appendUvarint(buf []byte, u uint64) []byte {
+	if u == 0 {
+		return append(buf, 0x80)
+	}
+	var temp [10]byte
+	var i int
+	for i = 9; u != 0; i-- {
+		temp[i] = byte(u & 0x7f)
+		u >>= 7
+	}
+	temp[9] |= 0x80
+	return append(buf, temp[i+1:]...)
+}
+
+// Decode decodes buffer of varint bytes into an array of signed ints. Trailing bytes that do not
+// form a complete varint are ignored, as are the bytes following a value that overflows 64 bits,
+// see DecodeN to detect such malformed input.
 //
 // Reference: http://jeelabs.org/article/1620c/
 func Decode(buf []byte) []int {
-	res := []int{}
-	val := 0
-	for i := range buf {
-		val = (val << 7) | int(buf[i]&0x7f)
-		if buf[i]&0x80 != 0 {
-			if val&1 == 0 {
-				val = int(uint64(val) >> 1)
-			} else {
-				val = int(^(uint64(val) >> 1))
-			}
-			res = append(res, val)
-			val = 0
+	res, _, _ := DecodeN(buf, -1)
+	return res
+}
+
+// DecodeSafe is like Decode but returns ErrTruncated if buf ends in the middle of a value and
+// ErrOverflow if a value exceeds 64 bits, together with the values preceding it. This detects
+// corruption of packets received over a lossy link that Decode silently ignores.
+func DecodeSafe(buf []byte) ([]int, error) {
+	res, _, err := DecodeN(buf, -1)
+	return res, err
+}
+
+// DecodeUint decodes a buffer of varint bytes produced by EncodeUint into an array of unsigned
+// ints. Like Decode it ignores trailing bytes that do not form a complete varint as well as the
+// bytes following a value that overflows 64 bits.
+func DecodeUint(buf []byte) []uint64 {
+	res := []uint64{}
+	for len(buf) > 0 {
+		u, l, err := decodeUvarint(buf)
+		if err != nil {
+			break
 		}
+		res = append(res, u)
+		buf = buf[l:]
 	}
 	return res
 }
+
+// DecodeN decodes up to n values from the start of buf, or all of them if n is negative, and
+// returns them along with the number of bytes consumed, which allows the remainder of the buffer
+// to hold something else. It stops at the first malformed value and returns ErrTruncated if buf
+// ends in the middle of a value and ErrOverflow if a value exceeds 64 bits. If buf holds fewer
+// than n values they are returned without error.
+func DecodeN(buf []byte, n int) (values []int, consumed int, err error) {
+	values = []int{}
+	for consumed < len(buf) && len(values) != n {
+		v, l, err := DecodeOne(buf[consumed:])
+		if err != nil {
+			return values, consumed, err
+		}
+		values = append(values, v)
+		consumed += l
+	}
+	return values, consumed, nil
+}
+
+// DecodeOne decodes the value at the start of buf and returns it along with its length n, so a
+// payload can be parsed incrementally by moving on to buf[n:]. It returns ErrTruncated if buf is
+// empty or ends in the middle of the value and ErrOverflow if the value exceeds 64 bits.
+func DecodeOne(buf []byte) (v int, n int, err error) {
+	u, l, err := decodeUvarint(buf)
+	return unzigzag(u), l, err
+}
+
+// decodeUvarint decodes the value at the start of buf without undoing the zig-zag encoding and
+// returns it along with its length.
+func decodeUvarint(buf []byte) (uint64, int, error) {
+	var u uint64
+	for i, b := range buf {
+		if u>>57 != 0 {
+			return 0, 0, ErrOverflow
+		}
+		u = (u << 7) | uint64(b&0x7f)
+		if b&0x80 != 0 {
+			return u, i + 1, nil
+		}
+	}
+	return 0, 0, ErrTruncated
+}
+
+// unzigzag undoes the zig-zag encoding in 64 bits, for the most negative value u is all ones and
+// the result is 1<<63.
+func unzigzag(u uint64) int {
+	return int(int64(u>>1) ^ -int64(u&1))
+}
+
+var (
+	// ErrTruncated is returned when the input ends in the middle of a varint.
+	ErrTruncated = errors.New("varint: truncated value")
+	// ErrOverflow is returned when a varint exceeds 64 bits.
+	ErrOverflow = errors.New("varint: value overflows 64 bits")
+)
+
+// Decoder decodes a stream of varints as they arrive, contrary to Decode, which operates on a
+// whole buffer.
+type Decoder struct {
+	r io.ByteReader
+}
+
+// NewDecoder returns a Decoder reading from r. If r does not implement io.ByteReader the
+// Decoder buffers it and may read beyond the last varint requested.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{br}
+}
+
+// Next returns the next value. It returns io.EOF if the input ends after the previous value,
+// ErrTruncated if it ends in the middle of a value, and ErrOverflow if the value exceeds 64
+// bits, in which case the remainder of the value is left unread. Other errors are passed
+// through.
+func (d *Decoder) Next() (int, error) {
+	var u uint64
+	for n := 0; ; n++ {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				err = ErrTruncated
+			}
+			return 0, err
+		}
+		if u>>57 != 0 {
+			return 0, ErrOverflow
+		}
+		u = (u << 7) | uint64(b&0x7f)
+		if b&0x80 != 0 {
+			return unzigzag(u), nil
+		}
+	}
+}
+
+// Encoder writes a stream of varints.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the values using a single Write call.
+func (e *Encoder) Encode(values ...int) error {
+	e.buf = e.buf[:0]
+	for _, v := range values {
+		e.buf = AppendVarint(e.buf, v)
+	}
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// RoundTrip returns true if decoding the encoding of ints produces ints again. It is intended
+// to check the invariant that Decode is the inverse of Encode, e.g., in fuzz tests.
+func RoundTrip(ints []int) bool {
+	dec := Decode(Encode(ints))
+	if len(dec) != len(ints) {
+		return false
+	}
+	for i := range dec {
+		if dec[i] != ints[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,7 +2,14 @@
 
 package varint
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"testing/iotest"
+)
 
 var varinttests = map[string]struct {
 	dec []int
@@ -51,3 +58,312 @@ func TestDencode(t *testing.T) {
 		}
 	}
 }
+
+func TestRoundTrip(t *testing.T) {
+	ints := []int{math.MinInt64, math.MaxInt64, math.MinInt64 + 1, math.MaxInt64 - 1,
+		math.MinInt32, math.MaxInt32}
+	for k := uint(0); k < 63; k++ {
+		ints = append(ints, 1<<k-1, 1<<k, 1<<k+1, -1<<k-1, -1<<k, -1<<k+1)
+	}
+	for _, v := range ints {
+		if !RoundTrip([]int{v}) {
+			t.Errorf("%d does not round-trip, decodes to %v", v, Decode(Encode([]int{v})))
+		}
+	}
+	if !RoundTrip(ints) {
+		t.Errorf("sequence does not round-trip")
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, tc := range varinttests {
+		f.Add(tc.enc)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Interpret the data as varints as well as raw 64-bit values.
+		if ints := Decode(data); !RoundTrip(ints) {
+			t.Errorf("%v does not round-trip", ints)
+		}
+		var ints []int
+		for ; len(data) >= 8; data = data[8:] {
+			ints = append(ints, int(int64(binary.LittleEndian.Uint64(data))))
+		}
+		if !RoundTrip(ints) {
+			t.Errorf("%v does not round-trip", ints)
+		}
+	})
+}
+
+func TestDecoder(t *testing.T) {
+	for n, tc := range varinttests {
+		// Feed the bytes one at a time to exercise the value boundaries.
+		d := NewDecoder(iotest.OneByteReader(bytes.NewReader(tc.enc)))
+		for i, want := range tc.dec {
+			if got, err := d.Next(); got != want || err != nil {
+				t.Errorf("%s: value %d: got %d, err %v, expected %d", n, i, got, err, want)
+			}
+		}
+		if _, err := d.Next(); err != io.EOF {
+			t.Errorf("%s: expected EOF, got %v", n, err)
+		}
+	}
+
+	// A truncated final value is reported.
+	d := NewDecoder(bytes.NewReader([]byte{0x82, 0x01, 0x7e}))
+	if v, err := d.Next(); v != 1 || err != nil {
+		t.Errorf("got %d, err %v, expected 1", v, err)
+	}
+	if _, err := d.Next(); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+
+	// Read errors are passed through.
+	d = NewDecoder(iotest.TimeoutReader(bytes.NewReader([]byte{0x82, 0x84})))
+	for i := 0; i < 2; i++ {
+		if _, err := d.Next(); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := d.Next(); err != iotest.ErrTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+var malformedtests = map[string]struct {
+	enc      []byte
+	dec      []int // values preceding the malformed one
+	consumed int
+	err      error
+}{
+	"truncated":      {[]byte{0x01}, []int{}, 0, ErrTruncated},
+	"truncated long": {[]byte{0x80, 0x82, 0x7f, 0x7f}, []int{0, 1}, 2, ErrTruncated},
+	"overflow": {[]byte{0x84, 0x02, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0xff},
+		[]int{2}, 1, ErrOverflow},
+	"overflow long": {[]byte{0x01, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x80},
+		[]int{}, 0, ErrOverflow},
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecodeN(t *testing.T) {
+	for n, tc := range varinttests {
+		got, consumed, err := DecodeN(tc.enc, -1)
+		if !equal(got, tc.dec) || consumed != len(tc.enc) || err != nil {
+			t.Errorf("%s: got %v, %d bytes, err %v, expected %v", n, got, consumed, err, tc.dec)
+		}
+	}
+	for n, tc := range malformedtests {
+		got, consumed, err := DecodeN(tc.enc, -1)
+		if !equal(got, tc.dec) || consumed != tc.consumed || err != tc.err {
+			t.Errorf("%s: got %v, %d bytes, err %v, expected %v, %d bytes, err %v",
+				n, got, consumed, err, tc.dec, tc.consumed, tc.err)
+		}
+		// Decode returns the values preceding the malformed one.
+		if got := Decode(tc.enc); !equal(got, tc.dec) {
+			t.Errorf("%s: Decode got %v, expected %v", n, got, tc.dec)
+		}
+	}
+
+	// The bytes following the first n values are left alone, even if they are malformed.
+	buf := append(Encode([]int{1, -1, 300}), 0x01, 0x02)
+	got, consumed, err := DecodeN(buf, 2)
+	if !equal(got, []int{1, -1}) || consumed != 2 || err != nil {
+		t.Errorf("got %v, %d bytes, err %v, expected [1 -1], 2 bytes", got, consumed, err)
+	}
+	got, consumed, err = DecodeN(buf[:4], 5)
+	if !equal(got, []int{1, -1, 300}) || consumed != 4 || err != nil {
+		t.Errorf("got %v, %d bytes, err %v, expected [1 -1 300], 4 bytes", got, consumed, err)
+	}
+}
+
+func TestDecoderMalformed(t *testing.T) {
+	for n, tc := range malformedtests {
+		d := NewDecoder(bytes.NewReader(tc.enc))
+		for i, want := range tc.dec {
+			if got, err := d.Next(); got != want || err != nil {
+				t.Errorf("%s: value %d: got %d, err %v, expected %d", n, i, got, err, want)
+			}
+		}
+		if _, err := d.Next(); err != tc.err {
+			t.Errorf("%s: expected %v, got %v", n, tc.err, err)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	for n, tc := range varinttests {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		if err := e.Encode(tc.dec...); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), tc.enc) {
+			t.Errorf("%s: got %v, expected %v", n, buf.Bytes(), tc.enc)
+		}
+	}
+
+	// Successive calls append to the stream.
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for _, v := range []int{5, -300, 0} {
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := Decode(buf.Bytes()); !equal(got, []int{5, -300, 0}) {
+		t.Errorf("got %v, expected [5 -300 0]", got)
+	}
+}
+
+func TestDecodeSafe(t *testing.T) {
+	for n, tc := range varinttests {
+		if got, err := DecodeSafe(tc.enc); !equal(got, tc.dec) || err != nil {
+			t.Errorf("%s: got %v, err %v, expected %v", n, got, err, tc.dec)
+		}
+	}
+
+	// A buffer cut short in the middle of the last value.
+	buf := Encode([]int{1, 1 << 20})
+	if got, err := DecodeSafe(buf[:len(buf)-1]); !equal(got, []int{1}) || err != ErrTruncated {
+		t.Errorf("got %v, err %v, expected [1] and ErrTruncated", got, err)
+	}
+
+	// An over-long 11-byte value.
+	buf = append([]byte{0x80}, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0xff)
+	if got, err := DecodeSafe(buf); !equal(got, []int{0}) || err != ErrOverflow {
+		t.Errorf("got %v, err %v, expected [0] and ErrOverflow", got, err)
+	}
+}
+
+var varuinttests = map[string]struct {
+	dec []uint64
+	enc []byte
+}{
+	"empty": {[]uint64{}, []byte{}},
+	"small": {[]uint64{0, 1, 2, 127}, []byte{0x80, 0x81, 0x82, 0xff}},
+	"boundaries": {
+		[]uint64{128, 1<<14 - 1, 1 << 14, 300},
+		[]byte{0x01, 0x80, 0x7f, 0xff, 0x01, 0x00, 0x80, 0x02, 0xac}},
+	"large": {
+		[]uint64{math.MaxUint32, 1 << 63, math.MaxUint64},
+		[]byte{0x0f, 0x7f, 0x7f, 0x7f, 0xff,
+			0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0x80,
+			0x01, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0xff}},
+}
+
+func TestEncodeUint(t *testing.T) {
+	for n, tc := range varuinttests {
+		if got := EncodeUint(tc.dec); !bytes.Equal(got, tc.enc) {
+			t.Errorf("Encoding %s got\n%+v expected\n%+v", n, got, tc.enc)
+		}
+	}
+}
+
+func TestDecodeUint(t *testing.T) {
+	for n, tc := range varuinttests {
+		got := DecodeUint(tc.enc)
+		if len(got) != len(tc.dec) {
+			t.Fatalf("Decoding '%s'\n%+v length mismatch got\n%+v expected\n%+v",
+				n, tc.enc, got, tc.dec)
+		}
+		for i := range got {
+			if got[i] != tc.dec[i] {
+				t.Fatalf("Decoding %s got\n%+v expected\n%+v", n, got, tc.dec)
+			}
+		}
+	}
+}
+
+func TestUint(t *testing.T) {
+	// Unsigned values up to 127 take a byte, the zig-zag encoding needs 2 from 64 on.
+	if len(EncodeUint([]uint64{100})) != 1 || len(Encode([]int{100})) != 2 {
+		t.Error("expected the unsigned encoding to be shorter")
+	}
+	// Malformed trailing bytes are ignored.
+	if got := DecodeUint([]byte{0x81, 0x01}); len(got) != 1 || got[0] != 1 {
+		t.Errorf("got %v, expected [1]", got)
+	}
+}
+
+func TestAppendDecodeOne(t *testing.T) {
+	for n, tc := range varinttests {
+		var buf []byte
+		for _, v := range tc.dec {
+			buf = AppendVarint(buf, v)
+		}
+		if !bytes.Equal(buf, tc.enc) {
+			t.Errorf("%s: AppendVarint got %v, expected %v", n, buf, tc.enc)
+		}
+		for i, want := range tc.dec {
+			v, l, err := DecodeOne(buf)
+			if v != want || err != nil {
+				t.Errorf("%s: value %d: got %d, err %v, expected %d", n, i, v, err, want)
+			}
+			buf = buf[l:]
+		}
+		if _, _, err := DecodeOne(buf); err != ErrTruncated {
+			t.Errorf("%s: expected ErrTruncated at the end, got %v", n, err)
+		}
+	}
+	for n, tc := range malformedtests {
+		if _, _, err := DecodeOne(tc.enc[tc.consumed:]); err != tc.err {
+			t.Errorf("%s: expected %v, got %v", n, tc.err, err)
+		}
+	}
+}
+
+// benchValues is a typical sensor payload.
+var benchValues = []int{3300, 3215, 2150, 1234, 567, 13, -2500, -87}
+
+func BenchmarkEncode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf []byte
+		for _, v := range benchValues {
+			buf = append(buf, Encode([]int{v})...)
+		}
+	}
+}
+
+func BenchmarkAppendVarint(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]byte, 0, 64)
+	for i := 0; i < b.N; i++ {
+		buf = buf[:0]
+		for _, v := range benchValues {
+			buf = AppendVarint(buf, v)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	b.ReportAllocs()
+	buf := Encode(benchValues)
+	for i := 0; i < b.N; i++ {
+		Decode(buf)
+	}
+}
+
+func BenchmarkDecodeOne(b *testing.B) {
+	b.ReportAllocs()
+	buf := Encode(benchValues)
+	for i := 0; i < b.N; i++ {
+		for p := buf; len(p) > 0; {
+			_, n, err := DecodeOne(p)
+			if err != nil {
+				b.Fatal(err)
+			}
+			p = p[n:]
+		}
+	}
+}